@@ -1,7 +1,10 @@
 package main
 
 import (
+	"awesomeProject4/protocol"
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
 	"os"
@@ -9,21 +12,124 @@ import (
 )
 
 func main() {
-	conn, err := net.Dial("tcp", "localhost:8080")
+	addr := flag.String("addr", "localhost:8080", "服务端的地址")
+	database := flag.String("db", "", "连接后使用的数据库")
+	text := flag.Bool("text", false, "使用旧的文本协议，服务端也要用 -text 启动")
+	flag.Parse()
+
+	conn, err := net.Dial("tcp", *addr)
 	if err != nil {
 		fmt.Println("dial连接出错: ", err)
 		os.Exit(1)
 	}
 	defer conn.Close()
 
-	reader := bufio.NewReader(os.Stdin)
+	if *text {
+		runText(conn)
+		return
+	}
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	hello, err := handshake(r, w, *database)
+	if err != nil {
+		fmt.Println("握手失败: ", err)
+		os.Exit(1)
+	}
+	fmt.Printf("已连接 %s (协议版本 %d)\n", hello.Name, hello.Version)
+
+	input := bufio.NewReader(os.Stdin)
 	for {
-		fmt.Print("请输入 SQL 命令，以分号 ; 结尾: ")
-		sqlCommand, _ := reader.ReadString('\n')
-		sqlCommand = strings.TrimSpace(sqlCommand)
+		sqlCommand, ok := readCommand(input)
+		if !ok {
+			continue
+		}
+		if strings.ToLower(sqlCommand) == "exit;" {
+			protocol.WriteMessage(w, protocol.MsgTerminate, nil)
+			w.Flush()
+			break
+		}
+		err := protocol.WriteMessage(w, protocol.MsgQuery, []byte(sqlCommand))
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			fmt.Println("client发送出错: ", err)
+			break
+		}
+		result, err := protocol.ReadResult(r)
+		var serverErr *protocol.Error
+		if errors.As(err, &serverErr) {
+			fmt.Println("执行命令出错:", serverErr.Message)
+			continue
+		}
+		if err != nil {
+			fmt.Println("读取服务器响应出错: ", err)
+			break
+		}
+		printResult(result)
+	}
+}
+
+// handshake 发送握手消息，等待服务端的握手
+func handshake(r *bufio.Reader, w *bufio.Writer, database string) (protocol.Handshake, error) {
+	hello := protocol.Handshake{Version: protocol.Version, Name: "aliangsql-client", Database: database}
+	if err := protocol.WriteMessage(w, protocol.MsgHandshake, hello.Encode()); err != nil {
+		return protocol.Handshake{}, err
+	}
+	if err := w.Flush(); err != nil {
+		return protocol.Handshake{}, err
+	}
+	typ, payload, err := protocol.ReadMessage(r)
+	if err != nil {
+		return protocol.Handshake{}, err
+	}
+	switch typ {
+	case protocol.MsgHandshake:
+		return protocol.DecodeHandshake(payload)
+	case protocol.MsgError:
+		e, err := protocol.DecodeError(payload)
+		if err != nil {
+			return protocol.Handshake{}, err
+		}
+		return protocol.Handshake{}, e
+	}
+	return protocol.Handshake{}, fmt.Errorf("意外的消息 %v", typ)
+}
+
+// printResult 查询显示成表格，其他语句显示服务端的说明
+func printResult(result *protocol.Result) {
+	switch {
+	case result.Columns != nil:
+		fmt.Println(result.ResultSet())
+	case result.Complete.Message != "":
+		fmt.Println(result.Complete.Message)
+	default:
+		fmt.Println("命令执行成功")
+	}
+}
 
-		if !strings.HasSuffix(sqlCommand, ";") {
-			fmt.Println("SQL 命令必须以分号 ';' 结尾，请重新输入。")
+// readCommand 从终端读一条以分号结尾的命令
+func readCommand(input *bufio.Reader) (string, bool) {
+	fmt.Print("请输入 SQL 命令，以分号 ; 结尾: ")
+	sqlCommand, err := input.ReadString('\n')
+	if err != nil && sqlCommand == "" {
+		// 标准输入已经关闭，当作 exit
+		return "exit;", true
+	}
+	sqlCommand = strings.TrimSpace(sqlCommand)
+	if !strings.HasSuffix(sqlCommand, ";") {
+		fmt.Println("SQL 命令必须以分号 ';' 结尾，请重新输入。")
+		return "", false
+	}
+	return sqlCommand, true
+}
+
+// runText 旧的文本协议，响应读到 END 行为止
+func runText(conn net.Conn) {
+	input := bufio.NewReader(os.Stdin)
+	for {
+		sqlCommand, ok := readCommand(input)
+		if !ok {
 			continue
 		}
 
@@ -0,0 +1,314 @@
+// Package httpapi 服务端的 HTTP/JSON 接口:
+//
+//	POST /login                       用 basic 认证登录，返回令牌和它的有效秒数 expires_in
+//	POST /logout                      让请求中的令牌失效
+//	POST /query                       执行一条语句，请求为 {"sql": ..., "params": [...], "database": ...}
+//	GET  /databases                   所有数据库
+//	GET  /databases/{db}/tables       数据库中所有的表
+//
+// 除了 /login，请求都要带 basic 认证或者 Authorization: Bearer 令牌，账号来自 user 包。
+// 每个请求一个会话，请求结束时没有提交的事务会回滚。查询的请求带 Accept: application/x-ndjson
+// 或者 ?stream=1 时，结果按 NDJSON 一行一行地发: 第一行是列，之后每行一个数组，最后一行是行数，
+// 开始发送之后出错时最后一行是 {"error": ...}
+package httpapi
+
+import (
+	"awesomeProject4/protocol"
+	"awesomeProject4/storgeengine"
+	"awesomeProject4/user"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxBodySize 请求的内容最多这么多字节
+const maxBodySize = 64 << 20
+
+// flushRows 流式返回时每写这么多行发一次
+const flushRows = 100
+
+// Server HTTP 接口，Users 是 user 包中的账号，用户名到密码
+type Server struct {
+	DB     *storgeengine.DB
+	Users  map[string]string
+	Tokens *user.Tokens
+}
+
+func NewServer(db *storgeengine.DB, users map[string]string) *Server {
+	return &Server{DB: db, Users: users, Tokens: user.NewTokens(user.DefaultTokenTTL)}
+}
+
+// QueryRequest POST /query 的请求。Params 是语句中 $1、$2 ... 或 ? 的值，Database 是执行语句时的当前数据库
+type QueryRequest struct {
+	SQL      string        `json:"sql"`
+	Params   []interface{} `json:"params,omitempty"`
+	Database string        `json:"database,omitempty"`
+}
+
+// Column 结果中的一列，Type 是查询中声明的类型，见 protocol.Columns
+type Column struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// QueryResponse POST /query 的响应。查询有 Columns、Rows 和 RowCount，其他语句有 Affected，
+// 出错时只有 Error
+type QueryResponse struct {
+	Columns      []Column        `json:"columns,omitempty"`
+	Rows         [][]interface{} `json:"rows,omitempty"`
+	RowCount     *int            `json:"row_count,omitempty"`
+	Affected     *int            `json:"affected,omitempty"`
+	LastInsertID int64           `json:"last_insert_id,omitempty"`
+	Message      string          `json:"message,omitempty"`
+	Error        string          `json:"error,omitempty"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("HTTP %s %s\n", r.Method, r.URL.Path)
+	if r.URL.Path == "/login" {
+		s.login(w, r)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="AliangSQL"`)
+		writeError(w, http.StatusUnauthorized, "用户名、密码或令牌不正确")
+		return
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "query":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "只支持 POST")
+			return
+		}
+		s.query(w, r)
+	case path == "logout":
+		if token, ok := bearer(r); ok {
+			s.Tokens.Revoke(token)
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"message": "已退出"})
+	case path == "databases" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string][]string{"databases": s.DB.Databases()})
+	case len(parts) == 3 && parts[0] == "databases" && parts[2] == "tables" && r.Method == http.MethodGet:
+		tables, err := s.DB.Tables(parts[1])
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"database": strings.ToUpper(parts[1]), "tables": tables})
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("没有 %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// login 用 basic 认证换一个令牌，之后的请求可以带 Authorization: Bearer 令牌，令牌过期后要重新登录
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "只支持 POST")
+		return
+	}
+	username, password, _ := r.BasicAuth()
+	token, err := s.Tokens.Issue(s.Users, username, password)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="AliangSQL"`)
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"token": token, "expires_in": int64(s.Tokens.TTL() / time.Second)})
+}
+
+// authorized 请求带着正确的 basic 认证或者有效的令牌
+func (s *Server) authorized(r *http.Request) bool {
+	if token, ok := bearer(r); ok {
+		_, ok = s.Tokens.Check(token)
+		return ok
+	}
+	username, password, ok := r.BasicAuth()
+	return ok && user.Login(s.Users, username, password) == nil
+}
+
+func bearer(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:]), true
+	}
+	return "", false
+}
+
+// query 执行一条语句。请求中数字参数是整数时当作 INT，有小数时当作 DECIMAL，不会丢失精度
+func (s *Server) query(w http.ResponseWriter, r *http.Request) {
+	var req QueryRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("请求不是有效的 JSON: %v", err))
+		return
+	}
+	args := make([]interface{}, len(req.Params))
+	for i, p := range req.Params {
+		var err error
+		if args[i], err = paramValue(p); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("参数 $%d: %v", i+1, err))
+			return
+		}
+	}
+	stmt, err := storgeengine.ParseWithArgs(req.SQL, args)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	session := s.DB.NewSession()
+	defer session.Close()
+	if req.Database != "" {
+		if err := session.Use(req.Database); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+	}
+	fmt.Println("接收到的 HTTP 命令:", req.SQL)
+	if sel, ok := stmt.(*storgeengine.SelectStmt); ok && streaming(r) {
+		streamRows(w, session, sel)
+		return
+	}
+	result := session.Execute(stmt)
+	if result.Error != nil {
+		writeError(w, http.StatusUnprocessableEntity, result.Error.Error())
+		return
+	}
+
+	resp := QueryResponse{}
+	switch res := result.Result.(type) {
+	case *storgeengine.ResultSet:
+		n := len(res.Rows)
+		resp.Columns, resp.RowCount = columns(res), &n
+		resp.Rows = make([][]interface{}, len(res.Rows))
+		for i, row := range res.Rows {
+			resp.Rows[i] = jsonRow(row)
+		}
+	case *storgeengine.InsertResult:
+		resp.Affected, resp.LastInsertID, resp.Message = &res.RowsAffected, res.LastInsertID, res.String()
+	case *storgeengine.AffectedResult:
+		resp.Affected, resp.Message = &res.RowsAffected, res.String()
+	case nil:
+		resp.Message = "命令执行成功"
+	default:
+		resp.Message = fmt.Sprint(res)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// streaming 客户端要不要 NDJSON
+func streaming(r *http.Request) bool {
+	if v := r.URL.Query().Get("stream"); v == "1" || v == "true" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// streamRows 一行一个 JSON: {"columns": [...]}、每行一个数组、{"row_count": n}。行由 Session.Stream
+// 一边扫描一边交过来，每写 flushRows 行发一次，大的结果不会整个放在内存中。
+// 开始写之前出错时和不是流式的请求一样返回错误，之后出错时最后一行是 {"error": ...}
+func streamRows(w http.ResponseWriter, session *storgeengine.Session, sel *storgeengine.SelectStmt) {
+	flusher, _ := w.(http.Flusher)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	flush := func() error {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	started, count := false, 0
+	err := session.Stream(sel, func(header *storgeengine.ResultSet) error {
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		started = true
+		if err := enc.Encode(map[string][]Column{"columns": columns(header)}); err != nil {
+			return err
+		}
+		return flush()
+	}, func(row []interface{}) error {
+		// 写不出去时客户端已经断开，停止查询
+		if err := enc.Encode(jsonRow(row)); err != nil {
+			return err
+		}
+		if count++; count%flushRows == 0 {
+			return flush()
+		}
+		return nil
+	})
+	switch {
+	case !started && err != nil:
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	case err != nil:
+		enc.Encode(map[string]string{"error": err.Error()})
+	default:
+		enc.Encode(map[string]int{"row_count": count})
+	}
+	bw.Flush()
+}
+
+func columns(rs *storgeengine.ResultSet) []Column {
+	cols := protocol.Columns(rs)
+	out := make([]Column, len(cols))
+	for i, col := range cols {
+		out[i] = Column{Name: col.Name, Type: col.Type.String()}
+	}
+	return out
+}
+
+// jsonRow 值在 JSON 中的写法: DECIMAL 是字符串以免丢失精度，DATE 是 2006-01-02，TIMESTAMP 是 RFC 3339，
+// BLOB 是 base64
+func jsonRow(row []interface{}) []interface{} {
+	out := make([]interface{}, len(row))
+	for i, v := range row {
+		switch v := v.(type) {
+		case storgeengine.Decimal:
+			out[i] = v.String()
+		case storgeengine.Date:
+			out[i] = v.Format("2006-01-02")
+		case time.Time:
+			out[i] = v.Format(time.RFC3339Nano)
+		default:
+			out[i] = v
+		}
+	}
+	return out
+}
+
+// paramValue 把 JSON 中的参数转换成语句中的值，对象和数组不能作为参数
+func paramValue(p interface{}) (interface{}, error) {
+	switch v := p.(type) {
+	case nil, string, bool:
+		return v, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		if d, err := storgeengine.ParseDecimal(v.String()); err == nil {
+			return d, nil
+		}
+		return v.Float64()
+	}
+	return nil, errors.New("只能是字符串、数字、布尔值或 null")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, QueryResponse{Error: message})
+}
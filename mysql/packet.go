@@ -0,0 +1,191 @@
+package mysql
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// maxPacketSize 一个包的内容最多 2^24-1 字节，更长的内容拆成多个包，最后一个包短于这个长度
+const maxPacketSize = 1<<24 - 1
+
+// maxCommandSize 客户端一条命令最多这么多字节
+const maxCommandSize = 64 << 20
+
+// conn MySQL 协议的一个连接。每个包为 长度 3 字节小端 | 序号 1 字节 | 内容，
+// 一次命令和它的响应中的包按序号依次递增，新的命令从 0 开始
+type conn struct {
+	net.Conn
+	r   *bufio.Reader
+	w   *bufio.Writer
+	seq byte // 下一个包的序号
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{Conn: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+}
+
+// readPacket 读一个完整的包，拆开发送的内容拼接起来
+func (c *conn) readPacket() ([]byte, error) {
+	var payload []byte
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			if err == io.EOF && payload != nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		n := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+		if header[3] != c.seq {
+			return nil, fmt.Errorf("包的序号是 %d，应该是 %d", header[3], c.seq)
+		}
+		c.seq++
+		if len(payload)+n > maxCommandSize {
+			return nil, fmt.Errorf("包太长")
+		}
+		start := len(payload)
+		payload = append(payload, make([]byte, n)...)
+		if _, err := io.ReadFull(c.r, payload[start:]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if n < maxPacketSize {
+			return payload, nil
+		}
+	}
+}
+
+// writePacket 写一个包，内容太长时拆开。写进缓冲区，flush 时才发出去
+func (c *conn) writePacket(payload []byte) error {
+	for {
+		n := len(payload)
+		if n > maxPacketSize {
+			n = maxPacketSize
+		}
+		header := [4]byte{byte(n), byte(n >> 8), byte(n >> 16), c.seq}
+		c.seq++
+		if _, err := c.w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := c.w.Write(payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		// 正好是最长的包时后面还要跟一个空包
+		if n < maxPacketSize {
+			return nil
+		}
+	}
+}
+
+func (c *conn) flush() error {
+	return c.w.Flush()
+}
+
+// appendLenEncInt 长度编码的整数
+func appendLenEncInt(buf []byte, n uint64) []byte {
+	switch {
+	case n < 251:
+		return append(buf, byte(n))
+	case n < 1<<16:
+		return append(buf, 0xfc, byte(n), byte(n>>8))
+	case n < 1<<24:
+		return append(buf, 0xfd, byte(n), byte(n>>8), byte(n>>16))
+	}
+	buf = append(buf, 0xfe)
+	return binary.LittleEndian.AppendUint64(buf, n)
+}
+
+// appendLenEncString 长度编码的字符串: 长度 | 内容
+func appendLenEncString(buf []byte, s string) []byte {
+	return append(appendLenEncInt(buf, uint64(len(s))), s...)
+}
+
+// reader 顺序读取包的内容，越界时记录错误并返回零值
+type reader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.buf)-r.pos {
+		r.err = fmt.Errorf("包不完整")
+		return nil
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) uint8() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+// lenEncInt 长度编码的整数
+func (r *reader) lenEncInt() uint64 {
+	switch first := r.uint8(); first {
+	case 0xfc:
+		b := r.bytes(2)
+		if b == nil {
+			return 0
+		}
+		return uint64(binary.LittleEndian.Uint16(b))
+	case 0xfd:
+		b := r.bytes(3)
+		if b == nil {
+			return 0
+		}
+		return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16
+	case 0xfe:
+		b := r.bytes(8)
+		if b == nil {
+			return 0
+		}
+		return binary.LittleEndian.Uint64(b)
+	default:
+		return uint64(first)
+	}
+}
+
+// nulString 以 0 结尾的字符串，包结束时没有 0 也可以
+func (r *reader) nulString() string {
+	if r.err != nil {
+		return ""
+	}
+	rest := r.buf[r.pos:]
+	for i, b := range rest {
+		if b == 0 {
+			r.pos += i + 1
+			return string(rest[:i])
+		}
+	}
+	r.pos = len(r.buf)
+	return string(rest)
+}
+
+// rest 剩下的全部内容
+func (r *reader) rest() []byte {
+	if r.err != nil {
+		return nil
+	}
+	b := r.buf[r.pos:]
+	r.pos = len(r.buf)
+	return b
+}
+
+func (r *reader) more() bool {
+	return r.err == nil && r.pos < len(r.buf)
+}
@@ -0,0 +1,534 @@
+// Package mysql 服务端的 MySQL 客户端/服务端协议，mysql 命令行和 go-sql-driver/mysql 可以直接连上来执行 AliangSQL 的语句。
+// 支持 handshake v10 和 mysql_native_password 认证，命令支持 COM_QUERY、COM_INIT_DB、COM_PING 和 COM_QUIT，
+// 查询返回文本结果集。不支持 SSL、压缩和预处理语句
+package mysql
+
+import (
+	"awesomeProject4/protocol"
+	"awesomeProject4/storgeengine"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ServerVersion 握手时告诉客户端的版本，客户端按 5.7 的行为和服务端打交道
+const ServerVersion = "5.7.0-AliangSQL"
+
+const nativePassword = "mysql_native_password"
+
+// 能力标志
+const (
+	clientLongPassword     = 0x00000001
+	clientFoundRows        = 0x00000002
+	clientLongFlag         = 0x00000004
+	clientConnectWithDB    = 0x00000008
+	clientProtocol41       = 0x00000200
+	clientTransactions     = 0x00002000
+	clientSecureConnection = 0x00008000
+	clientMultiResults     = 0x00020000
+	clientPluginAuth       = 0x00080000
+	clientPluginAuthLenEnc = 0x00200000
+
+	serverCapabilities = clientLongPassword | clientFoundRows | clientLongFlag | clientConnectWithDB |
+		clientProtocol41 | clientTransactions | clientSecureConnection | clientMultiResults |
+		clientPluginAuth | clientPluginAuthLenEnc
+)
+
+// 服务端状态
+const (
+	statusInTrans    = 0x0001
+	statusAutocommit = 0x0002
+)
+
+// 命令
+const (
+	comQuit   = 0x01
+	comInitDB = 0x02
+	comQuery  = 0x03
+	comPing   = 0x0e
+)
+
+// 错误码和 SQLSTATE
+const (
+	erAccessDenied = 1045 // 28000
+	erBadDB        = 1049 // 42000
+	erUnknownCom   = 1047 // 08S01
+	erParse        = 1064 // 42000
+	erUnknownVar   = 1193 // HY000
+	erUnknown      = 1105 // HY000
+)
+
+// 列的类型
+const (
+	typeTiny       = 0x01
+	typeDouble     = 0x05
+	typeLongLong   = 0x08
+	typeDate       = 0x0a
+	typeDatetime   = 0x0c
+	typeNewDecimal = 0xf6
+	typeBlob       = 0xfc
+	typeVarString  = 0xfd
+)
+
+const (
+	charsetUTF8MB4 = 45
+	charsetBinary  = 63
+)
+
+// Server MySQL 协议的服务端，Users 是 user 包中的账号，用户名到密码
+type Server struct {
+	DB     *storgeengine.DB
+	Users  map[string]string
+	nextID uint32
+}
+
+// Serve 接受连接，每个连接一个会话，直到监听出错
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn 处理一个连接，连接断开时返回
+func (s *Server) ServeConn(nc net.Conn) {
+	c := newConn(nc)
+	defer c.Close()
+	session := s.DB.NewSession()
+	defer session.Close()
+
+	if err := s.handshake(c, session); err != nil {
+		fmt.Println("MySQL 握手失败:", err)
+		return
+	}
+	for {
+		// 每条命令的包序号从 0 开始
+		c.seq = 0
+		payload, err := c.readPacket()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println("读取 MySQL 命令出错:", err)
+			}
+			return
+		}
+		quit, err := s.dispatch(c, session, payload)
+		if err == nil {
+			err = c.flush()
+		}
+		if err != nil {
+			fmt.Println("发送 MySQL 响应出错:", err)
+			return
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// handshake 发出 handshake v10，读客户端的 HandshakeResponse41 并认证。客户端用别的认证插件时
+// 发 AuthSwitchRequest 让它改用 mysql_native_password
+func (s *Server) handshake(c *conn, session *storgeengine.Session) error {
+	scramble, err := newScramble()
+	if err != nil {
+		return err
+	}
+	id := atomic.AddUint32(&s.nextID, 1)
+	buf := []byte{0x0a}
+	buf = append(buf, ServerVersion...)
+	buf = append(buf, 0)
+	buf = binary.LittleEndian.AppendUint32(buf, id)
+	buf = append(buf, scramble[:8]...)
+	buf = append(buf, 0)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(serverCapabilities&0xffff))
+	buf = append(buf, charsetUTF8MB4)
+	buf = binary.LittleEndian.AppendUint16(buf, statusAutocommit)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(serverCapabilities>>16))
+	buf = append(buf, byte(len(scramble)+1))
+	buf = append(buf, make([]byte, 10)...)
+	buf = append(buf, scramble[8:]...)
+	buf = append(buf, 0)
+	buf = append(buf, nativePassword...)
+	buf = append(buf, 0)
+	if err := c.writePacket(buf); err != nil {
+		return err
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+
+	payload, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	r := reader{buf: payload}
+	caps := r.uint32()
+	r.uint32() // 最大包长
+	r.uint8()  // 字符集
+	r.bytes(23)
+	if r.err == nil && caps&clientProtocol41 == 0 {
+		writeError(c, erUnknownCom, "08S01", "只支持 4.1 之后的协议")
+		c.flush()
+		return fmt.Errorf("客户端不支持 4.1 协议")
+	}
+	username := r.nulString()
+	var auth []byte
+	switch {
+	case caps&clientPluginAuthLenEnc != 0:
+		auth = r.bytes(int(r.lenEncInt()))
+	case caps&clientSecureConnection != 0:
+		auth = r.bytes(int(r.uint8()))
+	default:
+		auth = []byte(r.nulString())
+	}
+	var database, plugin string
+	if caps&clientConnectWithDB != 0 && r.more() {
+		database = r.nulString()
+	}
+	if caps&clientPluginAuth != 0 && r.more() {
+		plugin = r.nulString()
+	}
+	if r.err != nil {
+		writeError(c, erUnknownCom, "08S01", r.err.Error())
+		c.flush()
+		return r.err
+	}
+
+	if plugin != "" && plugin != nativePassword {
+		buf := append([]byte{0xfe}, nativePassword...)
+		buf = append(buf, 0)
+		buf = append(buf, scramble...)
+		buf = append(buf, 0)
+		if err := c.writePacket(buf); err != nil {
+			return err
+		}
+		if err := c.flush(); err != nil {
+			return err
+		}
+		if auth, err = c.readPacket(); err != nil {
+			return err
+		}
+	}
+	if !s.checkPassword(username, scramble, auth) {
+		writeError(c, erAccessDenied, "28000", fmt.Sprintf("用户 %s 认证失败", username))
+		c.flush()
+		return fmt.Errorf("用户 %s 认证失败", username)
+	}
+	if database != "" {
+		if err := session.Use(database); err != nil {
+			writeError(c, erBadDB, "42000", err.Error())
+			c.flush()
+			return err
+		}
+	}
+	fmt.Printf("MySQL 客户端 %s 已连接\n", username)
+	if err := writeOK(c, session, 0, 0, ""); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// newScramble 20 字节的随机数，客户端用它加密密码。每个字节都不是 0，因为握手包里它后面跟着 0
+func newScramble() ([]byte, error) {
+	scramble := make([]byte, 20)
+	if _, err := rand.Read(scramble); err != nil {
+		return nil, err
+	}
+	for i, b := range scramble {
+		scramble[i] = b%94 + 33
+	}
+	return scramble, nil
+}
+
+// checkPassword 按 mysql_native_password 检查客户端的回应，密码为空时回应也为空
+func (s *Server) checkPassword(username string, scramble, auth []byte) bool {
+	password, exists := s.Users[username]
+	if !exists {
+		return false
+	}
+	if password == "" {
+		return len(auth) == 0
+	}
+	return subtle.ConstantTimeCompare(auth, NativePassword(scramble, password)) == 1
+}
+
+// NativePassword mysql_native_password 的回应: SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password)))
+func NativePassword(scramble []byte, password string) []byte {
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(scramble)
+	h.Write(stage2[:])
+	out := h.Sum(nil)
+	for i := range out {
+		out[i] ^= stage1[i]
+	}
+	return out
+}
+
+// dispatch 处理一条命令，COM_QUIT 时返回 quit 为 true
+func (s *Server) dispatch(c *conn, session *storgeengine.Session, payload []byte) (quit bool, err error) {
+	if len(payload) == 0 {
+		return false, writeError(c, erUnknownCom, "08S01", "空的命令")
+	}
+	switch payload[0] {
+	case comQuit:
+		return true, nil
+	case comInitDB:
+		if err := session.Use(string(payload[1:])); err != nil {
+			return false, writeError(c, erBadDB, "42000", err.Error())
+		}
+		return false, writeOK(c, session, 0, 0, "")
+	case comPing:
+		return false, writeOK(c, session, 0, 0, "")
+	case comQuery:
+		return false, s.query(c, session, string(payload[1:]))
+	}
+	return false, writeError(c, erUnknownCom, "08S01", fmt.Sprintf("不支持的命令 0x%02x", payload[0]))
+}
+
+// query 执行一条 SQL 语句。客户端连接后自己发的查询，例如 select @@version_comment、set names，
+// 不是 AliangSQL 的语法，在这里直接回答
+func (s *Server) query(c *conn, session *storgeengine.Session, sql string) error {
+	sql = strings.TrimSpace(sql)
+	fmt.Println("接收到的 MySQL 命令:", sql)
+	if handled, err := s.intercept(c, session, sql); handled {
+		return err
+	}
+	stmt, err := storgeengine.Parse(sql)
+	if err != nil {
+		return writeError(c, erParse, "42000", err.Error())
+	}
+	result := session.Execute(stmt)
+	if result.Error != nil {
+		return writeError(c, erUnknown, "HY000", result.Error.Error())
+	}
+	switch r := result.Result.(type) {
+	case *storgeengine.ResultSet:
+		return writeResultSet(c, session, r)
+	case *storgeengine.InsertResult:
+		return writeOK(c, session, uint64(r.RowsAffected), uint64(r.LastInsertID), "")
+	case *storgeengine.AffectedResult:
+		return writeOK(c, session, uint64(r.RowsAffected), 0, "")
+	case nil:
+		return writeOK(c, session, 0, 0, "")
+	default:
+		return writeOK(c, session, 0, 0, fmt.Sprint(r))
+	}
+}
+
+// intercept 回答客户端和驱动自己发的查询，返回 handled 为 false 时按 AliangSQL 语句执行
+func (s *Server) intercept(c *conn, session *storgeengine.Session, sql string) (handled bool, err error) {
+	upper := strings.ToUpper(strings.TrimSuffix(sql, ";"))
+	fields := strings.Fields(upper)
+	switch {
+	case len(fields) == 0:
+		return false, nil
+	case strings.HasPrefix(upper, "SET NAMES") || strings.HasPrefix(upper, "SET CHARACTER SET"):
+		// 只用 utf8mb4
+		return true, writeOK(c, session, 0, 0, "")
+	case upper == "SELECT DATABASE()":
+		var database interface{}
+		if session.Database() != "" {
+			database = session.Database()
+		}
+		return true, writeResultSet(c, session, &storgeengine.ResultSet{Columns: []string{"DATABASE()"}, Types: []storgeengine.ColumnType{storgeengine.StringType}, Rows: [][]interface{}{{database}}})
+	case upper == "SHOW DATABASES":
+		rs := &storgeengine.ResultSet{Columns: []string{"Database"}, Types: []storgeengine.ColumnType{storgeengine.StringType}}
+		for _, name := range s.DB.Databases() {
+			rs.Rows = append(rs.Rows, []interface{}{name})
+		}
+		return true, writeResultSet(c, session, rs)
+	case upper == "SHOW TABLES":
+		if session.Database() == "" {
+			return true, writeError(c, erUnknown, "3D000", "没有选择数据库")
+		}
+		tables, err := s.DB.Tables(session.Database())
+		if err != nil {
+			return true, writeError(c, erBadDB, "42000", err.Error())
+		}
+		rs := &storgeengine.ResultSet{Columns: []string{"Tables_in_" + session.Database()}, Types: []storgeengine.ColumnType{storgeengine.StringType}}
+		for _, name := range tables {
+			rs.Rows = append(rs.Rows, []interface{}{name})
+		}
+		return true, writeResultSet(c, session, rs)
+	case len(fields) > 1 && fields[0] == "SELECT" && strings.HasPrefix(fields[1], "@@"):
+		return true, selectVariables(c, session, sql)
+	}
+	return false, nil
+}
+
+// selectVariables 回答 select @@a, @@b [limit 1]
+func selectVariables(c *conn, session *storgeengine.Session, sql string) error {
+	list := strings.TrimSpace(strings.TrimSuffix(sql, ";"))[len("SELECT"):]
+	if i := strings.LastIndex(strings.ToUpper(list), " LIMIT "); i >= 0 {
+		list = list[:i]
+	}
+	rs := &storgeengine.ResultSet{Rows: [][]interface{}{nil}}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		name := strings.ToLower(strings.TrimPrefix(item, "@@"))
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "session."), "global.")
+		var value interface{}
+		switch name {
+		case "version_comment":
+			value = "AliangSQL"
+		case "version":
+			value = ServerVersion
+		case "max_allowed_packet":
+			value = int64(maxCommandSize)
+		case "autocommit":
+			value = int64(0)
+			if session.Autocommit() {
+				value = int64(1)
+			}
+		case "tx_isolation", "transaction_isolation":
+			value = "REPEATABLE-READ"
+		case "character_set_client", "character_set_connection", "character_set_results":
+			value = "utf8mb4"
+		default:
+			return writeError(c, erUnknownVar, "HY000", fmt.Sprintf("未知的系统变量 %s", item))
+		}
+		rs.Columns = append(rs.Columns, item)
+		rs.Types = append(rs.Types, protocol.TypeOf(value).ColumnType())
+		rs.Rows[0] = append(rs.Rows[0], value)
+	}
+	return writeResultSet(c, session, rs)
+}
+
+func status(session *storgeengine.Session) uint16 {
+	var s uint16
+	if session.Autocommit() {
+		s |= statusAutocommit
+	}
+	if session.InTransaction() {
+		s |= statusInTrans
+	}
+	return s
+}
+
+// writeOK OK 包: 0x00 | 影响的行数 | 自增值 | 状态 | 警告数 | 说明
+func writeOK(c *conn, session *storgeengine.Session, affected, lastInsertID uint64, info string) error {
+	buf := []byte{0x00}
+	buf = appendLenEncInt(buf, affected)
+	buf = appendLenEncInt(buf, lastInsertID)
+	buf = binary.LittleEndian.AppendUint16(buf, status(session))
+	buf = append(buf, 0, 0)
+	buf = append(buf, info...)
+	return c.writePacket(buf)
+}
+
+// writeError ERR 包: 0xff | 错误码 | # | SQLSTATE | 错误信息
+func writeError(c *conn, code uint16, state, message string) error {
+	buf := []byte{0xff}
+	buf = binary.LittleEndian.AppendUint16(buf, code)
+	buf = append(buf, '#')
+	buf = append(buf, state...)
+	buf = append(buf, message...)
+	return c.writePacket(buf)
+}
+
+// writeEOF EOF 包: 0xfe | 警告数 | 状态
+func writeEOF(c *conn, session *storgeengine.Session) error {
+	buf := []byte{0xfe, 0, 0}
+	buf = binary.LittleEndian.AppendUint16(buf, status(session))
+	return c.writePacket(buf)
+}
+
+// writeResultSet 文本结果集: 列数 | 每列一个 ColumnDefinition41 | EOF | 每行一个包 | EOF。
+// 行中的值都写成文本，NULL 写成 0xfb
+func writeResultSet(c *conn, session *storgeengine.Session, rs *storgeengine.ResultSet) error {
+	if err := c.writePacket(appendLenEncInt(nil, uint64(len(rs.Columns)))); err != nil {
+		return err
+	}
+	for _, col := range protocol.Columns(rs) {
+		if err := c.writePacket(columnDefinition(session.Database(), col)); err != nil {
+			return err
+		}
+	}
+	if err := writeEOF(c, session); err != nil {
+		return err
+	}
+	for _, row := range rs.Rows {
+		var buf []byte
+		for _, v := range row {
+			if v == nil {
+				buf = append(buf, 0xfb)
+				continue
+			}
+			buf = appendLenEncString(buf, text(v))
+		}
+		if err := c.writePacket(buf); err != nil {
+			return err
+		}
+	}
+	return writeEOF(c, session)
+}
+
+// columnDefinition ColumnDefinition41，类型是 protocol.Columns 给出的类型，TypeNull 时当作字符串
+func columnDefinition(database string, col protocol.Column) []byte {
+	typ, charset, length, decimals := byte(typeVarString), uint16(charsetUTF8MB4), uint32(1024), byte(0x1f)
+	var flags uint16
+	switch col.Type {
+	case protocol.TypeInt:
+		typ, charset, length, decimals = typeLongLong, charsetBinary, 20, 0
+	case protocol.TypeFloat:
+		typ, charset, length = typeDouble, charsetBinary, 22
+	case protocol.TypeBool:
+		typ, charset, length, decimals = typeTiny, charsetBinary, 1, 0
+	case protocol.TypeDecimal:
+		typ, charset, length = typeNewDecimal, charsetBinary, 65
+	case protocol.TypeDate:
+		typ, charset, length, decimals = typeDate, charsetBinary, 10, 0
+	case protocol.TypeTimestamp:
+		typ, charset, length, decimals = typeDatetime, charsetBinary, 26, 6
+	case protocol.TypeBlob:
+		typ, charset, length, decimals = typeBlob, charsetBinary, 65535, 0
+		flags = 0x0010 | 0x0080 // BLOB | BINARY
+	}
+	buf := appendLenEncString(nil, "def")
+	buf = appendLenEncString(buf, database)
+	buf = appendLenEncString(buf, "")
+	buf = appendLenEncString(buf, "")
+	buf = appendLenEncString(buf, col.Name)
+	buf = appendLenEncString(buf, col.Name)
+	buf = append(buf, 0x0c)
+	buf = binary.LittleEndian.AppendUint16(buf, charset)
+	buf = binary.LittleEndian.AppendUint32(buf, length)
+	buf = append(buf, typ)
+	buf = binary.LittleEndian.AppendUint16(buf, flags)
+	buf = append(buf, decimals, 0, 0)
+	return buf
+}
+
+// text 值在文本结果集中的写法
+func text(v interface{}) string {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case storgeengine.Date:
+		return v.Format("2006-01-02")
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999")
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(v)
+}
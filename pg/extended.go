@@ -0,0 +1,253 @@
+package pg
+
+import (
+	"awesomeProject4/storgeengine"
+	"fmt"
+)
+
+// statement Parse 准备好的语句
+type statement struct {
+	sql    string
+	params []int32                // 参数的类型，客户端没有给出的当作 text
+	stmt   storgeengine.Statement // 参数换成 sampleParam 后解析出的语句，只用来描述结果的列，空语句为 nil
+}
+
+// portal Bind 绑定了参数的入口，查询在第一次 Execute 时执行，结果留到发完为止
+type portal struct {
+	stmt    storgeengine.Statement
+	formats []int // 要求的结果格式
+	result  *storgeengine.SQLResult
+	fields  []field // 查询结果的列，和描述语句时的一样，只有查询才有
+	sent    int     // 已经发出去的行数
+}
+
+// parse Parse: 语句名 | SQL | 参数个数 int16 | 每个参数的类型 int32
+func (c *session) parse(payload []byte) error {
+	r := reader{buf: payload}
+	name, sql := r.string(), r.string()
+	oids := make([]int32, r.int16())
+	for i := range oids {
+		oids[i] = r.int32()
+	}
+	if r.err != nil {
+		return errorf(codeProtocolViolation, "%v", r.err)
+	}
+	fmt.Println("接收到的 PostgreSQL 命令:", sql)
+	count, err := storgeengine.ParamCount(sql)
+	if err != nil {
+		return errorf(codeSyntaxError, "%v", err)
+	}
+	if count < len(oids) {
+		count = len(oids)
+	}
+	st := &statement{sql: sql, params: make([]int32, count)}
+	for i := range st.params {
+		st.params[i] = oidText
+		if i < len(oids) && oids[i] != 0 {
+			st.params[i] = oids[i]
+		}
+	}
+	if !emptyQuery(sql) {
+		samples := make([]interface{}, count)
+		for i, oid := range st.params {
+			samples[i] = sampleParam(oid)
+		}
+		if st.stmt, err = storgeengine.ParseWithArgs(sql, samples); err != nil {
+			return errorf(codeSyntaxError, "%v", err)
+		}
+	}
+	c.statements[name] = st
+	return c.send(newMessage('1'))
+}
+
+// emptyQuery SQL 中只有空白、注释和分号
+func emptyQuery(sql string) bool {
+	tokens, err := storgeengine.Tokenize(sql)
+	if err != nil {
+		return false
+	}
+	for _, tok := range tokens {
+		if tok.Type != storgeengine.TokEOF && !(tok.Type == storgeengine.TokPunct && tok.Text == ";") {
+			return false
+		}
+	}
+	return true
+}
+
+// bind Bind: 入口名 | 语句名 | 参数格式的个数 int16 | 每个格式 int16 | 参数个数 int16 |
+// 每个参数为 长度 int32(-1 是 NULL) | 内容 | 结果格式的个数 int16 | 每个格式 int16
+func (c *session) bind(payload []byte) error {
+	r := reader{buf: payload}
+	portalName, name := r.string(), r.string()
+	paramFormats := make([]int, r.int16())
+	for i := range paramFormats {
+		paramFormats[i] = r.int16()
+	}
+	values := make([][]byte, r.int16())
+	for i := range values {
+		if n := r.int32(); n >= 0 {
+			values[i] = r.bytes(int(n))
+		}
+	}
+	formats := make([]int, r.int16())
+	for i := range formats {
+		formats[i] = r.int16()
+	}
+	if r.err != nil {
+		return errorf(codeProtocolViolation, "%v", r.err)
+	}
+	st, exists := c.statements[name]
+	if !exists {
+		return errorf(codeInvalidStatement, "语句 %q 不存在", name)
+	}
+	if len(values) != len(st.params) {
+		return errorf(codeProtocolViolation, "语句需要 %d 个参数，收到了 %d 个", len(st.params), len(values))
+	}
+	p := &portal{formats: formats}
+	if st.stmt != nil {
+		args := make([]interface{}, len(values))
+		for i, b := range values {
+			format := formatText
+			switch {
+			case len(paramFormats) == 1:
+				format = paramFormats[0]
+			case i < len(paramFormats):
+				format = paramFormats[i]
+			}
+			var err error
+			if args[i], err = decodeParam(st.params[i], format, b); err != nil {
+				return errorf(codeInvalidParameter, "参数 $%d: %v", i+1, err)
+			}
+		}
+		var err error
+		if p.stmt, err = storgeengine.ParseWithArgs(st.sql, args); err != nil {
+			return errorf(codeSyntaxError, "%v", err)
+		}
+		// 结果的列按语句描述，客户端描述语句时和之后执行入口时得到的类型一样
+		if p.fields, err = c.describeStatement(st, formats); err != nil {
+			return err
+		}
+	}
+	c.portals[portalName] = p
+	return c.send(newMessage('2'))
+}
+
+// describeStatement 语句中查询结果的列，由表结构和查询的表达式推出，不执行查询。不是查询时为 nil
+func (c *session) describeStatement(st *statement, formats []int) ([]field, error) {
+	s, ok := st.stmt.(*storgeengine.SelectStmt)
+	if !ok {
+		return nil, nil
+	}
+	rs, err := c.sess.Describe(s)
+	if err != nil {
+		return nil, executeError(err)
+	}
+	return describeColumns(rs, formats), nil
+}
+
+// describe Describe: S 语句名 或者 P 入口名。语句回 ParameterDescription，再和入口一样回
+// RowDescription 或者 NoData。都不执行查询
+func (c *session) describe(payload []byte) error {
+	r := reader{buf: payload}
+	kind, name := r.byte(), r.string()
+	if r.err != nil {
+		return errorf(codeProtocolViolation, "%v", r.err)
+	}
+	switch kind {
+	case 'S':
+		st, exists := c.statements[name]
+		if !exists {
+			return errorf(codeInvalidStatement, "语句 %q 不存在", name)
+		}
+		m := newMessage('t').int16(len(st.params))
+		for _, oid := range st.params {
+			m.int32(oid)
+		}
+		if err := c.send(m); err != nil {
+			return err
+		}
+		fields, err := c.describeStatement(st, nil)
+		if err != nil {
+			return err
+		}
+		if fields == nil {
+			return c.send(newMessage('n'))
+		}
+		return c.send(rowDescription(fields))
+	case 'P':
+		p, exists := c.portals[name]
+		if !exists {
+			return errorf(codeInvalidPortal, "入口 %q 不存在", name)
+		}
+		if p.fields == nil {
+			return c.send(newMessage('n'))
+		}
+		return c.send(rowDescription(p.fields))
+	}
+	return errorf(codeProtocolViolation, "Describe 的类型 %q 无效", kind)
+}
+
+// run 执行入口中的语句，只执行一次
+func (c *session) run(p *portal) error {
+	if p.result == nil {
+		result := c.sess.Execute(p.stmt)
+		p.result = &result
+	}
+	if p.result.Error != nil {
+		return executeError(p.result.Error)
+	}
+	return nil
+}
+
+// execute Execute: 入口名 | 最多返回的行数 int32(0 是不限)。查询的行没有发完时回 PortalSuspended，
+// 客户端可以再发 Execute 取剩下的行
+func (c *session) execute(payload []byte) (quit bool, err error) {
+	r := reader{buf: payload}
+	name, maxRows := r.string(), int(r.int32())
+	if r.err != nil {
+		return false, errorf(codeProtocolViolation, "%v", r.err)
+	}
+	p, exists := c.portals[name]
+	if !exists {
+		return false, errorf(codeInvalidPortal, "入口 %q 不存在", name)
+	}
+	if p.stmt == nil {
+		return false, c.send(newMessage('I'))
+	}
+	if err := c.run(p); err != nil {
+		return false, err
+	}
+	if rs, ok := p.result.Result.(*storgeengine.ResultSet); ok {
+		rows := rs.Rows[p.sent:]
+		if maxRows > 0 && maxRows < len(rows) {
+			rows = rows[:maxRows]
+		}
+		n, err := c.sendRows(p.fields, rows)
+		p.sent += n
+		if err != nil {
+			return false, err
+		}
+		if p.sent < len(rs.Rows) {
+			return false, c.send(newMessage('s'))
+		}
+	}
+	_, quit = p.stmt.(*storgeengine.ExitStmt)
+	return quit, c.send(newMessage('C').string(commandTag(p.stmt, p.result.Result)))
+}
+
+// closeObject Close: S 语句名 或者 P 入口名，不存在也不算错
+func (c *session) closeObject(payload []byte) error {
+	r := reader{buf: payload}
+	kind, name := r.byte(), r.string()
+	switch {
+	case r.err != nil:
+		return errorf(codeProtocolViolation, "%v", r.err)
+	case kind == 'S':
+		delete(c.statements, name)
+	case kind == 'P':
+		delete(c.portals, name)
+	default:
+		return errorf(codeProtocolViolation, "Close 的类型 %q 无效", kind)
+	}
+	return c.send(newMessage('3'))
+}
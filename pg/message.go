@@ -0,0 +1,162 @@
+package pg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// maxMessageSize 客户端一条消息最多这么多字节
+const maxMessageSize = 64 << 20
+
+// 启动消息中的协议版本和特殊请求
+const (
+	protocolVersion = 3 << 16
+	sslRequestCode  = 80877103
+	gssRequestCode  = 80877104
+	cancelRequest   = 80877102
+)
+
+// conn PostgreSQL v3 协议的一个连接。启动消息为 长度 int32 | 内容，之后每条消息为
+// 类型 1 字节 | 长度 int32 | 内容，长度包括它自己的 4 字节，整数都是大端
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{Conn: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+}
+
+// readStartup 读一条没有类型的启动消息
+func (c *conn) readStartup() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+	return c.readBody(binary.BigEndian.Uint32(header[:]))
+}
+
+// readMessage 读一条消息
+func (c *conn) readMessage() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload, err := c.readBody(binary.BigEndian.Uint32(header[1:]))
+	return header[0], payload, err
+}
+
+func (c *conn) readBody(n uint32) ([]byte, error) {
+	if n < 4 || n-4 > maxMessageSize {
+		return nil, fmt.Errorf("消息长度 %d 无效", n)
+	}
+	payload := make([]byte, n-4)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return payload, nil
+}
+
+// message 正在拼的一条服务端消息
+type message struct {
+	buf []byte
+}
+
+func newMessage(typ byte) *message {
+	return &message{buf: []byte{typ, 0, 0, 0, 0}}
+}
+
+func (m *message) byte(b byte) *message {
+	m.buf = append(m.buf, b)
+	return m
+}
+
+func (m *message) int16(n int) *message {
+	m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(n))
+	return m
+}
+
+func (m *message) int32(n int32) *message {
+	m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(n))
+	return m
+}
+
+// string 以 0 结尾的字符串
+func (m *message) string(s string) *message {
+	m.buf = append(append(m.buf, s...), 0)
+	return m
+}
+
+func (m *message) bytes(b []byte) *message {
+	m.buf = append(m.buf, b...)
+	return m
+}
+
+// send 填上长度写进缓冲区，flush 时才发出去
+func (c *conn) send(m *message) error {
+	binary.BigEndian.PutUint32(m.buf[1:], uint32(len(m.buf)-1))
+	_, err := c.w.Write(m.buf)
+	return err
+}
+
+func (c *conn) flush() error {
+	return c.w.Flush()
+}
+
+// reader 顺序读取消息的内容，越界时记录错误并返回零值
+type reader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.buf)-r.pos {
+		r.err = fmt.Errorf("消息不完整")
+		return nil
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) int16() int {
+	if b := r.bytes(2); b != nil {
+		return int(int16(binary.BigEndian.Uint16(b)))
+	}
+	return 0
+}
+
+func (r *reader) int32() int32 {
+	if b := r.bytes(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+// string 以 0 结尾的字符串
+func (r *reader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	rest := r.buf[r.pos:]
+	for i, b := range rest {
+		if b == 0 {
+			r.pos += i + 1
+			return string(rest[:i])
+		}
+	}
+	r.err = fmt.Errorf("字符串没有结尾")
+	return ""
+}
@@ -0,0 +1,479 @@
+// Package pg 服务端的 PostgreSQL v3 协议，psql 和 pgx 可以直接连上来执行 AliangSQL 的语句。
+// 支持启动消息、明文和 MD5 密码认证、简单查询(Query)和扩展查询(Parse、Bind、Describe、Execute、Sync)，
+// 出错时返回带 SQLSTATE 的 ErrorResponse。不支持 SSL、COPY 和取消请求
+package pg
+
+import (
+	"awesomeProject4/protocol"
+	"awesomeProject4/storgeengine"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// ServerVersion 启动时告诉客户端的版本
+const ServerVersion = "14.0 (AliangSQL)"
+
+// 认证方式
+const (
+	AuthMD5      = "md5"
+	AuthPassword = "password" // 明文
+)
+
+// SQLSTATE
+const (
+	codeProtocolViolation   = "08P01"
+	codeFeatureUnsupported  = "0A000"
+	codeInvalidPassword     = "28P01"
+	codeInvalidDatabase     = "3D000"
+	codeSyntaxError         = "42601"
+	codeUndefinedTable      = "42P01"
+	codeInvalidParameter    = "22P02"
+	codeNotNullViolation    = "23502"
+	codeForeignKeyViolation = "23503"
+	codeUniqueViolation     = "23505"
+	codeCheckViolation      = "23514"
+	codeInvalidStatement    = "26000"
+	codeInvalidPortal       = "34000"
+	codeSerialization       = "40001"
+	codeExecute             = "XX000"
+)
+
+// kindCodes 引擎错误的种类对应的 SQLSTATE，其他的错误是 XX000
+var kindCodes = map[storgeengine.ErrorKind]string{
+	storgeengine.ErrUniqueViolation:     codeUniqueViolation,
+	storgeengine.ErrForeignKeyViolation: codeForeignKeyViolation,
+	storgeengine.ErrNotNullViolation:    codeNotNullViolation,
+	storgeengine.ErrCheckViolation:      codeCheckViolation,
+	storgeengine.ErrSerialization:       codeSerialization,
+	storgeengine.ErrUndefinedTable:      codeUndefinedTable,
+	storgeengine.ErrUndefinedDatabase:   codeInvalidDatabase,
+}
+
+// Error 带 SQLSTATE 的错误，发给客户端的 ErrorResponse
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func errorf(code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// executeError 执行语句出错时的错误，SQLSTATE 按引擎错误的种类给出，客户端可以据此区分唯一约束冲突、
+// 序列化失败等情况
+func executeError(err error) *Error {
+	var syntaxErr *storgeengine.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return errorf(codeSyntaxError, "%v", err)
+	}
+	if code, ok := kindCodes[storgeengine.KindOf(err)]; ok {
+		return errorf(code, "%v", err)
+	}
+	return errorf(codeExecute, "%v", err)
+}
+
+// Server PostgreSQL 协议的服务端，Users 是 user 包中的账号，用户名到密码；Auth 为 AuthMD5 或 AuthPassword，
+// 为空时用 MD5
+type Server struct {
+	DB      *storgeengine.DB
+	Users   map[string]string
+	Auth    string
+	nextPID int32
+}
+
+// Serve 接受连接，每个连接一个会话，直到监听出错
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn 处理一个连接，连接断开时返回
+func (s *Server) ServeConn(nc net.Conn) {
+	c := &session{conn: newConn(nc), statements: map[string]*statement{}, portals: map[string]*portal{}}
+	defer c.Close()
+	c.sess = s.DB.NewSession()
+	defer c.sess.Close()
+
+	if err := s.startup(c); err != nil {
+		if err != io.EOF {
+			fmt.Println("PostgreSQL 启动失败:", err)
+		}
+		return
+	}
+	for {
+		typ, payload, err := c.readMessage()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println("读取 PostgreSQL 消息出错:", err)
+			}
+			return
+		}
+		quit, err := c.handle(typ, payload)
+		if err != nil {
+			fmt.Println("发送 PostgreSQL 响应出错:", err)
+			return
+		}
+		if quit {
+			c.flush()
+			return
+		}
+	}
+}
+
+// startup 读启动消息，拒绝 SSL 请求，认证之后发参数、进程号和 ReadyForQuery
+func (s *Server) startup(c *session) error {
+	var params map[string]string
+	for params == nil {
+		payload, err := c.readStartup()
+		if err != nil {
+			return err
+		}
+		r := reader{buf: payload}
+		switch code := r.int32(); code {
+		case sslRequestCode, gssRequestCode:
+			// 不支持加密，客户端收到 N 后用明文重新发启动消息
+			if _, err := c.w.Write([]byte{'N'}); err != nil {
+				return err
+			}
+			if err := c.flush(); err != nil {
+				return err
+			}
+		case cancelRequest:
+			return io.EOF
+		case protocolVersion:
+			params = map[string]string{}
+			for r.err == nil {
+				key := r.string()
+				if key == "" {
+					break
+				}
+				params[key] = r.string()
+			}
+			if r.err != nil {
+				return c.fatal(errorf(codeProtocolViolation, "启动消息不完整"))
+			}
+		default:
+			return c.fatal(errorf(codeFeatureUnsupported, "不支持协议版本 %d.%d", code>>16, code&0xffff))
+		}
+	}
+
+	username := params["user"]
+	if err := s.authenticate(c, username); err != nil {
+		return err
+	}
+	// libpq 和 pgx 没有指定数据库时用用户名，这个数据库不存在时从没有选择数据库开始
+	if database := params["database"]; database != "" {
+		if err := c.sess.Use(database); err != nil && database != username {
+			return c.fatal(executeError(err))
+		}
+	}
+
+	c.send(newMessage('R').int32(0))
+	for _, kv := range [][2]string{
+		{"server_version", ServerVersion},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"TimeZone", "UTC"},
+		{"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"},
+	} {
+		c.send(newMessage('S').string(kv[0]).string(kv[1]))
+	}
+	secret := make([]byte, 4)
+	rand.Read(secret)
+	c.send(newMessage('K').int32(atomic.AddInt32(&s.nextPID, 1)).bytes(secret))
+	fmt.Printf("PostgreSQL 客户端 %s 已连接\n", username)
+	return c.ready()
+}
+
+// authenticate 要求客户端发密码并检查。MD5 时客户端发 "md5" + md5(md5(密码 + 用户名) + salt)
+func (s *Server) authenticate(c *session, username string) error {
+	password, exists := s.Users[username]
+	salt := make([]byte, 4)
+	if s.Auth == AuthPassword {
+		c.send(newMessage('R').int32(3))
+	} else {
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		c.send(newMessage('R').int32(5).bytes(salt))
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+	typ, payload, err := c.readMessage()
+	if err != nil {
+		return err
+	}
+	if typ != 'p' {
+		return c.fatal(errorf(codeProtocolViolation, "应该是密码消息，收到了 %q", typ))
+	}
+	r := reader{buf: payload}
+	answer := r.string()
+	expected := password
+	if s.Auth != AuthPassword {
+		expected = md5Password(username, password, salt)
+	}
+	if !exists || r.err != nil || subtle.ConstantTimeCompare([]byte(answer), []byte(expected)) != 1 {
+		return c.fatal(errorf(codeInvalidPassword, "用户 %s 认证失败", username))
+	}
+	return nil
+}
+
+// md5Password MD5 认证时客户端应该发来的密码
+func md5Password(username, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + username))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// session 一个连接的状态: 会话、扩展查询中准备好的语句和入口
+type session struct {
+	*conn
+	sess       *storgeengine.Session
+	statements map[string]*statement
+	portals    map[string]*portal
+	failed     bool // 扩展查询出错后忽略之后的消息，直到 Sync
+}
+
+// handle 处理一条消息，Terminate 或者 exit 时返回 quit 为 true
+func (c *session) handle(typ byte, payload []byte) (quit bool, err error) {
+	if c.failed && typ != 'S' && typ != 'X' {
+		return false, nil
+	}
+	switch typ {
+	case 'Q':
+		r := reader{buf: payload}
+		sql := r.string()
+		if r.err != nil {
+			return false, c.fatal(errorf(codeProtocolViolation, "%v", r.err))
+		}
+		quit, err = c.simpleQuery(sql)
+		if err == nil {
+			err = c.ready()
+		}
+		return quit, err
+	case 'X':
+		return true, nil
+	case 'S':
+		c.failed = false
+		// 隐式的事务结束后没有名字的入口就不能再用了
+		delete(c.portals, "")
+		return false, c.ready()
+	case 'H':
+		return false, c.flush()
+	case 'P':
+		err = c.parse(payload)
+	case 'B':
+		err = c.bind(payload)
+	case 'D':
+		err = c.describe(payload)
+	case 'E':
+		quit, err = c.execute(payload)
+	case 'C':
+		err = c.closeObject(payload)
+	default:
+		err = errorf(codeProtocolViolation, "不支持的消息 %q", typ)
+	}
+	var pgErr *Error
+	if errors.As(err, &pgErr) {
+		c.failed = true
+		return false, c.sendError(pgErr)
+	}
+	return quit, err
+}
+
+// simpleQuery 简单查询: 字符串中可以有多条语句，每条语句返回自己的结果，出错时后面的语句不再执行。
+// 和 PostgreSQL 一样，多条语句在一个隐式事务中执行，出错时前面语句的修改也撤销
+func (c *session) simpleQuery(sql string) (quit bool, err error) {
+	fmt.Println("接收到的 PostgreSQL 命令:", sql)
+	stmts, err := storgeengine.ParseScript(sql)
+	if err != nil {
+		return false, c.sendError(errorf(codeSyntaxError, "%v", err))
+	}
+	if len(stmts) == 0 {
+		return false, c.send(newMessage('I'))
+	}
+	implicit := c.implicitTransaction(stmts)
+	if implicit {
+		if result := c.sess.Execute(&storgeengine.BeginStmt{}); result.Error != nil {
+			return false, c.sendError(executeError(result.Error))
+		}
+	}
+	for _, stmt := range stmts {
+		result := c.sess.Execute(stmt)
+		if result.Error != nil {
+			if implicit {
+				c.sess.Execute(&storgeengine.RollbackStmt{})
+			}
+			return false, c.sendError(executeError(result.Error))
+		}
+		if rs, ok := result.Result.(*storgeengine.ResultSet); ok {
+			fields := describeColumns(rs, nil)
+			if err := c.send(rowDescription(fields)); err != nil {
+				return false, err
+			}
+			if _, err := c.sendRows(fields, rs.Rows); err != nil {
+				if implicit {
+					c.sess.Execute(&storgeengine.RollbackStmt{})
+				}
+				var pgErr *Error
+				if errors.As(err, &pgErr) {
+					return false, c.sendError(pgErr)
+				}
+				return false, err
+			}
+		}
+		if err := c.send(newMessage('C').string(commandTag(stmt, result.Result))); err != nil {
+			return false, err
+		}
+		if _, ok := stmt.(*storgeengine.ExitStmt); ok {
+			quit = true
+			break
+		}
+	}
+	if implicit {
+		if result := c.sess.Execute(&storgeengine.CommitStmt{}); result.Error != nil {
+			return quit, c.sendError(executeError(result.Error))
+		}
+	}
+	return quit, nil
+}
+
+// implicitTransaction 多条语句要不要放在一个隐式事务中。已经在事务中、关闭了自动提交，
+// 或者语句自己用 begin、commit、rollback、set 控制事务时不用。建表等语句不在事务中，出错时不会撤销
+func (c *session) implicitTransaction(stmts []storgeengine.Statement) bool {
+	if len(stmts) < 2 || c.sess.InTransaction() || !c.sess.Autocommit() {
+		return false
+	}
+	for _, stmt := range stmts {
+		switch stmt.(type) {
+		case *storgeengine.BeginStmt, *storgeengine.CommitStmt, *storgeengine.RollbackStmt, *storgeengine.SetStmt:
+			return false
+		}
+	}
+	return true
+}
+
+// field RowDescription 中的一列
+type field struct {
+	name   string
+	oid    int32
+	format int
+}
+
+// describeColumns 结果集的列，类型是查询中声明的类型，和结果中有哪些行无关。
+// formats 是 Bind 中要求的结果格式: 没有时都是文本，只有一个时所有的列都用它
+func describeColumns(rs *storgeengine.ResultSet, formats []int) []field {
+	fields := make([]field, len(rs.Columns))
+	for i, name := range rs.Columns {
+		fields[i] = field{name: name, oid: oidText}
+		if i < len(rs.Types) {
+			fields[i].oid = typeOID(protocol.TypeOfColumn(rs.Types[i]))
+		}
+		switch {
+		case len(formats) == 1:
+			fields[i].format = formats[0]
+		case i < len(formats):
+			fields[i].format = formats[i]
+		}
+	}
+	return fields
+}
+
+func rowDescription(fields []field) *message {
+	m := newMessage('T').int16(len(fields))
+	for _, f := range fields {
+		m.string(f.name).int32(0).int16(0).int32(f.oid).int16(typeSize(f.oid)).int32(-1).int16(f.format)
+	}
+	return m
+}
+
+// sendRows 每行一个 DataRow，返回发出去的行数
+func (c *session) sendRows(fields []field, rows [][]interface{}) (int, error) {
+	for n, row := range rows {
+		m := newMessage('D').int16(len(row))
+		for i, v := range row {
+			if v == nil {
+				m.int32(-1)
+				continue
+			}
+			b := encodeText(v)
+			if i < len(fields) && fields[i].format == formatBinary {
+				var err error
+				if b, err = encodeBinary(fields[i].oid, v); err != nil {
+					return n, errorf(codeExecute, "%v", err)
+				}
+			}
+			m.int32(int32(len(b))).bytes(b)
+		}
+		if err := c.send(m); err != nil {
+			return n, err
+		}
+	}
+	return len(rows), nil
+}
+
+// commandTag CommandComplete 中的命令和行数
+func commandTag(stmt storgeengine.Statement, result interface{}) string {
+	switch r := result.(type) {
+	case *storgeengine.ResultSet:
+		return fmt.Sprintf("SELECT %d", len(r.Rows))
+	case *storgeengine.InsertResult:
+		return fmt.Sprintf("INSERT 0 %d", r.RowsAffected)
+	case *storgeengine.AffectedResult:
+		return fmt.Sprintf("%s %d", protocol.CommandTag(stmt), r.RowsAffected)
+	}
+	return protocol.CommandTag(stmt)
+}
+
+// ready ReadyForQuery，状态为 I 空闲、T 在事务中，然后把缓冲区中的响应都发出去
+func (c *session) ready() error {
+	status := byte('I')
+	if c.sess.InTransaction() {
+		status = 'T'
+	}
+	if err := c.send(newMessage('Z').byte(status)); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// sendError ErrorResponse: 每个字段为 类型 1 字节 | 以 0 结尾的值，最后是一个 0
+func (c *session) sendError(e *Error) error {
+	return c.send(newMessage('E').
+		byte('S').string("ERROR").
+		byte('V').string("ERROR").
+		byte('C').string(e.Code).
+		byte('M').string(e.Message).
+		byte(0))
+}
+
+// fatal 发出 FATAL 的错误后断开连接
+func (c *session) fatal(e *Error) error {
+	c.send(newMessage('E').
+		byte('S').string("FATAL").
+		byte('V').string("FATAL").
+		byte('C').string(e.Code).
+		byte('M').string(e.Message).
+		byte(0))
+	c.flush()
+	return e
+}
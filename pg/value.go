@@ -0,0 +1,339 @@
+package pg
+
+import (
+	"awesomeProject4/protocol"
+	"awesomeProject4/storgeengine"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 类型的 OID
+const (
+	oidBool        = 16
+	oidBytea       = 17
+	oidName        = 19
+	oidInt8        = 20
+	oidInt2        = 21
+	oidInt4        = 23
+	oidText        = 25
+	oidFloat4      = 700
+	oidFloat8      = 701
+	oidUnknown     = 705
+	oidBpchar      = 1042
+	oidVarchar     = 1043
+	oidDate        = 1082
+	oidTimestamp   = 1114
+	oidTimestamptz = 1184
+	oidNumeric     = 1700
+)
+
+// 格式代码
+const (
+	formatText   = 0
+	formatBinary = 1
+)
+
+// pgEpoch 二进制格式的日期和时间从 2000-01-01 开始计算
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const secondsPerDay = 24 * 60 * 60
+
+// typeOID 结果中一列的类型，推不出类型的列当作 text
+func typeOID(t protocol.ValueType) int32 {
+	switch t {
+	case protocol.TypeInt:
+		return oidInt8
+	case protocol.TypeFloat:
+		return oidFloat8
+	case protocol.TypeBool:
+		return oidBool
+	case protocol.TypeDecimal:
+		return oidNumeric
+	case protocol.TypeDate:
+		return oidDate
+	case protocol.TypeTimestamp:
+		return oidTimestamp
+	case protocol.TypeBlob:
+		return oidBytea
+	}
+	return oidText
+}
+
+// typeSize 类型的长度，变长的类型为 -1
+func typeSize(oid int32) int {
+	switch oid {
+	case oidBool:
+		return 1
+	case oidDate:
+		return 4
+	case oidInt8, oidFloat8, oidTimestamp:
+		return 8
+	}
+	return -1
+}
+
+// encodeText 值的文本格式
+func encodeText(v interface{}) []byte {
+	switch v := v.(type) {
+	case int64:
+		return strconv.AppendInt(nil, v, 10)
+	case float64:
+		return strconv.AppendFloat(nil, v, 'g', -1, 64)
+	case bool:
+		if v {
+			return []byte("t")
+		}
+		return []byte("f")
+	case storgeengine.Date:
+		return []byte(v.Format("2006-01-02"))
+	case time.Time:
+		return []byte(v.Format("2006-01-02 15:04:05.999999"))
+	case []byte:
+		return []byte(`\x` + hex.EncodeToString(v))
+	case string:
+		return []byte(v)
+	}
+	return []byte(fmt.Sprint(v))
+}
+
+// encodeBinary 值按 oid 类型的二进制格式。text 的二进制格式和文本格式一样，推不出类型的列中什么值都可以
+func encodeBinary(oid int32, v interface{}) ([]byte, error) {
+	if oid == oidText {
+		return encodeText(v), nil
+	}
+	switch v := v.(type) {
+	case int64:
+		if oid == oidInt8 {
+			return binary.BigEndian.AppendUint64(nil, uint64(v)), nil
+		}
+	case float64:
+		if oid == oidFloat8 {
+			return binary.BigEndian.AppendUint64(nil, math.Float64bits(v)), nil
+		}
+	case bool:
+		if oid == oidBool {
+			if v {
+				return []byte{1}, nil
+			}
+			return []byte{0}, nil
+		}
+	case storgeengine.Decimal:
+		if oid == oidNumeric {
+			return encodeNumeric(v.String()), nil
+		}
+	case storgeengine.Date:
+		if oid == oidDate {
+			days := int32((v.Unix() - pgEpoch.Unix()) / secondsPerDay)
+			return binary.BigEndian.AppendUint32(nil, uint32(days)), nil
+		}
+	case time.Time:
+		if oid == oidTimestamp {
+			micros := (v.Unix()-pgEpoch.Unix())*1e6 + int64(v.Nanosecond()/1e3)
+			return binary.BigEndian.AppendUint64(nil, uint64(micros)), nil
+		}
+	case []byte:
+		if oid == oidBytea {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("值 %v 无法写成类型 %d 的二进制格式", v, oid)
+}
+
+// encodeNumeric numeric 的二进制格式: 位数 | 权重 | 符号 | 小数位数 | 每位一个 0-9999 的 int16。
+// 第一位的值是 10000 的 权重 次方
+func encodeNumeric(s string) []byte {
+	sign := uint16(0)
+	if strings.HasPrefix(s, "-") {
+		sign = 0x4000
+		s = s[1:]
+	}
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	dscale := len(fracPart)
+	// 整数部分在左边、小数部分在右边补 0，凑成 4 位一组
+	if n := len(intPart) % 4; n != 0 {
+		intPart = strings.Repeat("0", 4-n) + intPart
+	}
+	if n := len(fracPart) % 4; n != 0 {
+		fracPart += strings.Repeat("0", 4-n)
+	}
+	digits := intPart + fracPart
+	groups := make([]uint16, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		n, _ := strconv.Atoi(digits[i : i+4])
+		groups = append(groups, uint16(n))
+	}
+	weight := len(intPart)/4 - 1
+	for len(groups) > 0 && groups[0] == 0 {
+		groups = groups[1:]
+		weight--
+	}
+	for len(groups) > 0 && groups[len(groups)-1] == 0 {
+		groups = groups[:len(groups)-1]
+	}
+	if len(groups) == 0 {
+		weight, sign = 0, 0
+	}
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(groups)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(int16(weight)))
+	buf = binary.BigEndian.AppendUint16(buf, sign)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(dscale))
+	for _, g := range groups {
+		buf = binary.BigEndian.AppendUint16(buf, g)
+	}
+	return buf
+}
+
+// decodeNumeric 把 numeric 的二进制格式还原成十进制的文本
+func decodeNumeric(b []byte) (string, error) {
+	r := reader{buf: b}
+	ndigits, weight, sign, dscale := r.int16(), r.int16(), uint16(r.int16()), r.int16()
+	var digits strings.Builder
+	for i := 0; i < ndigits; i++ {
+		fmt.Fprintf(&digits, "%04d", r.int16())
+	}
+	if r.err != nil {
+		return "", r.err
+	}
+	if sign == 0xc000 {
+		return "", fmt.Errorf("不支持 NaN")
+	}
+	// 小数点在第 (weight+1)*4 位之后
+	s := digits.String()
+	point := (weight + 1) * 4
+	for point > len(s) {
+		s += "0"
+	}
+	for point < 0 {
+		s = "0" + s
+		point++
+	}
+	intPart, fracPart := strings.TrimLeft(s[:point], "0"), s[point:]
+	if intPart == "" {
+		intPart = "0"
+	}
+	for len(fracPart) < dscale {
+		fracPart += "0"
+	}
+	fracPart = fracPart[:dscale]
+	text := intPart
+	if fracPart != "" {
+		text += "." + fracPart
+	}
+	if sign == 0x4000 {
+		text = "-" + text
+	}
+	return text, nil
+}
+
+// sampleParam 类型为 oid 的参数的一个示例值，和 decodeParam 得到的值的类型相同，用来在 Bind 之前推出结果的类型。
+// 日期和时间的参数按文本格式是字符串、按二进制格式是日期和时间，类型不确定，用 NULL
+func sampleParam(oid int32) interface{} {
+	switch oid {
+	case oidInt2, oidInt4, oidInt8:
+		return int64(0)
+	case oidFloat4, oidFloat8:
+		return float64(0)
+	case oidBool:
+		return false
+	case oidNumeric:
+		d, _ := storgeengine.ParseDecimal("0")
+		return d
+	case oidBytea:
+		return []byte{}
+	case oidDate, oidTimestamp, oidTimestamptz:
+		return nil
+	}
+	return ""
+}
+
+// decodeParam 把 Bind 中的一个参数转换成语句中的值，类型不确定的参数当作字符串，由写入的列再转换
+func decodeParam(oid int32, format int, b []byte) (interface{}, error) {
+	if b == nil {
+		return nil, nil
+	}
+	if format == formatText {
+		s := string(b)
+		switch oid {
+		case oidInt2, oidInt4, oidInt8:
+			return strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		case oidFloat4, oidFloat8:
+			return strconv.ParseFloat(strings.TrimSpace(s), 64)
+		case oidBool:
+			switch strings.ToLower(strings.TrimSpace(s)) {
+			case "t", "true", "1", "on", "yes", "y":
+				return true, nil
+			case "f", "false", "0", "off", "no", "n":
+				return false, nil
+			}
+			return nil, fmt.Errorf("无效的布尔值 %q", s)
+		case oidNumeric:
+			return storgeengine.ParseDecimal(s)
+		case oidBytea:
+			if strings.HasPrefix(s, `\x`) {
+				return hex.DecodeString(s[2:])
+			}
+			return b, nil
+		}
+		return s, nil
+	}
+
+	n := len(b)
+	switch oid {
+	case oidInt2:
+		if n == 2 {
+			return int64(int16(binary.BigEndian.Uint16(b))), nil
+		}
+	case oidInt4:
+		if n == 4 {
+			return int64(int32(binary.BigEndian.Uint32(b))), nil
+		}
+	case oidInt8:
+		if n == 8 {
+			return int64(binary.BigEndian.Uint64(b)), nil
+		}
+	case oidFloat4:
+		if n == 4 {
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+		}
+	case oidFloat8:
+		if n == 8 {
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+		}
+	case oidBool:
+		if n == 1 {
+			return b[0] != 0, nil
+		}
+	case oidBytea:
+		return append([]byte{}, b...), nil
+	case 0, oidText, oidVarchar, oidBpchar, oidName, oidUnknown:
+		return string(b), nil
+	case oidDate:
+		if n == 4 {
+			t := pgEpoch.AddDate(0, 0, int(int32(binary.BigEndian.Uint32(b))))
+			return storgeengine.NewDate(t.Year(), t.Month(), t.Day()), nil
+		}
+	case oidTimestamp, oidTimestamptz:
+		if n == 8 {
+			micros := int64(binary.BigEndian.Uint64(b))
+			sec, frac := micros/1e6, micros%1e6
+			if frac < 0 {
+				sec, frac = sec-1, frac+1e6
+			}
+			return time.Unix(pgEpoch.Unix()+sec, frac*1e3).UTC(), nil
+		}
+	case oidNumeric:
+		s, err := decodeNumeric(b)
+		if err != nil {
+			return nil, err
+		}
+		return storgeengine.ParseDecimal(s)
+	default:
+		return nil, fmt.Errorf("不支持类型 %d 的二进制参数", oid)
+	}
+	return nil, fmt.Errorf("类型 %d 的二进制参数长度 %d 不对", oid, n)
+}
@@ -0,0 +1,273 @@
+// Package protocol 客户端和服务端之间的二进制协议。每条消息为
+//
+//	类型 uint8 | 内容长度 uint32 | 内容
+//
+// 整数都是大端，字符串和二进制为 长度 uint32 | 内容。连接建立后客户端先发 Handshake，
+// 服务端回一条 Handshake，版本不对时回 Error 并断开。之后客户端每发一条 Query，服务端回
+//
+//	RowDescription DataRow* CommandComplete    查询
+//	CommandComplete                            其他语句
+//	Error                                      出错
+//
+// 客户端发 Terminate 后服务端关闭连接。结果中的值带有类型标记，不会和消息的边界混在一起
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Version 协议的版本，握手时双方交换
+const Version = 1
+
+// MaxMessageSize 一条消息的内容最多这么多字节，更长的消息当作协议错误
+const MaxMessageSize = 64 << 20
+
+// MessageType 消息的类型
+type MessageType byte
+
+const (
+	MsgHandshake       MessageType = 'H' // 双方: 版本 uint16 | 名字 | 当前数据库
+	MsgQuery           MessageType = 'Q' // 客户端: 一条 SQL 语句
+	MsgTerminate       MessageType = 'X' // 客户端: 关闭连接，没有内容
+	MsgRowDescription  MessageType = 'T' // 服务端: 列数 uint16 | 每列为 列名、值的类型 uint8
+	MsgDataRow         MessageType = 'D' // 服务端: 列数 uint16 | 每列为 带类型标记的值
+	MsgCommandComplete MessageType = 'C' // 服务端: 命令 | 影响的行数 uint64 | 自增值 int64 | 说明
+	MsgError           MessageType = 'E' // 服务端: 错误码 uint16 | 错误信息
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MsgHandshake:
+		return "Handshake"
+	case MsgQuery:
+		return "Query"
+	case MsgTerminate:
+		return "Terminate"
+	case MsgRowDescription:
+		return "RowDescription"
+	case MsgDataRow:
+		return "DataRow"
+	case MsgCommandComplete:
+		return "CommandComplete"
+	case MsgError:
+		return "Error"
+	}
+	return fmt.Sprintf("未知消息 %q", byte(t))
+}
+
+// 错误码
+const (
+	CodeProtocol uint16 = 1 // 消息格式不对、版本不支持或者收到了不该收到的消息
+	CodeSyntax   uint16 = 2 // SQL 语法错误
+	CodeExecute  uint16 = 3 // 语句执行失败
+)
+
+// Error 服务端返回的错误
+type Error struct {
+	Code    uint16
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("错误 %d: %s", e.Code, e.Message)
+}
+
+// WriteMessage 写一条消息。w 通常带缓冲，一次响应写完后再 Flush
+func WriteMessage(w io.Writer, typ MessageType, payload []byte) error {
+	if len(payload) > MaxMessageSize {
+		return fmt.Errorf("消息太长: %d 字节", len(payload))
+	}
+	header := [5]byte{byte(typ)}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// ReadMessage 读一条完整的消息
+func ReadMessage(r *bufio.Reader) (MessageType, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > MaxMessageSize {
+		return 0, nil, &Error{Code: CodeProtocol, Message: fmt.Sprintf("消息太长: %d 字节", n)}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return MessageType(header[0]), payload, nil
+}
+
+// Handshake 握手消息。客户端的 Database 是连接后要使用的数据库，可以为空；服务端的是会话当前的数据库
+type Handshake struct {
+	Version  uint16
+	Name     string // 客户端或服务端的名字
+	Database string
+}
+
+func (h Handshake) Encode() []byte {
+	buf := binary.BigEndian.AppendUint16(nil, h.Version)
+	buf = appendString(buf, h.Name)
+	return appendString(buf, h.Database)
+}
+
+func DecodeHandshake(payload []byte) (Handshake, error) {
+	r := reader{buf: payload}
+	h := Handshake{Version: r.uint16(), Name: r.string(), Database: r.string()}
+	return h, r.done()
+}
+
+// Column 结果中的一列
+type Column struct {
+	Name string
+	Type ValueType // 查询中声明的类型，推不出类型并且全是 NULL 时为 TypeNull
+}
+
+func EncodeRowDescription(columns []Column) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(columns)))
+	for _, col := range columns {
+		buf = appendString(buf, col.Name)
+		buf = append(buf, byte(col.Type))
+	}
+	return buf
+}
+
+func DecodeRowDescription(payload []byte) ([]Column, error) {
+	r := reader{buf: payload}
+	n := int(r.uint16())
+	columns := make([]Column, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		columns = append(columns, Column{Name: r.string(), Type: ValueType(r.uint8())})
+	}
+	return columns, r.done()
+}
+
+func EncodeDataRow(values []interface{}) ([]byte, error) {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(values)))
+	for _, v := range values {
+		var err error
+		if buf, err = appendValue(buf, v); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func DecodeDataRow(payload []byte) ([]interface{}, error) {
+	r := reader{buf: payload}
+	n := int(r.uint16())
+	values := make([]interface{}, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		values = append(values, r.value())
+	}
+	return values, r.done()
+}
+
+// CommandComplete 一条语句执行完成
+type CommandComplete struct {
+	Tag          string // 语句的种类，例如 SELECT、INSERT
+	RowsAffected uint64 // 查询返回的行数，或者修改的行数
+	LastInsertID int64  // 自增列生成的值，没有时为 0
+	Message      string // 给人看的说明，可以为空
+}
+
+func (c CommandComplete) Encode() []byte {
+	buf := appendString(nil, c.Tag)
+	buf = binary.BigEndian.AppendUint64(buf, c.RowsAffected)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.LastInsertID))
+	return appendString(buf, c.Message)
+}
+
+func DecodeCommandComplete(payload []byte) (CommandComplete, error) {
+	r := reader{buf: payload}
+	c := CommandComplete{Tag: r.string(), RowsAffected: r.uint64(), LastInsertID: int64(r.uint64()), Message: r.string()}
+	return c, r.done()
+}
+
+func (e *Error) Encode() []byte {
+	return appendString(binary.BigEndian.AppendUint16(nil, e.Code), e.Message)
+}
+
+func DecodeError(payload []byte) (*Error, error) {
+	r := reader{buf: payload}
+	e := &Error{Code: r.uint16(), Message: r.string()}
+	return e, r.done()
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// reader 顺序读取消息的内容，越界时记录错误并返回零值
+type reader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.buf)-r.pos {
+		r.err = &Error{Code: CodeProtocol, Message: "消息不完整"}
+		return nil
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) uint8() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) float64() float64 {
+	return math.Float64frombits(r.uint64())
+}
+
+func (r *reader) string() string {
+	return string(r.bytes(int(r.uint32())))
+}
+
+// done 内容必须正好读完
+func (r *reader) done() error {
+	if r.err == nil && r.pos != len(r.buf) {
+		r.err = &Error{Code: CodeProtocol, Message: "消息末尾有多余的数据"}
+	}
+	return r.err
+}
@@ -0,0 +1,174 @@
+package protocol
+
+import (
+	"awesomeProject4/storgeengine"
+	"bufio"
+	"fmt"
+)
+
+// CommandTag 语句在 CommandComplete 中的命令
+func CommandTag(stmt storgeengine.Statement) string {
+	switch stmt.(type) {
+	case *storgeengine.SelectStmt:
+		return "SELECT"
+	case *storgeengine.InsertStmt:
+		return "INSERT"
+	case *storgeengine.UpdateStmt:
+		return "UPDATE"
+	case *storgeengine.DeleteStmt:
+		return "DELETE"
+	case *storgeengine.UseStmt:
+		return "USE"
+	case *storgeengine.CreateDatabaseStmt:
+		return "CREATE DATABASE"
+	case *storgeengine.CreateTableStmt:
+		return "CREATE TABLE"
+	case *storgeengine.CreateIndexStmt:
+		return "CREATE INDEX"
+	case *storgeengine.DropIndexStmt:
+		return "DROP INDEX"
+	case *storgeengine.CreateSequenceStmt:
+		return "CREATE SEQUENCE"
+	case *storgeengine.DropSequenceStmt:
+		return "DROP SEQUENCE"
+	case *storgeengine.BeginStmt:
+		return "BEGIN"
+	case *storgeengine.CommitStmt:
+		return "COMMIT"
+	case *storgeengine.RollbackStmt:
+		return "ROLLBACK"
+	case *storgeengine.SetStmt:
+		return "SET"
+	case *storgeengine.HelpStmt:
+		return "HELP"
+	case *storgeengine.ExitStmt:
+		return "EXIT"
+	}
+	return "UNKNOWN"
+}
+
+// Columns 结果集的列，类型是查询中声明的类型。推不出类型的列(例如 select null)取这一列中
+// 第一个不是 NULL 的值的类型
+func Columns(rs *storgeengine.ResultSet) []Column {
+	columns := make([]Column, len(rs.Columns))
+	for i, name := range rs.Columns {
+		columns[i].Name = name
+		if i < len(rs.Types) {
+			if columns[i].Type = TypeOfColumn(rs.Types[i]); columns[i].Type != TypeNull {
+				continue
+			}
+		}
+		for _, row := range rs.Rows {
+			if row[i] != nil {
+				columns[i].Type = TypeOf(row[i])
+				break
+			}
+		}
+	}
+	return columns
+}
+
+// WriteResult 把一条语句的执行结果写成消息: 查询是 RowDescription、DataRow 和 CommandComplete，
+// 其他语句只有 CommandComplete，出错时是 Error
+func WriteResult(w *bufio.Writer, tag string, result storgeengine.SQLResult) error {
+	if result.Error != nil {
+		return WriteError(w, CodeExecute, result.Error.Error())
+	}
+	complete := CommandComplete{Tag: tag}
+	switch r := result.Result.(type) {
+	case *storgeengine.ResultSet:
+		if err := WriteMessage(w, MsgRowDescription, EncodeRowDescription(Columns(r))); err != nil {
+			return err
+		}
+		for _, row := range r.Rows {
+			payload, err := EncodeDataRow(row)
+			if err != nil {
+				return err
+			}
+			if err := WriteMessage(w, MsgDataRow, payload); err != nil {
+				return err
+			}
+		}
+		complete.RowsAffected = uint64(len(r.Rows))
+	case *storgeengine.InsertResult:
+		complete.RowsAffected = uint64(r.RowsAffected)
+		complete.LastInsertID = r.LastInsertID
+		complete.Message = r.String()
+	case *storgeengine.AffectedResult:
+		complete.RowsAffected = uint64(r.RowsAffected)
+		complete.Message = r.String()
+	case nil:
+	default:
+		complete.Message = fmt.Sprint(r)
+	}
+	if err := WriteMessage(w, MsgCommandComplete, complete.Encode()); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// WriteError 写一条错误消息并发出去
+func WriteError(w *bufio.Writer, code uint16, message string) error {
+	if err := WriteMessage(w, MsgError, (&Error{Code: code, Message: message}).Encode()); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Result 客户端收到的一条语句的结果。Columns 为 nil 表示不是查询
+type Result struct {
+	Columns  []Column
+	Rows     [][]interface{}
+	Complete CommandComplete
+}
+
+// ResultSet 查询的结果，可以用 String 显示成表格
+func (r *Result) ResultSet() *storgeengine.ResultSet {
+	rs := &storgeengine.ResultSet{Columns: make([]string, len(r.Columns)), Types: make([]storgeengine.ColumnType, len(r.Columns)), Rows: r.Rows}
+	for i, col := range r.Columns {
+		rs.Columns[i], rs.Types[i] = col.Name, col.Type.ColumnType()
+	}
+	return rs
+}
+
+// ReadResult 读一条语句的结果，直到 CommandComplete。服务端返回错误时 err 是 *Error
+func ReadResult(r *bufio.Reader) (*Result, error) {
+	result := &Result{}
+	for {
+		typ, payload, err := ReadMessage(r)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case MsgRowDescription:
+			if result.Columns, err = DecodeRowDescription(payload); err != nil {
+				return nil, err
+			}
+		case MsgDataRow:
+			if result.Columns == nil {
+				return nil, &Error{Code: CodeProtocol, Message: "DataRow 之前没有 RowDescription"}
+			}
+			row, err := DecodeDataRow(payload)
+			if err != nil {
+				return nil, err
+			}
+			if len(row) != len(result.Columns) {
+				return nil, &Error{Code: CodeProtocol, Message: fmt.Sprintf("DataRow 有 %d 列，应该是 %d 列", len(row), len(result.Columns))}
+			}
+			result.Rows = append(result.Rows, row)
+		case MsgCommandComplete:
+			if result.Complete, err = DecodeCommandComplete(payload); err != nil {
+				return nil, err
+			}
+			return result, nil
+		case MsgError:
+			e, err := DecodeError(payload)
+			if err != nil {
+				return nil, err
+			}
+			return nil, e
+		default:
+			return nil, &Error{Code: CodeProtocol, Message: fmt.Sprintf("意外的消息 %v", typ)}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package protocol
+
+import (
+	"awesomeProject4/storgeengine"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ValueType 结果中值的类型标记，写在每个值的前面
+//
+//	NULL       没有内容
+//	INT        int64
+//	FLOAT      float64 的位
+//	STRING     字符串
+//	BOOL       uint8
+//	DECIMAL    十进制的文本，例如 -12.50
+//	DATE       1970-01-01 以来的天数 int32
+//	TIMESTAMP  UTC 的 Unix 秒数 int64 | 纳秒 uint32
+//	BLOB       二进制
+type ValueType byte
+
+const (
+	TypeNull ValueType = iota
+	TypeInt
+	TypeFloat
+	TypeString
+	TypeBool
+	TypeDecimal
+	TypeDate
+	TypeTimestamp
+	TypeBlob
+)
+
+func (t ValueType) String() string {
+	switch t {
+	case TypeNull:
+		return "NULL"
+	case TypeInt:
+		return "INT"
+	case TypeFloat:
+		return "FLOAT"
+	case TypeString:
+		return "STRING"
+	case TypeBool:
+		return "BOOL"
+	case TypeDecimal:
+		return "DECIMAL"
+	case TypeDate:
+		return "DATE"
+	case TypeTimestamp:
+		return "TIMESTAMP"
+	case TypeBlob:
+		return "BLOB"
+	}
+	return fmt.Sprintf("未知类型 %d", byte(t))
+}
+
+const secondsPerDay = 24 * 60 * 60
+
+// TypeOf 值在协议中的类型
+func TypeOf(value interface{}) ValueType {
+	switch value.(type) {
+	case int64:
+		return TypeInt
+	case float64:
+		return TypeFloat
+	case string:
+		return TypeString
+	case bool:
+		return TypeBool
+	case storgeengine.Decimal:
+		return TypeDecimal
+	case storgeengine.Date:
+		return TypeDate
+	case time.Time:
+		return TypeTimestamp
+	case []byte:
+		return TypeBlob
+	}
+	return TypeNull
+}
+
+// columnTypes 列类型和协议中类型的对应
+var columnTypes = map[storgeengine.ColumnType]ValueType{
+	storgeengine.IntType:       TypeInt,
+	storgeengine.FloatType:     TypeFloat,
+	storgeengine.StringType:    TypeString,
+	storgeengine.BoolType:      TypeBool,
+	storgeengine.DecimalType:   TypeDecimal,
+	storgeengine.DateType:      TypeDate,
+	storgeengine.TimestampType: TypeTimestamp,
+	storgeengine.BlobType:      TypeBlob,
+}
+
+// TypeOfColumn 列类型在协议中的类型，UnknownType 是 TypeNull
+func TypeOfColumn(t storgeengine.ColumnType) ValueType {
+	if typ, ok := columnTypes[t]; ok {
+		return typ
+	}
+	return TypeNull
+}
+
+// ColumnType 协议中的类型对应的列类型，TypeNull 是 UnknownType
+func (t ValueType) ColumnType() storgeengine.ColumnType {
+	for ct, typ := range columnTypes {
+		if typ == t {
+			return ct
+		}
+	}
+	return storgeengine.UnknownType
+}
+
+func appendValue(buf []byte, value interface{}) ([]byte, error) {
+	typ := TypeOf(value)
+	if typ == TypeNull && value != nil {
+		return nil, fmt.Errorf("无法发送 %T 类型的值", value)
+	}
+	buf = append(buf, byte(typ))
+	switch v := value.(type) {
+	case int64:
+		buf = binary.BigEndian.AppendUint64(buf, uint64(v))
+	case float64:
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(v))
+	case string:
+		buf = appendString(buf, v)
+	case bool:
+		b := byte(0)
+		if v {
+			b = 1
+		}
+		buf = append(buf, b)
+	case storgeengine.Decimal:
+		buf = appendString(buf, v.String())
+	case storgeengine.Date:
+		buf = binary.BigEndian.AppendUint32(buf, uint32(int32(v.Unix()/secondsPerDay)))
+	case time.Time:
+		buf = binary.BigEndian.AppendUint64(buf, uint64(v.Unix()))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(v.Nanosecond()))
+	case []byte:
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(v)))
+		buf = append(buf, v...)
+	}
+	return buf, nil
+}
+
+// value 读一个带类型标记的值，得到的值和查询结果中的类型相同
+func (r *reader) value() interface{} {
+	switch typ := ValueType(r.uint8()); typ {
+	case TypeNull:
+		return nil
+	case TypeInt:
+		return int64(r.uint64())
+	case TypeFloat:
+		return r.float64()
+	case TypeString:
+		return r.string()
+	case TypeBool:
+		return r.uint8() != 0
+	case TypeDecimal:
+		d, err := storgeengine.ParseDecimal(r.string())
+		if err != nil && r.err == nil {
+			r.err = &Error{Code: CodeProtocol, Message: err.Error()}
+		}
+		return d
+	case TypeDate:
+		days := int64(int32(r.uint32()))
+		return storgeengine.Date{Time: time.Unix(days*secondsPerDay, 0).UTC()}
+	case TypeTimestamp:
+		sec := int64(r.uint64())
+		return time.Unix(sec, int64(r.uint32())).UTC()
+	case TypeBlob:
+		return append([]byte{}, r.bytes(int(r.uint32()))...)
+	default:
+		if r.err == nil {
+			r.err = &Error{Code: CodeProtocol, Message: fmt.Sprintf("未知的值类型 %d", typ)}
+		}
+		return nil
+	}
+}
@@ -1,17 +1,87 @@
 package main
 
 import (
+	"awesomeProject4/httpapi"
+	"awesomeProject4/mysql"
+	"awesomeProject4/pg"
+	"awesomeProject4/protocol"
 	"awesomeProject4/storgeengine"
+	"awesomeProject4/user"
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 func main() {
+	poolSize := flag.Int("pool", storgeengine.DefaultPoolSize, "缓冲池能缓存的 b+树结点数")
+	dataDir := flag.String("data", ".", "数据目录，数据库、系统目录和日志都放在这里")
+	text := flag.Bool("text", false, "使用旧的文本协议: 每行一条命令，响应以 END 行结束")
+	mysqlAddr := flag.String("mysql", "", "同时用 MySQL 协议监听这个地址，例如 localhost:3306，为空时不监听")
+	pgAddr := flag.String("pg", "", "同时用 PostgreSQL 协议监听这个地址，例如 localhost:5432，为空时不监听")
+	pgAuth := flag.String("pgauth", pg.AuthMD5, "PostgreSQL 协议的密码认证方式: md5 或 password(明文)")
+	httpAddr := flag.String("http", "", "同时在这个地址提供 HTTP/JSON 接口，例如 localhost:8081，为空时不提供")
+	usersFile := flag.String("users", "", "MySQL、PostgreSQL 协议和 HTTP 接口登录用的账号文件，默认是数据目录下的 users.txt。文件必须已经存在，不能用默认的 root:1234")
+	flag.Parse()
+
 	// 创建数据库实例
-	db := storgeengine.NewDB()
+	db := storgeengine.OpenDB(*dataDir, *poolSize)
+	if db == nil {
+		os.Exit(1)
+	}
+
+	// MySQL、PostgreSQL 协议和 HTTP 接口都用 user 包中的账号登录。这些服务可以从网络上访问，
+	// 账号文件不存在时不创建默认账号，还是默认密码时不启动
+	var users map[string]string
+	if *mysqlAddr != "" || *pgAddr != "" || *httpAddr != "" {
+		if *usersFile == "" {
+			*usersFile = filepath.Join(*dataDir, "users.txt")
+		}
+		var err error
+		if users, err = user.NetworkUserDB(*usersFile); err != nil {
+			fmt.Println("读取账号文件出错: ", err)
+			os.Exit(1)
+		}
+	}
+	if *mysqlAddr != "" {
+		server := &mysql.Server{DB: db, Users: users}
+		l := listen(*mysqlAddr, "MySQL")
+		go func() {
+			fmt.Println("MySQL 协议服务停止: ", server.Serve(l))
+		}()
+	}
+	if *pgAddr != "" {
+		if *pgAuth != pg.AuthMD5 && *pgAuth != pg.AuthPassword {
+			fmt.Println("-pgauth 只能是 md5 或 password")
+			os.Exit(1)
+		}
+		server := &pg.Server{DB: db, Users: users, Auth: *pgAuth}
+		l := listen(*pgAddr, "PostgreSQL")
+		go func() {
+			fmt.Println("PostgreSQL 协议服务停止: ", server.Serve(l))
+		}()
+	}
+	if *httpAddr != "" {
+		// 可以从网络上访问，读请求要有时限，不然慢慢发请求的客户端能一直占着连接。
+		// 不设写的时限，流式返回的大结果可能要发很久
+		server := &http.Server{
+			Handler:           httpapi.NewServer(db, users),
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       time.Minute,
+			IdleTimeout:       2 * time.Minute,
+		}
+		l := listen(*httpAddr, "HTTP")
+		go func() {
+			fmt.Println("HTTP 服务停止: ", server.Serve(l))
+		}()
+	}
 
 	listener, err := net.Listen("tcp", "localhost:8080")
 	if err != nil {
@@ -27,13 +97,120 @@ func main() {
 			fmt.Println("连接出错: ", err)
 			continue
 		}
-		go handleRequest(conn, db)
+		if *text {
+			go handleRequest(conn, db)
+		} else {
+			go handleConn(conn, db)
+		}
+	}
+}
+
+// listen 监听兼容协议的地址，出错时退出
+func listen(addr, name string) net.Listener {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Printf("启动 %s 协议服务出错: %v\n", name, err)
+		os.Exit(1)
+	}
+	fmt.Printf("已启动%s的 %s 协议监听\n", addr, name)
+	return l
+}
+
+// handleConn 用二进制协议处理一个连接，协议见 protocol 包
+func handleConn(conn net.Conn, db *storgeengine.DB) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	// 每个连接一个会话，连接断开时回滚没有提交的事务
+	session := db.NewSession()
+	defer session.Close()
+
+	if err := handshake(r, w, session); err != nil {
+		fmt.Println("握手失败:", err)
+		return
+	}
+	for {
+		typ, payload, err := protocol.ReadMessage(r)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println("读取消息出错:", err)
+			}
+			break
+		}
+		quit := false
+		switch typ {
+		case protocol.MsgTerminate:
+			quit = true
+		case protocol.MsgQuery:
+			quit, err = execute(w, session, string(payload))
+		default:
+			err = protocol.WriteError(w, protocol.CodeProtocol, fmt.Sprintf("意外的消息 %v", typ))
+		}
+		if err != nil {
+			fmt.Println("发送结果出错:", err)
+			break
+		}
+		if quit {
+			break
+		}
+	}
+	stats := db.PoolStats()
+	fmt.Printf("缓冲池: 已用 %d/%d, 命中率 %.2f%%, 淘汰 %d 次\n", stats.Used, stats.Capacity, stats.HitRate()*100, stats.Evictions)
+	fmt.Println("handleConn函数结束，连接关闭")
+}
+
+// handshake 连接后的第一条消息必须是客户端的握手，客户端给出了数据库时切换过去
+func handshake(r *bufio.Reader, w *bufio.Writer, session *storgeengine.Session) error {
+	typ, payload, err := protocol.ReadMessage(r)
+	if err != nil {
+		return err
+	}
+	if typ != protocol.MsgHandshake {
+		protocol.WriteError(w, protocol.CodeProtocol, "第一条消息必须是握手")
+		return fmt.Errorf("第一条消息是 %v", typ)
+	}
+	hello, err := protocol.DecodeHandshake(payload)
+	if err != nil {
+		protocol.WriteError(w, protocol.CodeProtocol, err.Error())
+		return err
+	}
+	if hello.Version != protocol.Version {
+		msg := fmt.Sprintf("不支持协议版本 %d，服务端的版本是 %d", hello.Version, protocol.Version)
+		protocol.WriteError(w, protocol.CodeProtocol, msg)
+		return errors.New(msg)
+	}
+	if hello.Database != "" {
+		if err := session.Use(hello.Database); err != nil {
+			protocol.WriteError(w, protocol.CodeExecute, err.Error())
+			return err
+		}
+	}
+	fmt.Printf("客户端 %s 已连接\n", hello.Name)
+	reply := protocol.Handshake{Version: protocol.Version, Name: "AliangSQL", Database: session.Database()}
+	if err := protocol.WriteMessage(w, protocol.MsgHandshake, reply.Encode()); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// execute 执行一条语句并发回结果，语句是 exit 时返回 quit 为 true
+func execute(w *bufio.Writer, session *storgeengine.Session, sql string) (quit bool, err error) {
+	fmt.Println("接收到的命令:", sql)
+	stmt, err := storgeengine.Parse(sql)
+	if err != nil {
+		return false, protocol.WriteError(w, protocol.CodeSyntax, err.Error())
 	}
+	_, quit = stmt.(*storgeengine.ExitStmt)
+	return quit, protocol.WriteResult(w, protocol.CommandTag(stmt), session.Execute(stmt))
 }
 
+// handleRequest 旧的文本协议: 每行一条命令，响应是任意文本，最后一行是 END
 func handleRequest(conn net.Conn, db *storgeengine.DB) {
 	defer conn.Close()
 	reader := bufio.NewReader(conn)
+	// 每个连接一个会话，连接断开时回滚没有提交的事务
+	session := db.NewSession()
+	defer session.Close()
 
 	for {
 		message, err := reader.ReadString('\n')
@@ -49,7 +226,7 @@ func handleRequest(conn net.Conn, db *storgeengine.DB) {
 			break
 		}
 
-		result := storgeengine.ParseSQL(message, db)
+		result := session.ParseSQL(message)
 		if result.Error != nil {
 			fmt.Fprintf(conn, "执行命令出错: %s\n", result.Error)
 		} else {
@@ -62,5 +239,7 @@ func handleRequest(conn net.Conn, db *storgeengine.DB) {
 		// 添加结束标记
 		fmt.Fprintf(conn, "END\n")
 	}
+	stats := db.PoolStats()
+	fmt.Printf("缓冲池: 已用 %d/%d, 命中率 %.2f%%, 淘汰 %d 次\n", stats.Used, stats.Capacity, stats.HitRate()*100, stats.Evictions)
 	fmt.Println("handleRequest函数结束，连接关闭")
 }
@@ -0,0 +1,344 @@
+package storgeengine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 支持的聚合函数
+var aggregateFuncs = map[string]bool{"COUNT": true, "SUM": true, "AVG": true, "MIN": true, "MAX": true}
+
+func isAggregate(call *FuncCall) bool {
+	return aggregateFuncs[call.Name]
+}
+
+// aggregateKey 聚合结果在分组行中的键，以 \x00 开头避免和列名冲突
+func aggregateKey(call *FuncCall) string {
+	return "\x00" + exprString(call)
+}
+
+// hasAggregate 表达式中是否用到了聚合函数
+func hasAggregate(exprs ...Expr) bool {
+	found := false
+	for _, expr := range exprs {
+		walkExpr(expr, func(e Expr) {
+			if call, ok := e.(*FuncCall); ok && isAggregate(call) {
+				found = true
+			}
+		})
+	}
+	return found
+}
+
+// collectAggregates 找出表达式中的全部聚合函数，相同的调用只保留一个
+func collectAggregates(exprs []Expr) ([]*FuncCall, error) {
+	seen := make(map[string]bool)
+	calls := make([]*FuncCall, 0)
+	var err error
+	for _, expr := range exprs {
+		walkExpr(expr, func(e Expr) {
+			call, ok := e.(*FuncCall)
+			if !ok || !isAggregate(call) || err != nil {
+				return
+			}
+			if call.Star && call.Name != "COUNT" {
+				err = fmt.Errorf("%s 不支持 *", call.Name)
+				return
+			}
+			if !call.Star && len(call.Args) != 1 {
+				err = fmt.Errorf("%s 只能有一个参数", call.Name)
+				return
+			}
+			if hasAggregate(call.Args...) {
+				err = fmt.Errorf("聚合函数不能嵌套: %s", exprString(call))
+				return
+			}
+			if key := aggregateKey(call); !seen[key] {
+				seen[key] = true
+				calls = append(calls, call)
+			}
+		})
+	}
+	return calls, err
+}
+
+// checkGrouped 检查分组查询中的表达式：列要么出现在 group by 中，要么用在聚合函数里
+func checkGrouped(expr Expr, groupKeys map[string]bool) error {
+	if expr == nil || groupKeys[exprString(expr)] {
+		return nil
+	}
+	switch e := expr.(type) {
+	case *FuncCall:
+		if isAggregate(e) {
+			return nil
+		}
+	case *ColumnRef:
+		return fmt.Errorf("列 %s 必须出现在 group by 中或用在聚合函数里", e.Name)
+	}
+	for _, child := range exprChildren(expr) {
+		if err := checkGrouped(child, groupKeys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// substituteAliases 把 having 中引用的别名替换成对应的查询表达式
+func substituteAliases(expr Expr, fields []SelectField, schema TableSchema) Expr {
+	expr, _ = rewriteExpr(expr, func(e Expr) (Expr, error) {
+		col, ok := e.(*ColumnRef)
+		if !ok || col.Table != "" || schema.columnIndex(col.Name) >= 0 {
+			return e, nil
+		}
+		for _, field := range fields {
+			if !field.Star && field.Alias == col.Name {
+				return field.Expr, nil
+			}
+		}
+		return e, nil
+	})
+	return expr
+}
+
+// accumulator 一个分组中某个聚合函数的中间状态
+type accumulator struct {
+	call     *FuncCall
+	count    int64
+	sum      interface{} // SUM / AVG 的和，整数、DECIMAL 和浮点数按 arithmetic 的规则相加
+	wide     bool        // 整数的和超出过 int64，sum 改成了 Decimal
+	value    interface{} // MIN / MAX 的当前值
+	distinct map[string]bool
+}
+
+func newAccumulator(call *FuncCall) *accumulator {
+	acc := &accumulator{call: call}
+	if call.Distinct {
+		acc.distinct = make(map[string]bool)
+	}
+	return acc
+}
+
+func (acc *accumulator) add(row Row) error {
+	if acc.call.Star {
+		acc.count++
+		return nil
+	}
+	value, err := evalExpr(acc.call.Args[0], row)
+	if err != nil {
+		return err
+	}
+	// 聚合函数忽略 NULL
+	if value == nil {
+		return nil
+	}
+	if acc.distinct != nil {
+		key := distinctKey(value)
+		if acc.distinct[key] {
+			return nil
+		}
+		acc.distinct[key] = true
+	}
+	acc.count++
+	switch acc.call.Name {
+	case "SUM", "AVG":
+		n, ok := toNumber(value)
+		if !ok {
+			return fmt.Errorf("%s 的参数必须是数字: %v", acc.call.Name, value)
+		}
+		if acc.sum == nil {
+			acc.sum = n
+		} else if acc.sum, err = acc.addSum(n); err != nil {
+			return err
+		}
+	case "MIN":
+		if acc.value == nil || compareForSort(value, acc.value) < 0 {
+			acc.value = value
+		}
+	case "MAX":
+		if acc.value == nil || compareForSort(value, acc.value) > 0 {
+			acc.value = value
+		}
+	}
+	return nil
+}
+
+// addSum 把 n 加到和上。整数的和超出 int64 时改用 Decimal 继续加，中间的和超出范围不影响最后的结果
+func (acc *accumulator) addSum(n interface{}) (interface{}, error) {
+	if a, ok := acc.sum.(int64); ok {
+		if b, ok := n.(int64); ok {
+			if sum, err := intArithmetic("+", a, b); err == nil {
+				return sum, nil
+			}
+			acc.wide = true
+			return decimalArithmetic("+", decimalFromInt(a), decimalFromInt(b))
+		}
+	}
+	return arithmetic("+", acc.sum, n)
+}
+
+func (acc *accumulator) result() (interface{}, error) {
+	switch acc.call.Name {
+	case "COUNT":
+		return acc.count, nil
+	case "SUM":
+		if !acc.wide {
+			return acc.sum, nil
+		}
+		// 整数的和仍然是整数，超出范围时报错而不是返回回绕后的值
+		if sum, ok := acc.sum.(Decimal).int64(); ok {
+			return sum, nil
+		}
+		return nil, fmt.Errorf("%s 的结果 %v 超出整数的范围", exprString(acc.call), acc.sum)
+	case "AVG":
+		// 整数的平均值是浮点数，DECIMAL 的平均值仍然是 DECIMAL
+		switch sum := acc.sum.(type) {
+		case int64:
+			return float64(sum) / float64(acc.count), nil
+		case float64:
+			return sum / float64(acc.count), nil
+		case Decimal:
+			if acc.wide {
+				return sum.float64() / float64(acc.count), nil
+			}
+			return decimalArithmetic("/", sum, decimalFromInt(acc.count))
+		}
+		return nil, nil
+	}
+	return acc.value, nil
+}
+
+// 去重和分组用的键，数字 1 和字符串 '1' 视为不同的值，1、1.0 和 DECIMAL 的 1.00 视为相同的值
+func distinctKey(value interface{}) string {
+	if value == nil {
+		return "N"
+	}
+	if isTime(value) {
+		t, _ := toTime(value)
+		return "t" + formatTime(t)
+	}
+	if n, ok := toNumber(value); ok {
+		if _, isString := value.(string); !isString {
+			switch v := n.(type) {
+			case float64:
+				if v == float64(int64(v)) {
+					n = int64(v)
+				}
+			case Decimal:
+				n = v.normalize()
+			}
+			return "n" + toString(n)
+		}
+	}
+	return "s" + toString(value)
+}
+
+// group 一个分组：组内的第一行以及每个聚合函数的状态
+type group struct {
+	row  Row
+	accs []*accumulator
+}
+
+// aggregator 按 group by 分组并计算聚合函数，分组按第一次出现的顺序输出
+type aggregator struct {
+	groupBy []Expr
+	calls   []*FuncCall
+	groups  map[string]*group
+	order   []*group
+}
+
+func newAggregator(groupBy []Expr, calls []*FuncCall) *aggregator {
+	return &aggregator{groupBy: groupBy, calls: calls, groups: make(map[string]*group)}
+}
+
+func (a *aggregator) add(row Row) error {
+	keys := make([]string, len(a.groupBy))
+	for i, expr := range a.groupBy {
+		value, err := evalExpr(expr, row)
+		if err != nil {
+			return err
+		}
+		keys[i] = distinctKey(value)
+	}
+	key := strings.Join(keys, "\x00")
+	g, ok := a.groups[key]
+	if !ok {
+		g = a.newGroup(row)
+		a.groups[key] = g
+	}
+	for _, acc := range g.accs {
+		if err := acc.add(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *aggregator) newGroup(row Row) *group {
+	g := &group{row: row, accs: make([]*accumulator, len(a.calls))}
+	for i, call := range a.calls {
+		g.accs[i] = newAccumulator(call)
+	}
+	a.order = append(a.order, g)
+	return g
+}
+
+// rows 每个分组生成一行：组内第一行的列值加上聚合结果。
+// 没有 group by 时即使没有任何数据也输出一行，例如 count(*) 为 0
+func (a *aggregator) rows() ([]Row, error) {
+	if len(a.order) == 0 && len(a.groupBy) == 0 {
+		a.newGroup(Row{})
+	}
+	rows := make([]Row, 0, len(a.order))
+	for _, g := range a.order {
+		row := make(Row, len(g.row)+len(g.accs))
+		for k, v := range g.row {
+			row[k] = v
+		}
+		for _, acc := range g.accs {
+			value, err := acc.result()
+			if err != nil {
+				return nil, err
+			}
+			row[aggregateKey(acc.call)] = value
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// keyBoundRow 单表查询中只有主键上的 MIN / MAX 且没有条件和分组时，直接从 b+树两端的叶子取值。
+// 两端的数据项不是快照中的版本时不能用
+func keyBoundRow(table *BPTable, tx *txn, calls []*FuncCall) (Row, bool) {
+	if table == nil {
+		return nil, false
+	}
+	keyColumn := table.keyColumn()
+	for _, call := range calls {
+		if (call.Name != "MIN" && call.Name != "MAX") || call.Star || !isColumn(call.Args[0], keyColumn) {
+			return nil, false
+		}
+	}
+	row := make(Row, len(calls))
+	for _, call := range calls {
+		key, exists, ok := table.bound(tx, call.Name == "MAX")
+		if !ok {
+			return nil, false
+		}
+		if exists {
+			// 主键的第一列就是关键字中的第一个值
+			values, err := decodeKey(key)
+			if err != nil {
+				return nil, false
+			}
+			// 关键字中的日期、布尔值等要转换回列的类型
+			value, err := table.Schema.Columns[table.Schema.columnIndex(keyColumn)].coerce(values[0])
+			if err != nil {
+				return nil, false
+			}
+			row[aggregateKey(call)] = value
+		} else {
+			row[aggregateKey(call)] = nil
+		}
+	}
+	return row, true
+}
@@ -0,0 +1,264 @@
+package storgeengine
+
+// Statement 语法树中的一条语句
+type Statement interface {
+	statementNode()
+}
+
+// Expr 语法树中的表达式
+type Expr interface {
+	exprNode()
+}
+
+// ExitStmt exit;
+type ExitStmt struct{}
+
+// HelpStmt help;
+type HelpStmt struct{}
+
+// UseStmt use xxx;
+type UseStmt struct {
+	Database string
+}
+
+// CreateDatabaseStmt create database xxx;
+type CreateDatabaseStmt struct {
+	Name string
+}
+
+// ColumnDef 建表语句中的一个字段定义。字段上的 primary key、unique、check、references 约束放在 CreateTableStmt.Constraints 中
+type ColumnDef struct {
+	Name          string
+	Type          ColumnType
+	NotNull       bool
+	Default       Expr // nil 表示没有默认值
+	AutoIncrement bool // auto_increment 或 serial 类型
+	Length        int  // varchar(n) 的 n
+	Precision     int  // decimal(p, s) 的 p 和 s
+	Scale         int
+}
+
+// TableConstraint 建表语句中的约束: [constraint 名字] primary key (字段, ...) | unique (字段, ...) | check (条件)
+// | foreign key (字段, ...) references 表名 [(字段, ...)] [on delete 动作] [on update 动作]
+type TableConstraint struct {
+	Name    string // 可以省略
+	Kind    string // PRIMARY KEY, UNIQUE, CHECK, FOREIGN KEY
+	Columns []string
+	Check   Expr
+
+	RefTable   string
+	RefColumns []string // 省略时为被引用的表的主键
+	OnDelete   string   // RESTRICT, CASCADE, SET NULL, NO ACTION，省略时为空
+	OnUpdate   string
+}
+
+// CreateTableStmt create table xx (字段 类型 [约束 ...], ... [, 约束 ...]);
+type CreateTableStmt struct {
+	Name        string
+	Columns     []ColumnDef
+	Constraints []TableConstraint
+}
+
+// CreateIndexStmt create [unique] index 名字 on 表名 (字段, ...);
+type CreateIndexStmt struct {
+	Name    string
+	Table   string
+	Columns []string
+	Unique  bool
+}
+
+// DropIndexStmt drop index 名字 [on 表名]; 没有表名时在当前数据库中按名字查找
+type DropIndexStmt struct {
+	Name  string
+	Table string
+}
+
+// CreateSequenceStmt create sequence 名字 [start [with] n] [increment [by] n];
+type CreateSequenceStmt struct {
+	Name      string
+	Start     int64
+	Increment int64
+}
+
+// DropSequenceStmt drop sequence 名字;
+type DropSequenceStmt struct {
+	Name string
+}
+
+// InsertStmt insert into xx (字段, ...) values (值, ...);
+type InsertStmt struct {
+	Table   string
+	Columns []string
+	Values  []Expr
+}
+
+// Assignment update 语句中的 字段 = 值
+type Assignment struct {
+	Column string
+	Value  Expr
+}
+
+// UpdateStmt update xx set 字段 = 值 where ...;
+type UpdateStmt struct {
+	Table string
+	Set   []Assignment
+	Where Expr
+}
+
+// DeleteStmt delete from xx where ...;
+type DeleteStmt struct {
+	Table string
+	Where Expr
+}
+
+// SelectField 查询的一列，Star 表示 *，Table 不为空时表示 表名.*
+type SelectField struct {
+	Star  bool
+	Table string
+	Expr  Expr
+	Alias string
+}
+
+// TableRef from 后面的表，Database 为空时使用当前数据库
+type TableRef struct {
+	Database string
+	Table    string
+	Alias    string
+}
+
+// Name 查询中引用这张表时用的名字，有别名时为别名
+func (ref *TableRef) Name() string {
+	if ref.Alias != "" {
+		return ref.Alias
+	}
+	return ref.Table
+}
+
+// JoinClause [inner|left [outer]|right [outer]|cross] join 表 [on 条件]
+type JoinClause struct {
+	Type  string // INNER, LEFT, RIGHT, CROSS
+	Table *TableRef
+	On    Expr
+}
+
+// OrderItem order by 中的一项
+type OrderItem struct {
+	Expr Expr
+	Desc bool
+}
+
+// BeginStmt begin [transaction | work]; 或 start transaction;
+type BeginStmt struct{}
+
+// CommitStmt commit [work];
+type CommitStmt struct{}
+
+// RollbackStmt rollback [work];
+type RollbackStmt struct{}
+
+// SetStmt set 变量 = 值; 目前只有 autocommit
+type SetStmt struct {
+	Name  string
+	Value Expr
+}
+
+// SelectStmt select 列, ... [from [数据库名.]表名 [join ...]] [where ...] [order by ...] [limit n [offset m]];
+type SelectStmt struct {
+	Fields  []SelectField
+	From    *TableRef
+	Joins   []JoinClause
+	Where   Expr
+	GroupBy []Expr
+	Having  Expr
+	OrderBy []OrderItem
+	Limit   *int64 // nil 表示不限制
+	Offset  int64
+}
+
+func (*ExitStmt) statementNode()           {}
+func (*HelpStmt) statementNode()           {}
+func (*UseStmt) statementNode()            {}
+func (*CreateDatabaseStmt) statementNode() {}
+func (*CreateTableStmt) statementNode()    {}
+func (*CreateIndexStmt) statementNode()    {}
+func (*DropIndexStmt) statementNode()      {}
+func (*CreateSequenceStmt) statementNode() {}
+func (*DropSequenceStmt) statementNode()   {}
+func (*InsertStmt) statementNode()         {}
+func (*UpdateStmt) statementNode()         {}
+func (*DeleteStmt) statementNode()         {}
+func (*SelectStmt) statementNode()         {}
+func (*BeginStmt) statementNode()          {}
+func (*CommitStmt) statementNode()         {}
+func (*RollbackStmt) statementNode()       {}
+func (*SetStmt) statementNode()            {}
+
+// Literal 常量，Value 为 int64、float64、Decimal、bool、string、Date、time.Time、[]byte 或 nil(NULL)
+type Literal struct {
+	Value interface{}
+}
+
+// ColumnRef 对列的引用，Table 为列前面的表名或别名
+type ColumnRef struct {
+	Table string
+	Name  string
+}
+
+// BinaryExpr 二元表达式，Op 为比较运算符、算术运算符、AND 或 OR
+type BinaryExpr struct {
+	Op    string
+	Left  Expr
+	Right Expr
+}
+
+// UnaryExpr 一元表达式，Op 为 NOT 或 -
+type UnaryExpr struct {
+	Op   string
+	Expr Expr
+}
+
+// BetweenExpr expr [NOT] BETWEEN low AND high
+type BetweenExpr struct {
+	Expr Expr
+	Low  Expr
+	High Expr
+	Not  bool
+}
+
+// InExpr expr [NOT] IN (list)
+type InExpr struct {
+	Expr Expr
+	List []Expr
+	Not  bool
+}
+
+// LikeExpr expr [NOT] LIKE pattern
+type LikeExpr struct {
+	Expr    Expr
+	Pattern Expr
+	Not     bool
+}
+
+// IsNullExpr expr IS [NOT] NULL
+type IsNullExpr struct {
+	Expr Expr
+	Not  bool
+}
+
+// FuncCall 函数调用，例如 COUNT(*)、SUM(DISTINCT age)
+type FuncCall struct {
+	Name     string
+	Args     []Expr
+	Star     bool
+	Distinct bool
+}
+
+func (*Literal) exprNode()     {}
+func (*FuncCall) exprNode()    {}
+func (*ColumnRef) exprNode()   {}
+func (*BinaryExpr) exprNode()  {}
+func (*UnaryExpr) exprNode()   {}
+func (*BetweenExpr) exprNode() {}
+func (*InExpr) exprNode()      {}
+func (*LikeExpr) exprNode()    {}
+func (*IsNullExpr) exprNode()  {}
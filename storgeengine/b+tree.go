@@ -1,29 +1,39 @@
 package storgeengine
 
 import (
-	"encoding/csv"
 	"fmt"
 	"os"
-	"path"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
-	"unicode"
 )
 
+// BPItem 叶子结点中的一行，Val 是按表结构编码的行。Begin 和 End 是这个版本的有效期: 创建它的事务的提交时间戳，
+// 以及删除或替换它的事务的提交时间戳，End 为 0 表示还是最新的版本
 type BPItem struct {
-	Key int64
-	Val map[string]interface{}
+	Key   Key
+	Val   Record
+	Begin uint64
+	End   uint64
 }
 
-// BPNode b+tree节点
+// childRef 内部结点中的子结点：子结点所在的页和它的最大关键字，
+// 这样查找时不用把每个子结点都读进内存
+type childRef struct {
+	ID     PageID
+	MaxKey Key
+}
+
+// BPNode b+tree节点，保存在数据文件的一页中，放不下时使用溢出页
 type BPNode struct {
-	MaxKey int64     // 最大关键字
-	Nodes  []*BPNode // 子节点
-	Items  []BPItem  // 子数据项
-	Next   *BPNode   // 指针
+	ID       PageID     // 结点所在的页
+	Leaf     bool       // 是否是叶子结点
+	MaxKey   Key        // 最大关键字
+	Nodes    []childRef // 子节点
+	Items    []BPItem   // 子数据项
+	Next     PageID     // 下一个叶子结点
+	overflow []PageID   // 溢出页
 }
 
 type SQLResult struct {
@@ -32,12 +42,12 @@ type SQLResult struct {
 }
 
 // 查找数据项，返回子数据项的索引
-func (node *BPNode) findItem(key int64) int {
+func (node *BPNode) findItem(key Key, cmp Comparator) int {
 	num := len(node.Items)
 	for i := 0; i < num; i++ {
-		if node.Items[i].Key > key {
+		if c := cmp(node.Items[i].Key, key); c > 0 {
 			return -1
-		} else if node.Items[i].Key == key {
+		} else if c == 0 {
 			return i
 		}
 	}
@@ -45,30 +55,30 @@ func (node *BPNode) findItem(key int64) int {
 }
 
 // 为item赋值
-func (node *BPNode) setValue(key int64, value map[string]interface{}) {
-	item := BPItem{key, value}
+func (node *BPNode) setValue(item BPItem, cmp Comparator) {
+	key := item.Key
 	num := len(node.Items)
 	// 保证插入的位置有序
 	if num < 1 {
 		node.Items = append(node.Items, item)
 		node.MaxKey = item.Key
 		return
-	} else if key < node.Items[0].Key {
+	} else if cmp(key, node.Items[0].Key) < 0 {
 		node.Items = append([]BPItem{item}, node.Items...)
 		return
-	} else if key > node.Items[num-1].Key {
+	} else if cmp(key, node.Items[num-1].Key) > 0 {
 		node.Items = append(node.Items, item)
 		node.MaxKey = item.Key
 		return
 	}
 
 	for i := 0; i < num; i++ {
-		if node.Items[i].Key > key {
+		if c := cmp(node.Items[i].Key, key); c > 0 {
 			node.Items = append(node.Items, BPItem{})
 			copy(node.Items[i+1:], node.Items[i:])
 			node.Items[i] = item
 			return
-		} else if node.Items[i].Key == key {
+		} else if c == 0 {
 			node.Items[i] = item
 			return
 		}
@@ -76,24 +86,24 @@ func (node *BPNode) setValue(key int64, value map[string]interface{}) {
 }
 
 // 插入子节点，保证子节点有序
-func (node *BPNode) addChild(child *BPNode) {
+func (node *BPNode) addChild(child childRef, cmp Comparator) {
 	num := len(node.Nodes)
 	if num < 1 {
 		node.Nodes = append(node.Nodes, child)
 		node.MaxKey = child.MaxKey
 		return
-	} else if child.MaxKey < node.Nodes[0].MaxKey {
-		node.Nodes = append([]*BPNode{child}, node.Nodes...)
+	} else if cmp(child.MaxKey, node.Nodes[0].MaxKey) < 0 {
+		node.Nodes = append([]childRef{child}, node.Nodes...)
 		return
-	} else if child.MaxKey > node.Nodes[num-1].MaxKey {
+	} else if cmp(child.MaxKey, node.Nodes[num-1].MaxKey) > 0 {
 		node.Nodes = append(node.Nodes, child)
 		node.MaxKey = child.MaxKey
 		return
 	}
 
 	for i := 0; i < num; i++ {
-		if node.Nodes[i].MaxKey > child.MaxKey {
-			node.Nodes = append(node.Nodes, nil)
+		if cmp(node.Nodes[i].MaxKey, child.MaxKey) > 0 {
+			node.Nodes = append(node.Nodes, childRef{})
 			copy(node.Nodes[i+1:], node.Nodes[i:])
 			node.Nodes[i] = child
 			return
@@ -102,18 +112,18 @@ func (node *BPNode) addChild(child *BPNode) {
 }
 
 // 删除子数据项
-func (node *BPNode) deleteItem(key int64) bool {
+func (node *BPNode) deleteItem(key Key, cmp Comparator) bool {
 	num := len(node.Items)
 	for i := 0; i < num; i++ {
-		if node.Items[i].Key > key {
+		if c := cmp(node.Items[i].Key, key); c > 0 {
 			return false
-		} else if node.Items[i].Key == key {
+		} else if c == 0 {
 			copy(node.Items[i:], node.Items[i+1:])
 			node.Items = node.Items[:len(node.Items)-1]
 			if len(node.Items) > 0 {
 				node.MaxKey = node.Items[len(node.Items)-1].Key
 			} else {
-				node.MaxKey = 0 // 或者一个表示空的适当值
+				node.MaxKey = "" // 或者一个表示空的适当值
 			}
 			return true
 		}
@@ -122,10 +132,10 @@ func (node *BPNode) deleteItem(key int64) bool {
 }
 
 // 删除子节点
-func (node *BPNode) deleteChild(child *BPNode) bool {
+func (node *BPNode) deleteChild(id PageID) bool {
 	num := len(node.Nodes)
 	for i := 0; i < num; i++ {
-		if node.Nodes[i] == child {
+		if node.Nodes[i].ID == id {
 			copy(node.Nodes[i:], node.Nodes[i+1:])
 			node.Nodes = node.Nodes[0 : len(node.Nodes)-1]
 			if len(node.Nodes) > 0 {
@@ -137,29 +147,81 @@ func (node *BPNode) deleteChild(child *BPNode) bool {
 	return false
 }
 
+// 关键字所在的子结点，大于所有关键字时为最右侧的子结点
+func (node *BPNode) childIndex(key Key, cmp Comparator) int {
+	for i := 0; i < len(node.Nodes); i++ {
+		if cmp(key, node.Nodes[i].MaxKey) <= 0 {
+			return i
+		}
+	}
+	return len(node.Nodes) - 1
+}
+
+func (node *BPNode) ref() childRef {
+	return childRef{ID: node.ID, MaxKey: node.MaxKey}
+}
+
+// 结点的子项少于一半，需要从兄弟结点移动或者合并
+func (t *BPTree) underflow(node *BPNode) bool {
+	if node.Leaf {
+		return len(node.Items) < t.halfw
+	}
+	return len(node.Nodes) < t.halfw
+}
+
 // BPTree 整体的BPTree结构
 type BPTree struct {
 	mutex sync.RWMutex // 锁
-	root  *BPNode
+	root  PageID
 	width int // B+树的宽度
 	halfw int
 	table *BPTable // 存储表的结构信息
+
+	compare Comparator // 关键字的比较方式，默认逐字节比较
+
+	pager  *Pager      // 数据文件，为 nil 时整棵树只在内存中
+	pool   *BufferPool // 数据文件中的结点都通过缓冲池访问
+	pinned []*BPNode   // 写操作过程中固定的结点，操作结束时统一解除固定
+
+	memMu  sync.Mutex
+	mem    map[PageID]*BPNode // 只在内存中的树的全部结点
+	nextID PageID
 }
 
+// NewBPTree 只在内存中的 b+树，关键字逐字节比较
 func NewBPTree(width int) *BPTree {
+	return NewBPTreeWithComparator(width, compareBytes)
+}
+
+// NewBPTreeWithComparator 只在内存中、用 cmp 比较关键字的 b+树
+func NewBPTreeWithComparator(width int, cmp Comparator) *BPTree {
 	if width < 3 {
 		width = 3
 	}
-	var bt = &BPTree{}
-	bt.root = NewLeafNode(width)
+	var bt = &BPTree{nextID: 1, compare: cmp}
 	bt.width = width
 	bt.halfw = (bt.width + 1) / 2 //分裂条件 保证b+树的平衡
+	bt.mem = make(map[PageID]*BPNode)
+	bt.root = bt.newNode(true).ID
+	bt.releaseAll()
+	return bt
+}
+
+// openBPTree 在数据文件上打开 b+树，结点在用到时才通过缓冲池从文件中读取
+func openBPTree(pager *Pager, pool *BufferPool) *BPTree {
+	bt := &BPTree{pager: pager, pool: pool, width: pager.width, halfw: (pager.width + 1) / 2, compare: compareBytes}
+	bt.root = pager.root
+	if bt.root == invalidPage {
+		// 新建的文件，先放一个空的叶子结点作为根
+		bt.root = bt.newNode(true).ID
+		bt.releaseAll()
+	}
 	return bt
 }
 
 // NewLeafNode 申请width+1是因为插入时可能暂时出现节点key大于申请width的情况,待后期再分裂处理
 func NewLeafNode(width int) *BPNode {
-	var node = &BPNode{}
+	var node = &BPNode{Leaf: true}
 	node.Items = make([]BPItem, width+1)
 	node.Items = node.Items[0:0]
 	return node
@@ -168,83 +230,287 @@ func NewLeafNode(width int) *BPNode {
 // NewIndexNode 申请width+1是因为插入时可能暂时出现节点key大于申请width的情况,待后期再分裂处理
 func NewIndexNode(width int) *BPNode {
 	var node = &BPNode{}
-	node.Nodes = make([]*BPNode, width+1)
+	node.Nodes = make([]childRef, width+1)
 	node.Nodes = node.Nodes[0:0]
 	return node
 }
 
-// Get 从根节点一步一步向下遍历，找到key对应的值
-func (t *BPTree) Get(key int64) interface{} {
+// node 从缓冲池中取出结点并固定，用完后必须 unpin
+func (t *BPTree) node(id PageID) *BPNode {
+	if t.pager == nil {
+		t.memMu.Lock()
+		defer t.memMu.Unlock()
+		node, ok := t.mem[id]
+		if !ok {
+			throwStorage("结点 %d 不存在", id)
+		}
+		return node
+	}
+	node, err := t.pool.fetch(t.pager, id, t.width)
+	if err != nil {
+		throwStorage("读取页 %d 失败: %v", id, err)
+	}
+	return node
+}
+
+func (t *BPTree) unpin(node *BPNode) {
+	if t.pager != nil {
+		t.pool.unpin(t.pager, node.ID)
+	}
+}
+
+// pin 写操作中取出结点，固定到 releaseAll 为止。写操作持有树的写锁，pinned 不会被并发修改
+func (t *BPTree) pin(id PageID) *BPNode {
+	node := t.node(id)
+	t.pinned = append(t.pinned, node)
+	return node
+}
+
+// releaseAll 写操作结束，解除这次操作固定的全部结点
+func (t *BPTree) releaseAll() {
+	for _, node := range t.pinned {
+		t.unpin(node)
+	}
+	t.pinned = t.pinned[:0]
+}
+
+// newNode 分配一页作为新的结点，新结点固定到 releaseAll 为止
+func (t *BPTree) newNode(leaf bool) *BPNode {
+	var node *BPNode
+	if leaf {
+		node = NewLeafNode(t.width)
+	} else {
+		node = NewIndexNode(t.width)
+	}
+	if t.pager == nil {
+		t.memMu.Lock()
+		node.ID = t.nextID
+		t.nextID++
+		t.mem[node.ID] = node
+		t.memMu.Unlock()
+		return node
+	}
+	id, err := t.pager.allocate()
+	if err != nil {
+		throwStorage("分配页失败: %v", err)
+	}
+	node.ID = id
+	if err := t.pool.create(t.pager, node); err != nil {
+		throwStorage("%v", err)
+	}
+	t.pinned = append(t.pinned, node)
+	return node
+}
+
+func (t *BPTree) markDirty(node *BPNode) {
+	if t.pager != nil {
+		t.pool.markDirty(t.pager, node.ID)
+	}
+}
+
+// freeNode 结点被合并后释放它占用的页
+func (t *BPTree) freeNode(node *BPNode) {
+	if t.pager == nil {
+		t.memMu.Lock()
+		delete(t.mem, node.ID)
+		t.memMu.Unlock()
+		return
+	}
+	t.pool.drop(t.pager, node.ID)
+	t.pager.free(node.ID)
+	for _, id := range node.overflow {
+		t.pager.free(id)
+	}
+}
+
+// flush 把缓冲池中修改过的结点写回数据文件，再更新文件头
+func (t *BPTree) flush() error {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
+	if t.pager == nil {
+		return nil
+	}
+	if err := t.pool.flush(t.pager); err != nil {
+		return err
+	}
+	t.pager.setRoot(t.root)
+	return t.pager.flush()
+}
 
-	node := t.root
-	for i := 0; i < len(node.Nodes); i++ {
-		if key <= node.Nodes[i].MaxKey {
-			node = node.Nodes[i]
-			i = 0
-		}
+// Get 从根节点一步一步向下遍历，找到key对应的值
+func (t *BPTree) Get(key Key) Record {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	node := t.findLeaf(key)
+	defer t.unpin(node)
+	if i := node.findItem(key, t.compare); i >= 0 {
+		return node.Items[i].Val
 	}
+	return nil
+}
 
-	//没有到达叶子结点
-	if len(node.Nodes) > 0 {
+// lookup 按主键查找树中的数据项，包括它的版本信息
+func (t *BPTree) lookup(key Key) (BPItem, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	node := t.findLeaf(key)
+	defer t.unpin(node)
+	if i := node.findItem(key, t.compare); i >= 0 {
+		return node.Items[i], true
+	}
+	return BPItem{}, false
+}
+
+// 找到 key 所在(或应当所在)的叶子结点，key 大于所有关键字时落在最右侧的叶子。
+// 返回的叶子是固定的，路过的内部结点已经解除固定
+func (t *BPTree) findLeaf(key Key) *BPNode {
+	node := t.node(t.root)
+	for !node.Leaf {
+		next := t.node(node.Nodes[node.childIndex(key, t.compare)].ID)
+		t.unpin(node)
+		node = next
+	}
+	return node
+}
+
+// 最左侧的叶子结点，返回时是固定的
+func (t *BPTree) firstLeaf() *BPNode {
+	node := t.node(t.root)
+	for !node.Leaf {
+		next := t.node(node.Nodes[0].ID)
+		t.unpin(node)
+		node = next
+	}
+	return node
+}
+
+// 最右侧的叶子结点，返回时是固定的
+func (t *BPTree) lastLeaf() *BPNode {
+	node := t.node(t.root)
+	for !node.Leaf {
+		next := t.node(node.Nodes[len(node.Nodes)-1].ID)
+		t.unpin(node)
+		node = next
+	}
+	return node
+}
+
+// 叶子结点的后继，解除当前叶子的固定并固定后继，没有后继时返回 nil
+func (t *BPTree) nextLeaf(node *BPNode) *BPNode {
+	next := node.Next
+	t.unpin(node)
+	if next == invalidPage {
 		return nil
 	}
+	return t.node(next)
+}
 
-	for i := 0; i < len(node.Items); i++ {
-		if node.Items[i].Key == key {
-			return node.Items[i].Val
+// Min 主键最小的数据项，直接取最左侧叶子的第一项
+func (t *BPTree) Min() (BPItem, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for node := t.firstLeaf(); node != nil; node = t.nextLeaf(node) {
+		if len(node.Items) > 0 {
+			t.unpin(node)
+			return node.Items[0], true
 		}
 	}
-	return nil
+	return BPItem{}, false
 }
 
-func (db *DB) SelectAll(tableName string) map[int64]interface{} {
-	db.mutex.RLock()
-	defer db.mutex.RUnlock()
-	table, exists := db.databases[db.currentDB][tableName]
-	if !exists {
-		fmt.Printf("表 %s 不存在\n", tableName)
-		return nil
+// Max 主键最大的数据项，直接取最右侧叶子的最后一项
+func (t *BPTree) Max() (BPItem, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	node := t.lastLeaf()
+	defer t.unpin(node)
+	if len(node.Items) == 0 {
+		return BPItem{}, false
 	}
-	return table.Tree.getAllData()
+	return node.Items[len(node.Items)-1], true
 }
 
-func (t *BPTree) getAllData() map[int64]interface{} {
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
+// keyRange 主键范围，low/high 为 nil 表示该方向无界
+type keyRange struct {
+	low      *Key
+	high     *Key
+	lowIncl  bool
+	highIncl bool
+}
 
-	return t.getData(t.root)
+// contains 用 cmp 比较时 key 是否在范围内
+func (r keyRange) contains(key Key, cmp Comparator) bool {
+	return !r.belowLow(key, cmp) && !r.aboveHigh(key, cmp)
 }
 
-func (t *BPTree) getData(node *BPNode) map[int64]interface{} {
-	data := make(map[int64]interface{})
-	for i := 0; i < len(node.Items); i++ {
-		data[node.Items[i].Key] = node.Items[i].Val
+// belowLow key 在下界之下
+func (r keyRange) belowLow(key Key, cmp Comparator) bool {
+	if r.low == nil {
+		return false
 	}
+	c := cmp(key, *r.low)
+	return c < 0 || (c == 0 && !r.lowIncl)
+}
 
-	for i := 0; i < len(node.Nodes); i++ {
-		subData := t.getData(node.Nodes[i])
-		for key, val := range subData {
-			data[key] = val
+// aboveHigh key 在上界之上
+func (r keyRange) aboveHigh(key Key, cmp Comparator) bool {
+	if r.high == nil {
+		return false
+	}
+	c := cmp(key, *r.high)
+	return c > 0 || (c == 0 && !r.highIncl)
+}
+
+// scanRange 用游标按主键顺序遍历范围内的数据，desc 为 true 时从大到小，fn 返回 false 时停止。
+// 调用 fn 时不持有锁，慢的遍历不会挡住写操作
+func (t *BPTree) scanRange(r keyRange, desc bool, fn func(item BPItem) bool) {
+	it := t.iterator(r)
+	defer it.Close()
+	step := it.Next
+	if desc {
+		step = it.Prev
+	}
+	for step() {
+		if item, _ := it.Item(); !fn(item) {
+			return
 		}
 	}
-	return data
 }
 
-func (t *BPTree) GetData() map[int64]interface{} {
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
+func (db *DB) SelectAll(tableName string) map[Key]interface{} {
+	table, err := db.lookupTable(db.session.database, tableName)
+	if err != nil {
+		fmt.Printf("表 %s 不存在\n", tableName)
+		return nil
+	}
+	tx := db.begin()
+	defer db.release(tx)
+	data := make(map[Key]interface{})
+	table.scan(tx, keyRange{}, false, func(item rowItem) bool {
+		data[item.Key] = item.Val
+		return true
+	})
+	return data
+}
 
-	return t.getData(t.root)
+// GetData 树中全部的数据项，按主键顺序沿着叶子读取
+func (t *BPTree) GetData() map[Key]interface{} {
+	data := make(map[Key]interface{})
+	t.scanRange(keyRange{}, false, func(item BPItem) bool {
+		data[item.Key] = item.Val
+		return true
+	})
+	return data
 }
 
 // 分裂操作
 func (t *BPTree) splitNode(node *BPNode) *BPNode {
-	if len(node.Nodes) > t.width {
+	if !node.Leaf && len(node.Nodes) > t.width {
 		//创建新结点
 		halfw := t.width/2 + 1
-		node2 := NewIndexNode(t.width)
+		node2 := t.newNode(false)
 		node2.Nodes = append(node2.Nodes, node.Nodes[halfw:len(node.Nodes)]...)
 		node2.MaxKey = node2.Nodes[len(node2.Nodes)-1].MaxKey
 
@@ -253,15 +519,16 @@ func (t *BPTree) splitNode(node *BPNode) *BPNode {
 		node.MaxKey = node.Nodes[len(node.Nodes)-1].MaxKey
 
 		return node2
-	} else if len(node.Items) > t.width {
+	} else if node.Leaf && len(node.Items) > t.width {
 		//创建新结点
 		halfw := t.width/2 + 1
-		node2 := NewLeafNode(t.width)
+		node2 := t.newNode(true)
 		node2.Items = append(node2.Items, node.Items[halfw:len(node.Items)]...)
 		node2.MaxKey = node2.Items[len(node2.Items)-1].Key
 
-		//修改原结点数据
-		node.Next = node2
+		//修改原结点数据，新结点接在原结点和它原来的后继之间
+		node2.Next = node.Next
+		node.Next = node2.ID
 		node.Items = node.Items[0:halfw]
 		node.MaxKey = node.Items[len(node.Items)-1].Key
 
@@ -271,179 +538,166 @@ func (t *BPTree) splitNode(node *BPNode) *BPNode {
 	return nil
 }
 
-func (t *BPTree) setValue(parent *BPNode, node *BPNode, key int64, value map[string]interface{}) {
-	for i := 0; i < len(node.Nodes); i++ {
-		if key <= node.Nodes[i].MaxKey || i == len(node.Nodes)-1 {
-			t.setValue(node, node.Nodes[i], key, value)
-			break
+// setValue 在以 node 为根的子树中插入数据，返回结点分裂出来的新结点
+func (t *BPTree) setValue(node *BPNode, item BPItem) *BPNode {
+	if node.Leaf {
+		//叶子结点，添加数据
+		node.setValue(item, t.compare)
+	} else {
+		i := node.childIndex(item.Key, t.compare)
+		child := t.pin(node.Nodes[i].ID)
+		child2 := t.setValue(child, item)
+		//插入后子结点的最大关键字可能变了
+		node.Nodes[i].MaxKey = child.MaxKey
+		if child2 != nil {
+			node.addChild(child2.ref(), t.compare)
 		}
+		node.MaxKey = node.Nodes[len(node.Nodes)-1].MaxKey
 	}
-
-	//叶子结点，添加数据
-	if len(node.Nodes) < 1 {
-		node.setValue(key, value)
-	}
+	t.markDirty(node)
 
 	//结点分裂
-	node_new := t.splitNode(node)
-	if node_new != nil {
-		//节点为根节点的情况
-		if parent == nil {
-			parent = NewIndexNode(t.width)
-			parent.addChild(node)
-			t.root = parent
-		}
+	return t.splitNode(node)
+}
 
-		parent.addChild(node_new)
-	}
+func (t *BPTree) Set(key Key, value Record) {
+	t.put(BPItem{Key: key, Val: value})
 }
 
-func (t *BPTree) Set(key int64, value map[string]interface{}) { // 修改这里
+// put 写入一个版本，替换树中同一主键原来的数据项
+func (t *BPTree) put(item BPItem) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
-	t.setValue(nil, t.root, key, value)
-}
-
-func (t *BPTree) itemMoveOrMerge(parent *BPNode, node *BPNode) {
-	//获取兄弟结点
-	var node1 *BPNode = nil
-	var node2 *BPNode = nil
-	if parent != nil {
-		for i := 0; i < len(parent.Nodes); i++ {
-			if parent.Nodes[i] == node {
-				if i < len(parent.Nodes)-1 {
-					node2 = parent.Nodes[i+1]
-				} else if i > 0 {
-					node1 = parent.Nodes[i-1]
-				}
-				break
-			}
-		}
+	defer t.releaseAll()
+	root := t.pin(t.root)
+	if node2 := t.setValue(root, item); node2 != nil {
+		//根结点分裂，树长高一层
+		parent := t.newNode(false)
+		parent.addChild(root.ref(), t.compare)
+		parent.addChild(node2.ref(), t.compare)
+		t.root = parent.ID
 	}
+}
 
-	//将左侧结点的记录移动到删除结点
-	if node1 != nil && len(node1.Items) > t.halfw {
-		item := node1.Items[len(node1.Items)-1]
-		node1.Items = node1.Items[0 : len(node1.Items)-1]
-		node1.MaxKey = node1.Items[len(node1.Items)-1].Key
-		node.Items = append([]BPItem{item}, node.Items...)
+// moveOrMerge 第 i 个子结点的子项不足一半，优先和右侧兄弟调整，没有右侧兄弟时和左侧兄弟调整。
+// 兄弟结点子项多于一半时移动一项过来，否则两个结点合并
+func (t *BPTree) moveOrMerge(parent *BPNode, i int) {
+	if len(parent.Nodes) < 2 {
 		return
 	}
-
-	//将右侧结点的记录移动到删除结点
-	if node2 != nil && len(node2.Items) > t.halfw {
-		item := node2.Items[0]
-		node2.Items = node2.Items[1:] // 修正此行
-		node.Items = append(node.Items, item)
-		node.MaxKey = node.Items[len(node.Items)-1].Key
-		return
+	//left 和 right 为相邻的两个结点，其中一个是子项不足的结点
+	li := i
+	if i == len(parent.Nodes)-1 {
+		li = i - 1
 	}
-
-	//与左侧结点进行合并
-	if node1 != nil && len(node1.Items)+len(node.Items) <= t.width {
-		node1.Items = append(node1.Items, node.Items...)
-		node1.Next = node.Next
-		node1.MaxKey = node1.Items[len(node1.Items)-1].Key
-		if parent != nil {
-			parent.deleteChild(node)
-		}
-		return
+	left, right := t.pin(parent.Nodes[li].ID), t.pin(parent.Nodes[li+1].ID)
+	short := left
+	if li != i {
+		short = right
 	}
 
-	//与右侧结点进行合并
-	if node2 != nil && len(node2.Items)+len(node.Items) <= t.width {
-		node.Items = append(node.Items, node2.Items...)
-		node.Next = node2.Next
-		node.MaxKey = node.Items[len(node.Items)-1].Key
-		if parent != nil {
-			parent.deleteChild(node2)
+	if left.Leaf {
+		switch {
+		case short == left && len(right.Items) > t.halfw:
+			//将右侧结点的记录移动到删除结点
+			left.Items = append(left.Items, right.Items[0])
+			right.Items = right.Items[1:]
+			left.MaxKey = left.Items[len(left.Items)-1].Key
+		case short == right && len(left.Items) > t.halfw:
+			//将左侧结点的记录移动到删除结点
+			item := left.Items[len(left.Items)-1]
+			left.Items = left.Items[0 : len(left.Items)-1]
+			left.MaxKey = left.Items[len(left.Items)-1].Key
+			right.Items = append([]BPItem{item}, right.Items...)
+		default:
+			//两个结点合并
+			left.Items = append(left.Items, right.Items...)
+			left.Next = right.Next
+			left.MaxKey = left.Items[len(left.Items)-1].Key
+			t.mergeInto(parent, li, left, right)
+			return
 		}
-		return
-	}
-}
-
-func (t *BPTree) childMoveOrMerge(parent *BPNode, node *BPNode) {
-	if parent == nil {
-		return
-	}
-
-	//获取兄弟结点
-	var node1 *BPNode = nil
-	var node2 *BPNode = nil
-	for i := 0; i < len(parent.Nodes); i++ {
-		if parent.Nodes[i] == node {
-			if i < len(parent.Nodes)-1 {
-				node2 = parent.Nodes[i+1]
-			} else if i > 0 {
-				node1 = parent.Nodes[i-1]
-			}
-			break
+	} else {
+		switch {
+		case short == left && len(right.Nodes) > t.halfw:
+			//将右侧结点的子结点移动到删除结点
+			left.Nodes = append(left.Nodes, right.Nodes[0])
+			right.Nodes = right.Nodes[1:]
+			left.MaxKey = left.Nodes[len(left.Nodes)-1].MaxKey
+		case short == right && len(left.Nodes) > t.halfw:
+			//将左侧结点的子结点移动到删除结点
+			child := left.Nodes[len(left.Nodes)-1]
+			left.Nodes = left.Nodes[0 : len(left.Nodes)-1]
+			left.MaxKey = left.Nodes[len(left.Nodes)-1].MaxKey
+			right.Nodes = append([]childRef{child}, right.Nodes...)
+		default:
+			left.Nodes = append(left.Nodes, right.Nodes...)
+			left.MaxKey = left.Nodes[len(left.Nodes)-1].MaxKey
+			t.mergeInto(parent, li, left, right)
+			return
 		}
 	}
+	parent.Nodes[li].MaxKey = left.MaxKey
+	t.markDirty(left)
+	t.markDirty(right)
+}
 
-	//将左侧结点的子结点移动到删除结点
-	if node1 != nil && len(node1.Nodes) > t.halfw {
-		item := node1.Nodes[len(node1.Nodes)-1]
-		node1.Nodes = node1.Nodes[0 : len(node1.Nodes)-1]
-		node.Nodes = append([]*BPNode{item}, node.Nodes...)
-		return
-	}
-
-	//将右侧结点的子结点移动到删除结点
-	if node2 != nil && len(node2.Nodes) > t.halfw {
-		item := node2.Nodes[0]
-		node2.Nodes = node1.Nodes[1:]
-		node.Nodes = append(node.Nodes, item)
-		return
-	}
-
-	if node1 != nil && len(node1.Nodes)+len(node.Nodes) <= t.width {
-		node1.Nodes = append(node1.Nodes, node.Nodes...)
-		parent.deleteChild(node)
-		return
-	}
-
-	if node2 != nil && len(node2.Nodes)+len(node.Nodes) <= t.width {
-		node.Nodes = append(node.Nodes, node2.Nodes...)
-		parent.deleteChild(node2)
-		return
-	}
+// mergeInto 右侧结点已经并入左侧结点，从父结点中删掉它并释放它的页
+func (t *BPTree) mergeInto(parent *BPNode, li int, left, right *BPNode) {
+	parent.Nodes[li].MaxKey = left.MaxKey
+	parent.deleteChild(right.ID)
+	t.markDirty(left)
+	t.freeNode(right)
 }
 
-func (t *BPTree) deleteItem(parent *BPNode, node *BPNode, key int64) {
-	for i := 0; i < len(node.Nodes); i++ {
-		if key <= node.Nodes[i].MaxKey {
-			t.deleteItem(node, node.Nodes[i], key)
-			break
+// deleteItem 在以 node 为根的子树中删除 key，返回是否删除了数据
+func (t *BPTree) deleteItem(node *BPNode, key Key) bool {
+	if node.Leaf {
+		if !node.deleteItem(key, t.compare) {
+			return false
 		}
+		t.markDirty(node)
+		return true
 	}
 
-	if len(node.Nodes) < 1 {
-		//删除记录后若结点的子项<m/2，则从兄弟结点移动记录，或者合并结点
-		node.deleteItem(key)
-		if len(node.Items) < t.halfw {
-			t.itemMoveOrMerge(parent, node)
-		}
-	} else {
-		//若结点的子项<m/2，则从兄弟结点移动记录，或者合并结点
-		node.MaxKey = node.Nodes[len(node.Nodes)-1].MaxKey
-		if len(node.Nodes) < t.halfw {
-			t.childMoveOrMerge(parent, node)
+	for i := 0; i < len(node.Nodes); i++ {
+		if t.compare(key, node.Nodes[i].MaxKey) <= 0 {
+			child := t.pin(node.Nodes[i].ID)
+			if !t.deleteItem(child, key) {
+				return false
+			}
+			node.Nodes[i].MaxKey = child.MaxKey
+			//删除记录后若结点的子项<m/2，则从兄弟结点移动记录，或者合并结点
+			if t.underflow(child) {
+				t.moveOrMerge(node, i)
+			}
+			node.MaxKey = node.Nodes[len(node.Nodes)-1].MaxKey
+			t.markDirty(node)
+			return true
 		}
 	}
+	return false
 }
 
-func (t *BPTree) Remove(key int64) {
+func (t *BPTree) Remove(key Key) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
-	t.deleteItem(nil, t.root, key)
+	defer t.releaseAll()
+	root := t.pin(t.root)
+	t.deleteItem(root, key)
+	//根结点只剩一个子结点时，让子结点成为新的根
+	for !root.Leaf && len(root.Nodes) == 1 {
+		t.root = root.Nodes[0].ID
+		t.freeNode(root)
+		root = t.pin(t.root)
+	}
 }
-func (t *BPTree) Insert(key int64, value map[string]interface{}) {
+func (t *BPTree) Insert(key Key, value Record) {
 	t.Set(key, value)
 }
 
 // Select 查询数据
-func (t *BPTree) Select(key int64) (interface{}, bool) {
+func (t *BPTree) Select(key Key) (Record, bool) {
 	value := t.Get(key)
 	if value != nil {
 		return value, true
@@ -452,74 +706,172 @@ func (t *BPTree) Select(key int64) (interface{}, bool) {
 }
 
 // Delete 删除数据
-func (t *BPTree) Delete(key int64) bool {
+func (t *BPTree) Delete(key Key) bool {
 	t.Remove(key)
 	_, exists := t.Select(key)
 	return !exists
 }
 
 type DB struct {
-	mutex           sync.RWMutex
-	tables          map[string]*BPTable
-	currentDB       string                         // 当前的数据库
-	currentTable    string                         // 当前的表
-	databases       map[string]map[string]*BPTable // 存储每个数据库的表
-	initFilePath    string
-	operateFilePath string
+	mutex     sync.RWMutex // 保护数据库和表的目录，读写数据不需要它
+	tables    map[string]*BPTable
+	databases map[string]map[string]*BPTable  // 存储每个数据库的表
+	sequences map[string]map[string]*Sequence // 每个数据库的序列
+	dataDir   string                          // 数据目录的绝对路径，所有的文件都按它定位
+	pool      *BufferPool                     // 所有表共用的缓冲池
+	wal       *WAL
+	session   *Session // 没有指定会话时使用，例如 ParseSQL
+
+	commitMu  sync.Mutex     // 同一时刻只有一个事务提交，检查点和清理旧版本也在它下面进行
+	snapMu    sync.Mutex     // 保护 clock 和 snapshots
+	clock     uint64         // 最后一个提交完成的事务的提交时间戳，新的快照从这里开始
+	snapshots map[uint64]int // 活动的快照和使用它的事务数
+	garbage   []garbage      // 有旧版本等待清理的行，按提交时间戳排列
 }
 
-// Use 切换当前使用的数据库
-func (db *DB) Use(databaseName string) SQLResult {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-
-	// 检查数据库是否存在
-	if _, exists := db.databases[databaseName]; !exists {
-		return SQLResult{Error: fmt.Errorf("数据库 %s 不存在\n", databaseName)}
-	}
-	// 切换当前使用的数据库
-	db.currentDB = databaseName
-	fmt.Printf("切换到数据库 %s\n", databaseName)
-	filePath := filepath.Join(db.initFilePath, db.currentDB)
-	db.operateFilePath = filePath
-	ChangeWorkingDirectory(db.operateFilePath)
-	return SQLResult{Result: fmt.Sprintf("Use是否切换成功 %v", db.operateFilePath)}
+// PoolStats 缓冲池的命中和淘汰统计
+func (db *DB) PoolStats() PoolStats {
+	return db.pool.Stats()
 }
-func ChangeWorkingDirectory(path string) {
-	err := os.Chdir(path)
-	if err != nil {
-		fmt.Printf("切换工作路径失败: %v\n", err)
-	} else {
-		fmt.Printf("成功切换到工作路径: %s\n", path)
+
+// Use 切换默认会话使用的数据库，每个连接用自己会话的 Session.Use
+func (db *DB) Use(databaseName string) SQLResult {
+	if err := db.session.Use(databaseName); err != nil {
+		return SQLResult{Error: err}
 	}
+	return SQLResult{Result: fmt.Sprintf("切换到数据库 %s", databaseName)}
 }
 
-// ColumnType 表示列的数据类型
-type ColumnType int
-
-const (
-	IntType ColumnType = iota
-	StringType
-)
-
 // Column 定义了表中的一列
 type Column struct {
-	Name string     // 列的名称
-	Type ColumnType // 列的数据类型
+	Name    string     // 列的名称
+	Type    ColumnType // 列的数据类型
+	NotNull bool       // 不允许 NULL，主键的列总是不允许
+	Default Expr       // 插入时没有给出这一列的值时使用的默认值，nil 表示 NULL
+
+	Length    int // varchar(n) 最多的字符数，0 表示不限制
+	Precision int // decimal(p, s) 的总位数，0 表示不限制
+	Scale     int // decimal(p, s) 的小数位数
+
+	AutoIncrement bool // 自增列，插入时没有给出值就自动生成
 }
 
-// TableSchema 定义了表的结构
+// TableSchema 定义了表的结构。列的约束、主键、check 约束、索引和外键保存在系统目录中，
+// 数据文件的文件头中只有列的名称和类型
 type TableSchema struct {
-	Columns []Column
+	Columns     []Column
+	PrimaryKey  []string // 声明的主键的列，没有声明时第一列是主键
+	Checks      []Check
+	Indexes     []Index // 表上的索引，unique 约束也是唯一索引
+	ForeignKeys []ForeignKey
+}
+
+// ForeignKey 外键: 一行中 Columns 的值必须是表 RefTable 中某一行 RefColumns 的值，有 NULL 时不检查。
+// 被引用的行被删除或修改时按 OnDelete、OnUpdate 处理引用它的行
+type ForeignKey struct {
+	Name       string
+	Columns    []string
+	RefTable   string // 同一个数据库中的表
+	RefColumns []string
+	OnDelete   string // RESTRICT, CASCADE, SET NULL, NO ACTION
+	OnUpdate   string
+}
+
+// Check 表上的 check 约束，条件的结果为假时拒绝写入，为 NULL 时不算违反
+type Check struct {
+	Name string
+	Expr Expr
+}
+
+// Index 表上的一个索引
+type Index struct {
+	Name    string
+	Columns []string
+	Unique  bool
+}
+
+// 列在表结构中的位置，不存在时返回 -1
+func (schema TableSchema) columnIndex(name string) int {
+	for i, col := range schema.Columns {
+		if col.Name == name {
+			return i
+		}
+	}
+	return -1
 }
 
 // BPTable b+树中表的类型
 type BPTable struct {
-	Name   string
-	Tree   *BPTree
-	Schema TableSchema
+	Name     string
+	Database string
+	Tree     *BPTree
+	Schema   TableSchema
+
+	vmu      sync.RWMutex
+	versions map[Key][]BPItem // 被替换的旧版本，从新到旧，还有快照可能要读它们
+
+	imu     sync.RWMutex
+	indexes []*tableIndex // 表上的二级索引
+
+	autoMu   sync.Mutex
+	autoNext int64 // 自增列的下一个值，0 表示还没有从 b+树中读出
+}
+
+// 主键的列，没有声明主键时是第一列
+func (table *BPTable) keyColumns() []string {
+	return table.Schema.keyColumns()
+}
+
+// 主键的第一列，按它排序就是按主键排序
+func (table *BPTable) keyColumn() string {
+	return table.keyColumns()[0]
+}
+
+// keyOf 一行的主键，把主键各列的值依次编码。值必须已经转换成列的类型
+func (table *BPTable) keyOf(row map[string]interface{}) (Key, error) {
+	var buf []byte
+	for _, column := range table.keyColumns() {
+		value := row[column]
+		if value == nil {
+			return "", errorOf(ErrNotNullViolation, "列 %s 不能为 NULL", column)
+		}
+		if !table.Schema.Columns[table.Schema.columnIndex(column)].Type.holds(value) {
+			return "", fmt.Errorf("无效的主键值: %v", value)
+		}
+		buf = appendKeyValue(buf, value)
+	}
+	if len(buf) > maxKeyLen {
+		return "", fmt.Errorf("主键太长: 编码后 %d 字节，最多 %d 字节", len(buf), maxKeyLen)
+	}
+	return Key(buf), nil
 }
 
+// keyFor 主键只有一列时，这一列的值为 value 的行的主键。数字列中的字符串按数字转换，
+// 值不能作为主键时返回 false
+func (table *BPTable) keyFor(value interface{}) (Key, bool) {
+	columns := table.keyColumns()
+	if len(columns) != 1 {
+		return "", false
+	}
+	typ := table.Schema.Columns[table.Schema.columnIndex(columns[0])].Type
+	if s, ok := value.(string); ok && typ.keyTag() == keyNumber {
+		if n, ok := toNumber(s); ok {
+			value = n
+		}
+	}
+	if v, ok := typ.keyValue(value); ok {
+		return EncodeKey(v), true
+	}
+	return "", false
+}
+
+// tableWidth 表的 b+树宽度，一个叶子结点通常能放进一页
+const tableWidth = 32
+
+// tableFileExt 表数据文件的扩展名，文件放在数据库目录下
+const tableFileExt = ".tbl"
+
+// NewBPTable 只在内存中的表
 func NewBPTable(name string, schema TableSchema) *BPTable {
 	width := 4 // 这个值可以根据实际需要调整
 	return &BPTable{
@@ -529,95 +881,271 @@ func NewBPTable(name string, schema TableSchema) *BPTable {
 	}
 }
 
+// createBPTable 新建表的数据文件
+func createBPTable(filePath, database, name string, schema TableSchema, pool *BufferPool) (*BPTable, error) {
+	pager, err := createPager(filePath, schema, tableWidth)
+	if err != nil {
+		return nil, err
+	}
+	table := &BPTable{Name: name, Database: database, Tree: openBPTree(pager, pool), Schema: schema}
+	if err := table.flush(); err != nil {
+		pager.Close()
+		os.Remove(filePath)
+		return nil, err
+	}
+	return table, nil
+}
+
+// openBPTable 打开已有的数据文件，表结构取自系统目录
+func openBPTable(filePath, database, name string, schema TableSchema, pool *BufferPool) (*BPTable, error) {
+	pager, err := openPager(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &BPTable{Name: name, Database: database, Tree: openBPTree(pager, pool), Schema: schema}, nil
+}
+
+// readTableSchema 读取数据文件头中的表结构，没有系统目录的旧数据目录用它生成目录
+func readTableSchema(filePath string) (TableSchema, error) {
+	pager, err := openPager(filePath)
+	if err != nil {
+		return TableSchema{}, err
+	}
+	defer pager.Close()
+	return pager.schema, nil
+}
+
+// 数据文件对应的表名
+func tableNameOf(filePath string) string {
+	return strings.TrimSuffix(filepath.Base(filePath), tableFileExt)
+}
+
+// flush 把表中修改过的页写回数据文件
+func (table *BPTable) flush() error {
+	return table.Tree.flush()
+}
+
 func NewDB() *DB {
+	return NewDBWithPoolSize(DefaultPoolSize)
+}
+
+// NewDBWithPoolSize 指定缓冲池大小(能缓存的结点数)创建数据库，数据目录是当前目录
+func NewDBWithPoolSize(poolSize int) *DB {
 	getwd, err := os.Getwd()
 	if err != nil {
 		fmt.Println("为获取到当前路径")
 		return nil
 	}
-	return &DB{
-		databases:    make(map[string]map[string]*BPTable),
-		initFilePath: getwd,
+	return OpenDB(getwd, poolSize)
+}
+
+// OpenDB 打开数据目录 dir 中的数据库，目录不存在时创建。之后所有的文件都用从 dir 开始的绝对路径访问，
+// 不会改变进程的工作目录
+func OpenDB(dir string, poolSize int) *DB {
+	dataDir, err := filepath.Abs(dir)
+	if err != nil {
+		fmt.Println("无效的数据目录", err)
+		return nil
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		fmt.Println("创建数据目录失败", err)
+		return nil
+	}
+	db := &DB{
+		databases: make(map[string]map[string]*BPTable),
+		sequences: make(map[string]map[string]*Sequence),
+		dataDir:   dataDir,
+		pool:      NewBufferPool(poolSize),
+		snapshots: make(map[uint64]int),
+	}
+	db.session = db.NewSession()
+	if err := db.loadCatalog(); err != nil {
+		fmt.Println("读取系统目录失败", err)
+		return nil
+	}
+	wal, records, err := openWAL(filepath.Join(dataDir, walFileName))
+	if err != nil {
+		fmt.Println("打开日志失败", err)
+		return nil
+	}
+	db.wal = wal
+	if err := db.recover(records); err != nil {
+		fmt.Println("根据日志恢复失败", err)
+		return nil
+	}
+	for _, table := range db.allTables() {
+		table.buildIndexes()
 	}
+	return db
+}
+
+// 表数据文件的路径
+func (db *DB) tablePath(database, tableName string) string {
+	return filepath.Join(db.dataDir, database, tableName+tableFileExt)
 }
 
-// CreateDatabase 创建数据库
-func (db *DB) CreateDatabase(databaseName string) {
+// CreateDatabase 创建数据库的文件夹并记录到系统目录中，数据库已经存在时什么也不做
+func (db *DB) CreateDatabase(databaseName string) error {
+	_, err := db.createDatabase(databaseName)
+	return err
+}
+
+// createDatabase 创建数据库，返回是不是新建的
+func (db *DB) createDatabase(databaseName string) (bool, error) {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
 	// 检查数据库是否已经存在
 	if _, exists := db.databases[databaseName]; exists {
 		fmt.Printf("数据库 %s 已经存在\n", databaseName)
-		return
+		return false, nil
 	}
 
+	finalPath := filepath.Join(db.dataDir, databaseName)
+	fmt.Println("创建数据库的路径", finalPath)
+	if err := os.MkdirAll(finalPath, 0755); err != nil {
+		return false, fmt.Errorf("创建数据库文件夹失败: %v", err)
+	}
 	db.databases[databaseName] = make(map[string]*BPTable)
-	db.currentDB = databaseName
-
+	if err := db.saveCatalog(); err != nil {
+		delete(db.databases, databaseName)
+		return false, fmt.Errorf("创建数据库 %s 失败: %v", databaseName, err)
+	}
 	fmt.Printf("数据库 %s 成功创建\n", databaseName)
-	finalPath := path.Join(db.initFilePath, databaseName)
-	db.operateFilePath = finalPath
-	fmt.Println("创建数据库的路径", finalPath)
-	err := os.Mkdir(finalPath, 0755)
-	if err != nil {
-		fmt.Println("创建数据库文件夹是否成功")
-		return
+	return true, nil
+}
+
+// Databases 所有数据库的名字，按名字排序
+func (db *DB) Databases() []string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	names := make([]string, 0, len(db.databases))
+	for name := range db.databases {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
 
+// Tables 数据库 database 中所有表的名字，按名字排序
+func (db *DB) Tables(database string) ([]string, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	tables, exists := db.databases[strings.ToUpper(database)]
+	if !exists {
+		return nil, errorOf(ErrUndefinedDatabase, "数据库 %s 不存在", strings.ToUpper(database))
+	}
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
 }
 
-func (db *DB) CreateTable(tableName string, schema TableSchema) {
+// CreateTable 在数据库 database 中建表
+func (db *DB) CreateTable(database, tableName string, schema TableSchema) error {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
 	// 检查是否选择了数据库
-	if db.currentDB == "" {
-		fmt.Println("没有选择数据库")
-		return
+	if database == "" {
+		return fmt.Errorf("没有选择数据库")
+	}
+	tables, exists := db.databases[database]
+	if !exists {
+		return errorOf(ErrUndefinedDatabase, "数据库 %s 不存在", database)
 	}
 
 	// 检查表是否已经存在
-	if _, exists := db.databases[db.currentDB][tableName]; exists {
-		fmt.Printf("表 %s 已经存在\n", tableName)
-		return
+	if _, exists := tables[tableName]; exists {
+		return fmt.Errorf("表 %s 已经存在", tableName)
+	}
+	if err := db.resolveForeignKeys(database, tableName, &schema); err != nil {
+		return err
 	}
 
-	db.databases[db.currentDB][tableName] = NewBPTable(tableName, schema)
+	filePath := db.tablePath(database, tableName)
+	table, err := createBPTable(filePath, database, tableName, schema, db.pool)
+	if err != nil {
+		return fmt.Errorf("创建表 %s 失败: %v", tableName, err)
+	}
+	// unique 约束的唯一索引，表是空的
+	table.buildIndexes()
+	tables[tableName] = table
+	if err := db.saveCatalog(); err != nil {
+		delete(tables, tableName)
+		table.Tree.pager.Close()
+		os.Remove(filePath)
+		return fmt.Errorf("创建表 %s 失败: %v", tableName, err)
+	}
 	fmt.Printf("表 %s 成功创建\n", tableName)
+	return nil
+}
 
+// Insert 在默认会话的当前数据库中插入一行，作为单独的事务提交
+func (db *DB) Insert(tableName string, data map[string]interface{}) error {
+	return db.autocommit(func(tx *txn) error {
+		_, err := db.insertRow(tx, db.session.database, tableName, data)
+		return err
+	})
 }
 
-func (db *DB) Insert(tableName string, data map[string]interface{}) {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-	table, exists := db.databases[db.currentDB][tableName]
-	if !exists {
-		fmt.Printf("表 %s 不存在\n", tableName)
-		return
+// insertRow 在事务中插入一行，没有给出的列使用默认值，值转换成列的类型，主键已存在时返回错误。
+// 返回自增列生成的值，没有生成时为 0
+func (db *DB) insertRow(tx *txn, database, tableName string, data map[string]interface{}) (int64, error) {
+	table, err := db.lookupTable(database, tableName)
+	if err != nil {
+		return 0, err
 	}
-	keyColumn := table.Schema.Columns[0].Name
-	key, ok := data[keyColumn].(int64)
-	if !ok {
-		fmt.Printf("Invalid key for table %s\n", tableName)
-		return
+	if err := table.fillDefaults(data); err != nil {
+		return 0, err
 	}
-	table.Tree.Insert(key, data)
-
+	if err := table.coerceRow(data); err != nil {
+		return 0, err
+	}
+	id, err := table.autoIncrement(data)
+	if err != nil {
+		return 0, err
+	}
+	key, err := table.keyOf(data)
+	if err != nil {
+		return 0, err
+	}
+	if _, exists := table.get(tx, key); exists {
+		return 0, errorOf(ErrUniqueViolation, "主键 %s 已存在", key)
+	}
+	return id, db.writeRow(tx, table, key, nil, data)
 }
 
 func (db *DB) Update(tableName string, data map[string]interface{}) bool {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-	table, exists := db.databases[db.currentDB][tableName]
-	if !exists {
-		fmt.Printf("表 %s 不存在\n", tableName)
+	updated := false
+	err := db.autocommit(func(tx *txn) error {
+		table, err := db.lookupTable(db.session.database, tableName)
+		if err != nil {
+			return err
+		}
+		if err := table.coerceRow(data); err != nil {
+			return err
+		}
+		key, err := table.keyOf(data)
+		if err != nil {
+			return err
+		}
+		before, exists := table.get(tx, key)
+		if !exists {
+			return nil
+		}
+		updated = true
+		return db.replaceRow(tx, table, key, before, data)
+	})
+	if err != nil {
+		fmt.Println(err)
 		return false
 	}
-	// 调用 BPTable 中的 Update 方法
-	return table.Tree.Update(data["ID"].(int64), data)
+	return updated
 }
-func (t *BPTree) Update(key int64, value map[string]interface{}) bool {
+func (t *BPTree) Update(key Key, value Record) bool {
 	if _, exists := t.Select(key); exists {
 		t.Set(key, value)
 		return true
@@ -625,359 +1153,49 @@ func (t *BPTree) Update(key int64, value map[string]interface{}) bool {
 	return false
 }
 
-func (db *DB) Select(tableName string, key int64) interface{} {
-	db.mutex.RLock()
-	defer db.mutex.RUnlock()
-	table, exists := db.databases[db.currentDB][tableName]
-	if !exists {
+func (db *DB) Select(tableName string, key Key) interface{} {
+	table, err := db.lookupTable(db.session.database, tableName)
+	if err != nil {
 		fmt.Printf("表 %s 不存在t\n", tableName)
 		return nil
 	}
-	return table.Tree.Get(key)
-}
-
-func (db *DB) Delete(tableName string, key int64) bool {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-	table, exists := db.databases[db.currentDB][tableName]
-	if !exists {
-		fmt.Printf("Table %s does not exist\n", tableName)
-		return false
+	tx := db.begin()
+	defer db.release(tx)
+	if val, ok := table.get(tx, key); ok {
+		return val
 	}
-	table.Tree.Remove(key)
-	_, exists = table.Tree.Select(key)
-	return !exists
+	return nil
 }
 
-func ParseSQL(sql string, db *DB) SQLResult {
-	sql = strings.TrimSpace(sql)
-	sql = strings.ToUpper(sql)
-	sql = strings.TrimSuffix(sql, ";")
-	words := strings.FieldsFunc(sql, func(r rune) bool {
-		// 分割字符为逗号、左括号、右括号和空格
-		return r == ',' || r == '(' || r == ')' || unicode.IsSpace(r)
-	})
-
-	fmt.Println(words)
-	switch words[0] {
-	case "EXIT":
-		return SQLResult{}
-	case "USE":
-		return db.Use(words[1])
-	case "HELP":
-		return db.GetHelp()
-	case "CREATE":
-		if words[1] == "DATABASE" {
-			db.CreateDatabase(words[2])
-		} else if words[1] == "TABLE" {
-
-			if len(words) < 4 {
-				return SQLResult{
-					Error: fmt.Errorf("创表需要字段"),
-				}
-			} else {
-				//[CREATE TABLE USER ID INT NAME STRING AGE INT ;]
-				tableName := words[2]
-				// 解析表结构
-				columns := make([]Column, 0)
-				for i := 3; i < len(words); i += 2 {
-					// 检查是否有足够的单词
-					if i+1 >= len(words) {
-						return SQLResult{
-							Error: fmt.Errorf("列定义缺少类型"),
-						}
-					}
-
-					columnName := words[i]
-					columnType := words[i+1]
-					var colType ColumnType
-					switch columnType {
-					case "INT":
-						colType = IntType
-					case "STRING":
-						colType = StringType
-					default:
-						return SQLResult{
-							Error: fmt.Errorf("未知的字段类型: %v", columnType),
-						}
-					}
-					columns = append(columns, Column{Name: columnName, Type: colType})
-				}
-
-				// 定义表结构
-				tableSchema := TableSchema{
-					Columns: columns,
-				}
-
-				// 创建表
-				db.CreateTable(tableName, tableSchema)
-				//db.CreateTableFile(tableName, tableSchema)
-			}
-
-		}
-	case "INSERT":
-		// [INSERT INTO USER ID NAME AGE VALUES 1 '阿亮' 22 ;]
-		tableName := words[2]
-		i := 3
-		columns := make([]string, 0)
-		for words[i] != "VALUES" {
-			columns = append(columns, words[i])
-			i++
-		}
-		i++ // 跳过 "VALUES"
-		values := make([]interface{}, 0)
-		for i < len(words) {
-			var value interface{}
-			if intValue, err := strconv.ParseInt(words[i], 10, 64); err == nil {
-				value = intValue
-			} else {
-				value = words[i]
-			}
-			values = append(values, value)
-			i++
-		}
-		if len(columns) != len(values) {
-			return SQLResult{
-				Error: fmt.Errorf("列的数量和值的数量不匹配"),
-			}
-		}
-		data := make(map[string]interface{})
-		for i, column := range columns {
-			data[column] = values[i]
-		}
-		db.Insert(tableName, data)
-		//updateData := db.SelectAll(tableName)
-		//db.UpdateDataToFile(tableName, updateData)
-		updateData := db.SelectAll(tableName)
-
-		// 将map[int64]interface{}转换为map[string]interface{}
-		convertedData := make(map[string]interface{})
-		for key, value := range updateData {
-			convertedData[strconv.FormatInt(key, 10)] = value
-		}
-
-		db.UpdateDataToFile(tableName, convertedData)
-		//err := db.SaveDataToFile(tableName, data)
-		//if err != nil {
-		//	fmt.Println("insert插入文件失败")
-		//	return
-		//}
-	case "UPDATE":
-		// [UPDATE USER SET NAME = 1 AGE = 30 WHERE ID = 1;]
-		tableName := words[1]
-		i := 3
-		data := make(map[string]interface{})
-		for i < len(words) && words[i] != "WHERE" {
-			// 列名
-			columnName := words[i]
-			i++
-
-			// 判断是否是等号，如果不是，则语句无效
-			if i >= len(words) || words[i] != "=" {
-				return SQLResult{
-					Error: fmt.Errorf("无效的更新表达式:%v", words[i-1]),
-				}
-
-			}
-			i++
-
-			// 值
-			columnValue := words[i]
-			i++
-
-			// 存储到 data 中
-			data[columnName] = columnValue
-		}
-
-		// 检查是否提前结束循环
-		if i >= len(words) || words[i] != "WHERE" {
-			return SQLResult{
-				Error: fmt.Errorf("缺少 WHERE 子句"),
-			}
-		}
-
-		i++ // 跳过 "WHERE"
-
-		// 处理 WHERE 子句
-		keyColumn := words[i]
-		i++
-
-		// 判断是否是等号，如果不是，则语句无效
-		if i >= len(words) || words[i] != "=" {
-
-			return SQLResult{
-				Error: fmt.Errorf("无效的 WHERE 子句"),
-			}
-
-		}
-		i++
-
-		// 获取主键值
-		key, err := strconv.ParseInt(words[i], 10, 64)
+func (db *DB) Delete(tableName string, key Key) bool {
+	err := db.autocommit(func(tx *txn) error {
+		table, err := db.lookupTable(db.session.database, tableName)
 		if err != nil {
-			return SQLResult{
-				Error: fmt.Errorf("无效的主键值: %v", words[i]),
-			}
-		}
-
-		// 存储到 data 中
-		data[keyColumn] = key
-
-		// 调用 Update 函数
-		success := db.Update(tableName, data)
-		if success {
-			fmt.Println("更新成功")
-		} else {
-			return SQLResult{
-				Error: fmt.Errorf("更新失败"),
-			}
-
-		}
-		//updateData := db.SelectAll(tableName)
-		//db.UpdateDataToFile(tableName, updateData)
-		updateData := db.SelectAll(tableName)
-
-		// 将map[int64]interface{}转换为map[string]interface{}
-		convertedData := make(map[string]interface{})
-		for key, value := range updateData {
-			convertedData[strconv.FormatInt(key, 10)] = value
-		}
-
-		db.UpdateDataToFile(tableName, convertedData)
-	case "SELECT":
-		if len(words) < 5 {
-			return SQLResult{
-				Error: fmt.Errorf("select语句不正确，缺少必要的参数"),
-			}
-
-		} else {
-			if words[1] != "*" || words[2] != "FROM" {
-				return SQLResult{
-					Error: fmt.Errorf("select语句不正确"),
-				}
-			} else {
-				filePath := filepath.Join(words[3], words[4]+".csv")
-				s := db.readFileContent(filePath)
-				fmt.Println("select语句执行成功")
-				return SQLResult{
-					Result: s,
-				}
-			}
-		}
-
-	case "DELETE":
-		// [DELETE FROM USER WHERE ID = 2;]
-		tableName := words[2]
-		key, err := strconv.ParseInt(words[6], 10, 64)
-		if err != nil {
-			return SQLResult{
-				Error: fmt.Errorf("无效的主键值:%v", words[6]),
-			}
-		}
-		db.Delete(tableName, key)
-		//updateData := db.SelectAll(tableName)
-		//db.UpdateDataToFile(tableName, updateData)
-		updateData := db.SelectAll(tableName)
-
-		// 将map[int64]interface{}转换为map[string]interface{}
-		convertedData := make(map[string]interface{})
-		for key, value := range updateData {
-			convertedData[strconv.FormatInt(key, 10)] = value
+			return err
 		}
-
-		db.UpdateDataToFile(tableName, convertedData)
-	default:
-		return SQLResult{
-			Error: fmt.Errorf("无效的语句"),
+		if before, exists := table.get(tx, key); exists {
+			return db.deleteRow(tx, table, key, before)
 		}
-	}
-	return SQLResult{}
-}
-
-func (db *DB) SaveDataToFile(tableName string, data map[string]interface{}) error {
-	fileName := tableName + ".csv"
-	filePath := filepath.Join(db.operateFilePath, fileName)
-
-	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		return nil
+	})
 	if err != nil {
-		fmt.Println("打开文件失败", err)
-		return err
-	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-
-	keys := make([]string, 0, len(data))
-	for key := range data {
-		keys = append(keys, key)
-	}
-	sort.Strings(keys)
-
-	// 按照排序后的键写入数据
-	for _, key := range keys {
-		value := data[key]
-		rowData := []string{key, fmt.Sprintf("%v", value)}
-		err := writer.Write(rowData)
-		if err != nil {
-			fmt.Println("写入数据失败", err)
-			return err
-		}
+		fmt.Println(err)
+		return false
 	}
-	// 写入数据
-	//for _, key := range data {
-	//	//rowData := []string{key, fmt.Sprintf("%v", value)}
-	//
-	//	err := writer.Write(rowData)
-	//	if err != nil {
-	//		fmt.Println("写入数据失败", err)
-	//		return err
-	//	}
-	//}
-
-	writer.Flush() // 刷新缓冲区
-
-	fmt.Println("数据写入文件成功")
-	return nil
+	return true
 }
 
-func (db *DB) UpdateDataToFile(tableName string, data map[string]interface{}) error {
-	fileName := tableName + ".csv"
-	filePath := filepath.Join(db.operateFilePath, fileName)
-
-	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+// ParseSQL 解析并执行一条 SQL 语句
+func ParseSQL(sql string, db *DB) SQLResult {
+	stmt, err := Parse(sql)
 	if err != nil {
-		fmt.Println("打开文件失败", err)
-		return err
-	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-
-	// 对键进行排序
-	keys := make([]string, 0, len(data))
-	for key := range data {
-		keys = append(keys, key)
+		return SQLResult{Error: err}
 	}
-	sort.Strings(keys)
-
-	// 按照排序后的键写入数据
-	for _, key := range keys {
-		value := data[key]
-		rowData := []string{key, fmt.Sprintf("%v", value)}
-		err := writer.Write(rowData)
-		if err != nil {
-			fmt.Println("写入数据失败", err)
-			return err
-		}
-	}
-
-	writer.Flush() // 刷新缓冲区
-
-	fmt.Println("数据写入文件成功")
-	return nil
+	return db.Execute(stmt)
 }
+
 func (db *DB) GetHelp() SQLResult {
-	toolPath := filepath.Join(db.initFilePath, "tools")
+	toolPath := filepath.Join(db.dataDir, "tools")
 	var readFile []byte
 	if _, err := os.Stat(toolPath); os.IsNotExist(err) {
 		err := os.MkdirAll(toolPath, os.ModePerm)
@@ -988,7 +1206,7 @@ func (db *DB) GetHelp() SQLResult {
 		fmt.Println(toolPath, "文件夹创建成功")
 	}
 
-	filePath := filepath.Join(db.initFilePath, "tools/help.txt")
+	filePath := filepath.Join(db.dataDir, "tools/help.txt")
 	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return SQLResult{Error: fmt.Errorf("打开文件夹失败 %v", err)}
@@ -1000,7 +1218,7 @@ func (db *DB) GetHelp() SQLResult {
 		return SQLResult{Error: fmt.Errorf("os.Stat获取文件失败")}
 	}
 	if fi.Size() == 0 {
-		data := []byte("创建数据库语法: create database xxx;        // create database blog;\n使用数据库语法: use xxx;                    // use blog;\n创建表语法: create table xx (字段  类型,字段  类型); // create table user (id int,name string);\n插入语法: insert into xx (字段 , 字段) values (值,值); // insert into user (id ,name) values (1,'阿亮');\n查询语法: select * from 数据库名 表名;      // select * from  blog user;\n修改语法: update xx set 字段 = 值  where 字段 = 值; //update user set name = '亮亮' where id = 1;\n删除语法: delete from xx where 字段 = 值 ;     // delete from user where id = 1;")
+		data := []byte("创建数据库语法: create database xxx;        // create database blog;\n使用数据库语法: use xxx;                    // use blog;\n创建表语法: create table xx (字段  类型,字段  类型); // create table user (id int,name string);\n插入语法: insert into xx (字段 , 字段) values (值,值); // insert into user (id ,name) values (1,'阿亮');\n查询语法: select 字段 [as 别名], ... from [数据库名.]表名 [where ...]; // select id, name as n from blog.user where id > 1;\n修改语法: update xx set 字段 = 值  where 字段 = 值; //update user set name = '亮亮' where id = 1;\n删除语法: delete from xx where 字段 = 值 ;     // delete from user where id = 1;")
 		err := os.WriteFile(filePath, data, 0644)
 		if err != nil {
 			return SQLResult{Error: fmt.Errorf("os.WriteFile 写入文件出错")}
@@ -1015,16 +1233,6 @@ func (db *DB) GetHelp() SQLResult {
 	return SQLResult{Result: string(readFile)}
 }
 
-func (db *DB) readFileContent(filePath string) string {
-	laPath := filepath.Join(db.initFilePath, "/", filePath)
-	file, err := os.ReadFile(laPath)
-	if err != nil {
-		fmt.Println("readFileContent读取出错", err)
-	}
-	fmt.Println(string(file))
-	return string(file)
-}
-
 //// [SELECT * FROM USER WHERE ID = 1;]
 //tableName := words[3]
 //// [SELECT * FROM USER WHERE ID = 1;]
@@ -1056,8 +1264,8 @@ func (db *DB) readFileContent(filePath string) string {
 // 获取帮助信息
 
 //func (db *DB) GetHelp() {
-//	if _, err := os.Stat(db.initFilePath); os.IsNotExist(err) {
-//		toolPath := filepath.Join(db.initFilePath, "tools")
+//	if _, err := os.Stat(db.dataDir); os.IsNotExist(err) {
+//		toolPath := filepath.Join(db.dataDir, "tools")
 //		err := os.MkdirAll(toolPath, os.ModePerm)
 //		if err != nil {
 //			fmt.Println("创建文件夹失败", err)
@@ -1066,7 +1274,7 @@ func (db *DB) readFileContent(filePath string) string {
 //		fmt.Println(toolPath, "文件夹创建成功")
 //	}
 //
-//	filePath := filepath.Join(db.initFilePath, "tools/help.txt")
+//	filePath := filepath.Join(db.dataDir, "tools/help.txt")
 //	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
 //	if err != nil {
 //		fmt.Println("打开文件创建文件失败", err)
@@ -0,0 +1,214 @@
+package storgeengine
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DefaultPoolSize 缓冲池默认能容纳的结点数
+const DefaultPoolSize = 1024
+
+// 缓冲池至少要能放下一次写操作同时固定的结点(根到叶子的路径以及合并时的兄弟结点)
+const minPoolSize = 64
+
+// frameKey 缓冲池中一个结点的标识：所属的数据文件和页号
+type frameKey struct {
+	pager *Pager
+	id    PageID
+}
+
+// frame 缓冲池中的一个槽位
+type frame struct {
+	key   frameKey
+	node  *BPNode
+	pins  int  // 正在使用这个结点的次数，大于 0 时不能淘汰
+	dirty bool // 修改过，淘汰或刷盘时要写回文件
+	ref   bool // clock 算法的访问位
+}
+
+// PoolStats 缓冲池的统计信息，用于调整缓冲池大小
+type PoolStats struct {
+	Capacity  int
+	Used      int
+	Pinned    int
+	Dirty     int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// BufferPool 所有表共用的 b+树结点缓存，容量固定，满了以后用 clock 算法淘汰没有被固定的结点。
+// 结点被 fetch 之后处于固定状态，用完必须 unpin
+type BufferPool struct {
+	mu       sync.Mutex
+	capacity int
+	frames   []*frame
+	index    map[frameKey]int
+	hand     int
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func NewBufferPool(capacity int) *BufferPool {
+	if capacity < minPoolSize {
+		capacity = minPoolSize
+	}
+	return &BufferPool{
+		capacity: capacity,
+		frames:   make([]*frame, 0, capacity),
+		index:    make(map[frameKey]int, capacity),
+	}
+}
+
+// fetch 取出结点并固定，不在缓冲池中时从文件读取
+func (bp *BufferPool) fetch(pager *Pager, id PageID, width int) (*BPNode, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	key := frameKey{pager, id}
+	if i, ok := bp.index[key]; ok {
+		f := bp.frames[i]
+		f.pins++
+		f.ref = true
+		bp.hits++
+		return f.node, nil
+	}
+	bp.misses++
+	node, err := pager.readNode(id, width)
+	if err != nil {
+		return nil, err
+	}
+	if err := bp.put(&frame{key: key, node: node, pins: 1, ref: true}); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// create 放入一个新分配的结点，新结点是固定并且修改过的
+func (bp *BufferPool) create(pager *Pager, node *BPNode) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.put(&frame{key: frameKey{pager, node.ID}, node: node, pins: 1, dirty: true, ref: true})
+}
+
+// put 找一个空的槽位或者淘汰一个结点来放入 f
+func (bp *BufferPool) put(f *frame) error {
+	if len(bp.frames) < bp.capacity {
+		bp.index[f.key] = len(bp.frames)
+		bp.frames = append(bp.frames, f)
+		return nil
+	}
+	i, err := bp.victim()
+	if err != nil {
+		return err
+	}
+	old := bp.frames[i]
+	if old.dirty {
+		if err := old.key.pager.writeNode(old.node); err != nil {
+			return err
+		}
+	}
+	delete(bp.index, old.key)
+	bp.evictions++
+	bp.index[f.key] = i
+	bp.frames[i] = f
+	return nil
+}
+
+// victim clock 算法：转动指针，跳过被固定的结点，访问位为 1 的清零后再给一次机会
+func (bp *BufferPool) victim() (int, error) {
+	for n := 0; n < 2*len(bp.frames); n++ {
+		i := bp.hand
+		bp.hand = (bp.hand + 1) % len(bp.frames)
+		f := bp.frames[i]
+		if f.pins > 0 {
+			continue
+		}
+		if f.ref {
+			f.ref = false
+			continue
+		}
+		return i, nil
+	}
+	return 0, fmt.Errorf("缓冲池的 %d 个槽位都被固定，无法淘汰", len(bp.frames))
+}
+
+// unpin 使用完结点后解除固定
+func (bp *BufferPool) unpin(pager *Pager, id PageID) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if i, ok := bp.index[frameKey{pager, id}]; ok && bp.frames[i].pins > 0 {
+		bp.frames[i].pins--
+	}
+}
+
+func (bp *BufferPool) markDirty(pager *Pager, id PageID) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if i, ok := bp.index[frameKey{pager, id}]; ok {
+		bp.frames[i].dirty = true
+	}
+}
+
+// drop 结点所在的页被释放，直接丢弃不再写回
+func (bp *BufferPool) drop(pager *Pager, id PageID) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	key := frameKey{pager, id}
+	i, ok := bp.index[key]
+	if !ok {
+		return
+	}
+	delete(bp.index, key)
+	// 用最后一个槽位填补空位
+	last := len(bp.frames) - 1
+	if i != last {
+		bp.frames[i] = bp.frames[last]
+		bp.index[bp.frames[i].key] = i
+	}
+	bp.frames = bp.frames[:last]
+	if bp.hand >= len(bp.frames) {
+		bp.hand = 0
+	}
+}
+
+// flush 把一个数据文件在缓冲池中修改过的结点全部写回
+func (bp *BufferPool) flush(pager *Pager) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for _, f := range bp.frames {
+		if f.key.pager != pager || !f.dirty {
+			continue
+		}
+		if err := pager.writeNode(f.node); err != nil {
+			return err
+		}
+		f.dirty = false
+	}
+	return nil
+}
+
+// Stats 缓冲池当前的命中、未命中和淘汰次数
+func (bp *BufferPool) Stats() PoolStats {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	stats := PoolStats{Capacity: bp.capacity, Used: len(bp.frames), Hits: bp.hits, Misses: bp.misses, Evictions: bp.evictions}
+	for _, f := range bp.frames {
+		if f.pins > 0 {
+			stats.Pinned++
+		}
+		if f.dirty {
+			stats.Dirty++
+		}
+	}
+	return stats
+}
+
+// HitRate 命中率，还没有访问过时为 0
+func (s PoolStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
@@ -0,0 +1,388 @@
+package storgeengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// 系统目录: 记录所有的数据库、每个数据库的序列以及每张表的列、类型、约束和索引，保存在数据目录下的 aliangsql.catalog。
+// 启动时按目录打开每张表的数据文件；每次修改都重写整个文件，先写临时文件再改名，
+// 任何时候崩溃都有一份完整的目录。
+//
+// 文件布局: 魔数 "ALSQLCAT" | 版本 uint16 | 内容长度 uint32 | crc32 uint32 | 内容
+const (
+	catalogFileName   = "aliangsql.catalog"
+	catalogMagic      = "ALSQLCAT"
+	catalogVersion    = 5 // 2: 增加了主键、not null、默认值和 check 约束；3: 增加了外键；4: 增加了序列；5: 增加了列的长度和精度
+	catalogHeaderSize = 18
+)
+
+// catalogEntry 目录中的一个数据库和它的表
+type catalogEntry struct {
+	name      string
+	tables    map[string]TableSchema
+	sequences []Sequence // 按名字排序
+}
+
+// 目录文件的路径
+func (db *DB) catalogPath() string {
+	return filepath.Join(db.dataDir, catalogFileName)
+}
+
+// loadCatalog 启动时读取目录，重新打开每个数据库中的表。
+// 旧的数据目录还没有目录文件，这时把含有表数据文件的目录当作数据库，生成一份目录
+func (db *DB) loadCatalog() error {
+	entries, err := readCatalog(db.catalogPath())
+	if os.IsNotExist(err) {
+		if entries, err = db.scanDataDir(); err != nil {
+			return err
+		}
+		defer func() {
+			if err := db.saveCatalog(); err != nil {
+				fmt.Println("保存系统目录失败", err)
+			}
+		}()
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.MkdirAll(filepath.Join(db.dataDir, entry.name), 0755); err != nil {
+			return err
+		}
+		if len(entry.sequences) > 0 {
+			sequences := make(map[string]*Sequence, len(entry.sequences))
+			for i := range entry.sequences {
+				seq := entry.sequences[i]
+				seq.used = seq.reserved
+				sequences[seq.Name] = &seq
+			}
+			db.sequences[entry.name] = sequences
+		}
+		tables := make(map[string]*BPTable, len(entry.tables))
+		for name, schema := range entry.tables {
+			table, err := openBPTable(db.tablePath(entry.name, name), entry.name, name, schema, db.pool)
+			if err != nil {
+				// 数据文件丢失或损坏时只能跳过这张表，目录中的记录保留，修好文件后重启还能打开
+				fmt.Println("打开表失败", err)
+				continue
+			}
+			tables[name] = table
+		}
+		db.databases[entry.name] = tables
+	}
+	return nil
+}
+
+// scanDataDir 从数据目录中找出已有的表，表结构取自数据文件的文件头
+func (db *DB) scanDataDir() ([]catalogEntry, error) {
+	dirs, err := os.ReadDir(db.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []catalogEntry
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(db.dataDir, dir.Name(), "*"+tableFileExt))
+		if err != nil || len(files) == 0 {
+			continue
+		}
+		entry := catalogEntry{name: dir.Name(), tables: make(map[string]TableSchema)}
+		for _, file := range files {
+			schema, err := readTableSchema(file)
+			if err != nil {
+				fmt.Println("读取表结构失败", err)
+				continue
+			}
+			entry.tables[tableNameOf(file)] = schema
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// saveCatalog 把当前的数据库和表写进目录文件。调用方持有 db.mutex
+func (db *DB) saveCatalog() error {
+	names := make([]string, 0, len(db.databases))
+	for name := range db.databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]catalogEntry, 0, len(names))
+	for _, name := range names {
+		entry := catalogEntry{name: name, tables: make(map[string]TableSchema)}
+		for tableName, table := range db.databases[name] {
+			entry.tables[tableName] = table.Schema
+		}
+		for _, seq := range db.sequences[name] {
+			entry.sequences = append(entry.sequences, *seq)
+		}
+		sort.Slice(entry.sequences, func(i, j int) bool {
+			return entry.sequences[i].Name < entry.sequences[j].Name
+		})
+		entries = append(entries, entry)
+	}
+	return writeCatalog(db.catalogPath(), entries)
+}
+
+func writeCatalog(path string, entries []catalogEntry) error {
+	body := encodeCatalog(entries)
+	buf := make([]byte, catalogHeaderSize, catalogHeaderSize+len(body))
+	copy(buf, catalogMagic)
+	binary.LittleEndian.PutUint16(buf[8:], catalogVersion)
+	binary.LittleEndian.PutUint32(buf[10:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(buf[14:], crc32.ChecksumIEEE(body))
+	buf = append(buf, body...)
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := writeAt(file, buf, 0); err != nil {
+		file.Close()
+		return err
+	}
+	if err := syncFile(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+func readCatalog(path string) ([]catalogEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < catalogHeaderSize || string(data[:8]) != catalogMagic {
+		return nil, fmt.Errorf("%s 不是系统目录文件", path)
+	}
+	version := binary.LittleEndian.Uint16(data[8:])
+	if version < 1 || version > catalogVersion {
+		return nil, fmt.Errorf("不支持的系统目录版本 %d", version)
+	}
+	n := int(binary.LittleEndian.Uint32(data[10:]))
+	body := data[catalogHeaderSize:]
+	if n != len(body) || crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[14:]) {
+		return nil, fmt.Errorf("系统目录文件已损坏")
+	}
+	return decodeCatalog(body, version)
+}
+
+// 目录的内容: 数据库个数 uint16，每个数据库为 名字、表个数 uint16，
+// 每张表为 名字、表结构长度 uint16、表结构(和文件头中的相同)、索引个数 uint16，
+// 每个索引为 名字、是否唯一 uint8、列数 uint16、列名，之后是表的约束(版本 1 没有):
+// 主键列数 uint16、列名，每一列的标志 uint8(1 为 not null，2 为自增列)、默认值，check 约束个数 uint16，每个为 名字、条件。
+// 默认值和条件保存成 SQL 文本，没有默认值时为空。最后是外键个数 uint16(版本 3 开始)，每个为 名字、
+// 列数 uint16、列名、被引用的表、被引用的列名、删除和修改时的动作。之后(版本 5 开始)是每一列的长度 uint32、精度 uint8、小数位数 uint8。
+// 每个数据库的表之后是序列个数 uint16(版本 4 开始)，每个为 名字、起始值 int64、增量 int64、预留的个数 int64。
+// 名字和文本都是 长度 uint16 | 内容
+func encodeCatalog(entries []catalogEntry) []byte {
+	buf := binary.LittleEndian.AppendUint16(nil, uint16(len(entries)))
+	for _, entry := range entries {
+		buf = appendName(buf, entry.name)
+		names := make([]string, 0, len(entry.tables))
+		for name := range entry.tables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(names)))
+		for _, name := range names {
+			schema := entry.tables[name]
+			buf = appendName(buf, name)
+			columns := encodeSchema(schema)
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(len(columns)))
+			buf = append(buf, columns...)
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(len(schema.Indexes)))
+			for _, index := range schema.Indexes {
+				buf = appendName(buf, index.Name)
+				unique := byte(0)
+				if index.Unique {
+					unique = 1
+				}
+				buf = append(buf, unique)
+				buf = binary.LittleEndian.AppendUint16(buf, uint16(len(index.Columns)))
+				for _, column := range index.Columns {
+					buf = appendName(buf, column)
+				}
+			}
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(len(schema.PrimaryKey)))
+			for _, column := range schema.PrimaryKey {
+				buf = appendName(buf, column)
+			}
+			for _, col := range schema.Columns {
+				flags := byte(0)
+				if col.NotNull {
+					flags |= 1
+				}
+				if col.AutoIncrement {
+					flags |= 2
+				}
+				buf = append(buf, flags)
+				def := ""
+				if col.Default != nil {
+					def = exprString(col.Default)
+				}
+				buf = appendName(buf, def)
+			}
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(len(schema.Checks)))
+			for _, check := range schema.Checks {
+				buf = appendName(buf, check.Name)
+				buf = appendName(buf, exprString(check.Expr))
+			}
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(len(schema.ForeignKeys)))
+			for _, fk := range schema.ForeignKeys {
+				buf = appendName(buf, fk.Name)
+				buf = binary.LittleEndian.AppendUint16(buf, uint16(len(fk.Columns)))
+				for _, column := range fk.Columns {
+					buf = appendName(buf, column)
+				}
+				buf = appendName(buf, fk.RefTable)
+				for _, column := range fk.RefColumns {
+					buf = appendName(buf, column)
+				}
+				buf = appendName(buf, fk.OnDelete)
+				buf = appendName(buf, fk.OnUpdate)
+			}
+			for _, col := range schema.Columns {
+				buf = binary.LittleEndian.AppendUint32(buf, uint32(col.Length))
+				buf = append(buf, byte(col.Precision), byte(col.Scale))
+			}
+		}
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(entry.sequences)))
+		for _, seq := range entry.sequences {
+			buf = appendName(buf, seq.Name)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(seq.Start))
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(seq.Increment))
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(seq.reserved))
+		}
+	}
+	return buf
+}
+
+func decodeCatalog(buf []byte, version uint16) ([]catalogEntry, error) {
+	r := pageReader{buf: buf}
+	entries := make([]catalogEntry, int(r.uint16()))
+	for i := range entries {
+		entries[i] = catalogEntry{name: readName(&r), tables: make(map[string]TableSchema)}
+		tables := int(r.uint16())
+		for j := 0; j < tables && r.err == nil; j++ {
+			name := readName(&r)
+			schema, err := decodeSchema(r.bytes(int(r.uint16())))
+			if err != nil {
+				return nil, err
+			}
+			indexes := int(r.uint16())
+			for k := 0; k < indexes && r.err == nil; k++ {
+				index := Index{Name: readName(&r), Unique: r.uint8() == 1}
+				columns := int(r.uint16())
+				for c := 0; c < columns && r.err == nil; c++ {
+					index.Columns = append(index.Columns, readName(&r))
+				}
+				schema.Indexes = append(schema.Indexes, index)
+			}
+			if version >= 2 {
+				if err := decodeConstraints(&r, &schema); err != nil {
+					return nil, fmt.Errorf("表 %s 的约束已损坏: %v", name, err)
+				}
+			}
+			if version >= 3 {
+				decodeForeignKeys(&r, &schema)
+			}
+			if version >= 5 {
+				for c := range schema.Columns {
+					schema.Columns[c].Length = int(r.uint32())
+					schema.Columns[c].Precision = int(r.uint8())
+					schema.Columns[c].Scale = int(r.uint8())
+				}
+			}
+			entries[i].tables[name] = schema
+		}
+		if version >= 4 {
+			sequences := int(r.uint16())
+			for j := 0; j < sequences && r.err == nil; j++ {
+				seq := Sequence{Name: readName(&r), Start: int64(r.uint64()), Increment: int64(r.uint64())}
+				seq.reserved = int64(r.uint64())
+				entries[i].sequences = append(entries[i].sequences, seq)
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("系统目录文件已损坏")
+	}
+	return entries, nil
+}
+
+// decodeConstraints 读出一张表的约束，默认值和 check 条件重新解析成表达式
+func decodeConstraints(r *pageReader, schema *TableSchema) error {
+	keys := int(r.uint16())
+	for k := 0; k < keys && r.err == nil; k++ {
+		schema.PrimaryKey = append(schema.PrimaryKey, readName(r))
+	}
+	for c := range schema.Columns {
+		flags := r.uint8()
+		schema.Columns[c].NotNull = flags&1 != 0
+		schema.Columns[c].AutoIncrement = flags&2 != 0
+		if def := readName(r); def != "" && r.err == nil {
+			expr, err := ParseExpr(def)
+			if err != nil {
+				return err
+			}
+			schema.Columns[c].Default = expr
+		}
+	}
+	checks := int(r.uint16())
+	for k := 0; k < checks && r.err == nil; k++ {
+		check := Check{Name: readName(r)}
+		expr, err := ParseExpr(readName(r))
+		if r.err != nil {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		check.Expr = expr
+		schema.Checks = append(schema.Checks, check)
+	}
+	return r.err
+}
+
+// decodeForeignKeys 读出一张表的外键
+func decodeForeignKeys(r *pageReader, schema *TableSchema) {
+	fks := int(r.uint16())
+	for k := 0; k < fks && r.err == nil; k++ {
+		fk := ForeignKey{Name: readName(r)}
+		columns := int(r.uint16())
+		for c := 0; c < columns && r.err == nil; c++ {
+			fk.Columns = append(fk.Columns, readName(r))
+		}
+		fk.RefTable = readName(r)
+		for c := 0; c < columns && r.err == nil; c++ {
+			fk.RefColumns = append(fk.RefColumns, readName(r))
+		}
+		fk.OnDelete = readName(r)
+		fk.OnUpdate = readName(r)
+		schema.ForeignKeys = append(schema.ForeignKeys, fk)
+	}
+}
+
+func appendName(buf []byte, name string) []byte {
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(name)))
+	return append(buf, name...)
+}
+
+func readName(r *pageReader) string {
+	return string(r.bytes(int(r.uint16())))
+}
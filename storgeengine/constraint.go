@@ -0,0 +1,178 @@
+package storgeengine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 表上的约束: 主键、not null、unique、default、check 和外键。自增列见 sequence.go。建表时检查约束的定义并生成表结构，
+// 写入一行之前先把值转换成列的类型(见 types.go)，再检查 not null 和 check；主键由 b+树保证不重复，unique 约束是一个唯一索引，外键见 foreignkey.go
+
+// tableSchema 根据建表语句生成表结构
+func tableSchema(s *CreateTableStmt) (TableSchema, error) {
+	var schema TableSchema
+	for _, def := range s.Columns {
+		if schema.columnIndex(def.Name) >= 0 {
+			return TableSchema{}, fmt.Errorf("列 %s 重复", def.Name)
+		}
+		col := Column{
+			Name: def.Name, Type: def.Type, NotNull: def.NotNull, Default: def.Default, AutoIncrement: def.AutoIncrement,
+			Length: def.Length, Precision: def.Precision, Scale: def.Scale,
+		}
+		if col.Default != nil {
+			if err := checkDefault(col); err != nil {
+				return TableSchema{}, err
+			}
+		}
+		schema.Columns = append(schema.Columns, col)
+	}
+
+	for _, c := range s.Constraints {
+		if c.Kind == "CHECK" {
+			if err := checkColumns(c.Check, schema); err != nil {
+				return TableSchema{}, err
+			}
+			if hasAggregate(c.Check) {
+				return TableSchema{}, fmt.Errorf("check 约束中不能使用聚合函数")
+			}
+			name := c.Name
+			if name == "" {
+				name = fmt.Sprintf("%s_CHECK%d", s.Name, len(schema.Checks)+1)
+			}
+			schema.Checks = append(schema.Checks, Check{Name: name, Expr: c.Check})
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, column := range c.Columns {
+			if schema.columnIndex(column) < 0 {
+				return TableSchema{}, fmt.Errorf("未知的列 %s", column)
+			}
+			if seen[column] {
+				return TableSchema{}, fmt.Errorf("约束中的列 %s 重复", column)
+			}
+			seen[column] = true
+		}
+		if c.Kind == "FOREIGN KEY" {
+			name := c.Name
+			if name == "" {
+				name = s.Name + "_" + strings.Join(c.Columns, "_") + "_FKEY"
+			}
+			schema.ForeignKeys = append(schema.ForeignKeys, ForeignKey{
+				Name: name, Columns: c.Columns, RefTable: c.RefTable, RefColumns: c.RefColumns,
+				OnDelete: actionOrDefault(c.OnDelete), OnUpdate: actionOrDefault(c.OnUpdate),
+			})
+			continue
+		}
+		if c.Kind == "PRIMARY KEY" {
+			if schema.PrimaryKey != nil {
+				return TableSchema{}, fmt.Errorf("表 %s 只能有一个主键", s.Name)
+			}
+			schema.PrimaryKey = c.Columns
+			for _, column := range c.Columns {
+				schema.Columns[schema.columnIndex(column)].NotNull = true
+			}
+			continue
+		}
+		name := c.Name
+		if name == "" {
+			name = s.Name + "_" + strings.Join(c.Columns, "_") + "_KEY"
+			for i := 2; schema.hasIndex(name); i++ {
+				name = fmt.Sprintf("%s_%s_KEY%d", s.Name, strings.Join(c.Columns, "_"), i)
+			}
+		}
+		if schema.hasIndex(name) {
+			return TableSchema{}, fmt.Errorf("索引 %s 已经存在", name)
+		}
+		schema.Indexes = append(schema.Indexes, Index{Name: name, Columns: c.Columns, Unique: true})
+	}
+	if err := schema.checkAutoIncrement(); err != nil {
+		return TableSchema{}, err
+	}
+	return schema, nil
+}
+
+// checkDefault 默认值必须是常量表达式，建表时先计算一次，结果要能转换成列的类型
+func checkDefault(col Column) error {
+	var err error
+	walkExpr(col.Default, func(e Expr) {
+		if _, ok := e.(*ColumnRef); ok {
+			err = fmt.Errorf("列 %s 的默认值必须是常量", col.Name)
+		}
+	})
+	if err == nil && hasAggregate(col.Default) {
+		err = fmt.Errorf("列 %s 的默认值不能使用聚合函数", col.Name)
+	}
+	if err != nil {
+		return err
+	}
+	value, err := evalExpr(col.Default, nil)
+	if err != nil {
+		return fmt.Errorf("列 %s 的默认值无效: %v", col.Name, err)
+	}
+	_, err = col.coerce(value)
+	return err
+}
+
+// hasIndex 表结构中是否已经有名为 name 的索引
+func (schema TableSchema) hasIndex(name string) bool {
+	for _, index := range schema.Indexes {
+		if index.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fillDefaults 插入的行中没有给出的列填上默认值
+func (table *BPTable) fillDefaults(row map[string]interface{}) error {
+	for _, col := range table.Schema.Columns {
+		if _, ok := row[col.Name]; ok || col.Default == nil {
+			continue
+		}
+		value, err := evalExpr(col.Default, nil)
+		if err != nil {
+			return fmt.Errorf("列 %s 的默认值无效: %v", col.Name, err)
+		}
+		row[col.Name] = value
+	}
+	return nil
+}
+
+// coerceRow 检查行中的列都在表中，并把每一列的值转换成列的类型
+func (table *BPTable) coerceRow(row map[string]interface{}) error {
+	for name, value := range row {
+		i := table.Schema.columnIndex(name)
+		if i < 0 {
+			return fmt.Errorf("未知的列 %s", name)
+		}
+		converted, err := table.Schema.Columns[i].coerce(value)
+		if err != nil {
+			return err
+		}
+		row[name] = converted
+	}
+	return nil
+}
+
+// checkRow 写入一行之前检查 not null 和 check 约束
+func (table *BPTable) checkRow(row map[string]interface{}) error {
+	for _, col := range table.Schema.Columns {
+		if col.NotNull && row[col.Name] == nil {
+			return errorOf(ErrNotNullViolation, "列 %s 不能为 NULL", col.Name)
+		}
+	}
+	for _, check := range table.Schema.Checks {
+		value, err := evalExpr(check.Expr, row)
+		if err != nil {
+			return fmt.Errorf("检查约束 %s 失败: %v", check.Name, err)
+		}
+		b, err := toBool(value)
+		if err != nil {
+			return fmt.Errorf("检查约束 %s 失败: %v", check.Name, err)
+		}
+		if b != nil && !*b {
+			return errorOf(ErrCheckViolation, "违反 check 约束 %s: %s", check.Name, exprString(check.Expr))
+		}
+	}
+	return nil
+}
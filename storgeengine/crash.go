@@ -0,0 +1,54 @@
+package storgeengine
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+)
+
+// 崩溃测试: 设置环境变量 ALIANGSQL_CRASH_AT=N 后，进程在第 N 次写文件或落盘时直接退出，
+// 写文件时只写入前一半，模拟写到一半断电。tools/crashtest 用它在任意位置注入崩溃
+const CrashExitCode = 86
+
+var (
+	crashAt    = crashSetting()
+	crashCount int64
+)
+
+func crashSetting() int64 {
+	n, _ := strconv.ParseInt(os.Getenv("ALIANGSQL_CRASH_AT"), 10, 64)
+	return n
+}
+
+// crashPoint 到达第 N 次时返回 true
+func crashPoint() bool {
+	return crashAt > 0 && atomic.AddInt64(&crashCount, 1) == crashAt
+}
+
+// writeAt 数据文件、回滚日志和 WAL 都通过它写文件
+func writeAt(file *os.File, buf []byte, off int64) error {
+	if crashPoint() {
+		file.WriteAt(buf[:len(buf)/2], off)
+		os.Exit(CrashExitCode)
+	}
+	_, err := file.WriteAt(buf, off)
+	return err
+}
+
+func syncFile(file *os.File) error {
+	if crashPoint() {
+		os.Exit(CrashExitCode)
+	}
+	return file.Sync()
+}
+
+// syncDir 新建、删除或重命名文件后把目录落盘
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return syncFile(dir)
+}
@@ -0,0 +1,43 @@
+package storgeengine
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorKind 执行语句出错的种类，协议层按它给出 SQLSTATE 之类的错误码
+type ErrorKind int
+
+const (
+	ErrOther               ErrorKind = iota
+	ErrUniqueViolation               // 主键或唯一索引的值重复
+	ErrForeignKeyViolation           // 违反外键约束
+	ErrNotNullViolation              // not null 的列是 NULL
+	ErrCheckViolation                // 违反 check 约束
+	ErrSerialization                 // 行在事务开始后已被其他事务修改
+	ErrUndefinedTable                // 表或序列不存在
+	ErrUndefinedDatabase             // 数据库不存在
+)
+
+// Error 带种类的执行错误，Error() 和 fmt.Errorf 得到的文本一样
+type Error struct {
+	Kind ErrorKind
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func errorOf(kind ErrorKind, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+// KindOf 错误的种类，不是 *Error 时为 ErrOther
+func KindOf(err error) ErrorKind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return ErrOther
+}
@@ -0,0 +1,195 @@
+package storgeengine
+
+import (
+	"fmt"
+)
+
+// Execute 在数据库默认的会话中执行一条已经解析好的语句
+func (db *DB) Execute(stmt Statement) SQLResult {
+	return db.session.Execute(stmt)
+}
+
+// Execute 在会话中执行一条已经解析好的语句。读写数据文件出错时 b+树会 panic，这里转换成错误返回
+func (sess *Session) Execute(stmt Statement) (result SQLResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			err, ok := r.(storageError)
+			if !ok {
+				panic(r)
+			}
+			result = SQLResult{Error: err}
+		}
+	}()
+
+	db := sess.db
+	switch s := stmt.(type) {
+	case *ExitStmt:
+		return SQLResult{}
+	case *UseStmt:
+		return sess.execUse(s)
+	case *HelpStmt:
+		return db.GetHelp()
+	case *CreateDatabaseStmt:
+		return sess.execCreateDatabase(s)
+	case *CreateTableStmt:
+		return sess.execCreateTable(s)
+	case *CreateIndexStmt:
+		return SQLResult{Error: db.CreateIndex(sess.database, s.Table, Index{Name: s.Name, Columns: s.Columns, Unique: s.Unique})}
+	case *DropIndexStmt:
+		return SQLResult{Error: db.DropIndex(sess.database, s.Table, s.Name)}
+	case *CreateSequenceStmt:
+		return SQLResult{Error: db.CreateSequence(sess.database, s.Name, s.Start, s.Increment)}
+	case *DropSequenceStmt:
+		return SQLResult{Error: db.DropSequence(sess.database, s.Name)}
+	case *InsertStmt:
+		return sess.execInsert(s)
+	case *UpdateStmt:
+		return sess.execUpdate(s)
+	case *DeleteStmt:
+		return sess.execDelete(s)
+	case *SelectStmt:
+		return sess.execSelect(s)
+	case *BeginStmt:
+		return SQLResult{Error: sess.begin()}
+	case *CommitStmt:
+		return SQLResult{Error: sess.commit()}
+	case *RollbackStmt:
+		return SQLResult{Error: sess.rollback()}
+	case *SetStmt:
+		return SQLResult{Error: sess.set(s)}
+	default:
+		return SQLResult{Error: fmt.Errorf("无效的语句")}
+	}
+}
+
+func (sess *Session) execUse(s *UseStmt) SQLResult {
+	if err := sess.Use(s.Database); err != nil {
+		return SQLResult{Error: err}
+	}
+	fmt.Printf("切换到数据库 %s\n", s.Database)
+	return SQLResult{Result: fmt.Sprintf("切换到数据库 %s", s.Database)}
+}
+
+// execCreateDatabase 新建的数据库成为会话的当前数据库
+func (sess *Session) execCreateDatabase(s *CreateDatabaseStmt) SQLResult {
+	created, err := sess.db.createDatabase(s.Name)
+	if err != nil {
+		return SQLResult{Error: err}
+	}
+	if created {
+		sess.database = s.Name
+	}
+	return SQLResult{}
+}
+
+func (sess *Session) execCreateTable(s *CreateTableStmt) SQLResult {
+	schema, err := tableSchema(s)
+	if err != nil {
+		return SQLResult{Error: err}
+	}
+	if err := sess.db.CreateTable(sess.database, s.Name, schema); err != nil {
+		return SQLResult{Error: err}
+	}
+	return SQLResult{}
+}
+
+func (sess *Session) execInsert(s *InsertStmt) SQLResult {
+	if len(s.Columns) != len(s.Values) {
+		return SQLResult{Error: fmt.Errorf("列的数量和值的数量不匹配")}
+	}
+	data := make(map[string]interface{})
+	for i, column := range s.Columns {
+		expr, err := sess.bindSequences(s.Values[i])
+		if err != nil {
+			return SQLResult{Error: err}
+		}
+		value, err := constValue(expr)
+		if err != nil {
+			return SQLResult{Error: err}
+		}
+		data[column] = value
+	}
+	var id int64
+	err := sess.write(func(tx *txn) (err error) {
+		id, err = sess.db.insertRow(tx, sess.database, s.Table, data)
+		return err
+	})
+	if err != nil {
+		return SQLResult{Error: err}
+	}
+	return SQLResult{Result: &InsertResult{RowsAffected: 1, LastInsertID: id}}
+}
+
+func (sess *Session) execUpdate(s *UpdateStmt) SQLResult {
+	s, err := sess.bindUpdate(s)
+	if err != nil {
+		return SQLResult{Error: err}
+	}
+	var count int
+	err = sess.write(func(tx *txn) (err error) {
+		count, err = sess.db.UpdateWhere(tx, sess.database, s.Table, s.Set, s.Where)
+		return err
+	})
+	if err != nil {
+		return SQLResult{Error: err}
+	}
+	fmt.Println("更新成功")
+	return SQLResult{Result: &AffectedResult{RowsAffected: count}}
+}
+
+func (sess *Session) execDelete(s *DeleteStmt) SQLResult {
+	var count int
+	err := sess.write(func(tx *txn) (err error) {
+		count, err = sess.db.DeleteWhere(tx, sess.database, s.Table, s.Where)
+		return err
+	})
+	if err != nil {
+		return SQLResult{Error: err}
+	}
+	return SQLResult{Result: &AffectedResult{RowsAffected: count}}
+}
+
+func (sess *Session) execSelect(s *SelectStmt) SQLResult {
+	s, err := sess.bindSelect(s)
+	if err != nil {
+		return SQLResult{Error: err}
+	}
+	rs, err := sess.db.query(sess.read(), sess.database, s)
+	if err != nil {
+		return SQLResult{Error: err}
+	}
+	return SQLResult{Result: rs}
+}
+
+// Stream 执行 select 语句，结果不放在内存中: 先把列名和类型交给 header(Rows 为空)，再把每一行交给 out。
+// 没有 order by 或者只按主键排序时一边扫描一边交出行，否则排好序之后再交出。header 或 out 返回错误时停止查询，
+// 返回这个错误
+func (sess *Session) Stream(s *SelectStmt, header func(*ResultSet) error, out func([]interface{}) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			storageErr, ok := r.(storageError)
+			if !ok {
+				panic(r)
+			}
+			err = storageErr
+		}
+	}()
+	if s, err = sess.bindSelect(s); err != nil {
+		return err
+	}
+	return sess.db.stream(sess.read(), sess.database, s, header, out)
+}
+
+// 计算不引用任何列的常量表达式
+func constValue(expr Expr) (interface{}, error) {
+	var err error
+	walkExpr(expr, func(e Expr) {
+		if _, ok := e.(*ColumnRef); ok {
+			err = fmt.Errorf("值必须是常量")
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return evalExpr(expr, nil)
+}
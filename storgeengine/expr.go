@@ -0,0 +1,696 @@
+package storgeengine
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Row 一行数据，列名 -> 值
+type Row map[string]interface{}
+
+// evalExpr 在一行数据上计算表达式的值。
+// NULL 用 nil 表示，比较和逻辑运算遵循 SQL 的三值逻辑，结果为 nil 表示 UNKNOWN
+func evalExpr(expr Expr, row Row) (interface{}, error) {
+	switch e := expr.(type) {
+	case *Literal:
+		return e.Value, nil
+	case *ColumnRef:
+		value, ok := row[e.Name]
+		if !ok {
+			return nil, nil
+		}
+		return value, nil
+	case *UnaryExpr:
+		return evalUnary(e, row)
+	case *BinaryExpr:
+		return evalBinary(e, row)
+	case *BetweenExpr:
+		return evalBetween(e, row)
+	case *InExpr:
+		return evalIn(e, row)
+	case *LikeExpr:
+		return evalLike(e, row)
+	case *IsNullExpr:
+		value, err := evalExpr(e.Expr, row)
+		if err != nil {
+			return nil, err
+		}
+		return (value == nil) != e.Not, nil
+	case *FuncCall:
+		if !isAggregate(e) {
+			return nil, fmt.Errorf("未知的函数 %s", e.Name)
+		}
+		// 聚合函数的值在分组时已经算好，放在分组行中
+		value, ok := row[aggregateKey(e)]
+		if !ok {
+			return nil, fmt.Errorf("聚合函数 %s 不能用在这里", exprString(e))
+		}
+		return value, nil
+	}
+	return nil, fmt.Errorf("无法计算的表达式 %T", expr)
+}
+
+// exprType 表达式的值的类型，和 evalExpr 的规则一致，不需要读数据。
+// 值可能是不同类型(例如字符串参与算术运算)或者是 NULL 常量时为 UnknownType
+func exprType(expr Expr, schema TableSchema) ColumnType {
+	switch e := expr.(type) {
+	case *Literal:
+		return valueType(e.Value)
+	case *ColumnRef:
+		if i := schema.columnIndex(e.Name); i >= 0 {
+			return schema.Columns[i].Type
+		}
+	case *UnaryExpr:
+		if e.Op == "NOT" {
+			return BoolType
+		}
+		if t := exprType(e.Expr, schema); t == IntType || t == FloatType || t == DecimalType {
+			return t
+		}
+	case *BinaryExpr:
+		switch e.Op {
+		case "+", "-", "*", "/", "%":
+			return arithmeticType(exprType(e.Left, schema), exprType(e.Right, schema))
+		}
+		return BoolType
+	case *BetweenExpr, *InExpr, *LikeExpr, *IsNullExpr:
+		return BoolType
+	case *FuncCall:
+		if _, ok := sequenceCall(e); ok || e.Name == "COUNT" {
+			return IntType
+		}
+		if len(e.Args) != 1 {
+			break
+		}
+		switch arg := exprType(e.Args[0], schema); e.Name {
+		case "SUM":
+			return arithmeticType(arg, IntType)
+		case "AVG":
+			// 整数的平均值是浮点数
+			if t := arithmeticType(arg, IntType); t != IntType {
+				return t
+			}
+			return FloatType
+		case "MIN", "MAX":
+			return arg
+		}
+	}
+	return UnknownType
+}
+
+// valueType 值所属的列类型，NULL 为 UnknownType
+func valueType(value interface{}) ColumnType {
+	switch value.(type) {
+	case int64:
+		return IntType
+	case float64:
+		return FloatType
+	case string:
+		return StringType
+	case bool:
+		return BoolType
+	case Decimal:
+		return DecimalType
+	case Date:
+		return DateType
+	case time.Time:
+		return TimestampType
+	case []byte:
+		return BlobType
+	}
+	return UnknownType
+}
+
+// arithmeticType 算术运算结果的类型，和 arithmetic 一样: 有浮点数时是 FLOAT，都是整数(BOOL 当作整数)时是 INT，
+// 否则是 DECIMAL。字符串要看内容才知道是什么数字
+func arithmeticType(a, b ColumnType) ColumnType {
+	numeric := func(t ColumnType) bool {
+		return t == IntType || t == BoolType || t == FloatType || t == DecimalType
+	}
+	switch {
+	case !numeric(a) || !numeric(b):
+		return UnknownType
+	case a == FloatType || b == FloatType:
+		return FloatType
+	case (a == IntType || a == BoolType) && (b == IntType || b == BoolType):
+		return IntType
+	}
+	return DecimalType
+}
+
+// walkExpr 先序遍历表达式树
+func walkExpr(expr Expr, fn func(Expr)) {
+	if expr == nil {
+		return
+	}
+	fn(expr)
+	for _, child := range exprChildren(expr) {
+		walkExpr(child, fn)
+	}
+}
+
+// exprChildren 表达式的直接子表达式
+func exprChildren(expr Expr) []Expr {
+	switch e := expr.(type) {
+	case *UnaryExpr:
+		return []Expr{e.Expr}
+	case *BinaryExpr:
+		return []Expr{e.Left, e.Right}
+	case *BetweenExpr:
+		return []Expr{e.Expr, e.Low, e.High}
+	case *InExpr:
+		return append([]Expr{e.Expr}, e.List...)
+	case *LikeExpr:
+		return []Expr{e.Expr, e.Pattern}
+	case *IsNullExpr:
+		return []Expr{e.Expr}
+	case *FuncCall:
+		return e.Args
+	}
+	return nil
+}
+
+// rewriteExpr 自底向上重建表达式树，fn 可以替换其中的任意节点
+func rewriteExpr(expr Expr, fn func(Expr) (Expr, error)) (Expr, error) {
+	if expr == nil {
+		return nil, nil
+	}
+	children := exprChildren(expr)
+	rewritten := make([]Expr, len(children))
+	for i, child := range children {
+		var err error
+		if rewritten[i], err = rewriteExpr(child, fn); err != nil {
+			return nil, err
+		}
+	}
+	switch e := expr.(type) {
+	case *UnaryExpr:
+		expr = &UnaryExpr{Op: e.Op, Expr: rewritten[0]}
+	case *BinaryExpr:
+		expr = &BinaryExpr{Op: e.Op, Left: rewritten[0], Right: rewritten[1]}
+	case *BetweenExpr:
+		expr = &BetweenExpr{Expr: rewritten[0], Low: rewritten[1], High: rewritten[2], Not: e.Not}
+	case *InExpr:
+		expr = &InExpr{Expr: rewritten[0], List: rewritten[1:], Not: e.Not}
+	case *LikeExpr:
+		expr = &LikeExpr{Expr: rewritten[0], Pattern: rewritten[1], Not: e.Not}
+	case *IsNullExpr:
+		expr = &IsNullExpr{Expr: rewritten[0], Not: e.Not}
+	case *FuncCall:
+		expr = &FuncCall{Name: e.Name, Args: rewritten, Star: e.Star, Distinct: e.Distinct}
+	}
+	return fn(expr)
+}
+
+// exprString 把表达式还原成 SQL 文本，用作结果集的列名
+func exprString(expr Expr) string {
+	switch e := expr.(type) {
+	case *Literal:
+		switch v := e.Value.(type) {
+		case string:
+			return quoteString(v)
+		case bool:
+			return strings.ToUpper(toString(v))
+		case Date:
+			return "DATE " + quoteString(v.String())
+		case time.Time:
+			return "TIMESTAMP " + quoteString(formatTime(v))
+		case []byte:
+			return "X'" + hex.EncodeToString(v) + "'"
+		}
+		return formatValue(e.Value)
+	case *ColumnRef:
+		if e.Table != "" {
+			return e.Table + "." + e.Name
+		}
+		return e.Name
+	case *UnaryExpr:
+		if e.Op == "NOT" {
+			return "NOT " + operandString(e.Expr)
+		}
+		return e.Op + operandString(e.Expr)
+	case *BinaryExpr:
+		return operandString(e.Left) + " " + e.Op + " " + operandString(e.Right)
+	case *BetweenExpr:
+		return exprString(e.Expr) + notString(e.Not) + " BETWEEN " + exprString(e.Low) + " AND " + exprString(e.High)
+	case *InExpr:
+		items := make([]string, len(e.List))
+		for i, item := range e.List {
+			items[i] = exprString(item)
+		}
+		return exprString(e.Expr) + notString(e.Not) + " IN (" + strings.Join(items, ", ") + ")"
+	case *LikeExpr:
+		return exprString(e.Expr) + notString(e.Not) + " LIKE " + exprString(e.Pattern)
+	case *IsNullExpr:
+		return exprString(e.Expr) + " IS" + notString(e.Not) + " NULL"
+	case *FuncCall:
+		if e.Star {
+			return e.Name + "(*)"
+		}
+		args := make([]string, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = exprString(arg)
+		}
+		if e.Distinct {
+			return e.Name + "(DISTINCT " + strings.Join(args, ", ") + ")"
+		}
+		return e.Name + "(" + strings.Join(args, ", ") + ")"
+	}
+	return fmt.Sprintf("%T", expr)
+}
+
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// 嵌套的复合表达式加上括号
+func operandString(expr Expr) string {
+	switch expr.(type) {
+	case *Literal, *ColumnRef, *FuncCall:
+		return exprString(expr)
+	}
+	return "(" + exprString(expr) + ")"
+}
+
+func notString(not bool) string {
+	if not {
+		return " NOT"
+	}
+	return ""
+}
+
+// evalPredicate 计算 where 条件，只有结果为 TRUE 时才返回 true
+func evalPredicate(expr Expr, row Row) (bool, error) {
+	if expr == nil {
+		return true, nil
+	}
+	value, err := evalExpr(expr, row)
+	if err != nil {
+		return false, err
+	}
+	b, err := toBool(value)
+	if err != nil {
+		return false, err
+	}
+	return b != nil && *b, nil
+}
+
+// 转换成三值逻辑，nil 表示 UNKNOWN
+func toBool(value interface{}) (*bool, error) {
+	var b bool
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		b = v
+	case int64:
+		b = v != 0
+	case float64:
+		b = v != 0
+	case Decimal:
+		b = v.sign() != 0
+	default:
+		return nil, fmt.Errorf("%v 不是布尔值", value)
+	}
+	return &b, nil
+}
+
+func evalUnary(e *UnaryExpr, row Row) (interface{}, error) {
+	value, err := evalExpr(e.Expr, row)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	switch e.Op {
+	case "NOT":
+		b, err := toBool(value)
+		if err != nil || b == nil {
+			return nil, err
+		}
+		return !*b, nil
+	case "-":
+		switch v := value.(type) {
+		case int64:
+			if v == math.MinInt64 {
+				return nil, fmt.Errorf("整数 -(%d) 超出范围", v)
+			}
+			return -v, nil
+		case float64:
+			return -v, nil
+		case Decimal:
+			return v.neg(), nil
+		}
+		return nil, fmt.Errorf("无法对 %v 取负", value)
+	}
+	return nil, fmt.Errorf("未知的运算符 %s", e.Op)
+}
+
+func evalBinary(e *BinaryExpr, row Row) (interface{}, error) {
+	if e.Op == "AND" || e.Op == "OR" {
+		return evalLogic(e, row)
+	}
+	left, err := evalExpr(e.Left, row)
+	if err != nil {
+		return nil, err
+	}
+	right, err := evalExpr(e.Right, row)
+	if err != nil {
+		return nil, err
+	}
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	switch e.Op {
+	case "=", "<>", "<", "<=", ">", ">=":
+		c, err := compareValues(left, right)
+		if err != nil {
+			return nil, err
+		}
+		switch e.Op {
+		case "=":
+			return c == 0, nil
+		case "<>":
+			return c != 0, nil
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		default:
+			return c >= 0, nil
+		}
+	case "+", "-", "*", "/", "%":
+		return arithmetic(e.Op, left, right)
+	}
+	return nil, fmt.Errorf("未知的运算符 %s", e.Op)
+}
+
+// AND / OR 的三值逻辑，左边能决定结果时不再计算右边
+func evalLogic(e *BinaryExpr, row Row) (interface{}, error) {
+	leftValue, err := evalExpr(e.Left, row)
+	if err != nil {
+		return nil, err
+	}
+	left, err := toBool(leftValue)
+	if err != nil {
+		return nil, err
+	}
+	if left != nil && *left == (e.Op == "OR") {
+		return *left, nil
+	}
+	rightValue, err := evalExpr(e.Right, row)
+	if err != nil {
+		return nil, err
+	}
+	right, err := toBool(rightValue)
+	if err != nil {
+		return nil, err
+	}
+	if right != nil && *right == (e.Op == "OR") {
+		return *right, nil
+	}
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	return *left, nil
+}
+
+func evalBetween(e *BetweenExpr, row Row) (interface{}, error) {
+	// a BETWEEN b AND c 等价于 a >= b AND a <= c
+	var expr Expr = &BinaryExpr{
+		Op:    "AND",
+		Left:  &BinaryExpr{Op: ">=", Left: e.Expr, Right: e.Low},
+		Right: &BinaryExpr{Op: "<=", Left: e.Expr, Right: e.High},
+	}
+	if e.Not {
+		expr = &UnaryExpr{Op: "NOT", Expr: expr}
+	}
+	return evalExpr(expr, row)
+}
+
+func evalIn(e *InExpr, row Row) (interface{}, error) {
+	value, err := evalExpr(e.Expr, row)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	sawNull := false
+	for _, item := range e.List {
+		candidate, err := evalExpr(item, row)
+		if err != nil {
+			return nil, err
+		}
+		if candidate == nil {
+			sawNull = true
+			continue
+		}
+		c, err := compareValues(value, candidate)
+		if err != nil {
+			return nil, err
+		}
+		if c == 0 {
+			return !e.Not, nil
+		}
+	}
+	// 列表中有 NULL 且没有匹配时结果是 UNKNOWN
+	if sawNull {
+		return nil, nil
+	}
+	return e.Not, nil
+}
+
+func evalLike(e *LikeExpr, row Row) (interface{}, error) {
+	value, err := evalExpr(e.Expr, row)
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := evalExpr(e.Pattern, row)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil || pattern == nil {
+		return nil, nil
+	}
+	matched := likeMatch([]rune(toString(value)), []rune(toString(pattern)))
+	return matched != e.Not, nil
+}
+
+// likeMatch % 匹配任意多个字符，_ 匹配一个字符，\ 转义
+func likeMatch(s, p []rune) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case '%':
+			for len(p) > 0 && p[0] == '%' {
+				p = p[1:]
+			}
+			if len(p) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if likeMatch(s[i:], p) {
+					return true
+				}
+			}
+			return false
+		case '_':
+			if len(s) == 0 {
+				return false
+			}
+		case '\\':
+			if len(p) > 1 {
+				p = p[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != p[0] {
+				return false
+			}
+		}
+		s, p = s[1:], p[1:]
+	}
+	return len(s) == 0
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case time.Time:
+		return formatTime(v)
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// 数字和字符串比较时，尝试把字符串转换成数字。布尔值当作 0 和 1，DECIMAL 保持 Decimal
+func toNumber(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case int64, float64, Decimal:
+		return v, true
+	case bool:
+		return boolInt(v), true
+	case string:
+		if i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			return i, true
+		}
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	case Decimal:
+		return v.float64()
+	}
+	return math.NaN()
+}
+
+// isFloat 数字中有没有浮点数，有时按浮点数计算，否则整数和 DECIMAL 按 DECIMAL 精确计算
+func isFloat(a, b interface{}) bool {
+	_, af := a.(float64)
+	_, bf := b.(float64)
+	return af || bf
+}
+
+// compareValues 比较两个非 NULL 的值，返回 -1、0、1。字符串和二进制按字节比较，
+// 日期和时间可以和能解析成时间的字符串比较，其余的按数字比较
+func compareValues(a, b interface{}) (int, error) {
+	switch av := a.(type) {
+	case string:
+		switch bv := b.(type) {
+		case string:
+			return strings.Compare(av, bv), nil
+		case []byte:
+			return bytes.Compare([]byte(av), bv), nil
+		}
+	case []byte:
+		switch bv := b.(type) {
+		case []byte:
+			return bytes.Compare(av, bv), nil
+		case string:
+			return bytes.Compare(av, []byte(bv)), nil
+		}
+	}
+	if isTime(a) || isTime(b) {
+		at, aok := toTime(a)
+		bt, bok := toTime(b)
+		if !aok || !bok {
+			return 0, fmt.Errorf("无法比较 %v 和 %v", a, b)
+		}
+		return at.Compare(bt), nil
+	}
+	an, aok := toNumber(a)
+	bn, bok := toNumber(b)
+	if !aok || !bok {
+		return 0, fmt.Errorf("无法比较 %v 和 %v", a, b)
+	}
+	if ai, ok := an.(int64); ok {
+		if bi, ok := bn.(int64); ok {
+			switch {
+			case ai < bi:
+				return -1, nil
+			case ai > bi:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	if !isFloat(an, bn) {
+		return toDecimal(an).cmp(toDecimal(bn)), nil
+	}
+	af, bf := toFloat(an), toFloat(bn)
+	switch {
+	case af < bf:
+		return -1, nil
+	case af > bf:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func arithmetic(op string, a, b interface{}) (interface{}, error) {
+	an, aok := toNumber(a)
+	bn, bok := toNumber(b)
+	if !aok || !bok {
+		return nil, fmt.Errorf("无法计算 %v %s %v", a, op, b)
+	}
+	ai, aInt := an.(int64)
+	bi, bInt := bn.(int64)
+	if aInt && bInt {
+		return intArithmetic(op, ai, bi)
+	}
+	if !isFloat(an, bn) {
+		return decimalArithmetic(op, toDecimal(an), toDecimal(bn))
+	}
+	af, bf := toFloat(an), toFloat(bn)
+	switch op {
+	case "+":
+		return af + bf, nil
+	case "-":
+		return af - bf, nil
+	case "*":
+		return af * bf, nil
+	case "/":
+		if bf == 0 {
+			return nil, fmt.Errorf("除数不能为 0")
+		}
+		return af / bf, nil
+	case "%":
+		if bf == 0 {
+			return nil, fmt.Errorf("除数不能为 0")
+		}
+		return math.Mod(af, bf), nil
+	}
+	return nil, fmt.Errorf("未知的运算符 %s", op)
+}
+
+// intArithmetic 两个整数的 + - * / %，结果超出 int64 时返回错误，不会回绕成错误的值
+func intArithmetic(op string, a, b int64) (int64, error) {
+	var r int64
+	ok := true
+	switch op {
+	case "+":
+		r = a + b
+		// 两个数同号而结果和它们异号时溢出
+		ok = (a^r)&(b^r) >= 0
+	case "-":
+		r = a - b
+		ok = (a^b)&(a^r) >= 0
+	case "*":
+		r = a * b
+		ok = a == 0 || (r/a == b && !(a == -1 && b == math.MinInt64))
+	case "/", "%":
+		if b == 0 {
+			return 0, fmt.Errorf("除数不能为 0")
+		}
+		if a == math.MinInt64 && b == -1 {
+			ok = op == "%"
+		} else if op == "/" {
+			r = a / b
+		} else {
+			r = a % b
+		}
+	default:
+		return 0, fmt.Errorf("未知的运算符 %s", op)
+	}
+	if !ok {
+		return 0, fmt.Errorf("整数 %d %s %d 超出范围", a, op, b)
+	}
+	return r, nil
+}
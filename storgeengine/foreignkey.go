@@ -0,0 +1,328 @@
+package storgeengine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 外键: 写入引用别的表的行时检查被引用的行存在；删除或修改被引用的行时按外键的动作处理引用它的行:
+//
+//	RESTRICT   立即报错
+//	NO ACTION  语句结束时还有行引用已经不存在的值才报错(默认)
+//	CASCADE    删除时一起删除，修改时把引用的值改成新的值
+//	SET NULL   把引用的列改成 NULL
+//
+// 级联的修改和原来的修改在同一个事务中用 writeRow 写入，语句出错时一起撤销
+
+// fkCheck 推迟到语句结束时检查的外键: 表 child 中引用 values 的行
+type fkCheck struct {
+	child  *BPTable
+	fk     ForeignKey
+	values []interface{}
+}
+
+// actionOrDefault 没有写动作时是 NO ACTION
+func actionOrDefault(action string) string {
+	if action == "" {
+		return "NO ACTION"
+	}
+	return action
+}
+
+// resolveForeignKeys 建表时检查外键: 被引用的表在同一个数据库 database 中，被引用的列是它的主键或有唯一约束，
+// 两边的列类型相同；省略被引用的列时使用主键。调用方持有 db.mutex
+func (db *DB) resolveForeignKeys(database, tableName string, schema *TableSchema) error {
+	for i := range schema.ForeignKeys {
+		fk := &schema.ForeignKeys[i]
+		ref := schema
+		if fk.RefTable != tableName {
+			table, exists := db.databases[database][fk.RefTable]
+			if !exists {
+				return errorOf(ErrUndefinedTable, "外键 %s 引用的表 %s 不存在", fk.Name, fk.RefTable)
+			}
+			ref = &table.Schema
+		}
+		if fk.RefColumns == nil {
+			fk.RefColumns = ref.keyColumns()
+		}
+		if len(fk.RefColumns) != len(fk.Columns) {
+			return fmt.Errorf("外键 %s 的列数和引用的列数不同", fk.Name)
+		}
+		for j, column := range fk.RefColumns {
+			k := ref.columnIndex(column)
+			if k < 0 {
+				return fmt.Errorf("外键 %s 引用的列 %s 不存在", fk.Name, column)
+			}
+			if ref.Columns[k].Type != schema.Columns[schema.columnIndex(fk.Columns[j])].Type {
+				return fmt.Errorf("外键 %s 的列 %s 和引用的列 %s 类型不同", fk.Name, fk.Columns[j], column)
+			}
+		}
+		if !ref.isUnique(fk.RefColumns) {
+			return fmt.Errorf("外键 %s 引用的列 (%s) 不是表 %s 的主键，也没有唯一约束", fk.Name, strings.Join(fk.RefColumns, ", "), fk.RefTable)
+		}
+		if fk.OnDelete == "SET NULL" || fk.OnUpdate == "SET NULL" {
+			for _, column := range fk.Columns {
+				if schema.Columns[schema.columnIndex(column)].NotNull {
+					return fmt.Errorf("外键 %s 的动作是 SET NULL，但列 %s 不能为 NULL", fk.Name, column)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// keyColumns 主键的列，没有声明主键时是第一列
+func (schema *TableSchema) keyColumns() []string {
+	if len(schema.PrimaryKey) > 0 {
+		return schema.PrimaryKey
+	}
+	return []string{schema.Columns[0].Name}
+}
+
+// isUnique columns 是主键或者某个唯一索引的列
+func (schema *TableSchema) isUnique(columns []string) bool {
+	same := func(a []string) bool {
+		return strings.Join(a, ",") == strings.Join(columns, ",")
+	}
+	if same(schema.keyColumns()) {
+		return true
+	}
+	for _, index := range schema.Indexes {
+		if index.Unique && same(index.Columns) {
+			return true
+		}
+	}
+	return false
+}
+
+// referencedBy 索引 name 被外键用来保证引用的列唯一时，返回这个外键的名字
+func (db *DB) referencedBy(table *BPTable, name string) (string, bool) {
+	i := table.findIndex(name)
+	if i < 0 {
+		return "", false
+	}
+	columns := strings.Join(table.Schema.Indexes[i].Columns, ",")
+	for _, t := range db.databases[table.Database] {
+		for _, fk := range t.Schema.ForeignKeys {
+			if fk.RefTable == table.Name && strings.Join(fk.RefColumns, ",") == columns {
+				return fk.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// rowValues 一行中若干列的值
+func rowValues(row map[string]interface{}, columns []string) []interface{} {
+	values := make([]interface{}, len(columns))
+	for i, column := range columns {
+		values[i] = row[column]
+	}
+	return values
+}
+
+// sameRowValues 两组值是否相同，NULL 和 NULL 算相同
+func sameRowValues(a, b []interface{}) bool {
+	for i := range a {
+		if a[i] == nil || b[i] == nil {
+			if a[i] != b[i] {
+				return false
+			}
+			continue
+		}
+		if c, err := compareValues(a[i], b[i]); err != nil || c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// matchWhere 条件 列1 = 值1 and 列2 = 值2 ...，查找时可以用上主键或索引
+func matchWhere(columns []string, values []interface{}) Expr {
+	var where Expr
+	for i, column := range columns {
+		cond := &BinaryExpr{Op: "=", Left: &ColumnRef{Name: column}, Right: &Literal{Value: values[i]}}
+		if where == nil {
+			where = cond
+		} else {
+			where = &BinaryExpr{Op: "AND", Left: where, Right: cond}
+		}
+	}
+	return where
+}
+
+// hasMatch 事务 tx 能看到的表中是否有 columns 的值为 values 的行
+func hasMatch(tx *txn, table *BPTable, columns []string, values []interface{}) (bool, error) {
+	found := false
+	err := table.scanItems(tx, matchWhere(columns, values), false, func(rowItem) bool {
+		found = true
+		return false
+	})
+	return found, err
+}
+
+// checkParents 写入一行之前检查它的外键引用的行存在，外键的值没有改变时不用检查
+func (db *DB) checkParents(tx *txn, table *BPTable, before, after map[string]interface{}) error {
+	for _, fk := range table.Schema.ForeignKeys {
+		values := rowValues(after, fk.Columns)
+		if hasNull(values) || (before != nil && sameRowValues(values, rowValues(before, fk.Columns))) {
+			continue
+		}
+		parent, err := db.lookupTable(table.Database, fk.RefTable)
+		if err != nil {
+			return err
+		}
+		found, err := hasMatch(tx, parent, fk.RefColumns, values)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return errorOf(ErrForeignKeyViolation, "违反外键约束 %s: 表 %s 中没有 (%s) 为 %s 的行",
+				fk.Name, fk.RefTable, strings.Join(fk.RefColumns, ", "), describeValues(values))
+		}
+	}
+	return nil
+}
+
+// children 引用表 table 的外键和它们所在的表
+func (db *DB) children(table *BPTable) ([]*BPTable, []ForeignKey) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	var tables []*BPTable
+	var fks []ForeignKey
+	for _, t := range db.databases[table.Database] {
+		for _, fk := range t.Schema.ForeignKeys {
+			if fk.RefTable == table.Name {
+				tables = append(tables, t)
+				fks = append(fks, fk)
+			}
+		}
+	}
+	return tables, fks
+}
+
+// cascade 表 table 中的一行从 before 改成 after 之后(after 为 nil 时是删除)，按外键的动作处理引用 before 的行
+func (db *DB) cascade(tx *txn, table *BPTable, before, after map[string]interface{}) error {
+	tables, fks := db.children(table)
+	for i, fk := range fks {
+		child := tables[i]
+		old := rowValues(before, fk.RefColumns)
+		if hasNull(old) || (after != nil && sameRowValues(old, rowValues(after, fk.RefColumns))) {
+			continue
+		}
+		items, err := child.selectItems(tx, matchWhere(fk.Columns, old))
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			continue
+		}
+		action := fk.OnDelete
+		if after != nil {
+			action = fk.OnUpdate
+		}
+		switch action {
+		case "RESTRICT":
+			return errorOf(ErrForeignKeyViolation, "违反外键约束 %s: 表 %s 中还有引用 %s 的行", fk.Name, child.Name, describeValues(old))
+		case "NO ACTION":
+			tx.deferred = append(tx.deferred, fkCheck{child: child, fk: fk, values: old})
+			continue
+		}
+		for _, item := range items {
+			if _, exists := child.get(tx, item.Key); !exists {
+				// 自己引用自己的表中，这一行可能已经被前面的级联删除了
+				continue
+			}
+			if action == "CASCADE" && after == nil {
+				if err := db.deleteRow(tx, child, item.Key, item.Val); err != nil {
+					return err
+				}
+				continue
+			}
+			row := make(map[string]interface{}, len(item.Val))
+			for k, v := range item.Val {
+				row[k] = v
+			}
+			for j, column := range fk.Columns {
+				if action == "CASCADE" {
+					row[column] = after[fk.RefColumns[j]]
+				} else {
+					row[column] = nil
+				}
+			}
+			if err := db.replaceRow(tx, child, item.Key, item.Val, row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteRow 在事务中删除一行，然后处理引用它的行
+func (db *DB) deleteRow(tx *txn, table *BPTable, key Key, before map[string]interface{}) error {
+	if err := db.writeRow(tx, table, key, before, nil); err != nil {
+		return err
+	}
+	return db.cascade(tx, table, before, nil)
+}
+
+// replaceRow 在事务中把主键为 key 的行改成 after，主键改变时先删除原来的行，然后处理引用它的行。
+// 级联修改时被引用的列和外键的列类型可以不同，所以先把值转换成列的类型
+func (db *DB) replaceRow(tx *txn, table *BPTable, key Key, before, after map[string]interface{}) error {
+	if err := table.coerceRow(after); err != nil {
+		return err
+	}
+	newKey, err := table.keyOf(after)
+	if err != nil {
+		return err
+	}
+	if newKey == key {
+		err = db.writeRow(tx, table, key, before, after)
+	} else {
+		if _, exists := table.get(tx, newKey); exists {
+			return errorOf(ErrUniqueViolation, "主键 %s 已存在", newKey)
+		}
+		if err = db.writeRow(tx, table, key, before, nil); err == nil {
+			err = db.writeRow(tx, table, newKey, nil, after)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return db.cascade(tx, table, before, after)
+}
+
+// checkDeferred 语句结束时检查 NO ACTION 的外键: 还有行引用的值在被引用的表中必须仍然存在
+func (db *DB) checkDeferred(tx *txn) error {
+	for _, check := range tx.deferred {
+		parent, err := db.lookupTable(check.child.Database, check.fk.RefTable)
+		if err != nil {
+			return err
+		}
+		found, err := hasMatch(tx, parent, check.fk.RefColumns, check.values)
+		if err != nil || found {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if found, err = hasMatch(tx, check.child, check.fk.Columns, check.values); err != nil {
+			return err
+		}
+		if found {
+			return errorOf(ErrForeignKeyViolation, "违反外键约束 %s: 表 %s 中还有引用 %s 的行", check.fk.Name, check.child.Name, describeValues(check.values))
+		}
+	}
+	return nil
+}
+
+// runStatement 在事务中执行一条修改语句，语句结束时检查推迟的外键
+func (db *DB) runStatement(tx *txn, fn func(tx *txn) error) error {
+	tx.deferred = nil
+	err := fn(tx)
+	if err == nil {
+		err = db.checkDeferred(tx)
+	}
+	tx.deferred = nil
+	return err
+}
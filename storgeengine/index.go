@@ -0,0 +1,466 @@
+package storgeengine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// 二级索引: 每个索引是一棵只在内存中的 b+树。索引的定义保存在系统目录中，启动时在日志恢复之后根据表中的数据重新建立，
+// 所以索引本身不需要写日志，也不需要刷盘。
+//
+// 索引项的关键字是索引各列的值的编码后面接上行的主键，值相同的行按主键排列，不需要数据部分。
+// 先按索引列的前几列查找就是在关键字的前缀上查找。
+//
+// 索引项不区分版本: 行的每个版本写进 b+树时都把它的索引项加进索引，旧版本被 gc 清理时，
+// 这一行剩下的版本中没有同样的索引项了，才把它从索引中删掉，每个快照都能通过索引找到它看到的版本
+
+// tableIndex 表上的一个索引和它的 b+树
+type tableIndex struct {
+	Index
+	types []ColumnType // 索引各列的类型，决定值怎样编码
+	tree  *BPTree
+}
+
+func newTableIndex(index Index, schema TableSchema) *tableIndex {
+	types := make([]ColumnType, len(index.Columns))
+	for i, column := range index.Columns {
+		types[i] = schema.Columns[schema.columnIndex(column)].Type
+	}
+	return &tableIndex{Index: index, types: types, tree: NewBPTree(tableWidth)}
+}
+
+// values 一行中索引列的值
+func (idx *tableIndex) values(row map[string]interface{}) []interface{} {
+	values := make([]interface{}, len(idx.Columns))
+	for i, column := range idx.Columns {
+		values[i] = row[column]
+	}
+	return values
+}
+
+// prefix 索引列的值的编码。整数列中能转换成数字的字符串按数字编码，和它比较时也是按数字比较的
+func (idx *tableIndex) prefix(values []interface{}) Key {
+	var buf []byte
+	for i, value := range values {
+		if s, ok := value.(string); ok && idx.types[i] == IntType {
+			if n, ok := toNumber(s); ok {
+				value = n
+			}
+		}
+		buf = appendKeyValue(buf, value)
+	}
+	return Key(buf)
+}
+
+// entry 主键为 key 的行 row 的索引项
+func (idx *tableIndex) entry(key Key, row map[string]interface{}) Key {
+	return idx.prefix(idx.values(row)) + key
+}
+
+// primaryKey 从索引项中取出行的主键: 跳过前面各列的值
+func (idx *tableIndex) primaryKey(entry Key) Key {
+	for range idx.Columns {
+		n := keyValueLen(entry)
+		if n < 0 {
+			return ""
+		}
+		entry = entry[n:]
+	}
+	return entry
+}
+
+// add 把主键为 key 的行 row 加进索引。调用方持有 db.commitMu
+func (idx *tableIndex) add(key Key, row map[string]interface{}) {
+	idx.tree.put(BPItem{Key: idx.entry(key, row)})
+}
+
+// keys 关键字在范围内的索引项中的主键
+func (idx *tableIndex) keys(rng keyRange, fn func(key Key)) {
+	idx.tree.scanRange(rng, false, func(item BPItem) bool {
+		fn(idx.primaryKey(item.Key))
+		return true
+	})
+}
+
+// matches 索引值为 values 的索引项中的主键，其中可能有旧版本的值
+func (idx *tableIndex) matches(values []interface{}, fn func(key Key)) {
+	idx.keys(prefixRange(idx.prefix(values)), fn)
+}
+
+// sameValues 两行的索引值是否相同，有 NULL 时不算相同
+func (idx *tableIndex) sameValues(a, b map[string]interface{}) bool {
+	for _, column := range idx.Columns {
+		if a[column] == nil || b[column] == nil {
+			return false
+		}
+		if c, err := compareValues(a[column], b[column]); err != nil || c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hasNull 唯一索引不限制含有 NULL 的行
+func hasNull(values []interface{}) bool {
+	for _, v := range values {
+		if v == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// describeValues 错误信息中的索引值，写成 SQL 常量的样子，例如 'a@x' 或 (1, 'a@x')
+func describeValues(values []interface{}) string {
+	items := make([]string, len(values))
+	for i, v := range values {
+		items[i] = exprString(&Literal{Value: v})
+	}
+	if len(items) == 1 {
+		return items[0]
+	}
+	return "(" + strings.Join(items, ", ") + ")"
+}
+
+// build 用表中的全部版本建立索引，包括还有快照需要的旧版本和删除标记。调用方持有 db.commitMu
+func (idx *tableIndex) build(table *BPTable) {
+	table.Tree.scanRange(keyRange{}, false, func(item BPItem) bool {
+		idx.add(item.Key, table.decode(item.Val))
+		return true
+	})
+	table.vmu.RLock()
+	defer table.vmu.RUnlock()
+	for key, versions := range table.versions {
+		for _, v := range versions {
+			idx.add(key, table.decode(v.Val))
+		}
+	}
+}
+
+// indexList 表上现在的索引，创建和删除索引时整个替换
+func (table *BPTable) indexList() []*tableIndex {
+	table.imu.RLock()
+	defer table.imu.RUnlock()
+	return table.indexes
+}
+
+func (table *BPTable) setIndexes(indexes []*tableIndex) {
+	table.imu.Lock()
+	defer table.imu.Unlock()
+	table.indexes = indexes
+}
+
+// findIndex 表上名为 name 的索引的位置，不存在时返回 -1
+func (table *BPTable) findIndex(name string) int {
+	for i, index := range table.Schema.Indexes {
+		if index.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// buildIndexes 启动时根据表中的数据建立系统目录中记录的索引
+func (table *BPTable) buildIndexes() {
+	indexes := make([]*tableIndex, 0, len(table.Schema.Indexes))
+	for _, index := range table.Schema.Indexes {
+		idx := newTableIndex(index, table.Schema)
+		idx.build(table)
+		indexes = append(indexes, idx)
+	}
+	table.setIndexes(indexes)
+}
+
+// index 提交的新版本写进 b+树之前先加进索引。调用方持有 db.commitMu
+func (table *BPTable) index(key Key, row map[string]interface{}) {
+	for _, idx := range table.indexList() {
+		idx.add(key, row)
+	}
+}
+
+// unindex 一行的旧版本 dropped 被清理后，剩下的版本 remaining 中没有的索引项从索引中删掉。调用方持有 db.commitMu
+func (table *BPTable) unindex(key Key, dropped, remaining []map[string]interface{}) {
+	for _, idx := range table.indexList() {
+		used := make(map[Key]bool, len(remaining))
+		for _, row := range remaining {
+			used[idx.entry(key, row)] = true
+		}
+		for _, row := range dropped {
+			if entry := idx.entry(key, row); !used[entry] {
+				idx.tree.Remove(entry)
+			}
+		}
+	}
+}
+
+// checkUnique 事务写入一行之前检查唯一索引: 快照中的其他行和事务自己改过的行都不能有相同的值
+func (table *BPTable) checkUnique(tx *txn, key Key, row map[string]interface{}) error {
+	for _, idx := range table.indexList() {
+		if !idx.Unique {
+			continue
+		}
+		values := idx.values(row)
+		if hasNull(values) {
+			continue
+		}
+		var err error
+		idx.matches(values, func(pk Key) {
+			if err != nil || pk == key {
+				return
+			}
+			if other, ok := table.get(tx, pk); ok && idx.sameValues(other, row) {
+				err = errorOf(ErrUniqueViolation, "唯一索引 %s 中已存在值 %s", idx.Name, describeValues(values))
+			}
+		})
+		if err != nil {
+			return err
+		}
+		for pk, p := range tx.pending[table] {
+			if pk != key && p.row != nil && idx.sameValues(p.row, row) {
+				return errorOf(ErrUniqueViolation, "唯一索引 %s 中已存在值 %s", idx.Name, describeValues(values))
+			}
+		}
+	}
+	return nil
+}
+
+// checkCommitted 提交时再检查一次唯一索引: 快照之后别的事务可能提交了相同的值。
+// 事务自己改过的行在写入时已经互相检查过了。调用方持有 db.commitMu
+func (table *BPTable) checkCommitted(tx *txn, key Key, row map[string]interface{}) error {
+	for _, idx := range table.indexList() {
+		if !idx.Unique {
+			continue
+		}
+		values := idx.values(row)
+		if hasNull(values) {
+			continue
+		}
+		var err error
+		idx.matches(values, func(pk Key) {
+			if err != nil || pk == key || tx.pending[table][pk] != nil {
+				return
+			}
+			if item, ok := table.Tree.lookup(pk); ok && item.End == 0 && idx.sameValues(table.decode(item.Val), row) {
+				err = errorOf(ErrUniqueViolation, "唯一索引 %s 中已存在值 %s", idx.Name, describeValues(values))
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexPath 通过索引访问: 在索引的 b+树中遍历这些关键字范围，取出索引项中的主键
+type indexPath struct {
+	index  *tableIndex
+	ranges []keyRange
+}
+
+// uniqueScore 所有列都是等值条件的唯一索引最多找到一行，总是优先使用
+const uniqueScore = 1 << 20
+
+// planIndex 从 where 中 AND 连接的条件里找出能用索引查找的条件，选出最合适的索引:
+// 前面连续的等值或 IN 条件的列越多越好，之后还有一列的范围条件更好；没有能用的索引时返回 nil
+func (table *BPTable) planIndex(where Expr) *indexPath {
+	var best *indexPath
+	bestScore := 0
+	for _, idx := range table.indexList() {
+		path, score := idx.plan(conjuncts(where))
+		if score > bestScore {
+			best, bestScore = path, score
+		}
+	}
+	return best
+}
+
+func (idx *tableIndex) plan(conds []Expr) (*indexPath, int) {
+	// 索引列中的值可能和列的类型不同，要把字符串列中的数字也找出来
+	plan := planKeys(conds, idx.Columns, idx.types, true)
+	if plan.equal == 0 && !plan.hasRange {
+		return nil, 0
+	}
+	score := 2 * plan.equal
+	if plan.hasRange {
+		score++
+	}
+	if idx.Unique && plan.equal == len(idx.Columns) && len(plan.prefixes) == 1 {
+		score = uniqueScore
+	}
+	return &indexPath{index: idx, ranges: plan.ranges}, score
+}
+
+// 识别 列 op 常量 或 常量 op 列，返回把列放在左边后的运算符
+func columnComparison(e *BinaryExpr) (string, string, interface{}, bool) {
+	flipped := map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+	if _, ok := flipped[e.Op]; !ok {
+		return "", "", nil, false
+	}
+	if col, ok := e.Left.(*ColumnRef); ok {
+		if value, ok := constLiteral(e.Right); ok {
+			return col.Name, e.Op, value, true
+		}
+	}
+	if col, ok := e.Right.(*ColumnRef); ok {
+		if value, ok := constLiteral(e.Left); ok {
+			return col.Name, flipped[e.Op], value, true
+		}
+	}
+	return "", "", nil, false
+}
+
+// 不是 NULL 的常量
+func constLiteral(expr Expr) (interface{}, bool) {
+	lit, ok := expr.(*Literal)
+	if !ok || lit.Value == nil {
+		return nil, false
+	}
+	return lit.Value, true
+}
+
+// indexKeys 通过索引找出可能满足条件的行的主键，加上事务自己改过的行，按主键升序排列。
+// 事务自己改过的行还没有进索引，所以都要带上，由调用方用 where 条件过滤
+func (table *BPTable) indexKeys(tx *txn, path *indexPath) []Key {
+	seen := make(map[Key]bool)
+	var keys []Key
+	add := func(key Key) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, rng := range path.ranges {
+		path.index.keys(rng, add)
+	}
+	for key := range tx.pending[table] {
+		add(key)
+	}
+	cmp := table.Tree.compare
+	sort.Slice(keys, func(i, j int) bool { return cmp(keys[i], keys[j]) < 0 })
+	return keys
+}
+
+// CreateIndex 在数据库 database 的表上创建索引，唯一索引要求表中现有的行没有重复的值
+func (db *DB) CreateIndex(database, tableName string, index Index) error {
+	// 建立索引期间不能有事务提交，否则新提交的版本不会进索引
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if database == "" {
+		return fmt.Errorf("没有选择数据库")
+	}
+	table, exists := db.databases[database][tableName]
+	if !exists {
+		return errorOf(ErrUndefinedTable, "表 %s 不存在", tableName)
+	}
+	if table.findIndex(index.Name) >= 0 {
+		return fmt.Errorf("索引 %s 已经存在", index.Name)
+	}
+	seen := make(map[string]bool)
+	for _, column := range index.Columns {
+		if table.Schema.columnIndex(column) < 0 {
+			return fmt.Errorf("未知的列 %s", column)
+		}
+		if seen[column] {
+			return fmt.Errorf("索引中的列 %s 重复", column)
+		}
+		seen[column] = true
+	}
+
+	idx := newTableIndex(index, table.Schema)
+	idx.build(table)
+	if index.Unique {
+		if err := idx.checkExisting(table); err != nil {
+			return err
+		}
+	}
+	old := table.Schema.Indexes
+	table.Schema.Indexes = append(append([]Index(nil), old...), index)
+	if err := db.saveCatalog(); err != nil {
+		table.Schema.Indexes = old
+		return fmt.Errorf("创建索引 %s 失败: %v", index.Name, err)
+	}
+	table.setIndexes(append(append([]*tableIndex(nil), table.indexList()...), idx))
+	fmt.Printf("索引 %s 成功创建\n", index.Name)
+	return nil
+}
+
+// checkExisting 新建唯一索引时检查表中最新的行有没有重复的值。值相同的索引项是相邻的，
+// 只看最新版本的索引项，和前一个这样的索引项比较
+func (idx *tableIndex) checkExisting(table *BPTable) error {
+	var err error
+	var prev Key
+	idx.tree.scanRange(keyRange{}, false, func(entry BPItem) bool {
+		pk := idx.primaryKey(entry.Key)
+		item, ok := table.Tree.lookup(pk)
+		if !ok || item.End != 0 {
+			return true
+		}
+		row := table.decode(item.Val)
+		if hasNull(idx.values(row)) || idx.entry(pk, row) != entry.Key {
+			return true
+		}
+		prefix := entry.Key[:len(entry.Key)-len(pk)]
+		if prefix == prev {
+			err = errorOf(ErrUniqueViolation, "无法创建唯一索引 %s: 值 %s 重复", idx.Name, describeValues(idx.values(row)))
+			return false
+		}
+		prev = prefix
+		return true
+	})
+	return err
+}
+
+// DropIndex 删除数据库 database 中的索引。tableName 为空时在数据库的所有表中按名字查找
+func (db *DB) DropIndex(database, tableName, name string) error {
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if database == "" {
+		return fmt.Errorf("没有选择数据库")
+	}
+	var table *BPTable
+	if tableName != "" {
+		if table = db.databases[database][tableName]; table == nil {
+			return errorOf(ErrUndefinedTable, "表 %s 不存在", tableName)
+		}
+	} else {
+		for _, t := range db.databases[database] {
+			if t.findIndex(name) < 0 {
+				continue
+			}
+			if table != nil {
+				return fmt.Errorf("多张表上都有索引 %s，请用 drop index %s on 表名", name, name)
+			}
+			table = t
+		}
+	}
+	if table == nil || table.findIndex(name) < 0 {
+		return fmt.Errorf("索引 %s 不存在", name)
+	}
+
+	if fk, used := db.referencedBy(table, name); used {
+		return fmt.Errorf("外键 %s 依赖索引 %s，不能删除", fk, name)
+	}
+	i := table.findIndex(name)
+	old := table.Schema.Indexes
+	table.Schema.Indexes = append(append([]Index(nil), old[:i]...), old[i+1:]...)
+	if err := db.saveCatalog(); err != nil {
+		table.Schema.Indexes = old
+		return fmt.Errorf("删除索引 %s 失败: %v", name, err)
+	}
+	var indexes []*tableIndex
+	for _, idx := range table.indexList() {
+		if idx.Name != name {
+			indexes = append(indexes, idx)
+		}
+	}
+	table.setIndexes(indexes)
+	fmt.Printf("索引 %s 已删除\n", name)
+	return nil
+}
@@ -0,0 +1,178 @@
+package storgeengine
+
+// Bound 范围的一端，Inclusive 表示包含 Key 本身
+type Bound struct {
+	Key       Key
+	Inclusive bool
+}
+
+// Iterator 按主键顺序遍历 b+树的游标。游标位于两个数据项之间: Next 返回后一项并后移，
+// Prev 返回前一项并前移，所以交替调用时会返回同一项。刚创建的游标还没有位置，
+// Next 从范围的第一项开始，Prev 从最后一项开始。
+//
+// 游标每次在读锁下复制一个叶子中的数据项，用完后向后沿着叶子的 Next 指针、向前从根结点重新查找
+// 下一批，两次调用之间不持有锁也不固定结点，不会挡住写操作，看到的是每批读取时树中的数据
+type Iterator struct {
+	tree   *BPTree
+	rng    keyRange
+	items  []BPItem // 当前缓存的一批数据项，按主键升序
+	pos    int      // 游标位于 items[pos-1] 和 items[pos] 之间
+	cur    BPItem
+	valid  bool // cur 是否有效
+	closed bool
+}
+
+// NewIterator 遍历主键在 low 和 high 之间的数据项，nil 表示该方向无界
+func (t *BPTree) NewIterator(low, high *Bound) *Iterator {
+	var r keyRange
+	if low != nil {
+		r.restrictLow(low.Key, low.Inclusive, t.compare)
+	}
+	if high != nil {
+		r.restrictHigh(high.Key, high.Inclusive, t.compare)
+	}
+	return t.iterator(r)
+}
+
+func (t *BPTree) iterator(r keyRange) *Iterator {
+	return &Iterator{tree: t, rng: r}
+}
+
+// SeekTo 把游标移到第一个主键不小于 key 的数据项之前，之后 Next 返回这一项，Prev 返回它前面的一项。
+// 名字不用 Seek，go vet 要求叫 Seek 的方法和 io.Seeker 的签名一致
+func (it *Iterator) SeekTo(key Key) {
+	if it.closed {
+		return
+	}
+	it.valid = false
+	r := it.rng
+	r.restrictLow(key, true, it.tree.compare)
+	if it.items = it.tree.leafItems(r); len(it.items) > 0 {
+		it.pos = 0
+		return
+	}
+	r = it.rng
+	r.restrictHigh(key, false, it.tree.compare)
+	it.items = it.tree.leafItemsBefore(r)
+	it.pos = len(it.items)
+}
+
+// Next 移到下一项，没有更多数据时返回 false，游标停在最后
+func (it *Iterator) Next() bool {
+	if it.closed {
+		return false
+	}
+	if it.pos >= len(it.items) {
+		r := it.rng
+		if len(it.items) > 0 {
+			r.restrictLow(it.items[len(it.items)-1].Key, false, it.tree.compare)
+		}
+		items := it.tree.leafItems(r)
+		if len(items) == 0 {
+			it.valid = false
+			return false
+		}
+		it.items, it.pos = items, 0
+	}
+	it.cur, it.valid = it.items[it.pos], true
+	it.pos++
+	return true
+}
+
+// Prev 移到上一项，没有更多数据时返回 false，游标停在最前
+func (it *Iterator) Prev() bool {
+	if it.closed {
+		return false
+	}
+	if it.pos <= 0 {
+		r := it.rng
+		if len(it.items) > 0 {
+			r.restrictHigh(it.items[0].Key, false, it.tree.compare)
+		}
+		items := it.tree.leafItemsBefore(r)
+		if len(items) == 0 {
+			it.valid = false
+			return false
+		}
+		it.items, it.pos = items, len(items)
+	}
+	it.pos--
+	it.cur, it.valid = it.items[it.pos], true
+	return true
+}
+
+// Item 最近一次 Next 或 Prev 返回的数据项
+func (it *Iterator) Item() (BPItem, bool) {
+	return it.cur, it.valid
+}
+
+// Close 释放缓存的数据项，之后 Next 和 Prev 都返回 false
+func (it *Iterator) Close() {
+	it.items, it.valid, it.closed = nil, false, true
+}
+
+// leafItems 取出范围内第一个有数据的叶子中的数据项，沿着 Next 指针跳过没有范围内数据的叶子
+func (t *BPTree) leafItems(r keyRange) []BPItem {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	var node *BPNode
+	if r.low != nil {
+		node = t.findLeaf(*r.low)
+	} else {
+		node = t.firstLeaf()
+	}
+	var items []BPItem
+	for ; node != nil; node = t.nextLeaf(node) {
+		for _, item := range node.Items {
+			if r.aboveHigh(item.Key, t.compare) {
+				t.unpin(node)
+				return items
+			}
+			if r.contains(item.Key, t.compare) {
+				items = append(items, item)
+			}
+		}
+		if len(items) > 0 {
+			t.unpin(node)
+			return items
+		}
+	}
+	return nil
+}
+
+// leafItemsBefore 取出范围内最后一个有数据的叶子中的数据项。叶子之间只有向后的指针，
+// 所以从根结点开始，在可能含有上界的子结点和它左边的兄弟中从右往左查找
+func (t *BPTree) leafItemsBefore(r keyRange) []BPItem {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.itemsBefore(t.root, r)
+}
+
+func (t *BPTree) itemsBefore(id PageID, r keyRange) []BPItem {
+	node := t.node(id)
+	defer t.unpin(node)
+	if node.Leaf {
+		var items []BPItem
+		for _, item := range node.Items {
+			if r.contains(item.Key, t.compare) {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+	i := len(node.Nodes) - 1
+	if r.high != nil {
+		i = node.childIndex(*r.high, t.compare)
+	}
+	for ; i >= 0; i-- {
+		// 这个子结点以及它左边的子结点中的关键字都在下界之下
+		if r.belowLow(node.Nodes[i].MaxKey, t.compare) {
+			break
+		}
+		if items := t.itemsBefore(node.Nodes[i].ID, r); len(items) > 0 {
+			return items
+		}
+	}
+	return nil
+}
@@ -0,0 +1,454 @@
+package storgeengine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// joinTable 查询中的一张表，name 是别名或表名。
+// 连接查询中行的列名统一写成 name.列名，避免不同表的同名列互相覆盖
+type joinTable struct {
+	name  string
+	table *BPTable
+}
+
+func (jt joinTable) column(name string) string {
+	return jt.name + "." + name
+}
+
+// fill 把表中一行的值放到连接行中，val 为 nil 时这张表的列都是 NULL
+func (jt joinTable) fill(row Row, val map[string]interface{}) {
+	for _, col := range jt.table.Schema.Columns {
+		row[jt.column(col.Name)] = val[col.Name]
+	}
+}
+
+// joinStep 把左边已经连接好的行和右边的一张新表连接。
+// on 中有 左边表达式 = 新表的列 的条件时，新表的列是主键就用 b+树点查，否则先建哈希表；
+// 没有等值条件时逐行嵌套循环。最后都再用完整的 on 条件过滤一遍
+type joinStep struct {
+	kind        string // INNER, LEFT, RIGHT, CROSS
+	inner       joinTable
+	on          Expr
+	outer       Expr   // 等值条件中左边的表达式，nil 表示没有可用的等值条件
+	innerColumn string // 等值条件中新表的列
+	byKey       bool
+	hash        map[string][]rowItem
+	hashClass   byte         // 哈希表中键的类别，见 buildHash
+	matched     map[Key]bool // right join 时记录新表中匹配过的行
+}
+
+// joinPlan 多表连接，按 from 中的顺序从左到右依次连接
+type joinPlan struct {
+	tables []joinTable
+	steps  []*joinStep
+	schema TableSchema // 连接后全部的列
+	owner  map[string]int
+	tx     *txn
+	err    error
+}
+
+// queryTables 查询中用到的全部表，没有写数据库名的表在 database 中。表名或别名不能重复
+func (db *DB) queryTables(database string, s *SelectStmt) ([]joinTable, error) {
+	if s.From == nil {
+		return nil, nil
+	}
+	refs := []*TableRef{s.From}
+	for _, join := range s.Joins {
+		refs = append(refs, join.Table)
+	}
+	tables := make([]joinTable, 0, len(refs))
+	seen := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		name := ref.Database
+		if name == "" {
+			name = database
+		}
+		table, err := db.lookupTable(name, ref.Table)
+		if err != nil {
+			return nil, err
+		}
+		if seen[ref.Name()] {
+			return nil, fmt.Errorf("表名 %s 重复，请使用别名", ref.Name())
+		}
+		seen[ref.Name()] = true
+		tables = append(tables, joinTable{name: ref.Name(), table: table})
+	}
+	return tables, nil
+}
+
+// newJoinPlan 根据已经解析过列名的 select 语句生成连接计划
+func newJoinPlan(tx *txn, s *SelectStmt, tables []joinTable) (*joinPlan, error) {
+	plan := &joinPlan{tables: tables, owner: make(map[string]int), tx: tx}
+	for i, jt := range tables {
+		for _, col := range jt.table.Schema.Columns {
+			name := jt.column(col.Name)
+			plan.schema.Columns = append(plan.schema.Columns, Column{Name: name, Type: col.Type})
+			plan.owner[name] = i
+		}
+	}
+	for i, join := range s.Joins {
+		// on 中只能引用它左边的表和新连接的表
+		visible := TableSchema{}
+		for _, col := range plan.schema.Columns {
+			if plan.owner[col.Name] <= i+1 {
+				visible.Columns = append(visible.Columns, col)
+			}
+		}
+		if err := checkColumns(join.On, visible); err != nil {
+			return nil, err
+		}
+		step := &joinStep{kind: join.Type, inner: tables[i+1], on: join.On}
+		step.planEquality(plan.owner, i+1)
+		if step.kind == "RIGHT" {
+			step.matched = make(map[Key]bool)
+		}
+		plan.steps = append(plan.steps, step)
+	}
+	return plan, nil
+}
+
+// planEquality 在 on 的 AND 条件中找 左边表达式 = 新表的列，优先使用新表的主键
+func (step *joinStep) planEquality(owner map[string]int, index int) {
+	keyColumn := step.inner.column(step.inner.table.keyColumn())
+	for _, cond := range conjuncts(step.on) {
+		e, ok := cond.(*BinaryExpr)
+		if !ok || e.Op != "=" {
+			continue
+		}
+		for _, pair := range [][2]Expr{{e.Left, e.Right}, {e.Right, e.Left}} {
+			col, ok := pair[0].(*ColumnRef)
+			if !ok || owner[col.Name] != index || !onlyTablesBefore(pair[1], owner, index) {
+				continue
+			}
+			if step.outer == nil || (!step.byKey && col.Name == keyColumn) {
+				step.outer = pair[1]
+				step.innerColumn = strings.TrimPrefix(col.Name, step.inner.name+".")
+				step.byKey = col.Name == keyColumn && len(step.inner.table.keyColumns()) == 1
+			}
+		}
+	}
+}
+
+// 表达式只用到了前 index 张表中的列
+func onlyTablesBefore(expr Expr, owner map[string]int, index int) bool {
+	ok := true
+	walkExpr(expr, func(e Expr) {
+		if col, isCol := e.(*ColumnRef); isCol {
+			if i, exists := owner[col.Name]; !exists || i >= index {
+				ok = false
+			}
+		} else if call, isCall := e.(*FuncCall); isCall && isAggregate(call) {
+			ok = false
+		}
+	})
+	return ok
+}
+
+// scan 逐行输出连接结果中满足 where 的行，fn 返回 false 时提前结束
+func (plan *joinPlan) scan(where Expr, fn func(Row) bool) error {
+	if err := checkColumns(where, plan.schema); err != nil {
+		return err
+	}
+	for _, step := range plan.steps {
+		if step.outer != nil && !step.byKey {
+			step.buildHash(plan.tx)
+		}
+	}
+
+	var emit func(level int, row Row) bool
+	emit = func(level int, row Row) bool {
+		if plan.err != nil {
+			return false
+		}
+		if level == len(plan.steps) {
+			ok, err := evalPredicate(where, row)
+			if err != nil {
+				plan.err = err
+				return false
+			}
+			return !ok || fn(row)
+		}
+		cont, err := plan.steps[level].join(plan.tx, row, func(joined Row) bool {
+			return emit(level+1, joined)
+		})
+		if err != nil {
+			plan.err = err
+			return false
+		}
+		return cont
+	}
+
+	first := plan.tables[0]
+	err := first.table.scanItems(plan.tx, plan.pushdown(where), false, func(item rowItem) bool {
+		row := make(Row, len(plan.schema.Columns))
+		first.fill(row, item.Val)
+		return emit(0, row)
+	})
+	if err != nil {
+		return err
+	}
+	if plan.err != nil {
+		return plan.err
+	}
+
+	// right join 中没有匹配上的行，左边的列都是 NULL，再继续和后面的表连接
+	for i, step := range plan.steps {
+		if step.kind != "RIGHT" {
+			continue
+		}
+		cont := true
+		step.inner.table.scan(plan.tx, keyRange{}, false, func(item rowItem) bool {
+			if step.matched[item.Key] {
+				return true
+			}
+			row := make(Row, len(plan.schema.Columns))
+			for _, jt := range plan.tables[:i+1] {
+				jt.fill(row, nil)
+			}
+			step.inner.fill(row, item.Val)
+			cont = emit(i+1, row)
+			return cont
+		})
+		if plan.err != nil {
+			return plan.err
+		}
+		if !cont {
+			break
+		}
+	}
+	return nil
+}
+
+// pushdown where 中只涉及第一张表的条件提前到扫描第一张表时过滤，这样可以用上主键。
+// right join 时第一张表可能补 NULL，不能提前过滤
+func (plan *joinPlan) pushdown(where Expr) Expr {
+	for _, step := range plan.steps {
+		if step.kind == "RIGHT" {
+			return nil
+		}
+	}
+	first := plan.tables[0]
+	var pushed Expr
+	for _, cond := range conjuncts(where) {
+		if !onlyTablesBefore(cond, plan.owner, 1) {
+			continue
+		}
+		cond, _ = rewriteExpr(cond, func(e Expr) (Expr, error) {
+			if col, ok := e.(*ColumnRef); ok {
+				return &ColumnRef{Name: strings.TrimPrefix(col.Name, first.name+".")}, nil
+			}
+			return e, nil
+		})
+		if pushed == nil {
+			pushed = cond
+		} else {
+			pushed = &BinaryExpr{Op: "AND", Left: pushed, Right: cond}
+		}
+	}
+	return pushed
+}
+
+// buildHash 按新表的列建哈希表。键是 distinctKey，第一个字符是类别: 数字 n、字符串 s、时间 t。
+// 同一类别中 distinctKey 相同和比较相等是一回事，类别不同时比较前要转换(数字 2 等于字符串 '2')，
+// 这时不能用哈希表查找，要逐行比较。hashClass 是全部键的类别，混有不同类别时为 '*'
+func (step *joinStep) buildHash(tx *txn) {
+	step.hash = make(map[string][]rowItem)
+	step.hashClass = 0
+	step.inner.table.scan(tx, keyRange{}, false, func(item rowItem) bool {
+		if value := item.Val[step.innerColumn]; value != nil {
+			key := distinctKey(value)
+			step.hash[key] = append(step.hash[key], item)
+			if step.hashClass == 0 {
+				step.hashClass = key[0]
+			} else if step.hashClass != key[0] {
+				step.hashClass = '*'
+			}
+		}
+		return true
+	})
+}
+
+// join 把一行和新表中满足 on 的行连接后交给 out，返回 false 表示不再需要更多的行
+func (step *joinStep) join(tx *txn, row Row, out func(Row) bool) (bool, error) {
+	matched, cont := false, true
+	var err error
+	try := func(item rowItem) bool {
+		joined := make(Row, len(row)+len(item.Val))
+		for k, v := range row {
+			joined[k] = v
+		}
+		step.inner.fill(joined, item.Val)
+		ok, evalErr := evalPredicate(step.on, joined)
+		if evalErr != nil {
+			err = evalErr
+			return false
+		}
+		if !ok {
+			return true
+		}
+		matched = true
+		if step.matched != nil {
+			step.matched[item.Key] = true
+		}
+		cont = out(joined)
+		return cont
+	}
+
+	if step.outer == nil {
+		step.inner.table.scan(tx, keyRange{}, false, try)
+	} else {
+		value, evalErr := evalExpr(step.outer, row)
+		if evalErr != nil {
+			return false, evalErr
+		}
+		if value != nil && step.byKey {
+			if key, ok := step.inner.table.keyFor(value); ok {
+				if val, ok := step.inner.table.get(tx, key); ok {
+					try(rowItem{Key: key, Val: val})
+				}
+			}
+		} else if key := distinctKey(value); value != nil && key[0] == step.hashClass {
+			for _, item := range step.hash[key] {
+				if !try(item) {
+					break
+				}
+			}
+		} else if value != nil && step.hashClass != 0 {
+			// 键的类别不同，和没有等值条件时一样逐行比较
+			step.inner.table.scan(tx, keyRange{}, false, try)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	if !matched && cont && step.kind == "LEFT" {
+		joined := make(Row, len(row)+len(step.inner.table.Schema.Columns))
+		for k, v := range row {
+			joined[k] = v
+		}
+		step.inner.fill(joined, nil)
+		return out(joined), nil
+	}
+	return cont, nil
+}
+
+// resolveColumns 解析列引用前面的表名。
+// 单表查询时去掉表名，列名和表结构中的一致；连接查询时统一写成 表名.列名，
+// 没写表名的列到所有表中查找，找不到的留给后面的检查(可能是别名)
+func resolveColumns(expr Expr, tables []joinTable) (Expr, error) {
+	return rewriteExpr(expr, func(e Expr) (Expr, error) {
+		col, ok := e.(*ColumnRef)
+		if !ok {
+			return e, nil
+		}
+		if col.Table == "" {
+			if len(tables) < 2 {
+				return e, nil
+			}
+			var found *joinTable
+			for i := range tables {
+				if tables[i].table.Schema.columnIndex(col.Name) < 0 {
+					continue
+				}
+				if found != nil {
+					return nil, fmt.Errorf("列 %s 不明确，请在前面加上表名", col.Name)
+				}
+				found = &tables[i]
+			}
+			if found == nil {
+				return e, nil
+			}
+			return &ColumnRef{Name: found.column(col.Name)}, nil
+		}
+		jt, err := findTable(tables, col.Table)
+		if err != nil {
+			return nil, err
+		}
+		if jt.table.Schema.columnIndex(col.Name) < 0 {
+			return nil, fmt.Errorf("未知的列 %s.%s", col.Table, col.Name)
+		}
+		if len(tables) < 2 {
+			return &ColumnRef{Name: col.Name}, nil
+		}
+		return &ColumnRef{Name: jt.column(col.Name)}, nil
+	})
+}
+
+func findTable(tables []joinTable, name string) (joinTable, error) {
+	for _, jt := range tables {
+		if jt.name == name {
+			return jt, nil
+		}
+	}
+	return joinTable{}, fmt.Errorf("未知的表 %s", name)
+}
+
+// resolveSelect 解析 select 语句中全部的列引用，返回新的语句
+func resolveSelect(s *SelectStmt, tables []joinTable) (*SelectStmt, error) {
+	resolved := *s
+	var err error
+	resolved.Fields = make([]SelectField, len(s.Fields))
+	for i, field := range s.Fields {
+		if field.Star {
+			if field.Table != "" {
+				if _, err := findTable(tables, field.Table); err != nil {
+					return nil, err
+				}
+				if len(tables) < 2 {
+					field.Table = ""
+				}
+			}
+		} else {
+			expr, err := resolveColumns(field.Expr, tables)
+			if err != nil {
+				return nil, err
+			}
+			// 结果集的列名保持原来的写法
+			if field.Alias == "" && exprString(expr) != exprString(field.Expr) {
+				field.Alias = exprString(field.Expr)
+			}
+			field.Expr = expr
+		}
+		resolved.Fields[i] = field
+	}
+	resolved.Joins = make([]JoinClause, len(s.Joins))
+	for i, join := range s.Joins {
+		if join.On, err = resolveColumns(join.On, tables); err != nil {
+			return nil, err
+		}
+		resolved.Joins[i] = join
+	}
+	if resolved.Where, err = resolveColumns(s.Where, tables); err != nil {
+		return nil, err
+	}
+	resolved.GroupBy = make([]Expr, len(s.GroupBy))
+	for i, expr := range s.GroupBy {
+		if resolved.GroupBy[i], err = resolveColumns(expr, tables); err != nil {
+			return nil, err
+		}
+	}
+	if resolved.Having, err = resolveColumns(s.Having, tables); err != nil {
+		return nil, err
+	}
+	resolved.OrderBy = make([]OrderItem, len(s.OrderBy))
+	for i, item := range s.OrderBy {
+		// order by 中的别名优先于表中的列
+		if col, ok := item.Expr.(*ColumnRef); !ok || col.Table != "" || !hasAlias(s.Fields, col.Name) {
+			if item.Expr, err = resolveColumns(item.Expr, tables); err != nil {
+				return nil, err
+			}
+		}
+		resolved.OrderBy[i] = item
+	}
+	return &resolved, nil
+}
+
+func hasAlias(fields []SelectField, name string) bool {
+	for _, field := range fields {
+		if !field.Star && field.Alias == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package storgeengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// 回滚日志: 两次检查点之间，数据文件中的页第一次被覆盖前，先把它原来的内容保存到 表名.tbl-journal。
+// 缓冲池淘汰结点时随时会写数据文件，崩溃时文件里可能只有半个 b+树操作的结果，
+// 启动时先用回滚日志把数据文件恢复到上一个检查点，再由 WAL 重做之后的修改。
+//
+// 文件布局: 魔数 "ALSQLJNL" | 检查点时的总页数 uint32，之后每一项为 页号 uint32 | crc32 uint32 | 页的内容
+const (
+	journalSuffix     = "-journal"
+	journalMagic      = "ALSQLJNL"
+	journalHeaderSize = 12
+	journalEntrySize  = 8 + PageSize
+)
+
+// protect 在覆盖页之前把检查点时的内容写入回滚日志并落盘，调用方持有 p.mu。
+// 检查点之后新分配的页恢复时直接截掉，不需要保存
+func (p *Pager) protect(ids ...PageID) error {
+	written := false
+	for _, id := range ids {
+		if uint32(id) >= p.base || p.journaled[id] {
+			continue
+		}
+		if p.journal == nil {
+			if err := p.createJournal(); err != nil {
+				return err
+			}
+		}
+		buf := make([]byte, journalEntrySize)
+		if _, err := p.file.ReadAt(buf[8:], int64(id)*PageSize); err != nil && err != io.EOF {
+			return err
+		}
+		binary.LittleEndian.PutUint32(buf, uint32(id))
+		binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(buf[8:]))
+		if err := writeAt(p.journal, buf, p.journalSize); err != nil {
+			return err
+		}
+		p.journalSize += journalEntrySize
+		p.journaled[id] = true
+		written = true
+	}
+	if written {
+		return syncFile(p.journal)
+	}
+	return nil
+}
+
+func (p *Pager) createJournal() error {
+	path := p.path + journalSuffix
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, journalHeaderSize)
+	copy(header, journalMagic)
+	binary.LittleEndian.PutUint32(header[8:], p.base)
+	if err := writeAt(file, header, 0); err != nil {
+		file.Close()
+		return err
+	}
+	if err := syncDir(path); err != nil {
+		file.Close()
+		return err
+	}
+	p.journal = file
+	p.journalSize = journalHeaderSize
+	return nil
+}
+
+// dropJournal 数据文件落盘后删除回滚日志，当前的页数作为新的检查点。调用方持有 p.mu
+func (p *Pager) dropJournal() error {
+	p.base = p.pageCount
+	p.journaled = make(map[PageID]bool)
+	if p.journal == nil {
+		return nil
+	}
+	p.journal.Close()
+	p.journal = nil
+	path := p.path + journalSuffix
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// restoreJournal 打开数据文件前，如果有上次没有删除的回滚日志，把数据文件恢复到检查点时的样子
+func restoreJournal(path string) error {
+	journalPath := path + journalSuffix
+	data, err := os.ReadFile(journalPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// 文件头不完整说明还没有覆盖过任何页
+	if len(data) >= journalHeaderSize && string(data[:8]) == journalMagic {
+		file, err := os.OpenFile(path, os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		base := binary.LittleEndian.Uint32(data[8:])
+		// 最后一项可能只写了一半，那时对应的页还没有被覆盖
+		for pos := journalHeaderSize; pos+journalEntrySize <= len(data); pos += journalEntrySize {
+			entry := data[pos : pos+journalEntrySize]
+			page := entry[8:]
+			if crc32.ChecksumIEEE(page) != binary.LittleEndian.Uint32(entry[4:]) {
+				break
+			}
+			id := binary.LittleEndian.Uint32(entry)
+			if id >= base {
+				return fmt.Errorf("回滚日志 %s 已损坏", journalPath)
+			}
+			if err := writeAt(file, page, int64(id)*PageSize); err != nil {
+				return err
+			}
+		}
+		if err := file.Truncate(int64(base) * PageSize); err != nil {
+			return err
+		}
+		if err := syncFile(file); err != nil {
+			return err
+		}
+		fmt.Printf("已用回滚日志恢复 %s\n", path)
+	}
+	if err := os.Remove(journalPath); err != nil {
+		return err
+	}
+	return syncDir(journalPath)
+}
@@ -0,0 +1,244 @@
+package storgeengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Key b+树的关键字，是列值的保序编码: 逐字节比较两个关键字的结果和依次比较原来的值的结果一致，
+// 复合关键字就是各列的编码依次拼接。用 string 保存，可以直接作为 map 的键
+//
+// 每个值以类型标记开头，NULL < 数字 < 字符串 < 时间 < 二进制:
+//
+//	NULL   0x01
+//	数字   0x02 | 整数部分 int64 大端、翻转符号位 | 0x00，有小数部分时为 0x01 | 小数部分的 float64 位 大端
+//	字符串 0x03 | 内容，其中的 0x00 写成 0x00 0xff | 结束标记 0x00 0x01
+//	时间   0x04 | Unix 秒数 int64 大端、翻转符号位 | 纳秒 uint32 大端
+//	二进制 0x05 | 和字符串相同
+//
+// 整数、浮点数、DECIMAL 和布尔值(0 和 1)用同一种编码，1 和 1.0 的关键字相同；DECIMAL 的小数部分超出 float64 精度的差别
+// 在关键字中区分不出来。日期和时间用同一种编码，日期就是那一天的 0 点。字符串的结束标记比任何内容字节都小，
+// 所以一个字符串排在以它为前缀的字符串之前，后面拼接的列也不会影响前面的列的顺序
+type Key string
+
+// maxKeyLen 关键字的最大长度，页和日志中用 uint16 保存关键字的长度
+const maxKeyLen = math.MaxUint16
+
+// Comparator 比较两个关键字，返回 -1、0、1
+type Comparator func(a, b Key) int
+
+// compareBytes 默认的比较方式，逐字节比较
+func compareBytes(a, b Key) int {
+	return strings.Compare(string(a), string(b))
+}
+
+const (
+	keyNull   byte = 0x01
+	keyNumber byte = 0x02
+	keyString byte = 0x03
+	keyTime   byte = 0x04
+	keyBytes  byte = 0x05
+	// keyMax 大于任何类型标记，加在前缀后面得到的关键字大于所有以这个前缀开头的关键字
+	keyMax byte = 0xff
+)
+
+// EncodeKey 把一组值编码成关键字，值为 nil 或列中保存的各种类型的值
+func EncodeKey(values ...interface{}) Key {
+	var buf []byte
+	for _, v := range values {
+		buf = appendKeyValue(buf, v)
+	}
+	return Key(buf)
+}
+
+// IntKey 整数的关键字
+func IntKey(i int64) Key {
+	return EncodeKey(i)
+}
+
+// StringKey 字符串的关键字
+func StringKey(s string) Key {
+	return EncodeKey(s)
+}
+
+func appendKeyValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, keyNull)
+	case int64:
+		buf = append(buf, keyNumber)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(v)^1<<63)
+		return append(buf, 0)
+	case int:
+		return appendKeyValue(buf, int64(v))
+	case bool:
+		return appendKeyValue(buf, boolInt(v))
+	case float64:
+		whole := math.Floor(v)
+		var i int64
+		switch {
+		case whole >= math.MaxInt64:
+			i = math.MaxInt64
+		case whole <= math.MinInt64:
+			i = math.MinInt64
+		default:
+			i = int64(whole)
+		}
+		return appendKeyNumber(buf, i, v-whole)
+	case Decimal:
+		whole, frac := v.keyParts()
+		return appendKeyNumber(buf, whole, frac)
+	case string:
+		return appendKeyText(append(buf, keyString), v)
+	case []byte:
+		return appendKeyText(append(buf, keyBytes), string(v))
+	case Date:
+		return appendKeyValue(buf, v.Time)
+	case time.Time:
+		buf = append(buf, keyTime)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(v.Unix())^1<<63)
+		return binary.BigEndian.AppendUint32(buf, uint32(v.Nanosecond()))
+	}
+	// 其他类型按字符串保存，编码仍然是保序的
+	return appendKeyValue(buf, fmt.Sprint(value))
+}
+
+func appendKeyNumber(buf []byte, whole int64, frac float64) []byte {
+	buf = append(buf, keyNumber)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(whole)^1<<63)
+	if frac > 0 && frac < 1 {
+		// [0, 1) 中的正数按位比较的顺序和数值的顺序一致
+		buf = append(buf, 1)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(frac))
+	}
+	return append(buf, 0)
+}
+
+func appendKeyText(buf []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 {
+			buf = append(buf, 0, 0xff)
+		} else {
+			buf = append(buf, s[i])
+		}
+	}
+	return append(buf, 0, 1)
+}
+
+// decodeKey 还原关键字中的各个值，小数部分为 0 的数字还原成 int64，其他的数字还原成 float64，
+// 时间还原成 time.Time。需要列的类型时用 Column.coerce 转换
+func decodeKey(key Key) ([]interface{}, error) {
+	var values []interface{}
+	for s := string(key); len(s) > 0; {
+		tag := s[0]
+		s = s[1:]
+		switch tag {
+		case keyNull:
+			values = append(values, nil)
+		case keyNumber:
+			if len(s) < 9 {
+				return nil, fmt.Errorf("关键字已损坏")
+			}
+			i := int64(binary.BigEndian.Uint64([]byte(s[:8])) ^ 1<<63)
+			if s[8] == 0 {
+				values = append(values, i)
+				s = s[9:]
+				continue
+			}
+			if len(s) < 17 {
+				return nil, fmt.Errorf("关键字已损坏")
+			}
+			values = append(values, float64(i)+math.Float64frombits(binary.BigEndian.Uint64([]byte(s[9:17]))))
+			s = s[17:]
+		case keyString, keyBytes:
+			var b strings.Builder
+			for {
+				if len(s) < 2 && (len(s) == 0 || s[0] == 0) {
+					return nil, fmt.Errorf("关键字已损坏")
+				}
+				if s[0] != 0 {
+					b.WriteByte(s[0])
+					s = s[1:]
+					continue
+				}
+				if s[1] == 1 {
+					s = s[2:]
+					break
+				}
+				b.WriteByte(0)
+				s = s[2:]
+			}
+			if tag == keyBytes {
+				values = append(values, []byte(b.String()))
+			} else {
+				values = append(values, b.String())
+			}
+		case keyTime:
+			if len(s) < 12 {
+				return nil, fmt.Errorf("关键字已损坏")
+			}
+			sec := int64(binary.BigEndian.Uint64([]byte(s[:8])) ^ 1<<63)
+			values = append(values, time.Unix(sec, int64(binary.BigEndian.Uint32([]byte(s[8:12])))).UTC())
+			s = s[12:]
+		default:
+			return nil, fmt.Errorf("关键字已损坏")
+		}
+	}
+	return values, nil
+}
+
+// String 关键字写成 SQL 常量的样子，复合关键字加上括号，例如 1 或 (1, 'a')
+func (key Key) String() string {
+	values, err := decodeKey(key)
+	if err != nil {
+		return fmt.Sprintf("%q", string(key))
+	}
+	return describeValues(values)
+}
+
+// prefixEnd 比所有以 key 为前缀的关键字都大的关键字，用作前缀范围的上界
+func (key Key) prefixEnd() Key {
+	return key + Key(keyMax)
+}
+
+// prefixRange 以 prefix 开头的全部关键字
+func prefixRange(prefix Key) keyRange {
+	end := prefix.prefixEnd()
+	return keyRange{low: &prefix, high: &end, lowIncl: true}
+}
+
+// keyValueLen 关键字中第一个值的编码的长度，关键字已损坏时返回 -1
+func keyValueLen(key Key) int {
+	if len(key) == 0 {
+		return -1
+	}
+	switch key[0] {
+	case keyNull:
+		return 1
+	case keyNumber:
+		if len(key) >= 10 && key[9] == 0 {
+			return 10
+		}
+		if len(key) >= 18 {
+			return 18
+		}
+	case keyTime:
+		if len(key) >= 13 {
+			return 13
+		}
+	case keyString, keyBytes:
+		for i := 1; i+1 < len(key); i++ {
+			if key[i] != 0 {
+				continue
+			}
+			if key[i+1] == 1 {
+				return i + 2
+			}
+			i++
+		}
+	}
+	return -1
+}
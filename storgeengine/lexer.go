@@ -0,0 +1,305 @@
+package storgeengine
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// TokenType 词法单元的类型
+type TokenType int
+
+const (
+	TokEOF      TokenType = iota
+	TokIdent              // 标识符，未加引号的会统一转成大写
+	TokKeyword            // 关键字
+	TokString             // 字符串字面量，保留原始大小写和空格
+	TokNumber             // 数字字面量
+	TokOperator           // 运算符 = <> != < <= > >= + - * / %
+	TokPunct              // 标点 , ( ) ; .
+	TokParam              // 参数 $1、$2 ... 或 ?，值在解析时给出
+)
+
+func (t TokenType) String() string {
+	switch t {
+	case TokEOF:
+		return "结束符"
+	case TokIdent:
+		return "标识符"
+	case TokKeyword:
+		return "关键字"
+	case TokString:
+		return "字符串"
+	case TokNumber:
+		return "数字"
+	case TokOperator:
+		return "运算符"
+	case TokPunct:
+		return "标点"
+	case TokParam:
+		return "参数"
+	}
+	return "未知"
+}
+
+// Token 词法单元，Line 和 Col 从 1 开始计数
+type Token struct {
+	Type TokenType
+	Text string
+	Line int
+	Col  int
+}
+
+// keywords SQL 关键字，词法分析时不区分大小写
+var keywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "INSERT": true, "INTO": true,
+	"VALUES": true, "UPDATE": true, "SET": true, "DELETE": true, "CREATE": true,
+	"DATABASE": true, "TABLE": true, "USE": true, "HELP": true, "EXIT": true,
+	"AND": true, "OR": true, "NOT": true, "NULL": true, "IS": true,
+	"IN": true, "LIKE": true, "BETWEEN": true, "AS": true, "ORDER": true,
+	"BY": true, "ASC": true, "DESC": true, "LIMIT": true, "OFFSET": true,
+	"GROUP": true, "HAVING": true, "DISTINCT": true,
+	"JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "OUTER": true, "CROSS": true, "ON": true,
+	"BEGIN": true, "START": true, "TRANSACTION": true, "WORK": true, "COMMIT": true, "ROLLBACK": true,
+	"INDEX": true, "UNIQUE": true, "DROP": true,
+	"PRIMARY": true, "KEY": true, "DEFAULT": true, "CHECK": true, "CONSTRAINT": true,
+	"FOREIGN": true, "REFERENCES": true, "CASCADE": true, "RESTRICT": true, "NO": true, "ACTION": true,
+	"AUTO_INCREMENT": true, "SEQUENCE": true, "INCREMENT": true, "WITH": true,
+	"TRUE": true, "FALSE": true,
+}
+
+// SyntaxError 语法错误，记录出错位置
+type SyntaxError struct {
+	Line int
+	Col  int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("语法错误 (第 %d 行, 第 %d 列): %s", e.Line, e.Col, e.Msg)
+}
+
+// Lexer 词法分析器
+type Lexer struct {
+	src  []rune
+	pos  int
+	line int
+	col  int
+}
+
+func NewLexer(sql string) *Lexer {
+	return &Lexer{src: []rune(sql), line: 1, col: 1}
+}
+
+// Tokenize 把整条 SQL 切分成词法单元，最后一个总是 TokEOF
+func Tokenize(sql string) ([]Token, error) {
+	lx := NewLexer(sql)
+	tokens := make([]Token, 0)
+	for {
+		tok, err := lx.Next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+		if tok.Type == TokEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (lx *Lexer) peek(offset int) rune {
+	if lx.pos+offset >= len(lx.src) {
+		return 0
+	}
+	return lx.src[lx.pos+offset]
+}
+
+func (lx *Lexer) advance() rune {
+	r := lx.src[lx.pos]
+	lx.pos++
+	if r == '\n' {
+		lx.line++
+		lx.col = 1
+	} else {
+		lx.col++
+	}
+	return r
+}
+
+func (lx *Lexer) errorf(line, col int, format string, args ...interface{}) error {
+	return &SyntaxError{Line: line, Col: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+// 跳过空白和注释，支持 -- 行注释和 /* */ 块注释
+func (lx *Lexer) skipSpaceAndComments() error {
+	for lx.pos < len(lx.src) {
+		r := lx.peek(0)
+		switch {
+		case unicode.IsSpace(r):
+			lx.advance()
+		case r == '-' && lx.peek(1) == '-':
+			for lx.pos < len(lx.src) && lx.peek(0) != '\n' {
+				lx.advance()
+			}
+		case r == '/' && lx.peek(1) == '*':
+			line, col := lx.line, lx.col
+			lx.advance()
+			lx.advance()
+			for {
+				if lx.pos >= len(lx.src) {
+					return lx.errorf(line, col, "注释没有结束")
+				}
+				if lx.peek(0) == '*' && lx.peek(1) == '/' {
+					lx.advance()
+					lx.advance()
+					break
+				}
+				lx.advance()
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// Next 返回下一个词法单元
+func (lx *Lexer) Next() (Token, error) {
+	if err := lx.skipSpaceAndComments(); err != nil {
+		return Token{}, err
+	}
+	line, col := lx.line, lx.col
+	if lx.pos >= len(lx.src) {
+		return Token{Type: TokEOF, Line: line, Col: col}, nil
+	}
+
+	r := lx.peek(0)
+	switch {
+	case r == '\'':
+		text, err := lx.readQuoted('\'')
+		if err != nil {
+			return Token{}, err
+		}
+		return Token{Type: TokString, Text: text, Line: line, Col: col}, nil
+	case r == '"' || r == '`':
+		// 引号中的标识符保留原样
+		text, err := lx.readQuoted(r)
+		if err != nil {
+			return Token{}, err
+		}
+		return Token{Type: TokIdent, Text: text, Line: line, Col: col}, nil
+	case unicode.IsDigit(r) || (r == '.' && unicode.IsDigit(lx.peek(1))):
+		return Token{Type: TokNumber, Text: lx.readNumber(), Line: line, Col: col}, nil
+	case r == '$' && unicode.IsDigit(lx.peek(1)):
+		lx.advance()
+		return Token{Type: TokParam, Text: "$" + lx.readNumber(), Line: line, Col: col}, nil
+	case r == '?':
+		lx.advance()
+		return Token{Type: TokParam, Text: "?", Line: line, Col: col}, nil
+	case r == '_' || unicode.IsLetter(r):
+		word := strings.ToUpper(lx.readWord())
+		if keywords[word] {
+			return Token{Type: TokKeyword, Text: word, Line: line, Col: col}, nil
+		}
+		return Token{Type: TokIdent, Text: word, Line: line, Col: col}, nil
+	}
+
+	// 运算符和标点
+	lx.advance()
+	switch r {
+	case ',', '(', ')', ';', '.':
+		return Token{Type: TokPunct, Text: string(r), Line: line, Col: col}, nil
+	case '=', '+', '-', '*', '/', '%':
+		return Token{Type: TokOperator, Text: string(r), Line: line, Col: col}, nil
+	case '<':
+		if lx.peek(0) == '=' || lx.peek(0) == '>' {
+			return Token{Type: TokOperator, Text: string([]rune{r, lx.advance()}), Line: line, Col: col}, nil
+		}
+		return Token{Type: TokOperator, Text: "<", Line: line, Col: col}, nil
+	case '>':
+		if lx.peek(0) == '=' {
+			lx.advance()
+			return Token{Type: TokOperator, Text: ">=", Line: line, Col: col}, nil
+		}
+		return Token{Type: TokOperator, Text: ">", Line: line, Col: col}, nil
+	case '!':
+		if lx.peek(0) == '=' {
+			lx.advance()
+			// != 和 <> 等价
+			return Token{Type: TokOperator, Text: "<>", Line: line, Col: col}, nil
+		}
+	}
+	return Token{}, lx.errorf(line, col, "无法识别的字符 %q", r)
+}
+
+// 读取引号包围的内容，两个连续引号或反斜杠用于转义
+func (lx *Lexer) readQuoted(quote rune) (string, error) {
+	line, col := lx.line, lx.col
+	lx.advance()
+	var sb strings.Builder
+	for {
+		if lx.pos >= len(lx.src) {
+			return "", lx.errorf(line, col, "引号没有闭合")
+		}
+		r := lx.advance()
+		if r == quote {
+			if lx.peek(0) == quote {
+				lx.advance()
+				sb.WriteRune(quote)
+				continue
+			}
+			return sb.String(), nil
+		}
+		if r == '\\' && quote == '\'' && lx.pos < len(lx.src) {
+			switch esc := lx.advance(); esc {
+			case 'n':
+				sb.WriteRune('\n')
+			case 't':
+				sb.WriteRune('\t')
+			case 'r':
+				sb.WriteRune('\r')
+			case '0':
+				sb.WriteRune(0)
+			default:
+				sb.WriteRune(esc)
+			}
+			continue
+		}
+		sb.WriteRune(r)
+	}
+}
+
+func (lx *Lexer) readNumber() string {
+	start := lx.pos
+	for unicode.IsDigit(lx.peek(0)) {
+		lx.advance()
+	}
+	if lx.peek(0) == '.' {
+		lx.advance()
+		for unicode.IsDigit(lx.peek(0)) {
+			lx.advance()
+		}
+	}
+	// 科学计数法 1e10 / 1.5E-3
+	if e := lx.peek(0); e == 'e' || e == 'E' {
+		next := lx.peek(1)
+		if unicode.IsDigit(next) || ((next == '+' || next == '-') && unicode.IsDigit(lx.peek(2))) {
+			lx.advance()
+			if next == '+' || next == '-' {
+				lx.advance()
+			}
+			for unicode.IsDigit(lx.peek(0)) {
+				lx.advance()
+			}
+		}
+	}
+	return string(lx.src[start:lx.pos])
+}
+
+func (lx *Lexer) readWord() string {
+	start := lx.pos
+	for r := lx.peek(0); r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r); r = lx.peek(0) {
+		lx.advance()
+	}
+	return string(lx.src[start:lx.pos])
+}
@@ -0,0 +1,177 @@
+package storgeengine
+
+// 多版本并发控制(MVCC): b+树中的每个数据项是一行的一个版本，带有创建和结束它的事务的提交时间戳。
+// 事务开始时取当前的提交时间戳作为快照，只能看到快照之前提交、快照时还没有结束的版本，
+// 读的时候不需要加数据库的锁。行被替换时旧版本移到表的版本链中，被删除时留在 b+树中作为删除标记，
+// 等到没有快照还需要它们时由 gc 清理
+
+// garbage 在提交时间戳 ts 结束了版本的一行，所有快照都不早于 ts 时可以清理
+type garbage struct {
+	table *BPTable
+	key   Key
+	ts    uint64
+}
+
+// visibleAt 版本对快照是否可见: 在快照之前提交，并且在快照时还没有被删除或替换
+func (item BPItem) visibleAt(snapshot uint64) bool {
+	return item.Begin <= snapshot && (item.End == 0 || item.End > snapshot)
+}
+
+// resolve 找出 b+树中的数据项在快照中对应的版本，快照中这一行不存在时返回 false
+func (table *BPTable) resolve(item BPItem, snapshot uint64) (BPItem, bool) {
+	if item.visibleAt(snapshot) {
+		return item, true
+	}
+	if item.Begin <= snapshot {
+		// 在快照之前已经删除
+		return BPItem{}, false
+	}
+	table.vmu.RLock()
+	defer table.vmu.RUnlock()
+	// 版本链从新到旧，第一个在快照之前创建的版本就是快照中的那一行
+	for _, v := range table.versions[item.Key] {
+		if v.Begin <= snapshot {
+			return v, v.visibleAt(snapshot)
+		}
+	}
+	return BPItem{}, false
+}
+
+// pushVersion 被替换的版本放到版本链的最前面
+func (table *BPTable) pushVersion(item BPItem) {
+	table.vmu.Lock()
+	defer table.vmu.Unlock()
+	if table.versions == nil {
+		table.versions = make(map[Key][]BPItem)
+	}
+	table.versions[item.Key] = append([]BPItem{item}, table.versions[item.Key]...)
+}
+
+// prune 清理一行在 horizon 之前结束的版本，b+树中的删除标记也一起删除，
+// 再从索引中删掉剩下的版本已经用不到的索引项
+func (table *BPTable) prune(key Key, horizon uint64) {
+	var dropped, remaining []map[string]interface{}
+	table.vmu.Lock()
+	kept := table.versions[key][:0]
+	for _, v := range table.versions[key] {
+		if v.End > horizon {
+			kept = append(kept, v)
+			remaining = append(remaining, table.decode(v.Val))
+		} else {
+			dropped = append(dropped, table.decode(v.Val))
+		}
+	}
+	if len(kept) == 0 {
+		delete(table.versions, key)
+	} else {
+		table.versions[key] = kept
+	}
+	table.vmu.Unlock()
+
+	if item, ok := table.Tree.lookup(key); ok && item.End != 0 && item.End <= horizon {
+		table.Tree.Remove(key)
+		dropped = append(dropped, table.decode(item.Val))
+	} else if ok {
+		remaining = append(remaining, table.decode(item.Val))
+	}
+	if len(dropped) > 0 {
+		table.unindex(key, dropped, remaining)
+	}
+}
+
+// purgeDeleted 删除 b+树中所有的删除标记。只在启动时调用，那时没有任何快照，
+// 上次退出前还有快照需要的删除标记可能已经写进了数据文件
+func (table *BPTable) purgeDeleted() {
+	var keys []Key
+	table.Tree.scanRange(keyRange{}, false, func(item BPItem) bool {
+		if item.End != 0 {
+			keys = append(keys, item.Key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		table.Tree.Remove(key)
+	}
+}
+
+// begin 开始一个事务，取当前的提交时间戳作为快照并登记，gc 不会清理它还能看到的版本
+func (db *DB) begin() *txn {
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	tx := &txn{snapshot: db.clock}
+	db.snapshots[tx.snapshot]++
+	return tx
+}
+
+// release 事务结束，注销它的快照
+func (db *DB) release(tx *txn) {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	if db.snapshots[tx.snapshot]--; db.snapshots[tx.snapshot] == 0 {
+		delete(db.snapshots, tx.snapshot)
+	}
+}
+
+// publish 事务的修改全部写进 b+树之后推进提交时间戳，之后开始的快照才能看到它们
+func (db *DB) publish(ts uint64) {
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	db.clock = ts
+}
+
+// horizon 最早的活动快照，没有快照时就是当前的提交时间戳。结束时间不晚于它的版本已经没有快照能看到
+func (db *DB) horizon() uint64 {
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	h := db.clock
+	for snapshot := range db.snapshots {
+		if snapshot < h {
+			h = snapshot
+		}
+	}
+	return h
+}
+
+// install 把提交的一行写成提交时间戳为 ts 的新版本。原来的版本结束于 ts，
+// 被替换时先移到版本链中再写新版本，并发的读者在任何时刻都能找到自己快照中的那一行；
+// 被删除时留在 b+树中作为删除标记。新版本在写进 b+树之前先加进索引。rec 是编码后的 row，
+// 和日志中写的是同一份。调用方持有 db.commitMu
+func (db *DB) install(table *BPTable, key Key, row map[string]interface{}, rec Record, ts uint64) {
+	old, exists := table.Tree.lookup(key)
+	if exists && old.End == 0 {
+		old.End = ts
+	}
+	switch {
+	case row != nil:
+		if exists {
+			table.pushVersion(old)
+		}
+		table.index(key, row)
+		table.Tree.put(BPItem{Key: key, Val: rec, Begin: ts})
+	case exists && old.End == ts:
+		table.Tree.put(old)
+	default:
+		return
+	}
+	if exists {
+		db.garbage = append(db.garbage, garbage{table: table, key: key, ts: ts})
+	}
+}
+
+// gc 按提交的顺序清理已经没有快照需要的旧版本。调用方持有 db.commitMu
+func (db *DB) gc() {
+	horizon := db.horizon()
+	n := 0
+	for ; n < len(db.garbage) && db.garbage[n].ts <= horizon; n++ {
+		db.garbage[n].table.prune(db.garbage[n].key, horizon)
+	}
+	if n == len(db.garbage) {
+		db.garbage = nil
+	} else {
+		db.garbage = db.garbage[n:]
+	}
+}
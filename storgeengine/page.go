@@ -0,0 +1,225 @@
+package storgeengine
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// 页的类型，写在每一页的第一个字节
+const (
+	pageLeaf     byte = 1
+	pageInternal byte = 2
+	pageOverflow byte = 3
+	pageFree     byte = 4
+)
+
+// 结点页的布局: 类型 uint8 | 下一个溢出页 uint32 | 本页数据长度 uint16 | 数据。
+// 一个结点序列化后放不下一页时，剩下的数据依次写到溢出页中
+const (
+	nodePageHeader = 7
+	nodePageData   = PageSize - nodePageHeader
+)
+
+// 结点序列化后的内容
+//
+//	叶子结点: 下一个叶子 uint32 | 数据项个数 uint16 | 每项为 主键长度 uint16、主键、版本起止时间戳 uint64 x2、行长度 uint32、按表结构编码的行
+//	内部结点: 子结点个数 uint16 | 每个子结点为 页号 uint32、最大关键字长度 uint16、最大关键字
+func encodeNode(node *BPNode) []byte {
+	var buf []byte
+	if node.Leaf {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(node.Next))
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(node.Items)))
+		for _, item := range node.Items {
+			buf = appendKey(buf, item.Key)
+			buf = binary.LittleEndian.AppendUint64(buf, item.Begin)
+			buf = binary.LittleEndian.AppendUint64(buf, item.End)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(item.Val)))
+			buf = append(buf, item.Val...)
+		}
+		return buf
+	}
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(node.Nodes)))
+	for _, child := range node.Nodes {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(child.ID))
+		buf = appendKey(buf, child.MaxKey)
+	}
+	return buf
+}
+
+// appendKey 写入关键字: 长度 uint16 | 内容，关键字的长度在生成时已经检查过
+func appendKey(buf []byte, key Key) []byte {
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(key)))
+	return append(buf, key...)
+}
+
+func decodeNode(id PageID, kind byte, buf []byte, width int, schema TableSchema) (*BPNode, error) {
+	r := pageReader{buf: buf}
+	var node *BPNode
+	if kind == pageLeaf {
+		node = NewLeafNode(width)
+		node.Next = PageID(r.uint32())
+		n := int(r.uint16())
+		for i := 0; i < n && r.err == nil; i++ {
+			item := BPItem{Key: r.key(), Begin: r.uint64(), End: r.uint64()}
+			item.Val = Record(r.bytes(int(r.uint32())))
+			if r.err == nil {
+				if err := checkRecord(schema, item.Val); err != nil {
+					return nil, fmt.Errorf("页 %d: %v", id, err)
+				}
+			}
+			node.Items = append(node.Items, item)
+		}
+		if len(node.Items) > 0 {
+			node.MaxKey = node.Items[len(node.Items)-1].Key
+		}
+	} else {
+		node = NewIndexNode(width)
+		n := int(r.uint16())
+		for i := 0; i < n && r.err == nil; i++ {
+			node.Nodes = append(node.Nodes, childRef{ID: PageID(r.uint32()), MaxKey: r.key()})
+		}
+		if len(node.Nodes) > 0 {
+			node.MaxKey = node.Nodes[len(node.Nodes)-1].MaxKey
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("页 %d 已损坏", id)
+	}
+	node.ID = id
+	return node, nil
+}
+
+// pageReader 顺序读取页中的数据，越界时记录错误并返回零值
+type pageReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *pageReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || r.pos+n > len(r.buf) {
+		r.err = fmt.Errorf("数据不完整")
+		return nil
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *pageReader) key() Key {
+	return Key(r.bytes(int(r.uint16())))
+}
+
+func (r *pageReader) uint8() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *pageReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *pageReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *pageReader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// readNode 读出结点所在的页以及它的溢出页
+func (p *Pager) readNode(id PageID, width int) (*BPNode, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var data []byte
+	var kind byte
+	var overflow []PageID
+	for page := id; page != invalidPage; {
+		buf, err := p.readPage(page)
+		if err != nil {
+			return nil, err
+		}
+		if page == id {
+			kind = buf[0]
+			if kind != pageLeaf && kind != pageInternal {
+				return nil, fmt.Errorf("页 %d 不是 b+树结点", id)
+			}
+		} else {
+			if buf[0] != pageOverflow {
+				return nil, fmt.Errorf("页 %d 不是溢出页", page)
+			}
+			overflow = append(overflow, page)
+		}
+		used := int(binary.LittleEndian.Uint16(buf[5:]))
+		if used > nodePageData {
+			return nil, fmt.Errorf("页 %d 已损坏", page)
+		}
+		data = append(data, buf[nodePageHeader:nodePageHeader+used]...)
+		page = PageID(binary.LittleEndian.Uint32(buf[1:]))
+	}
+	node, err := decodeNode(id, kind, data, width, p.schema)
+	if err != nil {
+		return nil, err
+	}
+	node.overflow = overflow
+	return node, nil
+}
+
+// writeNode 把结点写回它所在的页，溢出页不够时分配新页，多余的释放掉
+func (p *Pager) writeNode(node *BPNode) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data := encodeNode(node)
+	need := (len(data) + nodePageData - 1) / nodePageData
+	if need < 1 {
+		need = 1
+	}
+	for len(node.overflow) < need-1 {
+		id, err := p.allocateLocked()
+		if err != nil {
+			return err
+		}
+		node.overflow = append(node.overflow, id)
+	}
+	p.freed = append(p.freed, node.overflow[need-1:]...)
+	node.overflow = node.overflow[:need-1]
+
+	pages := append([]PageID{node.ID}, node.overflow...)
+	if err := p.protect(pages...); err != nil {
+		return err
+	}
+	for i, id := range pages {
+		buf := make([]byte, PageSize)
+		buf[0] = pageOverflow
+		if i == 0 {
+			buf[0] = pageInternal
+			if node.Leaf {
+				buf[0] = pageLeaf
+			}
+		}
+		if i+1 < len(pages) {
+			binary.LittleEndian.PutUint32(buf[1:], uint32(pages[i+1]))
+		}
+		chunk := data[i*nodePageData:]
+		if len(chunk) > nodePageData {
+			chunk = chunk[:nodePageData]
+		}
+		binary.LittleEndian.PutUint16(buf[5:], uint16(len(chunk)))
+		copy(buf[nodePageHeader:], chunk)
+		if err := p.writePage(id, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
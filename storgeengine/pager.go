@@ -0,0 +1,277 @@
+package storgeengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// PageSize 数据文件中每一页的大小
+const PageSize = 4096
+
+// PageID 页在数据文件中的编号，第 0 页是文件头，所以 0 也用来表示"没有页"
+type PageID uint32
+
+const invalidPage PageID = 0
+
+// 文件头(第 0 页)的布局:
+//
+//	0  魔数 "ALSQLTBL"
+//	8  版本号        uint16
+//	10 页大小        uint32
+//	14 总页数        uint32
+//	18 根结点所在页  uint32
+//	22 空闲页链表头  uint32
+//	26 b+树宽度      uint16
+//	28 表结构长度    uint16
+//	30 表结构
+const (
+	pageMagic     = "ALSQLTBL"
+	pageVersion   = 4 // 2: 数据项带有版本的起止时间戳；3: 关键字是保序编码的字节串；4: 行按表结构编码
+	headerSize    = 30
+	maxSchemaSize = PageSize - headerSize
+)
+
+// storageError 读写数据文件时的错误。b+树的操作不返回错误，
+// 出错时用它 panic，由 Execute 统一恢复成 SQLResult.Error
+type storageError struct {
+	err error
+}
+
+func (e storageError) Error() string {
+	return "存储错误: " + e.err.Error()
+}
+
+func throwStorage(format string, args ...interface{}) {
+	panic(storageError{fmt.Errorf(format, args...)})
+}
+
+// Pager 以固定大小的页读写一个表的数据文件，并管理页的分配和回收。
+// 缓冲池淘汰结点时也会写文件，所以页的分配和读写都要加锁
+type Pager struct {
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	pageCount uint32
+	root      PageID
+	freeHead  PageID   // 文件中空闲页链表的头
+	freed     []PageID // 本次刷盘前释放的页，刷盘时才挂到空闲链表上
+	width     int
+	schema    TableSchema
+	dirty     bool // 文件头需要重写
+
+	base        uint32 // 上一个检查点时的总页数
+	journal     *os.File
+	journalSize int64
+	journaled   map[PageID]bool // 已经保存到回滚日志中的页
+}
+
+// createPager 新建数据文件，只写入文件头
+func createPager(path string, schema TableSchema, width int) (*Pager, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pager{path: path, file: file, pageCount: 1, width: width, schema: schema, dirty: true, journaled: make(map[PageID]bool)}
+	if len(encodeSchema(schema)) > maxSchemaSize {
+		file.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("表结构太大，无法写入文件头")
+	}
+	return p, nil
+}
+
+// openPager 打开已有的数据文件并读取文件头，有回滚日志时先恢复
+func openPager(path string) (*Pager, error) {
+	if err := restoreJournal(path); err != nil {
+		return nil, fmt.Errorf("恢复 %s 失败: %v", path, err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, PageSize)
+	if _, err := io.ReadFull(file, buf); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("读取文件头失败 %s: %v", path, err)
+	}
+	if string(buf[:8]) != pageMagic {
+		file.Close()
+		return nil, fmt.Errorf("%s 不是数据文件", path)
+	}
+	if v := binary.LittleEndian.Uint16(buf[8:]); v != pageVersion {
+		file.Close()
+		return nil, fmt.Errorf("不支持的数据文件版本 %d", v)
+	}
+	if size := binary.LittleEndian.Uint32(buf[10:]); size != PageSize {
+		file.Close()
+		return nil, fmt.Errorf("数据文件的页大小 %d 与程序不一致", size)
+	}
+	p := &Pager{
+		path:      path,
+		file:      file,
+		pageCount: binary.LittleEndian.Uint32(buf[14:]),
+		root:      PageID(binary.LittleEndian.Uint32(buf[18:])),
+		freeHead:  PageID(binary.LittleEndian.Uint32(buf[22:])),
+		width:     int(binary.LittleEndian.Uint16(buf[26:])),
+		journaled: make(map[PageID]bool),
+	}
+	p.base = p.pageCount
+	schemaLen := int(binary.LittleEndian.Uint16(buf[28:]))
+	if schemaLen > maxSchemaSize {
+		file.Close()
+		return nil, fmt.Errorf("文件头中的表结构已损坏")
+	}
+	if p.schema, err = decodeSchema(buf[headerSize : headerSize+schemaLen]); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Pager) writeHeader() error {
+	if err := p.protect(0); err != nil {
+		return err
+	}
+	buf := make([]byte, PageSize)
+	copy(buf, pageMagic)
+	binary.LittleEndian.PutUint16(buf[8:], pageVersion)
+	binary.LittleEndian.PutUint32(buf[10:], PageSize)
+	binary.LittleEndian.PutUint32(buf[14:], p.pageCount)
+	binary.LittleEndian.PutUint32(buf[18:], uint32(p.root))
+	binary.LittleEndian.PutUint32(buf[22:], uint32(p.freeHead))
+	binary.LittleEndian.PutUint16(buf[26:], uint16(p.width))
+	schema := encodeSchema(p.schema)
+	binary.LittleEndian.PutUint16(buf[28:], uint16(len(schema)))
+	copy(buf[headerSize:], schema)
+	return p.writePage(0, buf)
+}
+
+func (p *Pager) readPage(id PageID) ([]byte, error) {
+	if id == invalidPage || uint32(id) >= p.pageCount {
+		return nil, fmt.Errorf("页 %d 超出文件范围", id)
+	}
+	buf := make([]byte, PageSize)
+	_, err := p.file.ReadAt(buf, int64(id)*PageSize)
+	if err == io.EOF {
+		// 分配了但还没写过的页
+		err = nil
+	}
+	return buf, err
+}
+
+// writePage 写入一页，调用方要先用 protect 把原来的内容保存到回滚日志
+func (p *Pager) writePage(id PageID, buf []byte) error {
+	return writeAt(p.file, buf, int64(id)*PageSize)
+}
+
+// allocate 分配一页，优先复用释放的页
+func (p *Pager) allocate() (PageID, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.allocateLocked()
+}
+
+func (p *Pager) allocateLocked() (PageID, error) {
+	if n := len(p.freed); n > 0 {
+		id := p.freed[n-1]
+		p.freed = p.freed[:n-1]
+		return id, nil
+	}
+	p.dirty = true
+	if p.freeHead != invalidPage {
+		id := p.freeHead
+		buf, err := p.readPage(id)
+		if err != nil {
+			return invalidPage, err
+		}
+		if buf[0] != pageFree {
+			return invalidPage, fmt.Errorf("空闲页链表已损坏(页 %d)", id)
+		}
+		p.freeHead = PageID(binary.LittleEndian.Uint32(buf[1:]))
+		return id, nil
+	}
+	id := PageID(p.pageCount)
+	p.pageCount++
+	return id, nil
+}
+
+// free 释放一页，刷盘前不会覆盖它原来的内容
+func (p *Pager) free(id PageID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.freed = append(p.freed, id)
+}
+
+// flush 把释放的页挂到空闲链表上，写文件头并落盘，之后就不再需要回滚日志
+func (p *Pager) flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.protect(p.freed...); err != nil {
+		return err
+	}
+	for _, id := range p.freed {
+		buf := make([]byte, PageSize)
+		buf[0] = pageFree
+		binary.LittleEndian.PutUint32(buf[1:], uint32(p.freeHead))
+		if err := p.writePage(id, buf); err != nil {
+			return err
+		}
+		p.freeHead = id
+		p.dirty = true
+	}
+	p.freed = p.freed[:0]
+	if p.dirty {
+		if err := p.writeHeader(); err != nil {
+			return err
+		}
+		p.dirty = false
+	}
+	if err := syncFile(p.file); err != nil {
+		return err
+	}
+	return p.dropJournal()
+}
+
+func (p *Pager) setRoot(id PageID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.root != id {
+		p.root = id
+		p.dirty = true
+	}
+}
+
+func (p *Pager) Close() error {
+	if p.journal != nil {
+		p.journal.Close()
+	}
+	return p.file.Close()
+}
+
+// 表结构的编码: 列数 uint16，每列为 名字长度 uint16、名字、类型 uint8
+func encodeSchema(schema TableSchema) []byte {
+	buf := binary.LittleEndian.AppendUint16(nil, uint16(len(schema.Columns)))
+	for _, col := range schema.Columns {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(col.Name)))
+		buf = append(buf, col.Name...)
+		buf = append(buf, byte(col.Type))
+	}
+	return buf
+}
+
+func decodeSchema(buf []byte) (TableSchema, error) {
+	var schema TableSchema
+	r := pageReader{buf: buf}
+	n := int(r.uint16())
+	for i := 0; i < n && r.err == nil; i++ {
+		name := string(r.bytes(int(r.uint16())))
+		schema.Columns = append(schema.Columns, Column{Name: name, Type: ColumnType(r.uint8())})
+	}
+	if r.err != nil {
+		return TableSchema{}, fmt.Errorf("文件头中的表结构已损坏")
+	}
+	return schema, nil
+}
@@ -0,0 +1,1349 @@
+package storgeengine
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parser 递归下降语法分析器，把词法单元转换成语法树
+type Parser struct {
+	tokens []Token
+	pos    int
+	args   []interface{} // 参数的值，$n 是 args[n-1]
+	marks  int           // 已经读到的 ? 的个数
+}
+
+// Parse 解析一条 SQL 语句，末尾的分号可有可无
+func Parse(sql string) (Statement, error) {
+	return ParseWithArgs(sql, nil)
+}
+
+// ParseWithArgs 解析带参数的语句，参数 $n 换成 args[n-1]，? 按出现的顺序依次取 args 中的值。
+// 值可以是 Go 的整数、浮点数、string、bool、[]byte、time.Time、Date、Decimal 或 nil
+func ParseWithArgs(sql string, args []interface{}) (Statement, error) {
+	tokens, err := Tokenize(sql)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		if values[i], err = paramValue(arg); err != nil {
+			return nil, fmt.Errorf("参数 $%d: %v", i+1, err)
+		}
+	}
+	p := &Parser{tokens: tokens, args: values}
+	stmt, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+	p.acceptPunct(";")
+	if !p.at(TokEOF) {
+		return nil, p.unexpected()
+	}
+	return stmt, nil
+}
+
+// ParseScript 解析用分号分开的多条语句，空的语句跳过，没有语句时返回空的切片
+func ParseScript(sql string) ([]Statement, error) {
+	tokens, err := Tokenize(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &Parser{tokens: tokens}
+	var stmts []Statement
+	for {
+		for p.acceptPunct(";") {
+		}
+		if p.at(TokEOF) {
+			return stmts, nil
+		}
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+		if !p.acceptPunct(";") && !p.at(TokEOF) {
+			return nil, p.unexpected()
+		}
+	}
+}
+
+// ParseExpr 解析一个单独的表达式。系统目录中的默认值和 check 条件保存成 SQL 文本，打开表时用它还原
+func ParseExpr(text string) (Expr, error) {
+	tokens, err := Tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &Parser{tokens: tokens}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.at(TokEOF) {
+		return nil, p.unexpected()
+	}
+	return expr, nil
+}
+
+func (p *Parser) cur() Token {
+	return p.tokens[p.pos]
+}
+
+func (p *Parser) next() Token {
+	tok := p.tokens[p.pos]
+	if tok.Type != TokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *Parser) at(t TokenType) bool {
+	return p.cur().Type == t
+}
+
+func (p *Parser) atKeyword(kw string) bool {
+	tok := p.cur()
+	return tok.Type == TokKeyword && tok.Text == kw
+}
+
+func (p *Parser) atPunct(s string) bool {
+	tok := p.cur()
+	return tok.Type == TokPunct && tok.Text == s
+}
+
+func (p *Parser) atOperator(s string) bool {
+	tok := p.cur()
+	return tok.Type == TokOperator && tok.Text == s
+}
+
+func (p *Parser) acceptKeyword(kw string) bool {
+	if p.atKeyword(kw) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *Parser) acceptPunct(s string) bool {
+	if p.atPunct(s) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *Parser) errorf(tok Token, format string, args ...interface{}) error {
+	return &SyntaxError{Line: tok.Line, Col: tok.Col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *Parser) unexpected() error {
+	tok := p.cur()
+	if tok.Type == TokEOF {
+		return p.errorf(tok, "语句意外结束")
+	}
+	return p.errorf(tok, "意外的%s %q", tok.Type, tok.Text)
+}
+
+func (p *Parser) expectKeyword(kw string) error {
+	if !p.acceptKeyword(kw) {
+		tok := p.cur()
+		return p.errorf(tok, "缺少关键字 %s", kw)
+	}
+	return nil
+}
+
+func (p *Parser) expectPunct(s string) error {
+	if !p.acceptPunct(s) {
+		tok := p.cur()
+		return p.errorf(tok, "缺少 %q", s)
+	}
+	return nil
+}
+
+func (p *Parser) expectOperator(s string) error {
+	if !p.atOperator(s) {
+		tok := p.cur()
+		return p.errorf(tok, "缺少 %q", s)
+	}
+	p.next()
+	return nil
+}
+
+// 标识符
+func (p *Parser) expectIdent() (string, error) {
+	tok := p.cur()
+	if tok.Type != TokIdent {
+		if tok.Type == TokEOF {
+			return "", p.errorf(tok, "缺少名称")
+		}
+		return "", p.errorf(tok, "需要名称，但得到%s %q", tok.Type, tok.Text)
+	}
+	p.next()
+	return tok.Text, nil
+}
+
+func (p *Parser) parseStatement() (Statement, error) {
+	tok := p.cur()
+	if tok.Type != TokKeyword {
+		if tok.Type == TokEOF {
+			return nil, p.errorf(tok, "空语句")
+		}
+		return nil, p.errorf(tok, "无效的语句 %q", tok.Text)
+	}
+	switch tok.Text {
+	case "EXIT":
+		p.next()
+		return &ExitStmt{}, nil
+	case "HELP":
+		p.next()
+		return &HelpStmt{}, nil
+	case "USE":
+		p.next()
+		name, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		return &UseStmt{Database: name}, nil
+	case "CREATE":
+		return p.parseCreate()
+	case "DROP":
+		return p.parseDrop()
+	case "INSERT":
+		return p.parseInsert()
+	case "UPDATE":
+		return p.parseUpdate()
+	case "DELETE":
+		return p.parseDelete()
+	case "SELECT":
+		return p.parseSelect()
+	case "BEGIN":
+		p.next()
+		if !p.acceptKeyword("TRANSACTION") {
+			p.acceptKeyword("WORK")
+		}
+		return &BeginStmt{}, nil
+	case "START":
+		p.next()
+		if !p.acceptKeyword("TRANSACTION") {
+			return nil, p.unexpected()
+		}
+		return &BeginStmt{}, nil
+	case "COMMIT":
+		p.next()
+		p.acceptKeyword("WORK")
+		return &CommitStmt{}, nil
+	case "ROLLBACK":
+		p.next()
+		p.acceptKeyword("WORK")
+		return &RollbackStmt{}, nil
+	case "SET":
+		return p.parseSet()
+	}
+	return nil, p.errorf(tok, "无效的语句 %q", tok.Text)
+}
+
+// set 变量 = 值。和 MySQL 一样，值可以是没有引号的词，例如 on、off，当作大写的字符串
+func (p *Parser) parseSet() (Statement, error) {
+	p.next()
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectOperator("="); err != nil {
+		return nil, err
+	}
+	if tok := p.cur(); tok.Type == TokIdent || (tok.Type == TokKeyword && tok.Text == "ON") {
+		p.next()
+		return &SetStmt{Name: name, Value: &Literal{Value: strings.ToUpper(tok.Text)}}, nil
+	}
+	value, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &SetStmt{Name: name, Value: value}, nil
+}
+
+// create database xxx | create table xx (字段 类型, ...) | create [unique] index 名字 on 表名 (字段, ...)
+// | create sequence 名字 ...
+func (p *Parser) parseCreate() (Statement, error) {
+	p.next()
+	switch {
+	case p.acceptKeyword("UNIQUE"):
+		if err := p.expectKeyword("INDEX"); err != nil {
+			return nil, err
+		}
+		return p.parseCreateIndex(true)
+	case p.acceptKeyword("INDEX"):
+		return p.parseCreateIndex(false)
+	case p.acceptKeyword("DATABASE"):
+		name, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		return &CreateDatabaseStmt{Name: name}, nil
+	case p.acceptKeyword("TABLE"):
+		return p.parseCreateTable()
+	case p.acceptKeyword("SEQUENCE"):
+		return p.parseCreateSequence()
+	}
+	return nil, p.unexpected()
+}
+
+// create sequence 名字 [start [with] n] [increment [by] n]，两个选项的顺序任意
+func (p *Parser) parseCreateSequence() (Statement, error) {
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &CreateSequenceStmt{Name: name, Start: 1, Increment: 1}
+	for {
+		switch {
+		case p.acceptKeyword("START"):
+			p.acceptKeyword("WITH")
+			if stmt.Start, err = p.parseInteger(); err != nil {
+				return nil, err
+			}
+		case p.acceptKeyword("INCREMENT"):
+			p.acceptKeyword("BY")
+			tok := p.cur()
+			if stmt.Increment, err = p.parseInteger(); err != nil {
+				return nil, err
+			}
+			if stmt.Increment == 0 {
+				return nil, p.errorf(tok, "序列的增量不能为 0")
+			}
+		default:
+			return stmt, nil
+		}
+	}
+}
+
+func (p *Parser) parseCreateTable() (Statement, error) {
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	if !p.atPunct("(") {
+		return nil, p.errorf(p.cur(), "创表需要字段")
+	}
+	p.next()
+	stmt := &CreateTableStmt{Name: name}
+	for {
+		if p.atKeyword("CONSTRAINT") || p.atKeyword("PRIMARY") || p.atKeyword("UNIQUE") || p.atKeyword("CHECK") || p.atKeyword("FOREIGN") {
+			constraint, err := p.parseTableConstraint()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Constraints = append(stmt.Constraints, constraint)
+		} else {
+			col, err := p.parseColumnDef(stmt)
+			if err != nil {
+				return nil, err
+			}
+			stmt.Columns = append(stmt.Columns, col)
+		}
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// [constraint 名字] primary key (字段, ...) | unique (字段, ...) | check (条件)
+func (p *Parser) parseTableConstraint() (TableConstraint, error) {
+	var c TableConstraint
+	var err error
+	if p.acceptKeyword("CONSTRAINT") {
+		if c.Name, err = p.expectIdent(); err != nil {
+			return c, err
+		}
+	}
+	switch {
+	case p.acceptKeyword("PRIMARY"):
+		if err := p.expectKeyword("KEY"); err != nil {
+			return c, err
+		}
+		c.Kind = "PRIMARY KEY"
+		c.Columns, err = p.parseNameList()
+	case p.acceptKeyword("UNIQUE"):
+		c.Kind = "UNIQUE"
+		c.Columns, err = p.parseNameList()
+	case p.acceptKeyword("CHECK"):
+		c.Kind = "CHECK"
+		c.Check, err = p.parseCheck()
+	case p.acceptKeyword("FOREIGN"):
+		if err := p.expectKeyword("KEY"); err != nil {
+			return c, err
+		}
+		c.Kind = "FOREIGN KEY"
+		if c.Columns, err = p.parseNameList(); err != nil {
+			return c, err
+		}
+		if err := p.expectKeyword("REFERENCES"); err != nil {
+			return c, err
+		}
+		err = p.parseReferences(&c)
+	default:
+		return c, p.unexpected()
+	}
+	return c, err
+}
+
+// references 后面的部分: 表名 [(字段, ...)] [on delete 动作] [on update 动作]
+func (p *Parser) parseReferences(c *TableConstraint) error {
+	var err error
+	if c.RefTable, err = p.expectIdent(); err != nil {
+		return err
+	}
+	if p.atPunct("(") {
+		if c.RefColumns, err = p.parseNameList(); err != nil {
+			return err
+		}
+	}
+	for p.acceptKeyword("ON") {
+		var action *string
+		switch {
+		case p.acceptKeyword("DELETE"):
+			action = &c.OnDelete
+		case p.acceptKeyword("UPDATE"):
+			action = &c.OnUpdate
+		default:
+			return p.unexpected()
+		}
+		switch {
+		case p.acceptKeyword("RESTRICT"):
+			*action = "RESTRICT"
+		case p.acceptKeyword("CASCADE"):
+			*action = "CASCADE"
+		case p.acceptKeyword("SET"):
+			if err := p.expectKeyword("NULL"); err != nil {
+				return err
+			}
+			*action = "SET NULL"
+		case p.acceptKeyword("NO"):
+			if err := p.expectKeyword("ACTION"); err != nil {
+				return err
+			}
+			*action = "NO ACTION"
+		default:
+			return p.unexpected()
+		}
+	}
+	return nil
+}
+
+// (名字, ...)
+func (p *Parser) parseNameList() ([]string, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		name, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// check 后面括号中的条件
+func (p *Parser) parseCheck() (Expr, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+func (p *Parser) parseCreateIndex(unique bool) (Statement, error) {
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("ON"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	columns, err := p.parseNameList()
+	if err != nil {
+		return nil, err
+	}
+	return &CreateIndexStmt{Name: name, Table: table, Columns: columns, Unique: unique}, nil
+}
+
+// drop index 名字 [on 表名] | drop sequence 名字
+func (p *Parser) parseDrop() (Statement, error) {
+	p.next()
+	if p.acceptKeyword("SEQUENCE") {
+		name, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		return &DropSequenceStmt{Name: name}, nil
+	}
+	if err := p.expectKeyword("INDEX"); err != nil {
+		return nil, err
+	}
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &DropIndexStmt{Name: name}
+	if p.acceptKeyword("ON") {
+		if stmt.Table, err = p.expectIdent(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// 字段 类型 [[constraint 名字] primary key | unique | check (条件) | references 表名 [(字段)] ... | not null | null | default 值 ...]
+func (p *Parser) parseColumnDef(stmt *CreateTableStmt) (ColumnDef, error) {
+	name, err := p.expectIdent()
+	if err != nil {
+		return ColumnDef{}, err
+	}
+	typeTok := p.cur()
+	if typeTok.Type != TokIdent {
+		return ColumnDef{}, p.errorf(typeTok, "列定义缺少类型")
+	}
+	p.next()
+	def := ColumnDef{Name: name}
+	if err := p.parseColumnType(typeTok, &def); err != nil {
+		return ColumnDef{}, err
+	}
+	for {
+		c := TableConstraint{Columns: []string{name}}
+		if p.acceptKeyword("CONSTRAINT") {
+			if c.Name, err = p.expectIdent(); err != nil {
+				return ColumnDef{}, err
+			}
+		}
+		switch {
+		case p.acceptKeyword("PRIMARY"):
+			if err := p.expectKeyword("KEY"); err != nil {
+				return ColumnDef{}, err
+			}
+			c.Kind = "PRIMARY KEY"
+		case p.acceptKeyword("UNIQUE"):
+			c.Kind = "UNIQUE"
+		case p.acceptKeyword("CHECK"):
+			c.Kind = "CHECK"
+			if c.Check, err = p.parseCheck(); err != nil {
+				return ColumnDef{}, err
+			}
+		case p.acceptKeyword("REFERENCES"):
+			c.Kind = "FOREIGN KEY"
+			if err := p.parseReferences(&c); err != nil {
+				return ColumnDef{}, err
+			}
+		case c.Name != "":
+			// constraint 名字 后面只能是上面几种约束
+			return ColumnDef{}, p.unexpected()
+		case p.acceptKeyword("NOT"):
+			if err := p.expectKeyword("NULL"); err != nil {
+				return ColumnDef{}, err
+			}
+			def.NotNull = true
+			continue
+		case p.acceptKeyword("NULL"):
+			continue
+		case p.acceptKeyword("AUTO_INCREMENT"):
+			def.AutoIncrement = true
+			continue
+		case p.acceptKeyword("DEFAULT"):
+			// 默认值不用完整的条件表达式，否则会把后面的 not null 当成 not in / not like 的开头
+			if def.Default, err = p.parseAdditive(); err != nil {
+				return ColumnDef{}, err
+			}
+			continue
+		default:
+			return def, nil
+		}
+		stmt.Constraints = append(stmt.Constraints, c)
+	}
+}
+
+// 类型名 [(长度)] | decimal [(精度 [, 小数位数])]
+func (p *Parser) parseColumnType(typeTok Token, def *ColumnDef) error {
+	typ, ok := columnTypeNames[typeTok.Text]
+	if !ok {
+		return p.errorf(typeTok, "未知的字段类型: %v", typeTok.Text)
+	}
+	def.Type = typ
+	def.AutoIncrement = typeTok.Text == "SERIAL" || typeTok.Text == "BIGSERIAL"
+	if !p.atPunct("(") {
+		return nil
+	}
+	switch typeTok.Text {
+	case "VARCHAR", "CHAR":
+		p.next()
+		tok := p.cur()
+		n, err := p.parseInteger()
+		if err != nil {
+			return err
+		}
+		if n < 1 || n > maxVarcharLength {
+			return p.errorf(tok, "%s 的长度必须在 1 到 %d 之间", typeTok.Text, int64(maxVarcharLength))
+		}
+		def.Length = int(n)
+	case "DECIMAL", "NUMERIC":
+		p.next()
+		tok := p.cur()
+		precision, err := p.parseInteger()
+		if err != nil {
+			return err
+		}
+		if precision < 1 || precision > maxDecimalDigits {
+			return p.errorf(tok, "%s 的精度必须在 1 到 %d 之间", typeTok.Text, maxDecimalDigits)
+		}
+		var scale int64
+		if p.acceptPunct(",") {
+			tok = p.cur()
+			if scale, err = p.parseInteger(); err != nil {
+				return err
+			}
+			if scale < 0 || scale > maxDecimalScale || scale > precision {
+				return p.errorf(tok, "%s 的小数位数必须在 0 到 %d 之间，并且不能大于精度", typeTok.Text, maxDecimalScale)
+			}
+		}
+		def.Precision, def.Scale = int(precision), int(scale)
+	default:
+		return p.errorf(p.cur(), "%s 类型没有参数", typeTok.Text)
+	}
+	return p.expectPunct(")")
+}
+
+// insert into xx (字段, ...) values (值, ...)
+func (p *Parser) parseInsert() (Statement, error) {
+	p.next()
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &InsertStmt{Table: table}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	for {
+		col, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Columns = append(stmt.Columns, col)
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	for {
+		val, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Values = append(stmt.Values, val)
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// update xx set 字段 = 值 [,] ... where ...
+func (p *Parser) parseUpdate() (Statement, error) {
+	p.next()
+	table, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	stmt := &UpdateStmt{Table: table}
+	for {
+		col, err := p.expectIdent()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectOperator("="); err != nil {
+			return nil, err
+		}
+		val, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Set = append(stmt.Set, Assignment{Column: col, Value: val})
+		// 兼容旧语法：多个赋值之间的逗号可以省略
+		if !p.acceptPunct(",") && !p.at(TokIdent) {
+			break
+		}
+	}
+	if p.acceptKeyword("WHERE") {
+		if stmt.Where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// delete from xx where ...
+func (p *Parser) parseDelete() (Statement, error) {
+	p.next()
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &DeleteStmt{Table: table}
+	if p.acceptKeyword("WHERE") {
+		if stmt.Where, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// select 列, ... [from 表 [join ...]] [where ...] [group by ...] [having ...] [order by ...] [limit ...]
+func (p *Parser) parseSelect() (Statement, error) {
+	p.next()
+	stmt := &SelectStmt{}
+	for {
+		field, err := p.parseSelectField()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Fields = append(stmt.Fields, field)
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	if p.acceptKeyword("FROM") {
+		ref, err := p.parseTableRef()
+		if err != nil {
+			return nil, err
+		}
+		stmt.From = ref
+		for {
+			join, ok, err := p.parseJoin()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+			stmt.Joins = append(stmt.Joins, join)
+		}
+	}
+	if p.acceptKeyword("WHERE") {
+		if stmt.From == nil {
+			return nil, p.errorf(p.cur(), "没有 from 时不能使用 where")
+		}
+		where, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Where = where
+	}
+	if p.acceptKeyword("GROUP") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.GroupBy = append(stmt.GroupBy, expr)
+			if !p.acceptPunct(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("HAVING") {
+		having, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Having = having
+	}
+	if p.acceptKeyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			item := OrderItem{Expr: expr}
+			if p.acceptKeyword("DESC") {
+				item.Desc = true
+			} else {
+				p.acceptKeyword("ASC")
+			}
+			stmt.OrderBy = append(stmt.OrderBy, item)
+			if !p.acceptPunct(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("LIMIT") {
+		limit, err := p.parseCount()
+		if err != nil {
+			return nil, err
+		}
+		// 兼容 MySQL 的 limit 偏移量, 行数
+		if p.acceptPunct(",") {
+			stmt.Offset = limit
+			if limit, err = p.parseCount(); err != nil {
+				return nil, err
+			}
+		} else if p.acceptKeyword("OFFSET") {
+			if stmt.Offset, err = p.parseCount(); err != nil {
+				return nil, err
+			}
+		}
+		stmt.Limit = &limit
+	}
+	return stmt, nil
+}
+
+// limit / offset 后面的非负整数
+func (p *Parser) parseCount() (int64, error) {
+	tok := p.cur()
+	if tok.Type != TokNumber {
+		return 0, p.errorf(tok, "需要非负整数")
+	}
+	n, err := strconv.ParseInt(tok.Text, 10, 64)
+	if err != nil || n < 0 {
+		return 0, p.errorf(tok, "需要非负整数，但得到 %s", tok.Text)
+	}
+	p.next()
+	return n, nil
+}
+
+// 可以带负号的整数
+func (p *Parser) parseInteger() (int64, error) {
+	negative := false
+	if p.atOperator("-") {
+		p.next()
+		negative = true
+	}
+	tok := p.cur()
+	if tok.Type != TokNumber {
+		return 0, p.errorf(tok, "需要整数")
+	}
+	text := tok.Text
+	if negative {
+		text = "-" + text
+	}
+	n, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return 0, p.errorf(tok, "需要整数，但得到 %s", text)
+	}
+	p.next()
+	return n, nil
+}
+
+// * | 表名.* | 表达式 [[AS] 别名]
+func (p *Parser) parseSelectField() (SelectField, error) {
+	if p.atOperator("*") {
+		p.next()
+		return SelectField{Star: true}, nil
+	}
+	if p.at(TokIdent) && p.pos+2 < len(p.tokens) &&
+		p.tokens[p.pos+1].Text == "." && p.tokens[p.pos+2].Type == TokOperator && p.tokens[p.pos+2].Text == "*" {
+		table := p.next().Text
+		p.next()
+		p.next()
+		return SelectField{Star: true, Table: table}, nil
+	}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return SelectField{}, err
+	}
+	field := SelectField{Expr: expr}
+	if p.acceptKeyword("AS") {
+		if field.Alias, err = p.expectIdent(); err != nil {
+			return SelectField{}, err
+		}
+	} else if p.at(TokIdent) {
+		field.Alias = p.next().Text
+	}
+	return field, nil
+}
+
+// [数据库名.]表名 [[AS] 别名]
+func (p *Parser) parseTableRef() (*TableRef, error) {
+	name, err := p.expectIdent()
+	if err != nil {
+		return nil, err
+	}
+	ref := &TableRef{Table: name}
+	if p.acceptPunct(".") {
+		ref.Database = name
+		if ref.Table, err = p.expectIdent(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("AS") {
+		if ref.Alias, err = p.expectIdent(); err != nil {
+			return nil, err
+		}
+	} else if p.at(TokIdent) {
+		ref.Alias = p.next().Text
+	}
+	return ref, nil
+}
+
+// [inner] join 表 on 条件 | left [outer] join 表 on 条件 | right [outer] join 表 on 条件 | cross join 表。
+// 逗号分隔的多个表等同于 cross join
+func (p *Parser) parseJoin() (JoinClause, bool, error) {
+	var join JoinClause
+	switch {
+	case p.acceptPunct(","):
+		join.Type = "CROSS"
+	case p.acceptKeyword("JOIN"):
+		join.Type = "INNER"
+	case p.acceptKeyword("INNER"), p.acceptKeyword("CROSS"):
+		join.Type = p.tokens[p.pos-1].Text
+		if err := p.expectKeyword("JOIN"); err != nil {
+			return join, false, err
+		}
+	case p.acceptKeyword("LEFT"), p.acceptKeyword("RIGHT"):
+		join.Type = p.tokens[p.pos-1].Text
+		p.acceptKeyword("OUTER")
+		if err := p.expectKeyword("JOIN"); err != nil {
+			return join, false, err
+		}
+	default:
+		return join, false, nil
+	}
+	table, err := p.parseTableRef()
+	if err != nil {
+		return join, false, err
+	}
+	join.Table = table
+	if join.Type == "CROSS" {
+		return join, true, nil
+	}
+	if err := p.expectKeyword("ON"); err != nil {
+		return join, false, err
+	}
+	if join.On, err = p.parseExpr(); err != nil {
+		return join, false, err
+	}
+	return join, true, nil
+}
+
+// 表达式，优先级从低到高: OR, AND, NOT, 比较/谓词, + -, * / %, 一元负号
+func (p *Parser) parseExpr() (Expr, error) {
+	return p.parseOr()
+}
+
+func (p *Parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: "OR", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *Parser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: "AND", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *Parser) parseNot() (Expr, error) {
+	if p.acceptKeyword("NOT") {
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: "NOT", Expr: expr}, nil
+	}
+	return p.parsePredicate()
+}
+
+// 比较运算以及 BETWEEN、IN、LIKE、IS NULL
+func (p *Parser) parsePredicate() (Expr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.cur()
+	if tok.Type == TokOperator {
+		switch tok.Text {
+		case "=", "<>", "<", "<=", ">", ">=":
+			p.next()
+			right, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			return &BinaryExpr{Op: tok.Text, Left: left, Right: right}, nil
+		}
+	}
+
+	if p.acceptKeyword("IS") {
+		not := p.acceptKeyword("NOT")
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return &IsNullExpr{Expr: left, Not: not}, nil
+	}
+
+	not := false
+	if p.atKeyword("NOT") {
+		// NOT 后面必须跟 BETWEEN、IN 或 LIKE
+		switch nextTok := p.tokens[p.pos+1]; {
+		case nextTok.Type == TokKeyword && (nextTok.Text == "BETWEEN" || nextTok.Text == "IN" || nextTok.Text == "LIKE"):
+			p.next()
+			not = true
+		default:
+			return left, nil
+		}
+	}
+	switch {
+	case p.acceptKeyword("BETWEEN"):
+		low, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &BetweenExpr{Expr: left, Low: low, High: high, Not: not}, nil
+	case p.acceptKeyword("IN"):
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		in := &InExpr{Expr: left, Not: not}
+		for {
+			item, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			in.List = append(in.List, item)
+			if !p.acceptPunct(",") {
+				break
+			}
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		return in, nil
+	case p.acceptKeyword("LIKE"):
+		pattern, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return &LikeExpr{Expr: left, Pattern: pattern, Not: not}, nil
+	}
+	return left, nil
+}
+
+func (p *Parser) parseAdditive() (Expr, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.atOperator("+") || p.atOperator("-") {
+		op := p.next().Text
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: op, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *Parser) parseMultiplicative() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.atOperator("*") || p.atOperator("/") || p.atOperator("%") {
+		op := p.next().Text
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: op, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *Parser) parseUnary() (Expr, error) {
+	if p.atOperator("-") {
+		// 负数常量直接折叠成字面量
+		if p.tokens[p.pos+1].Type == TokNumber {
+			p.next()
+			return parseNumber(p, p.next(), true)
+		}
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: "-", Expr: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *Parser) parsePrimary() (Expr, error) {
+	tok := p.cur()
+	switch tok.Type {
+	case TokNumber:
+		p.next()
+		return parseNumber(p, tok, false)
+	case TokString:
+		p.next()
+		return &Literal{Value: tok.Text}, nil
+	case TokParam:
+		p.next()
+		return p.param(tok)
+	case TokIdent:
+		p.next()
+		if p.atPunct("(") {
+			return p.parseFuncCall(tok.Text)
+		}
+		// date '2024-01-01'、timestamp '2024-01-01 10:00:00'、x'0a1b'
+		if p.at(TokString) {
+			if lit, ok, err := p.parseTypedLiteral(tok); ok {
+				return lit, err
+			}
+		}
+		// 表名.列名
+		if p.acceptPunct(".") {
+			name, err := p.expectIdent()
+			if err != nil {
+				return nil, err
+			}
+			return &ColumnRef{Table: tok.Text, Name: name}, nil
+		}
+		return &ColumnRef{Name: tok.Text}, nil
+	case TokKeyword:
+		switch tok.Text {
+		case "NULL":
+			p.next()
+			return &Literal{Value: nil}, nil
+		case "TRUE", "FALSE":
+			p.next()
+			return &Literal{Value: tok.Text == "TRUE"}, nil
+		}
+	case TokPunct:
+		if tok.Text == "(" {
+			p.next()
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct(")"); err != nil {
+				return nil, err
+			}
+			return expr, nil
+		}
+	}
+	return nil, p.unexpected()
+}
+
+// param 参数换成它的值
+func (p *Parser) param(tok Token) (Expr, error) {
+	n := p.marks + 1
+	if tok.Text == "?" {
+		p.marks++
+	} else if i, err := strconv.Atoi(tok.Text[1:]); err == nil {
+		n = i
+	}
+	if n < 1 || n > len(p.args) {
+		return nil, p.errorf(tok, "参数 %s 没有值", tok.Text)
+	}
+	return &Literal{Value: p.args[n-1]}, nil
+}
+
+// ParamCount 语句中参数的个数: $n 中最大的 n，或者 ? 的个数
+func ParamCount(sql string) (int, error) {
+	tokens, err := Tokenize(sql)
+	if err != nil {
+		return 0, err
+	}
+	count, marks := 0, 0
+	for _, tok := range tokens {
+		if tok.Type != TokParam {
+			continue
+		}
+		n := 0
+		if tok.Text == "?" {
+			marks++
+			n = marks
+		} else if n, err = strconv.Atoi(tok.Text[1:]); err != nil {
+			return 0, &SyntaxError{Line: tok.Line, Col: tok.Col, Msg: fmt.Sprintf("无效的参数 %s", tok.Text)}
+		}
+		if n > count {
+			count = n
+		}
+	}
+	return count, nil
+}
+
+// paramValue 把参数转换成常量中的值
+func paramValue(arg interface{}) (interface{}, error) {
+	switch v := arg.(type) {
+	case nil, int64, float64, string, bool, Date, Decimal, time.Time:
+		return v, nil
+	case []byte:
+		return append([]byte{}, v...), nil
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case float32:
+		return float64(v), nil
+	}
+	return nil, fmt.Errorf("不支持 %T 类型的值", arg)
+}
+
+// 类型名后面跟着字符串的常量，tok 不是这几种类型名时返回 false
+func (p *Parser) parseTypedLiteral(tok Token) (Expr, bool, error) {
+	var value interface{}
+	var err error
+	text := p.cur().Text
+	switch tok.Text {
+	case "DATE":
+		var t time.Time
+		if t, err = parseTime(text); err == nil {
+			value = dateOf(t)
+		}
+	case "TIMESTAMP":
+		value, err = parseTime(text)
+	case "X":
+		if value, err = hex.DecodeString(text); err != nil {
+			err = fmt.Errorf("无效的十六进制 %q", text)
+		}
+	default:
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, p.errorf(p.cur(), "%v", err)
+	}
+	p.next()
+	return &Literal{Value: value}, true, nil
+}
+
+// 整数解析为 int64，带小数点的解析为 Decimal，带指数的解析为 float64
+func parseNumber(p *Parser, tok Token, negative bool) (Expr, error) {
+	text := tok.Text
+	if negative {
+		text = "-" + text
+	}
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return &Literal{Value: i}, nil
+	}
+	if !strings.ContainsAny(text, "eE") {
+		if d, err := ParseDecimal(text); err == nil {
+			return &Literal{Value: d}, nil
+		}
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, p.errorf(tok, "无效的数字 %q", tok.Text)
+	}
+	return &Literal{Value: f}, nil
+}
+
+// 函数名(*) | 函数名([DISTINCT] 参数, ...)
+func (p *Parser) parseFuncCall(name string) (Expr, error) {
+	p.next()
+	call := &FuncCall{Name: name}
+	if p.atOperator("*") {
+		p.next()
+		call.Star = true
+	} else if !p.atPunct(")") {
+		call.Distinct = p.acceptKeyword("DISTINCT")
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			call.Args = append(call.Args, arg)
+			if !p.acceptPunct(",") {
+				break
+			}
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	return call, nil
+}
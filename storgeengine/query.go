@@ -0,0 +1,551 @@
+package storgeengine
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Query 在默认会话的当前数据库中执行 select 语句，只能看到已经提交的数据
+func (db *DB) Query(s *SelectStmt) (*ResultSet, error) {
+	return db.query(nil, db.session.database, s)
+}
+
+// query 在事务 tx 的快照中执行 select 语句，tx 为 nil 时使用一个新的快照。没有写数据库名的表在 database 中。
+// 数据直接从表的 b+树中读取，select * 按表结构中列的顺序展开，连接查询时依次展开每张表的列
+func (db *DB) query(tx *txn, database string, s *SelectStmt) (*ResultSet, error) {
+	rs := &ResultSet{Rows: [][]interface{}{}}
+	err := db.stream(tx, database, s, func(header *ResultSet) error {
+		rs.Columns, rs.Types = header.Columns, header.Types
+		return nil
+	}, func(values []interface{}) error {
+		rs.Rows = append(rs.Rows, values)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// stream 和 query 一样执行 select 语句，但不返回结果集: 先把列名和类型交给 header，再依次把每一行交给 out。
+// 不需要排序时一边扫描一边交出行，不把结果放在内存中；需要排序时先排好再交出。header 或 out 出错时停止查询
+func (db *DB) stream(tx *txn, database string, s *SelectStmt, header func(*ResultSet) error, out func([]interface{}) error) error {
+	if tx == nil {
+		tx = db.begin()
+		defer db.release(tx)
+	}
+
+	tables, err := db.queryTables(database, s)
+	if err != nil {
+		return err
+	}
+	if s, err = resolveSelect(s, tables); err != nil {
+		return err
+	}
+
+	// table 只在单表查询时不为空，用于按主键的优化
+	var table *BPTable
+	var schema TableSchema
+	var scan scanFunc
+	var desc bool // 单表查询按主键降序排列时从 b+树的末尾往前读
+	switch {
+	case len(tables) > 1:
+		plan, err := newJoinPlan(tx, s, tables)
+		if err != nil {
+			return err
+		}
+		schema = plan.schema
+		scan = func(fn func(Row) bool) error { return plan.scan(s.Where, fn) }
+	case len(tables) == 1:
+		table = tables[0].table
+		schema = table.Schema
+		scan = func(fn func(Row) bool) error {
+			return table.scanItems(tx, s.Where, desc, func(item rowItem) bool { return fn(item.Val) })
+		}
+	default:
+		// 没有 from 时只对一行空数据计算一次，例如 select 1 + 1
+		scan = func(fn func(Row) bool) error {
+			fn(Row{})
+			return nil
+		}
+	}
+
+	columns, exprs, err := expandFields(s.Fields, schema)
+	if err != nil {
+		return err
+	}
+	order, err := resolveOrder(s.OrderBy, s.Fields, columns, exprs, schema)
+	if err != nil {
+		return err
+	}
+	orderExprs := make([]Expr, len(order))
+	for i, key := range order {
+		orderExprs[i] = key.expr
+	}
+	grouped := len(s.GroupBy) > 0 || s.Having != nil || hasAggregate(exprs...) || hasAggregate(orderExprs...)
+
+	// 需要保留的行数，-1 表示全部
+	keep := int64(-1)
+	if s.Limit != nil {
+		keep = s.Offset + *s.Limit
+	}
+	sinkTable := table
+	if grouped {
+		// 分组后的行不再按主键有序
+		sinkTable = nil
+	} else if table != nil {
+		_, desc = order.onlyKey(table.keyColumn())
+	}
+	if err := header(&ResultSet{Columns: columns, Types: resultTypes(exprs, schema)}); err != nil {
+		return err
+	}
+	sink := newRowSink(order, s.Offset, keep, sinkTable, out)
+
+	var evalErr error
+	emit := func(row Row) bool {
+		r := sortRow{seq: sink.count, values: make([]interface{}, len(exprs))}
+		for i, expr := range exprs {
+			if r.values[i], evalErr = evalExpr(expr, row); evalErr != nil {
+				return false
+			}
+		}
+		if r.keys, evalErr = order.keys(row, r.values); evalErr != nil {
+			return false
+		}
+		return sink.add(r)
+	}
+	if grouped {
+		rows, err := groupRows(tx, s, table, schema, exprs, orderExprs, scan)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if !emit(row) {
+				break
+			}
+		}
+	} else if err := scan(emit); err != nil {
+		return err
+	}
+	if evalErr != nil {
+		return evalErr
+	}
+	if sink.err != nil || sink.direct() {
+		return sink.err
+	}
+
+	rows := sink.rows()
+	if s.Offset >= int64(len(rows)) {
+		rows = nil
+	} else {
+		rows = rows[s.Offset:]
+	}
+	if s.Limit != nil && int64(len(rows)) > *s.Limit {
+		rows = rows[:*s.Limit]
+	}
+	for _, r := range rows {
+		if err := out(r.values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describe select 语句结果的列名和类型，Rows 为空。只看表结构，不读数据，也不计算 nextval
+func (sess *Session) Describe(s *SelectStmt) (*ResultSet, error) {
+	return sess.db.describe(sess.database, s)
+}
+
+func (db *DB) describe(database string, s *SelectStmt) (*ResultSet, error) {
+	tables, err := db.queryTables(database, s)
+	if err != nil {
+		return nil, err
+	}
+	if s, err = resolveSelect(s, tables); err != nil {
+		return nil, err
+	}
+	var schema TableSchema
+	switch {
+	case len(tables) > 1:
+		plan, err := newJoinPlan(nil, s, tables)
+		if err != nil {
+			return nil, err
+		}
+		schema = plan.schema
+	case len(tables) == 1:
+		schema = tables[0].table.Schema
+	}
+	columns, exprs, err := expandFields(s.Fields, schema)
+	if err != nil {
+		return nil, err
+	}
+	return &ResultSet{Columns: columns, Types: resultTypes(exprs, schema), Rows: [][]interface{}{}}, nil
+}
+
+func resultTypes(exprs []Expr, schema TableSchema) []ColumnType {
+	types := make([]ColumnType, len(exprs))
+	for i, expr := range exprs {
+		types[i] = exprType(expr, schema)
+	}
+	return types
+}
+
+// scanFunc 逐行读取查询的数据，fn 返回 false 时提前结束
+type scanFunc func(fn func(Row) bool) error
+
+// groupRows 分组并计算聚合函数，返回通过 having 过滤后的分组行
+func groupRows(tx *txn, s *SelectStmt, table *BPTable, schema TableSchema, exprs, orderExprs []Expr, scan scanFunc) ([]Row, error) {
+	groupKeys := make(map[string]bool, len(s.GroupBy))
+	for _, expr := range s.GroupBy {
+		if hasAggregate(expr) {
+			return nil, fmt.Errorf("group by 中不能使用聚合函数")
+		}
+		if err := checkColumns(expr, schema); err != nil {
+			return nil, err
+		}
+		groupKeys[exprString(expr)] = true
+	}
+	having := substituteAliases(s.Having, s.Fields, schema)
+	if err := checkColumns(having, schema); err != nil {
+		return nil, err
+	}
+	checked := append(append(append([]Expr{}, exprs...), orderExprs...), having)
+	for _, expr := range checked {
+		if err := checkGrouped(expr, groupKeys); err != nil {
+			return nil, err
+		}
+	}
+	calls, err := collectAggregates(checked)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []Row
+	if row, ok := keyBoundRow(table, tx, calls); ok && s.Where == nil && len(s.GroupBy) == 0 {
+		rows = []Row{row}
+	} else {
+		agg := newAggregator(s.GroupBy, calls)
+		var aggErr error
+		err := scan(func(row Row) bool {
+			aggErr = agg.add(row)
+			return aggErr == nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if aggErr != nil {
+			return nil, aggErr
+		}
+		if rows, err = agg.rows(); err != nil {
+			return nil, err
+		}
+	}
+
+	if having == nil {
+		return rows, nil
+	}
+	filtered := rows[:0]
+	for _, row := range rows {
+		ok, err := evalPredicate(having, row)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			filtered = append(filtered, row)
+		}
+	}
+	return filtered, nil
+}
+
+// expandFields 把查询列展开成列名和对应的表达式
+func expandFields(fields []SelectField, schema TableSchema) ([]string, []Expr, error) {
+	columns := make([]string, 0, len(fields))
+	exprs := make([]Expr, 0, len(fields))
+	for _, field := range fields {
+		if field.Star {
+			if len(schema.Columns) == 0 {
+				return nil, nil, fmt.Errorf("没有 from 时不能使用 *")
+			}
+			for _, col := range starColumns(field, schema) {
+				columns = append(columns, col.Name)
+				exprs = append(exprs, &ColumnRef{Name: col.Name})
+			}
+			continue
+		}
+		if err := checkColumns(field.Expr, schema); err != nil {
+			return nil, nil, err
+		}
+		name := field.Alias
+		if name == "" {
+			name = exprString(field.Expr)
+		}
+		columns = append(columns, name)
+		exprs = append(exprs, field.Expr)
+	}
+	return columns, exprs, nil
+}
+
+// starColumns * 展开后的列，表名.* 只展开这张表的列
+func starColumns(field SelectField, schema TableSchema) []Column {
+	if field.Table == "" {
+		return schema.Columns
+	}
+	columns := make([]Column, 0)
+	for _, col := range schema.Columns {
+		if strings.HasPrefix(col.Name, field.Table+".") {
+			columns = append(columns, col)
+		}
+	}
+	return columns
+}
+
+// orderKey 排序键，output >= 0 时直接取结果集中的第 output 列
+type orderKey struct {
+	output int
+	expr   Expr
+	desc   bool
+}
+
+type orderKeys []orderKey
+
+// resolveOrder 解析 order by：整数表示结果集中的列序号(从 1 开始)，
+// 与别名同名的列引用结果集中的列，其余表达式在原始行上计算
+func resolveOrder(items []OrderItem, fields []SelectField, columns []string, exprs []Expr, schema TableSchema) (orderKeys, error) {
+	order := make(orderKeys, 0, len(items))
+	for _, item := range items {
+		key := orderKey{output: -1, expr: item.Expr, desc: item.Desc}
+		if pos, ok := intLiteral(item.Expr); ok {
+			if pos < 1 || pos > int64(len(columns)) {
+				return nil, fmt.Errorf("order by 的列序号 %d 超出范围", pos)
+			}
+			key.output = int(pos - 1)
+		} else if col, ok := item.Expr.(*ColumnRef); ok {
+			for i, field := range fields {
+				if field.Alias == col.Name {
+					key.output = outputIndex(fields, i, schema)
+					break
+				}
+			}
+		}
+		if key.output >= 0 {
+			key.expr = exprs[key.output]
+		} else if err := checkColumns(item.Expr, schema); err != nil {
+			return nil, err
+		}
+		order = append(order, key)
+	}
+	return order, nil
+}
+
+// 第 i 个查询字段在结果集中的位置，* 会展开成表中的全部列
+func outputIndex(fields []SelectField, i int, schema TableSchema) int {
+	pos := 0
+	for _, field := range fields[:i] {
+		if field.Star {
+			pos += len(starColumns(field, schema))
+		} else {
+			pos++
+		}
+	}
+	return pos
+}
+
+func (order orderKeys) keys(row Row, values []interface{}) ([]interface{}, error) {
+	if len(order) == 0 {
+		return nil, nil
+	}
+	keys := make([]interface{}, len(order))
+	for i, key := range order {
+		if key.output >= 0 {
+			keys[i] = values[key.output]
+			continue
+		}
+		value, err := evalExpr(key.expr, row)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = value
+	}
+	return keys, nil
+}
+
+// less 按排序键比较，键相同时保持读取顺序
+func (order orderKeys) less(a, b sortRow) bool {
+	for i, key := range order {
+		c := compareForSort(a.keys[i], b.keys[i])
+		if c == 0 {
+			continue
+		}
+		if key.desc {
+			return c > 0
+		}
+		return c < 0
+	}
+	return a.seq < b.seq
+}
+
+// 只按主键排序时返回方向，b+树叶子本身就是按主键有序的
+func (order orderKeys) onlyKey(keyColumn string) (bool, bool) {
+	if len(order) != 1 || !isColumn(order[0].expr, keyColumn) {
+		return false, false
+	}
+	return true, order[0].desc
+}
+
+// compareForSort 排序时的比较，NULL 最小，类型不同的值按 数字 < 字符串 < 时间 < 二进制 < 其他 排列
+func compareForSort(a, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		}
+		return 1
+	}
+	if c, err := compareValues(a, b); err == nil {
+		return c
+	}
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	sa, sb := toString(a), toString(b)
+	switch {
+	case sa < sb:
+		return -1
+	case sa > sb:
+		return 1
+	}
+	return 0
+}
+
+func typeRank(value interface{}) int {
+	switch value.(type) {
+	case int64, float64, Decimal, bool:
+		return 0
+	case string:
+		return 1
+	case Date, time.Time:
+		return 2
+	case []byte:
+		return 3
+	}
+	return 4
+}
+
+// sortRow 结果集中的一行以及它的排序键
+type sortRow struct {
+	seq    int64
+	keys   []interface{}
+	values []interface{}
+}
+
+// rowSink 收集查询结果，根据排序方式选择不同的策略：
+// 没有排序或按主键排序时按扫描顺序直接交给 out(降序时从后往前扫描)，跳过前 offset 行，够数后立即停止扫描；
+// 有 limit 的一般排序用大小为 offset+limit 的堆只保留前 N 行；
+// 其余情况收集全部行后排序
+type rowSink struct {
+	order  orderKeys
+	keep   int64
+	count  int64
+	sorted bool
+	buf    []sortRow
+	top    *topN
+	offset int64
+	out    func([]interface{}) error
+	err    error // out 返回的错误
+}
+
+func newRowSink(order orderKeys, offset, keep int64, table *BPTable, out func([]interface{}) error) *rowSink {
+	sink := &rowSink{order: order, keep: keep, offset: offset, out: out}
+	if len(order) == 0 {
+		return sink
+	}
+	if table != nil {
+		if byKey, _ := order.onlyKey(table.keyColumn()); byKey {
+			return sink
+		}
+	}
+	if keep >= 0 {
+		sink.top = &topN{order: order, limit: int(keep)}
+	} else {
+		sink.sorted = true
+	}
+	return sink
+}
+
+// direct 行按扫描顺序输出，不需要先收集起来
+func (sink *rowSink) direct() bool {
+	return sink.top == nil && !sink.sorted
+}
+
+// add 加入一行，返回 false 表示已经不需要更多的行
+func (sink *rowSink) add(r sortRow) bool {
+	sink.count++
+	if sink.direct() {
+		if sink.keep >= 0 && sink.count > sink.keep {
+			return false
+		}
+		if sink.count > sink.offset {
+			if sink.err = sink.out(r.values); sink.err != nil {
+				return false
+			}
+		}
+		return sink.keep < 0 || sink.count < sink.keep
+	}
+	if sink.top != nil {
+		sink.top.offer(r)
+		return true
+	}
+	sink.buf = append(sink.buf, r)
+	return true
+}
+
+// rows 排好序的行，只用于不是 direct 的情况
+func (sink *rowSink) rows() []sortRow {
+	if sink.top != nil {
+		return sink.top.result()
+	}
+	sort.Slice(sink.buf, func(i, j int) bool { return sink.order.less(sink.buf[i], sink.buf[j]) })
+	return sink.buf
+}
+
+// topN 有界的大顶堆，堆顶是当前保留的行中排在最后的一行
+type topN struct {
+	order orderKeys
+	limit int
+	rows  []sortRow
+}
+
+func (t *topN) Len() int           { return len(t.rows) }
+func (t *topN) Less(i, j int) bool { return t.order.less(t.rows[j], t.rows[i]) }
+func (t *topN) Swap(i, j int)      { t.rows[i], t.rows[j] = t.rows[j], t.rows[i] }
+func (t *topN) Push(x interface{}) { t.rows = append(t.rows, x.(sortRow)) }
+func (t *topN) Pop() interface{} {
+	last := t.rows[len(t.rows)-1]
+	t.rows = t.rows[:len(t.rows)-1]
+	return last
+}
+
+func (t *topN) offer(r sortRow) {
+	if t.limit == 0 {
+		return
+	}
+	if len(t.rows) < t.limit {
+		heap.Push(t, r)
+		return
+	}
+	if t.order.less(r, t.rows[0]) {
+		t.rows[0] = r
+		heap.Fix(t, 0)
+	}
+}
+
+func (t *topN) result() []sortRow {
+	sort.Slice(t.rows, func(i, j int) bool { return t.order.less(t.rows[i], t.rows[j]) })
+	return t.rows
+}
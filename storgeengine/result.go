@@ -0,0 +1,110 @@
+package storgeengine
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ResultSet select 的查询结果，Rows 中每一行的值与 Columns 一一对应。
+// Types 是每一列声明的类型，表中的列取表结构中的类型，表达式按运算的规则推出，推不出时为 UnknownType
+type ResultSet struct {
+	Columns []string
+	Types   []ColumnType
+	Rows    [][]interface{}
+}
+
+// InsertResult 插入的结果，LastInsertID 是自增列生成的值，没有生成时为 0
+type InsertResult struct {
+	RowsAffected int
+	LastInsertID int64
+}
+
+func (r *InsertResult) String() string {
+	if r.LastInsertID == 0 {
+		return fmt.Sprintf("%d 行受影响", r.RowsAffected)
+	}
+	return fmt.Sprintf("%d 行受影响，生成的自增值为 %d", r.RowsAffected, r.LastInsertID)
+}
+
+// AffectedResult update 和 delete 的结果
+type AffectedResult struct {
+	RowsAffected int
+}
+
+func (r *AffectedResult) String() string {
+	return fmt.Sprintf("%d 行受影响", r.RowsAffected)
+}
+
+// String 以表格形式输出结果，NULL 显示为 NULL
+func (rs *ResultSet) String() string {
+	cells := make([][]string, len(rs.Rows))
+	widths := make([]int, len(rs.Columns))
+	for i, col := range rs.Columns {
+		widths[i] = displayWidth(col)
+	}
+	for r, row := range rs.Rows {
+		cells[r] = make([]string, len(row))
+		for i, value := range row {
+			cells[r][i] = formatValue(value)
+			if w := displayWidth(cells[r][i]); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+
+	var sb strings.Builder
+	border := func() {
+		for _, w := range widths {
+			sb.WriteString("+")
+			sb.WriteString(strings.Repeat("-", w+2))
+		}
+		sb.WriteString("+\n")
+	}
+	line := func(values []string) {
+		for i, v := range values {
+			sb.WriteString("| ")
+			sb.WriteString(v)
+			sb.WriteString(strings.Repeat(" ", widths[i]-displayWidth(v)+1))
+		}
+		sb.WriteString("|\n")
+	}
+
+	border()
+	line(rs.Columns)
+	border()
+	for _, row := range cells {
+		line(row)
+	}
+	if len(cells) > 0 {
+		border()
+	}
+	fmt.Fprintf(&sb, "%d 行记录", len(rs.Rows))
+	return sb.String()
+}
+
+// formatValue 显示的值，二进制数据显示成 0x 开头的十六进制
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return "0x" + hex.EncodeToString(v)
+	}
+	return toString(value)
+}
+
+// 终端中的显示宽度，中文等宽字符占两列
+func displayWidth(s string) int {
+	width := 0
+	for _, r := range s {
+		if unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hangul, r) || unicode.Is(unicode.Hiragana, r) ||
+			unicode.Is(unicode.Katakana, r) || (r >= 0xFF00 && r <= 0xFFEF) || (r >= 0x3000 && r <= 0x303F) {
+			width += 2
+		} else {
+			width++
+		}
+	}
+	return width
+}
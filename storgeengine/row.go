@@ -0,0 +1,214 @@
+package storgeengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"time"
+)
+
+// 行的编码。b+树、数据文件的叶子页和日志中的一行都是按表结构编码的字节串，不保存列名和类型标记:
+//
+//	NULL 位图 每列一位 | 定长区 每列一个槽 | 变长区
+//
+// 槽按列的顺序排列，宽度只取决于列的类型，所以每一列的位置都能直接算出来:
+//
+//	INT、FLOAT                 8 字节，int64 或 float64 的位
+//	BOOL                       1 字节
+//	DATE                       1970-01-01 以来的天数 int32
+//	TIMESTAMP                  Unix 秒数 int64 | 纳秒 uint32
+//	STRING、BLOB、DECIMAL      值在变长区中的结束位置 uint32，开始位置是前一个变长列的结束位置
+//
+// DECIMAL 在变长区中为 小数位数 uint16 | 是否为负 uint8 | 绝对值 大端。
+// NULL 的列位图中的位为 1，槽中是 0，变长列在变长区中的长度为 0。表结构不能改变，所以编码中不需要版本
+
+// Record 按表结构编码的一行
+type Record []byte
+
+// secondsPerDay 日期在行中保存成天数
+const secondsPerDay = 24 * 60 * 60
+
+// rowItem 事务看到的一行，值已经按表结构解码
+type rowItem struct {
+	Key Key
+	Val map[string]interface{}
+}
+
+// slotWidth 列在定长区中的宽度
+func (t ColumnType) slotWidth() int {
+	switch t {
+	case BoolType:
+		return 1
+	case DateType, StringType, BlobType, DecimalType:
+		return 4
+	case TimestampType:
+		return 12
+	}
+	return 8
+}
+
+// variable 值是否放在变长区
+func (t ColumnType) variable() bool {
+	return t == StringType || t == BlobType || t == DecimalType
+}
+
+// recordLayout NULL 位图的长度和变长区开始的位置
+func recordLayout(schema TableSchema) (bitmap, fixed int) {
+	bitmap = (len(schema.Columns) + 7) / 8
+	fixed = bitmap
+	for _, col := range schema.Columns {
+		fixed += col.Type.slotWidth()
+	}
+	return bitmap, fixed
+}
+
+// EncodeRecord 按表结构编码一行，值必须已经转换成列的类型，row 中没有的列是 NULL
+func EncodeRecord(schema TableSchema, row map[string]interface{}) (Record, error) {
+	slot, fixed := recordLayout(schema)
+	buf := make([]byte, fixed, fixed+16)
+	for i, col := range schema.Columns {
+		pos := slot
+		slot += col.Type.slotWidth()
+		value := row[col.Name]
+		if value == nil {
+			buf[i/8] |= 1 << uint(i%8)
+		} else if !col.Type.holds(value) {
+			return nil, fmt.Errorf("列 %s 的值 %v 无法保存", col.Name, value)
+		}
+		switch v := value.(type) {
+		case int64:
+			binary.LittleEndian.PutUint64(buf[pos:], uint64(v))
+		case float64:
+			binary.LittleEndian.PutUint64(buf[pos:], math.Float64bits(v))
+		case bool:
+			buf[pos] = byte(boolInt(v))
+		case Date:
+			binary.LittleEndian.PutUint32(buf[pos:], uint32(int32(v.Unix()/secondsPerDay)))
+		case time.Time:
+			binary.LittleEndian.PutUint64(buf[pos:], uint64(v.Unix()))
+			binary.LittleEndian.PutUint32(buf[pos+8:], uint32(v.Nanosecond()))
+		case string:
+			buf = append(buf, v...)
+		case []byte:
+			buf = append(buf, v...)
+		case Decimal:
+			negative := byte(0)
+			if v.sign() < 0 {
+				negative = 1
+			}
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(v.scale))
+			buf = append(buf, negative)
+			buf = append(buf, v.int().Bytes()...)
+		}
+		if col.Type.variable() {
+			binary.LittleEndian.PutUint32(buf[pos:], uint32(len(buf)-fixed))
+		}
+	}
+	return buf, nil
+}
+
+// decodeRecord 按表结构解码一行，NULL 的列为 nil。rec 必须是按这个表结构编码的:
+// 内存中的行都由 EncodeRecord 生成，从数据文件和日志中读出的行已经用 checkRecord 检查过
+func decodeRecord(schema TableSchema, rec Record) map[string]interface{} {
+	row := make(map[string]interface{}, len(schema.Columns))
+	walkRecord(schema, rec, func(col Column, null bool, slot, data []byte) {
+		if null {
+			row[col.Name] = nil
+		} else {
+			row[col.Name] = decodeValue(col.Type, slot, data)
+		}
+	})
+	return row
+}
+
+// DecodeRecord 检查并解码按表结构编码的一行
+func DecodeRecord(schema TableSchema, rec Record) (map[string]interface{}, error) {
+	if err := checkRecord(schema, rec); err != nil {
+		return nil, err
+	}
+	return decodeRecord(schema, rec), nil
+}
+
+// checkRecord 检查从文件中读出的行是不是按表结构编码的
+func checkRecord(schema TableSchema, rec Record) error {
+	slot, fixed := recordLayout(schema)
+	if len(rec) < fixed {
+		return fmt.Errorf("行数据不完整")
+	}
+	end := fixed
+	for _, col := range schema.Columns {
+		if col.Type.variable() {
+			next := fixed + int(binary.LittleEndian.Uint32(rec[slot:]))
+			if next < end || next > len(rec) {
+				return fmt.Errorf("行数据不完整")
+			}
+			end = next
+		}
+		slot += col.Type.slotWidth()
+	}
+	if end != len(rec) {
+		return fmt.Errorf("行的长度不对")
+	}
+	var err error
+	walkRecord(schema, rec, func(col Column, null bool, _, data []byte) {
+		if !null && col.Type == DecimalType && len(data) < 3 && err == nil {
+			err = fmt.Errorf("列 %s 的 DECIMAL 值已损坏", col.Name)
+		}
+	})
+	return err
+}
+
+// walkRecord 依次取出每一列的槽和它在变长区中的数据
+func walkRecord(schema TableSchema, rec Record, fn func(col Column, null bool, slot, data []byte)) {
+	slot, fixed := recordLayout(schema)
+	start := fixed
+	for i, col := range schema.Columns {
+		s := rec[slot : slot+col.Type.slotWidth()]
+		slot += len(s)
+		var data []byte
+		if col.Type.variable() {
+			end := fixed + int(binary.LittleEndian.Uint32(s))
+			data, start = rec[start:end], end
+		}
+		fn(col, rec[i/8]&(1<<uint(i%8)) != 0, s, data)
+	}
+}
+
+// decodeValue 从槽和变长区的数据中取出一列的值
+func decodeValue(typ ColumnType, slot, data []byte) interface{} {
+	switch typ {
+	case IntType:
+		return int64(binary.LittleEndian.Uint64(slot))
+	case FloatType:
+		return math.Float64frombits(binary.LittleEndian.Uint64(slot))
+	case BoolType:
+		return slot[0] != 0
+	case DateType:
+		return Date{time.Unix(int64(int32(binary.LittleEndian.Uint32(slot)))*secondsPerDay, 0).UTC()}
+	case TimestampType:
+		sec := int64(binary.LittleEndian.Uint64(slot))
+		return time.Unix(sec, int64(binary.LittleEndian.Uint32(slot[8:]))).UTC()
+	case StringType:
+		return string(data)
+	case BlobType:
+		return append([]byte{}, data...)
+	case DecimalType:
+		abs := new(big.Int).SetBytes(data[3:])
+		if data[2] == 1 {
+			abs.Neg(abs)
+		}
+		return Decimal{unscaled: abs, scale: int(binary.LittleEndian.Uint16(data))}
+	}
+	return nil
+}
+
+// encode 按表的结构编码一行
+func (table *BPTable) encode(row map[string]interface{}) (Record, error) {
+	return EncodeRecord(table.Schema, row)
+}
+
+// decode 解码表中的一行
+func (table *BPTable) decode(rec Record) map[string]interface{} {
+	return decodeRecord(table.Schema, rec)
+}
@@ -0,0 +1,164 @@
+package storgeengine
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// 比较一行保存成 map 和按表结构编码成 Record 时占用的内存，以及编码和解码一行的时间:
+//
+//	go test ./storgeengine -run '^$' -bench Row -benchmem
+//
+// bytes/row 是每行还在使用的堆内存，表有各种类型的列，每隔几行有一个 NULL
+
+var benchSchema = TableSchema{Columns: []Column{
+	{Name: "id", Type: IntType},
+	{Name: "name", Type: StringType, Length: 32},
+	{Name: "email", Type: StringType, Length: 64},
+	{Name: "age", Type: IntType},
+	{Name: "score", Type: FloatType},
+	{Name: "active", Type: BoolType},
+	{Name: "balance", Type: DecimalType, Precision: 12, Scale: 2},
+	{Name: "birthday", Type: DateType},
+	{Name: "created", Type: TimestampType},
+}}
+
+// benchRow 第 i 行，值已经是各列的类型
+func benchRow(i int) map[string]interface{} {
+	balance, err := ParseDecimal(fmt.Sprintf("%d.%02d", i*37%100000, i%100))
+	if err != nil {
+		panic(err)
+	}
+	row := map[string]interface{}{
+		"id":       int64(i),
+		"name":     fmt.Sprintf("user%d", i),
+		"email":    fmt.Sprintf("user%d@example.com", i),
+		"age":      int64(18 + i%60),
+		"score":    float64(i%1000) / 10,
+		"active":   i%2 == 0,
+		"balance":  balance,
+		"birthday": NewDate(1970+i%50, time.Month(1+i%12), 1+i%28),
+		"created":  time.Unix(1700000000+int64(i), int64(i%1000)*1000).UTC(),
+	}
+	if i%5 == 0 {
+		row["email"] = nil
+	}
+	return row
+}
+
+// heapGrowth fn 新分配并且还在使用的堆内存，垃圾回收不计入计时
+func heapGrowth(b *testing.B, fn func()) float64 {
+	var before, after runtime.MemStats
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.StartTimer()
+	fn()
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.StartTimer()
+	return float64(after.HeapAlloc) - float64(before.HeapAlloc)
+}
+
+func BenchmarkRowMemory(b *testing.B) {
+	b.Run("map", func(b *testing.B) {
+		b.ReportAllocs()
+		rows := make([]map[string]interface{}, b.N)
+		grown := heapGrowth(b, func() {
+			for i := range rows {
+				rows[i] = benchRow(i)
+			}
+		})
+		b.ReportMetric(grown/float64(b.N), "bytes/row")
+		runtime.KeepAlive(rows)
+	})
+	b.Run("record", func(b *testing.B) {
+		b.ReportAllocs()
+		b.StopTimer()
+		rows := make([]map[string]interface{}, b.N)
+		for i := range rows {
+			rows[i] = benchRow(i)
+		}
+		records := make([]Record, b.N)
+		b.StartTimer()
+		encoded := 0
+		grown := heapGrowth(b, func() {
+			for i, row := range rows {
+				rec, err := EncodeRecord(benchSchema, row)
+				if err != nil {
+					b.Fatal(err)
+				}
+				records[i] = rec
+				encoded += len(rec)
+			}
+		})
+		b.ReportMetric(grown/float64(b.N), "bytes/row")
+		b.ReportMetric(float64(encoded)/float64(b.N), "encoded-bytes/row")
+		// 原来的 map 行不能在测量时被回收
+		runtime.KeepAlive(rows)
+		runtime.KeepAlive(records)
+	})
+}
+
+func BenchmarkRowEncode(b *testing.B) {
+	rows := make([]map[string]interface{}, 1000)
+	for i := range rows {
+		rows[i] = benchRow(i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := EncodeRecord(benchSchema, rows[i%len(rows)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRowDecode(b *testing.B) {
+	records := make([]Record, 1000)
+	for i := range records {
+		rec, err := EncodeRecord(benchSchema, benchRow(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		records[i] = rec
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeRecord(benchSchema, records[i%len(records)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestRecordRoundTrip 基准测试用的行编码后再解码得到同样的值
+func TestRecordRoundTrip(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		row := benchRow(i)
+		rec, err := EncodeRecord(benchSchema, row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := DecodeRecord(benchSchema, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, col := range benchSchema.Columns {
+			want := row[col.Name]
+			if d, ok := want.(Decimal); ok {
+				if g, ok := got[col.Name].(Decimal); !ok || g.cmp(d) != 0 {
+					t.Fatalf("第 %d 行的 %s 是 %v，应该是 %v", i, col.Name, got[col.Name], want)
+				}
+				continue
+			}
+			if !reflect.DeepEqual(got[col.Name], want) {
+				t.Fatalf("第 %d 行的 %s 是 %#v，应该是 %#v", i, col.Name, got[col.Name], want)
+			}
+		}
+	}
+}
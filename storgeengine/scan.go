@@ -0,0 +1,464 @@
+package storgeengine
+
+import (
+	"fmt"
+	"sort"
+)
+
+// accessPath 根据 where 条件选出的访问方式：主键点查或主键范围扫描
+type accessPath struct {
+	usePoints bool
+	points    []Key
+	ranges    []keyRange // 按主键顺序排列、互不重叠的范围，nil 表示整张表
+}
+
+// planAccess 从 where 中 AND 连接的条件里提取主键各列上的等值、IN、范围条件。
+// 其余条件不影响访问方式，由 evalPredicate 在取出的行上再过滤一遍
+func (table *BPTable) planAccess(where Expr) accessPath {
+	columns := table.keyColumns()
+	types := make([]ColumnType, len(columns))
+	for i, column := range columns {
+		types[i] = table.Schema.Columns[table.Schema.columnIndex(column)].Type
+	}
+	// 主键的值总是和列的类型相同
+	plan := planKeys(conjuncts(where), columns, types, false)
+	var path accessPath
+	switch {
+	case plan.equal == len(columns):
+		path.usePoints, path.points = true, plan.prefixes
+	case plan.equal > 0 || plan.hasRange:
+		path.ranges = plan.ranges
+	}
+	return path
+}
+
+// columnConds 一列上能用来查找的条件，关键字都是这一列的单个值的编码
+type columnConds struct {
+	usePoints bool
+	points    []Key // 等值和 IN 条件的交集
+	rng       keyRange
+}
+
+func (cc *columnConds) intersectPoints(keys []Key) {
+	old := make(map[Key]bool, len(cc.points))
+	for _, key := range cc.points {
+		old[key] = true
+	}
+	seen := make(map[Key]bool, len(keys))
+	points := make([]Key, 0, len(keys))
+	for _, key := range keys {
+		if seen[key] || (cc.usePoints && !old[key]) {
+			continue
+		}
+		seen[key] = true
+		points = append(points, key)
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+	cc.usePoints = true
+	cc.points = points
+}
+
+// restrictLow 把下界收紧到 key，已有的下界更严格时不变
+func (r *keyRange) restrictLow(key Key, incl bool, cmp Comparator) {
+	if r.low == nil {
+		r.low, r.lowIncl = &key, incl
+		return
+	}
+	if c := cmp(key, *r.low); c > 0 || (c == 0 && !incl) {
+		r.low, r.lowIncl = &key, incl
+	}
+}
+
+// restrictHigh 把上界收紧到 key，已有的上界更严格时不变
+func (r *keyRange) restrictHigh(key Key, incl bool, cmp Comparator) {
+	if r.high == nil {
+		r.high, r.highIncl = &key, incl
+		return
+	}
+	if c := cmp(key, *r.high); c < 0 || (c == 0 && !incl) {
+		r.high, r.highIncl = &key, incl
+	}
+}
+
+// keyPlan 在按若干列依次编码的关键字上的查找
+type keyPlan struct {
+	equal    int        // 前面连续有等值或 IN 条件的列数
+	prefixes []Key      // 这几列的取值的各种组合的编码，按顺序排列
+	hasRange bool       // 接下来的一列有范围条件
+	ranges   []keyRange // 要遍历的关键字范围
+}
+
+// maxKeyPrefixes 等值条件组合出的前缀个数的上限，超过时后面的列不再参与查找
+const maxKeyPrefixes = 100
+
+// planKeys 从 AND 连接的条件 conds 中找出 columns 上的等值、IN、范围条件，规划在关键字上的查找。
+// 只用 ColumnType.keyValue 认可的常量，它们比较的顺序和编码的顺序一致。mixed 为 true 时列中可能有和列的类型不同的值:
+// 字符串列中的数字和字符串按数字比较，所以字符串列上的查找总是带上数字的那一段
+func planKeys(conds []Expr, columns []string, types []ColumnType, mixed bool) keyPlan {
+	byColumn := make([]columnConds, len(columns))
+	// position 表达式是 columns 中的第几列，不是这些列时返回 -1
+	position := func(expr Expr) int {
+		for i, column := range columns {
+			if isColumn(expr, column) {
+				return i
+			}
+		}
+		return -1
+	}
+	encode := func(i int, value interface{}) (Key, bool) {
+		if v, ok := types[i].keyValue(value); ok {
+			return EncodeKey(v), true
+		}
+		return "", false
+	}
+	encodeExpr := func(i int, expr Expr) (Key, bool) {
+		if value, ok := constLiteral(expr); ok {
+			return encode(i, value)
+		}
+		return "", false
+	}
+	for _, cond := range conds {
+		switch e := cond.(type) {
+		case *BinaryExpr:
+			column, op, value, ok := columnComparison(e)
+			if !ok {
+				continue
+			}
+			i := position(&ColumnRef{Name: column})
+			if i < 0 {
+				continue
+			}
+			key, ok := encode(i, value)
+			if !ok {
+				continue
+			}
+			cc := &byColumn[i]
+			switch op {
+			case "=":
+				cc.intersectPoints([]Key{key})
+			case "<":
+				cc.rng.restrictHigh(key, false, compareBytes)
+			case "<=":
+				cc.rng.restrictHigh(key, true, compareBytes)
+			case ">":
+				cc.rng.restrictLow(key, false, compareBytes)
+			case ">=":
+				cc.rng.restrictLow(key, true, compareBytes)
+			}
+		case *BetweenExpr:
+			i := position(e.Expr)
+			if e.Not || i < 0 {
+				continue
+			}
+			low, lok := encodeExpr(i, e.Low)
+			high, hok := encodeExpr(i, e.High)
+			if lok && hok {
+				byColumn[i].rng.restrictLow(low, true, compareBytes)
+				byColumn[i].rng.restrictHigh(high, true, compareBytes)
+			}
+		case *InExpr:
+			i := position(e.Expr)
+			if e.Not || i < 0 {
+				continue
+			}
+			keys := make([]Key, 0, len(e.List))
+			for _, item := range e.List {
+				key, ok := encodeExpr(i, item)
+				if !ok {
+					keys = nil
+					break
+				}
+				keys = append(keys, key)
+			}
+			if keys != nil {
+				byColumn[i].intersectPoints(keys)
+			}
+		}
+	}
+
+	// numbers 字符串列中数字的那一段
+	numbers := func(prefix Key) keyRange {
+		low, high := prefix+Key(keyNumber), prefix+Key(keyString)
+		return keyRange{low: &low, high: &high, lowIncl: true}
+	}
+	plan := keyPlan{prefixes: []Key{""}}
+	for i := range columns {
+		cc := &byColumn[i]
+		if !cc.usePoints || len(plan.prefixes)*len(cc.points) > maxKeyPrefixes {
+			break
+		}
+		next := make([]Key, 0, len(plan.prefixes)*len(cc.points))
+		for _, prefix := range plan.prefixes {
+			for _, point := range cc.points {
+				// 等值的值同样要满足这一列上的范围条件
+				if cc.rng.contains(point, compareBytes) {
+					next = append(next, prefix+point)
+				}
+			}
+			if mixed && types[i] == StringType {
+				plan.ranges = append(plan.ranges, numbers(prefix))
+			}
+		}
+		plan.prefixes = next
+		plan.equal++
+	}
+	var rng keyRange
+	if plan.equal < len(columns) {
+		rng = byColumn[plan.equal].rng
+		plan.hasRange = rng.low != nil || rng.high != nil
+	}
+	for _, prefix := range plan.prefixes {
+		if !plan.hasRange {
+			plan.ranges = append(plan.ranges, prefixRange(prefix))
+			continue
+		}
+		// 没有限制的一端取列的类型的那一段的边界，NULL 和其他类型的值都不在范围内
+		tag := types[plan.equal].keyTag()
+		low, high := prefix+Key(tag), prefix+Key(tag+1)
+		if rng.low != nil {
+			if low = prefix + *rng.low; !rng.lowIncl {
+				low = low.prefixEnd()
+			}
+		}
+		if rng.high != nil {
+			if high = prefix + *rng.high; rng.highIncl {
+				high = high.prefixEnd()
+			}
+		}
+		plan.ranges = append(plan.ranges, keyRange{low: &low, high: &high, lowIncl: true})
+		if mixed && types[plan.equal] == StringType {
+			plan.ranges = append(plan.ranges, numbers(prefix))
+		}
+	}
+	sort.Slice(plan.ranges, func(i, j int) bool { return *plan.ranges[i].low < *plan.ranges[j].low })
+	return plan
+}
+
+// 把 a AND b AND c 拆成 [a b c]
+func conjuncts(expr Expr) []Expr {
+	if expr == nil {
+		return nil
+	}
+	if e, ok := expr.(*BinaryExpr); ok && e.Op == "AND" {
+		return append(conjuncts(e.Left), conjuncts(e.Right)...)
+	}
+	return []Expr{expr}
+}
+
+func isColumn(expr Expr, name string) bool {
+	col, ok := expr.(*ColumnRef)
+	return ok && col.Name == name
+}
+
+func intLiteral(expr Expr) (int64, bool) {
+	lit, ok := expr.(*Literal)
+	if !ok {
+		return 0, false
+	}
+	key, ok := lit.Value.(int64)
+	return key, ok
+}
+
+// 检查表达式中引用的列都存在于表中
+func checkColumns(expr Expr, schema TableSchema) error {
+	var err error
+	walkExpr(expr, func(e Expr) {
+		col, ok := e.(*ColumnRef)
+		if !ok || err != nil {
+			return
+		}
+		if schema.columnIndex(col.Name) < 0 {
+			err = fmt.Errorf("未知的列 %s", col.Name)
+		}
+	})
+	return err
+}
+
+// scanItems 按主键顺序逐行遍历事务 tx 能看到的满足 where 条件的行，desc 为 true 时从大到小，
+// fn 返回 false 时提前结束
+func (table *BPTable) scanItems(tx *txn, where Expr, desc bool, fn func(item rowItem) bool) error {
+	if err := checkColumns(where, table.Schema); err != nil {
+		return err
+	}
+	path := table.planAccess(where)
+	if !path.usePoints && path.ranges == nil {
+		// 主键上没有条件时看看能不能用索引，索引找到的行同样按主键顺序逐个读取
+		if index := table.planIndex(where); index != nil {
+			path.usePoints, path.points = true, table.indexKeys(tx, index)
+		}
+	}
+
+	var err error
+	visit := func(item rowItem) bool {
+		ok, evalErr := evalPredicate(where, item.Val)
+		if evalErr != nil {
+			err = evalErr
+			return false
+		}
+		if !ok {
+			return true
+		}
+		return fn(item)
+	}
+	if path.usePoints {
+		for i := range path.points {
+			key := path.points[i]
+			if desc {
+				key = path.points[len(path.points)-1-i]
+			}
+			val, ok := table.get(tx, key)
+			if ok && !visit(rowItem{Key: key, Val: val}) {
+				break
+			}
+		}
+	} else if path.ranges == nil {
+		table.scan(tx, keyRange{}, desc, visit)
+	} else {
+		cont := true
+		for i := range path.ranges {
+			rng := path.ranges[i]
+			if desc {
+				rng = path.ranges[len(path.ranges)-1-i]
+			}
+			table.scan(tx, rng, desc, func(item rowItem) bool {
+				cont = visit(item)
+				return cont
+			})
+			if !cont {
+				break
+			}
+		}
+	}
+	return err
+}
+
+// selectItems 取出满足 where 条件的行，按主键升序排列
+func (table *BPTable) selectItems(tx *txn, where Expr) ([]rowItem, error) {
+	items := make([]rowItem, 0)
+	err := table.scanItems(tx, where, false, func(item rowItem) bool {
+		items = append(items, item)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// 数据库 database 中的表，database 为空表示会话还没有选择数据库
+func (db *DB) lookupTable(database, tableName string) (*BPTable, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if database == "" {
+		return nil, fmt.Errorf("没有选择数据库")
+	}
+	tables, exists := db.databases[database]
+	if !exists {
+		return nil, errorOf(ErrUndefinedDatabase, "数据库 %s 不存在", database)
+	}
+	table, exists := tables[tableName]
+	if !exists {
+		return nil, errorOf(ErrUndefinedTable, "表 %s 不存在", tableName)
+	}
+	return table, nil
+}
+
+// UpdateWhere 在事务中修改满足条件的行，返回修改的行数
+func (db *DB) UpdateWhere(tx *txn, database, tableName string, set []Assignment, where Expr) (int, error) {
+	table, err := db.lookupTable(database, tableName)
+	if err != nil {
+		return 0, err
+	}
+	for _, assign := range set {
+		if table.Schema.columnIndex(assign.Column) < 0 {
+			return 0, fmt.Errorf("未知的列 %s", assign.Column)
+		}
+		if err := checkColumns(assign.Value, table.Schema); err != nil {
+			return 0, err
+		}
+	}
+	items, err := table.selectItems(tx, where)
+	if err != nil {
+		return 0, err
+	}
+
+	// 先计算出全部新行再写入，保证中途出错时不会只改了一部分
+	oldKeys := make(map[Key]bool, len(items))
+	for _, item := range items {
+		oldKeys[item.Key] = true
+	}
+	usedKeys := make(map[Key]bool, len(items))
+	newRows := make([]map[string]interface{}, len(items))
+	newKeys := make([]Key, len(items))
+	for i, item := range items {
+		row := make(map[string]interface{}, len(item.Val))
+		for k, v := range item.Val {
+			row[k] = v
+		}
+		for _, assign := range set {
+			value, err := evalExpr(assign.Value, item.Val)
+			if err != nil {
+				return 0, err
+			}
+			row[assign.Column] = value
+		}
+		if err := table.coerceRow(row); err != nil {
+			return 0, err
+		}
+		key, err := table.keyOf(row)
+		if err != nil {
+			return 0, err
+		}
+		if _, exists := table.get(tx, key); usedKeys[key] || (!oldKeys[key] && exists) {
+			return 0, errorOf(ErrUniqueViolation, "主键 %s 已存在", key)
+		}
+		usedKeys[key] = true
+		newRows[i] = row
+		newKeys[i] = key
+	}
+
+	// 主键改变的行先删除再写入新主键，新主键可能正好是另一行原来的主键
+	for i, item := range items {
+		if newKeys[i] != item.Key {
+			if err := db.writeRow(tx, table, item.Key, item.Val, nil); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for i := range items {
+		before, _ := table.get(tx, newKeys[i])
+		if err := db.writeRow(tx, table, newKeys[i], before, newRows[i]); err != nil {
+			return 0, err
+		}
+	}
+	for i, item := range items {
+		if err := db.cascade(tx, table, item.Val, newRows[i]); err != nil {
+			return 0, err
+		}
+	}
+	return len(items), nil
+}
+
+// DeleteWhere 在事务中删除满足条件的行，返回删除的行数
+func (db *DB) DeleteWhere(tx *txn, database, tableName string, where Expr) (int, error) {
+	table, err := db.lookupTable(database, tableName)
+	if err != nil {
+		return 0, err
+	}
+	items, err := table.selectItems(tx, where)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, item := range items {
+		if _, exists := table.get(tx, item.Key); !exists {
+			// 已经被前面的行级联删除了
+			continue
+		}
+		if err := db.deleteRow(tx, table, item.Key, item.Val); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
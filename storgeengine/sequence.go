@@ -0,0 +1,292 @@
+package storgeengine
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// 自增列和序列。
+//
+// 自增列(auto_increment 或 serial)必须是主键的第一列，插入时没有给出或给出 NULL 就取下一个值。
+// 计数器只在内存中，第一次使用时从 b+树中最大的主键加一开始，所以不用持久化；
+// 插入了更大的值时计数器跟着变大，回滚的事务用掉的值不会再用。
+//
+// 序列由 create sequence 创建，nextval('名字') 取下一个值，currval('名字') 是这个会话最近一次取到的值。
+// 序列保存在系统目录中，每次预留 sequenceCache 个值并把预留的个数写进目录，
+// 崩溃或重启后从预留的位置继续，中间没有用掉的值会被跳过，但不会重复
+
+// sequenceCache 序列每次写目录时预留的值的个数
+const sequenceCache = 32
+
+// Sequence 一个序列，第 n 个值(从 0 开始)是 Start + n*Increment。used 是已经取过的个数，
+// reserved 是已经写进目录的预留个数，used 到达 reserved 时要先预留下一批。used 和 reserved 受 db.mutex 保护
+type Sequence struct {
+	Name      string
+	Start     int64
+	Increment int64
+	used      int64
+	reserved  int64
+}
+
+// value 序列的第 n 个值，超出 int64 的范围时返回 false
+func (seq *Sequence) value(n int64) (int64, bool) {
+	v := new(big.Int).Mul(big.NewInt(n), big.NewInt(seq.Increment))
+	v.Add(v, big.NewInt(seq.Start))
+	return v.Int64(), v.IsInt64()
+}
+
+// autoColumn 表的自增列，没有时为空
+func (schema *TableSchema) autoColumn() string {
+	for _, col := range schema.Columns {
+		if col.AutoIncrement {
+			return col.Name
+		}
+	}
+	return ""
+}
+
+// checkAutoIncrement 建表时检查自增列: 最多一个，类型是 int，并且是主键的第一列
+func (schema *TableSchema) checkAutoIncrement() error {
+	column := ""
+	for _, col := range schema.Columns {
+		if !col.AutoIncrement {
+			continue
+		}
+		if column != "" {
+			return fmt.Errorf("一张表只能有一个自增列")
+		}
+		if col.Type != IntType {
+			return fmt.Errorf("自增列 %s 的类型必须是 int", col.Name)
+		}
+		if col.Default != nil {
+			return fmt.Errorf("自增列 %s 不能有默认值", col.Name)
+		}
+		column = col.Name
+	}
+	if column != "" && schema.keyColumns()[0] != column {
+		return fmt.Errorf("自增列 %s 必须是主键的第一列", column)
+	}
+	return nil
+}
+
+// autoIncrement 插入的行中自增列没有值时填上下一个值并返回它，给出的值更大时推进计数器。
+// 没有生成值时返回 0
+func (table *BPTable) autoIncrement(row map[string]interface{}) (int64, error) {
+	column := table.Schema.autoColumn()
+	if column == "" {
+		return 0, nil
+	}
+	table.autoMu.Lock()
+	defer table.autoMu.Unlock()
+	if table.autoNext == 0 {
+		table.autoNext = 1
+		if max, ok := table.maxKeyValue(); ok && max >= 1 {
+			table.autoNext = max + 1
+		}
+	}
+	switch v := row[column].(type) {
+	case nil:
+		if table.autoNext == math.MaxInt64 {
+			return 0, fmt.Errorf("表 %s 的自增列 %s 已经用完", table.Name, column)
+		}
+		id := table.autoNext
+		table.autoNext++
+		row[column] = id
+		return id, nil
+	case int64:
+		if v >= table.autoNext && v < math.MaxInt64 {
+			table.autoNext = v + 1
+		} else if v == math.MaxInt64 {
+			table.autoNext = v
+		}
+	}
+	return 0, nil
+}
+
+// maxKeyValue b+树中最大的主键的第一列，已经删除但还留着旧版本的行也算在内
+func (table *BPTable) maxKeyValue() (int64, bool) {
+	it := table.Tree.NewIterator(nil, nil)
+	defer it.Close()
+	if !it.Prev() {
+		return 0, false
+	}
+	item, _ := it.Item()
+	values, err := decodeKey(item.Key)
+	if err != nil || len(values) == 0 {
+		return 0, false
+	}
+	switch v := values[0].(type) {
+	case int64:
+		return v, true
+	case float64:
+		return int64(math.Floor(v)), true
+	}
+	return 0, false
+}
+
+// CreateSequence 在数据库 database 中创建序列
+func (db *DB) CreateSequence(database, name string, start, increment int64) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if database == "" {
+		return fmt.Errorf("没有选择数据库")
+	}
+	if _, exists := db.databases[database]; !exists {
+		return errorOf(ErrUndefinedDatabase, "数据库 %s 不存在", database)
+	}
+	if increment == 0 {
+		return fmt.Errorf("序列的增量不能为 0")
+	}
+	sequences := db.sequences[database]
+	if sequences == nil {
+		sequences = make(map[string]*Sequence)
+		db.sequences[database] = sequences
+	}
+	if _, exists := sequences[name]; exists {
+		return fmt.Errorf("序列 %s 已经存在", name)
+	}
+	sequences[name] = &Sequence{Name: name, Start: start, Increment: increment}
+	if err := db.saveCatalog(); err != nil {
+		delete(sequences, name)
+		return fmt.Errorf("创建序列 %s 失败: %v", name, err)
+	}
+	return nil
+}
+
+// DropSequence 删除数据库 database 中的序列
+func (db *DB) DropSequence(database, name string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if database == "" {
+		return fmt.Errorf("没有选择数据库")
+	}
+	seq, exists := db.sequences[database][name]
+	if !exists {
+		return errorOf(ErrUndefinedTable, "序列 %s 不存在", name)
+	}
+	delete(db.sequences[database], name)
+	if err := db.saveCatalog(); err != nil {
+		db.sequences[database][name] = seq
+		return fmt.Errorf("删除序列 %s 失败: %v", name, err)
+	}
+	return nil
+}
+
+// nextval 取数据库 database 中序列的下一个值，预留的值用完时先把新的预留位置写进目录
+func (db *DB) nextval(database, name string) (int64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	seq, exists := db.sequences[database][name]
+	if !exists {
+		return 0, errorOf(ErrUndefinedTable, "序列 %s 不存在", name)
+	}
+	value, ok := seq.value(seq.used)
+	if !ok {
+		return 0, fmt.Errorf("序列 %s 已经用完", name)
+	}
+	if seq.used == seq.reserved {
+		seq.reserved += sequenceCache
+		if err := db.saveCatalog(); err != nil {
+			seq.reserved -= sequenceCache
+			return 0, fmt.Errorf("序列 %s 取值失败: %v", name, err)
+		}
+	}
+	seq.used++
+	return value, nil
+}
+
+// sequenceCall 表达式是不是 nextval('名字') 或 currval('名字')
+func sequenceCall(e Expr) (*FuncCall, bool) {
+	call, ok := e.(*FuncCall)
+	return call, ok && (call.Name == "NEXTVAL" || call.Name == "CURRVAL")
+}
+
+// bindSequences 计算表达式中的 nextval 和 currval，换成常量。一条语句中的每次调用只计算一次
+func (sess *Session) bindSequences(expr Expr) (Expr, error) {
+	found := false
+	walkExpr(expr, func(e Expr) {
+		if _, ok := sequenceCall(e); ok {
+			found = true
+		}
+	})
+	if !found {
+		return expr, nil
+	}
+	database := sess.database
+	if database == "" {
+		return nil, fmt.Errorf("没有选择数据库")
+	}
+	return rewriteExpr(expr, func(e Expr) (Expr, error) {
+		call, ok := sequenceCall(e)
+		if !ok {
+			return e, nil
+		}
+		var name string
+		if len(call.Args) == 1 {
+			if lit, ok := call.Args[0].(*Literal); ok {
+				name, _ = lit.Value.(string)
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("%s 的参数必须是序列的名字", call.Name)
+		}
+		name = strings.ToUpper(name)
+		key := database + "/" + name
+		if call.Name == "CURRVAL" {
+			value, ok := sess.currval[key]
+			if !ok {
+				return nil, fmt.Errorf("这个会话中还没有对序列 %s 调用过 nextval", name)
+			}
+			return &Literal{Value: value}, nil
+		}
+		value, err := sess.db.nextval(database, name)
+		if err != nil {
+			return nil, err
+		}
+		if sess.currval == nil {
+			sess.currval = make(map[string]int64)
+		}
+		sess.currval[key] = value
+		return &Literal{Value: value}, nil
+	})
+}
+
+// bindUpdate 计算 update 语句中的 nextval 和 currval，返回语句的副本，原来的语句不变
+func (sess *Session) bindUpdate(s *UpdateStmt) (*UpdateStmt, error) {
+	bound := *s
+	bound.Set = make([]Assignment, len(s.Set))
+	var err error
+	for i, assign := range s.Set {
+		bound.Set[i] = Assignment{Column: assign.Column}
+		if bound.Set[i].Value, err = sess.bindSequences(assign.Value); err != nil {
+			return nil, err
+		}
+	}
+	if bound.Where, err = sess.bindSequences(s.Where); err != nil {
+		return nil, err
+	}
+	return &bound, nil
+}
+
+// bindSelect 计算查询的列和 where 条件中的 nextval 和 currval，返回语句的副本
+func (sess *Session) bindSelect(s *SelectStmt) (*SelectStmt, error) {
+	bound := *s
+	bound.Fields = make([]SelectField, len(s.Fields))
+	var err error
+	for i, field := range s.Fields {
+		bound.Fields[i] = field
+		if bound.Fields[i].Expr, err = sess.bindSequences(field.Expr); err != nil {
+			return nil, err
+		}
+		// 结果集的列名保持原来的写法，而不是算出来的值
+		if !field.Star && field.Alias == "" && bound.Fields[i].Expr != field.Expr {
+			bound.Fields[i].Alias = exprString(field.Expr)
+		}
+	}
+	if bound.Where, err = sess.bindSequences(s.Where); err != nil {
+		return nil, err
+	}
+	return &bound, nil
+}
@@ -0,0 +1,156 @@
+package storgeengine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Session 一个客户端连接的会话，保存这个连接自己的当前数据库、事务状态和设置。
+// 一个会话中没有提交的修改，别的会话看不到，use 也只改变这个会话的当前数据库
+type Session struct {
+	db         *DB
+	database   string           // 当前的数据库，空表示还没有选择
+	tx         *txn             // 正在进行的事务，nil 表示没有
+	autocommit bool             // 为 false 时第一条修改语句自动开始事务，直到 commit 或 rollback
+	currval    map[string]int64 // 这个会话中每个序列最近一次 nextval 的值，键为 数据库名/序列名
+}
+
+// NewSession 为一个连接创建会话，默认每条语句自动提交
+func (db *DB) NewSession() *Session {
+	return &Session{db: db, autocommit: true}
+}
+
+// ParseSQL 在会话中解析并执行一条 SQL 语句
+func (sess *Session) ParseSQL(sql string) SQLResult {
+	stmt, err := Parse(sql)
+	if err != nil {
+		return SQLResult{Error: err}
+	}
+	return sess.Execute(stmt)
+}
+
+// Use 切换会话的当前数据库，名字和 SQL 中的标识符一样不区分大小写
+func (sess *Session) Use(database string) error {
+	database = strings.ToUpper(database)
+	sess.db.mutex.RLock()
+	_, exists := sess.db.databases[database]
+	sess.db.mutex.RUnlock()
+	if !exists {
+		return errorOf(ErrUndefinedDatabase, "数据库 %s 不存在", database)
+	}
+	sess.database = database
+	return nil
+}
+
+// Database 会话的当前数据库，还没有选择时为空
+func (sess *Session) Database() string {
+	return sess.database
+}
+
+// InTransaction 会话中有没有还没有结束的事务
+func (sess *Session) InTransaction() bool {
+	return sess.tx != nil
+}
+
+// Autocommit 会话是不是每条语句自动提交
+func (sess *Session) Autocommit() bool {
+	return sess.autocommit
+}
+
+// Close 连接断开时回滚没有提交的事务
+func (sess *Session) Close() error {
+	return sess.rollback()
+}
+
+func (sess *Session) begin() error {
+	if sess.tx != nil {
+		return fmt.Errorf("已经在事务中，请先 commit 或 rollback")
+	}
+	sess.tx = sess.db.begin()
+	return nil
+}
+
+func (sess *Session) commit() error {
+	if sess.tx == nil {
+		return nil
+	}
+	tx := sess.tx
+	sess.tx = nil
+	if err := sess.db.commit(tx); err != nil {
+		return fmt.Errorf("提交失败，事务已回滚: %w", err)
+	}
+	return nil
+}
+
+func (sess *Session) rollback() error {
+	if sess.tx == nil {
+		return nil
+	}
+	sess.db.rollback(sess.tx)
+	sess.tx = nil
+	return nil
+}
+
+// read 语句使用的事务。关闭自动提交时第一条语句就开始事务，之后的语句都读同一个快照；
+// 否则返回 nil，查询使用自己的快照
+func (sess *Session) read() *txn {
+	if sess.tx == nil && !sess.autocommit {
+		sess.tx = sess.db.begin()
+	}
+	return sess.tx
+}
+
+// write 执行一条修改语句。不在事务中并且自动提交时，这条语句单独作为一个事务；
+// 在事务中出错时只撤销这条语句做的修改，事务还可以继续
+func (sess *Session) write(fn func(tx *txn) error) error {
+	tx := sess.read()
+	if tx == nil {
+		return sess.db.autocommit(fn)
+	}
+	savepoint := len(tx.writes)
+	if err := sess.db.runStatement(tx, fn); err != nil {
+		tx.rollbackTo(savepoint)
+		return err
+	}
+	return nil
+}
+
+// set 修改会话的设置
+func (sess *Session) set(s *SetStmt) error {
+	value, err := constValue(s.Value)
+	if err != nil {
+		return err
+	}
+	switch s.Name {
+	case "AUTOCOMMIT":
+		on, ok := settingBool(value)
+		if !ok {
+			return fmt.Errorf("autocommit 只能设置为 0、1、on、off、true 或 false")
+		}
+		sess.autocommit = on
+		if sess.autocommit {
+			// 重新打开自动提交时提交当前的事务
+			return sess.commit()
+		}
+		return nil
+	}
+	return fmt.Errorf("未知的设置 %s", s.Name)
+}
+
+// settingBool 开关类设置的值: 0 和 1、true 和 false，或者不区分大小写的字符串 on、off、true、false、1、0
+func settingBool(value interface{}) (on bool, ok bool) {
+	switch v := value.(type) {
+	case int64:
+		return v == 1, v == 0 || v == 1
+	case bool:
+		return v, true
+	case string:
+		switch strings.ToUpper(strings.TrimSpace(v)) {
+		case "ON", "TRUE", "1":
+			return true, true
+		case "OFF", "FALSE", "0":
+			return false, true
+		}
+	}
+	return false, false
+}
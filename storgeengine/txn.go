@@ -0,0 +1,371 @@
+package storgeengine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// txn 一个还没有结束的事务。事务读的是开始时的快照，修改先记在事务自己这里，
+// 提交时才写日志和 b+树，所以别的事务看不到没有提交的修改
+type txn struct {
+	snapshot uint64                             // 开始时的提交时间戳
+	writes   []txnWrite                         // 按顺序记录的修改，语句出错时从后往前撤销
+	pending  map[*BPTable]map[Key]*pendingWrite // 每一行被修改之后现在的样子
+	done     bool                               // 已经提交或回滚，快照已经注销
+	deferred []fkCheck                          // 当前语句推迟到结束时检查的外键
+}
+
+// txnWrite 事务对一行的一次修改
+type txnWrite struct {
+	table  *BPTable
+	key    Key
+	before map[string]interface{} // nil 表示修改前这一行不存在
+	after  map[string]interface{} // nil 表示这一行被删除
+}
+
+// record 修改的日志记录，修改前后的行按表结构编码
+func (w txnWrite) record() (walRecord, error) {
+	rec := walRecord{kind: walWrite, table: w.table.fullName(), key: w.key}
+	var err error
+	if w.before != nil {
+		if rec.before, err = w.table.encode(w.before); err != nil {
+			return walRecord{}, err
+		}
+	}
+	if w.after != nil {
+		if rec.after, err = w.table.encode(w.after); err != nil {
+			return walRecord{}, err
+		}
+	}
+	return rec, nil
+}
+
+// pendingWrite 事务修改过的一行
+type pendingWrite struct {
+	row   map[string]interface{} // nil 表示已经删除
+	first int                    // 事务第一次修改这一行的记录在 writes 中的位置
+}
+
+// fullName 日志中表的名字: 数据库名/表名
+func (table *BPTable) fullName() string {
+	return table.Database + "/" + table.Name
+}
+
+// applyRow 把主键 key 的行直接改成 val，val 为 nil 时删除这一行。只在恢复时使用
+func (table *BPTable) applyRow(key Key, val Record, ts uint64) {
+	if val == nil {
+		table.Tree.Remove(key)
+	} else {
+		table.Tree.put(BPItem{Key: key, Val: val, Begin: ts})
+	}
+}
+
+// get 事务 tx 能看到的一行: 自己改过的行取修改后的值，其余的取快照中的版本
+func (table *BPTable) get(tx *txn, key Key) (map[string]interface{}, bool) {
+	if p := tx.pending[table][key]; p != nil {
+		return p.row, p.row != nil
+	}
+	item, ok := table.Tree.lookup(key)
+	if !ok {
+		return nil, false
+	}
+	if item, ok = table.resolve(item, tx.snapshot); !ok {
+		return nil, false
+	}
+	return table.decode(item.Val), true
+}
+
+// scan 按主键顺序遍历范围内事务 tx 能看到的行，desc 为 true 时从大到小。b+树中的数据项换成快照中的版本并解码，
+// 再和事务自己改过的行按主键合并，fn 返回 false 时停止
+func (table *BPTable) scan(tx *txn, rng keyRange, desc bool, fn func(item rowItem) bool) {
+	cmp := table.Tree.compare
+	var own []rowItem
+	for key, p := range tx.pending[table] {
+		if rng.contains(key, cmp) {
+			own = append(own, rowItem{Key: key, Val: p.row})
+		}
+	}
+	// before 按遍历的方向 a 是否在 b 前面
+	before := func(a, b Key) bool {
+		if desc {
+			return cmp(a, b) > 0
+		}
+		return cmp(a, b) < 0
+	}
+	sort.Slice(own, func(i, j int) bool { return before(own[i].Key, own[j].Key) })
+	// 事务自己删除的行 Val 为 nil，跳过
+	emit := func(item rowItem) bool {
+		return item.Val == nil || fn(item)
+	}
+	i, cont := 0, true
+	table.Tree.scanRange(rng, desc, func(item BPItem) bool {
+		for ; i < len(own) && before(own[i].Key, item.Key); i++ {
+			if cont = emit(own[i]); !cont {
+				return false
+			}
+		}
+		if i < len(own) && own[i].Key == item.Key {
+			i++
+			cont = emit(own[i-1])
+			return cont
+		}
+		if version, ok := table.resolve(item, tx.snapshot); ok {
+			cont = fn(rowItem{Key: version.Key, Val: table.decode(version.Val)})
+		}
+		return cont
+	})
+	for ; cont && i < len(own); i++ {
+		cont = emit(own[i])
+	}
+}
+
+// bound 快照中主键最小或最大的一行，直接取 b+树两端的数据项。事务自己改过这张表，
+// 或者两端的数据项在快照中不可见时返回 ok 为 false，由调用方遍历整张表
+func (table *BPTable) bound(tx *txn, last bool) (key Key, exists, ok bool) {
+	if len(tx.pending[table]) > 0 {
+		return "", false, false
+	}
+	var item BPItem
+	if last {
+		item, exists = table.Tree.Max()
+	} else {
+		item, exists = table.Tree.Min()
+	}
+	if !exists {
+		return "", false, true
+	}
+	if _, visible := table.resolve(item, tx.snapshot); !visible {
+		return "", false, false
+	}
+	return item.Key, true, true
+}
+
+// conflict 先提交者胜出: 这一行在事务的快照之后已经被别的事务修改并提交，事务不能再修改它
+func (table *BPTable) conflict(tx *txn, key Key) error {
+	item, ok := table.Tree.lookup(key)
+	if ok && (item.Begin > tx.snapshot || item.End > tx.snapshot) {
+		return errorOf(ErrSerialization, "表 %s 中主键为 %s 的行在事务开始后已被其他事务修改", table.Name, key)
+	}
+	return nil
+}
+
+// writeRow 在事务中修改一行，先检查表上的约束。修改只记在事务中，提交时才写进 b+树。
+// 外键在记下修改之后检查，这样引用自己的行也能找到；检查失败时整条语句都会被撤销
+func (db *DB) writeRow(tx *txn, table *BPTable, key Key, before, after map[string]interface{}) error {
+	if err := table.conflict(tx, key); err != nil {
+		return err
+	}
+	if after != nil {
+		if err := table.checkRow(after); err != nil {
+			return err
+		}
+		if err := table.checkUnique(tx, key, after); err != nil {
+			return err
+		}
+	}
+	rows := tx.pending[table]
+	if rows == nil {
+		if tx.pending == nil {
+			tx.pending = make(map[*BPTable]map[Key]*pendingWrite)
+		}
+		rows = make(map[Key]*pendingWrite)
+		tx.pending[table] = rows
+	}
+	if p := rows[key]; p != nil {
+		p.row = after
+	} else {
+		rows[key] = &pendingWrite{row: after, first: len(tx.writes)}
+	}
+	tx.writes = append(tx.writes, txnWrite{table: table, key: key, before: before, after: after})
+	if after != nil {
+		return db.checkParents(tx, table, before, after)
+	}
+	return nil
+}
+
+// rollbackTo 按相反的顺序撤销事务在 savepoint 之后做的修改
+func (tx *txn) rollbackTo(savepoint int) {
+	for i := len(tx.writes) - 1; i >= savepoint; i-- {
+		w := tx.writes[i]
+		rows := tx.pending[w.table]
+		if p := rows[w.key]; p.first == i {
+			delete(rows, w.key)
+		} else {
+			p.row = w.before
+		}
+	}
+	tx.writes = tx.writes[:savepoint]
+}
+
+// autocommit 把一条修改语句作为一个事务执行: 成功时提交，日志落盘后才返回；出错时丢弃已经做的修改
+func (db *DB) autocommit(fn func(tx *txn) error) error {
+	tx := db.begin()
+	if err := db.runStatement(tx, fn); err != nil {
+		db.rollback(tx)
+		return err
+	}
+	return db.commit(tx)
+}
+
+// commit 提交事务，不论成功与否事务都结束了。先检查冲突和唯一索引，再写日志并落盘，然后把修改写成 b+树中的新版本，
+// 最后推进提交时间戳，之后开始的快照一次看到事务的全部修改
+func (db *DB) commit(tx *txn) error {
+	if len(tx.writes) == 0 {
+		db.release(tx)
+		return nil
+	}
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+
+	// 每一行只记录最后的结果
+	var records []walRecord
+	var rows []txnWrite
+	for i, w := range tx.writes {
+		p := tx.pending[w.table][w.key]
+		if p.first != i || (w.before == nil && p.row == nil) {
+			continue
+		}
+		if err := w.table.conflict(tx, w.key); err != nil {
+			db.release(tx)
+			return err
+		}
+		if p.row != nil {
+			if err := w.table.checkCommitted(tx, w.key, p.row); err != nil {
+				db.release(tx)
+				return err
+			}
+		}
+		write := txnWrite{table: w.table, key: w.key, before: w.before, after: p.row}
+		rec, err := write.record()
+		if err != nil {
+			db.release(tx)
+			return err
+		}
+		records = append(records, rec)
+		rows = append(rows, write)
+	}
+	ts, err := db.wal.commit(records)
+	if err != nil {
+		db.release(tx)
+		return err
+	}
+	for i, row := range rows {
+		db.install(row.table, row.key, row.after, records[i].after, ts)
+	}
+	db.publish(ts)
+	db.release(tx)
+	db.gc()
+	if db.wal.full() {
+		// 事务已经提交，检查点失败不影响这条语句的结果，下次还会再做
+		if err := db.checkpoint(); err != nil {
+			fmt.Println("检查点失败:", err)
+		}
+	}
+	return nil
+}
+
+// rollback 丢弃事务的全部修改，它们还没有写进日志和 b+树
+func (db *DB) rollback(tx *txn) {
+	tx.writes, tx.pending = nil, nil
+	db.release(tx)
+}
+
+// 日志中记录的表
+func (db *DB) walTable(name string) (*BPTable, error) {
+	database, tableName, ok := strings.Cut(name, "/")
+	if !ok {
+		return nil, fmt.Errorf("日志中的表名 %s 无效", name)
+	}
+	table, exists := db.databases[database][tableName]
+	if !exists {
+		return nil, fmt.Errorf("日志中的表 %s 不存在", name)
+	}
+	return table, nil
+}
+
+// recover 启动时根据日志恢复: 按顺序重做有提交记录的事务，提交中途崩溃的事务只写了一部分日志，跳过。
+// 然后清理数据文件中留下的删除标记，最后做一次检查点
+func (db *DB) recover(records []walRecord) error {
+	committed := make(map[uint64]bool)
+	for _, rec := range records {
+		if rec.kind == walCommit {
+			committed[rec.txn] = true
+		}
+	}
+	skipped := 0
+	for _, rec := range records {
+		if rec.kind != walWrite {
+			continue
+		}
+		if !committed[rec.txn] {
+			skipped++
+			continue
+		}
+		table, err := db.walTable(rec.table)
+		if err != nil {
+			// 表的数据文件已经不在了，只能跳过
+			fmt.Println("恢复时跳过:", err)
+			continue
+		}
+		if rec.after != nil {
+			if err := checkRecord(table.Schema, rec.after); err != nil {
+				return fmt.Errorf("日志中表 %s 的行已损坏: %v", rec.table, err)
+			}
+		}
+		table.applyRow(rec.key, rec.after, rec.txn)
+	}
+	db.clock = db.wal.lastTxn()
+	for _, table := range db.allTables() {
+		table.purgeDeleted()
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	fmt.Printf("根据日志恢复: 重做 %d 个事务，跳过 %d 条没有提交的修改\n", len(committed), skipped)
+	return db.checkpoint()
+}
+
+// Checkpoint 把所有表修改过的页写回数据文件并落盘，然后清理日志
+func (db *DB) Checkpoint() error {
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+	return db.checkpoint()
+}
+
+// checkpoint b+树中只有已经提交的版本，它们的日志在提交时都已经落盘。
+// 调用方持有 db.commitMu，刷盘期间不会有事务提交
+func (db *DB) checkpoint() error {
+	for _, table := range db.allTables() {
+		if err := table.flush(); err != nil {
+			return err
+		}
+	}
+	return db.wal.checkpoint()
+}
+
+// allTables 所有数据库中的表
+func (db *DB) allTables() []*BPTable {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	var tables []*BPTable
+	for _, byName := range db.databases {
+		for _, table := range byName {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// Close 清理旧版本并做一次检查点，然后关闭所有数据文件和日志
+func (db *DB) Close() error {
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+	db.gc()
+	err := db.checkpoint()
+	for _, table := range db.allTables() {
+		table.Tree.pager.Close()
+	}
+	db.wal.Close()
+	return err
+}
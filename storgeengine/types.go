@@ -0,0 +1,594 @@
+package storgeengine
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// 列的数据类型和值。各类型的列中保存的值:
+//
+//	INT                    int64
+//	FLOAT                  float64，不能是 NaN 或无穷大
+//	BOOL                   bool
+//	DECIMAL(p, s)          Decimal，小数位数固定为 s，整数部分最多 p-s 位；没有写 (p, s) 时不限制
+//	DATE                   Date
+//	TIMESTAMP              UTC 的 time.Time
+//	STRING / VARCHAR(n)    string，VARCHAR(n) 最多 n 个字符
+//	BLOB                   []byte
+//
+// NULL 在任何类型的列中都是 nil。写入时用 Column.coerce 把值转换成列的类型，转换不了时报错
+
+// ColumnType 表示列的数据类型，数值写在数据文件头和系统目录中，不能改变
+type ColumnType int
+
+const (
+	IntType ColumnType = iota
+	StringType
+	FloatType
+	BoolType
+	DecimalType
+	DateType
+	TimestampType
+	BlobType
+)
+
+// UnknownType 只用在查询结果中，表示推不出类型的列，例如 select null
+const UnknownType ColumnType = -1
+
+func (t ColumnType) String() string {
+	switch t {
+	case IntType:
+		return "INT"
+	case StringType:
+		return "STRING"
+	case FloatType:
+		return "FLOAT"
+	case BoolType:
+		return "BOOL"
+	case DecimalType:
+		return "DECIMAL"
+	case DateType:
+		return "DATE"
+	case TimestampType:
+		return "TIMESTAMP"
+	case BlobType:
+		return "BLOB"
+	case UnknownType:
+		return "UNKNOWN"
+	}
+	return fmt.Sprintf("未知类型 %d", int(t))
+}
+
+// 建表语句中的类型名
+var columnTypeNames = map[string]ColumnType{
+	"INT": IntType, "INTEGER": IntType, "BIGINT": IntType, "SMALLINT": IntType, "TINYINT": IntType,
+	"SERIAL": IntType, "BIGSERIAL": IntType,
+	"FLOAT": FloatType, "DOUBLE": FloatType, "REAL": FloatType,
+	"BOOL": BoolType, "BOOLEAN": BoolType,
+	"DECIMAL": DecimalType, "NUMERIC": DecimalType,
+	"DATE": DateType, "TIMESTAMP": TimestampType, "DATETIME": TimestampType,
+	"STRING": StringType, "TEXT": StringType, "VARCHAR": StringType, "CHAR": StringType,
+	"BLOB": BlobType, "BYTEA": BlobType,
+}
+
+// 类型参数的上限
+const (
+	maxVarcharLength   = math.MaxUint32
+	maxDecimalDigits   = 65
+	maxDecimalScale    = 30
+	decimalDivideScale = 4 // 除法的结果比被除数多保留的小数位数
+)
+
+// typeName 列的类型，带上长度或精度，例如 VARCHAR(20)、DECIMAL(10,2)
+func (col Column) typeName() string {
+	switch {
+	case col.Type == StringType && col.Length > 0:
+		return fmt.Sprintf("VARCHAR(%d)", col.Length)
+	case col.Type == DecimalType && col.Precision > 0:
+		return fmt.Sprintf("DECIMAL(%d,%d)", col.Precision, col.Scale)
+	}
+	return col.Type.String()
+}
+
+// coerce 把要写入这一列的值转换成列的类型，并检查长度和精度。NULL 不变，not null 由 checkRow 检查
+func (col Column) coerce(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	converted, ok := convertValue(col.Type, value)
+	if !ok {
+		return nil, fmt.Errorf("列 %s 的类型是 %s，值 %s 无法转换", col.Name, col.typeName(), exprString(&Literal{Value: value}))
+	}
+	switch v := converted.(type) {
+	case string:
+		if col.Length > 0 && utf8.RuneCountInString(v) > col.Length {
+			return nil, fmt.Errorf("列 %s 的类型是 %s，值 %s 太长", col.Name, col.typeName(), exprString(&Literal{Value: v}))
+		}
+	case Decimal:
+		if col.Precision > 0 {
+			v = v.rescale(col.Scale)
+			if v.intDigits() > col.Precision-col.Scale {
+				return nil, fmt.Errorf("列 %s 的类型是 %s，值 %s 超出范围", col.Name, col.typeName(), v)
+			}
+			converted = v
+		}
+	}
+	return converted, nil
+}
+
+// convertValue 把非 NULL 的值转换成 typ 类型的列中保存的值
+func convertValue(typ ColumnType, value interface{}) (interface{}, bool) {
+	switch typ {
+	case IntType:
+		switch v := value.(type) {
+		case int64:
+			return v, true
+		case bool:
+			return boolInt(v), true
+		case float64:
+			return floatToInt(v)
+		case Decimal:
+			return v.rescale(0).int64()
+		case string:
+			s := strings.TrimSpace(v)
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return i, true
+			}
+			if d, err := ParseDecimal(s); err == nil {
+				return d.rescale(0).int64()
+			}
+		}
+	case FloatType:
+		var f float64
+		switch v := value.(type) {
+		case float64:
+			f = v
+		case int64:
+			f = float64(v)
+		case bool:
+			f = float64(boolInt(v))
+		case Decimal:
+			f = v.float64()
+		case string:
+			var err error
+			if f, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, false
+		}
+		return f, true
+	case BoolType:
+		switch v := value.(type) {
+		case bool:
+			return v, true
+		case int64:
+			return v != 0, true
+		case float64:
+			return v != 0, true
+		case Decimal:
+			return v.sign() != 0, true
+		case string:
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "true", "t", "yes", "y", "on", "1":
+				return true, true
+			case "false", "f", "no", "n", "off", "0":
+				return false, true
+			}
+		}
+	case DecimalType:
+		switch v := value.(type) {
+		case Decimal:
+			return v, true
+		case int64:
+			return decimalFromInt(v), true
+		case bool:
+			return decimalFromInt(boolInt(v)), true
+		case float64:
+			d, err := decimalFromFloat(v)
+			return d, err == nil
+		case string:
+			d, err := ParseDecimal(strings.TrimSpace(v))
+			return d, err == nil
+		}
+	case DateType:
+		if t, ok := toTime(value); ok {
+			return dateOf(t), true
+		}
+	case TimestampType:
+		if t, ok := toTime(value); ok {
+			return t, true
+		}
+	case StringType:
+		switch v := value.(type) {
+		case string:
+			return v, true
+		case []byte:
+			return string(v), true
+		}
+		return toString(value), true
+	case BlobType:
+		switch v := value.(type) {
+		case []byte:
+			return v, true
+		case string:
+			return []byte(v), true
+		}
+	}
+	return nil, false
+}
+
+// holds 值是不是这种类型的列中保存的值
+func (t ColumnType) holds(value interface{}) bool {
+	switch value.(type) {
+	case int64:
+		return t == IntType
+	case float64:
+		return t == FloatType
+	case bool:
+		return t == BoolType
+	case Decimal:
+		return t == DecimalType
+	case Date:
+		return t == DateType
+	case time.Time:
+		return t == TimestampType
+	case string:
+		return t == StringType
+	case []byte:
+		return t == BlobType
+	}
+	return false
+}
+
+// keyValue 这种类型的列和常量 value 比较时，如果比较的结果和关键字的顺序一致，返回常量在关键字中要编码成的值
+func (t ColumnType) keyValue(value interface{}) (interface{}, bool) {
+	switch t {
+	case IntType, FloatType, DecimalType, BoolType:
+		switch value.(type) {
+		case int64, float64, Decimal, bool:
+			return value, true
+		}
+	case StringType:
+		if _, ok := value.(string); ok {
+			return value, true
+		}
+	case DateType, TimestampType:
+		if t, ok := toTime(value); ok {
+			return t, true
+		}
+	case BlobType:
+		switch v := value.(type) {
+		case []byte:
+			return v, true
+		case string:
+			return []byte(v), true
+		}
+	}
+	return nil, false
+}
+
+// keyTag 这种类型的列中非 NULL 的值在关键字中的类型标记
+func (t ColumnType) keyTag() byte {
+	switch t {
+	case StringType:
+		return keyString
+	case DateType, TimestampType:
+		return keyTime
+	case BlobType:
+		return keyBytes
+	}
+	return keyNumber
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// floatToInt 四舍五入成整数，超出 int64 的范围时返回 false
+func floatToInt(f float64) (interface{}, bool) {
+	f = math.Round(f)
+	if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return nil, false
+	}
+	return int64(f), true
+}
+
+// Date 日期，Time 总是 UTC 的 0 点
+type Date struct {
+	time.Time
+}
+
+// NewDate 某年某月某日
+func NewDate(year int, month time.Month, day int) Date {
+	return Date{time.Date(year, month, day, 0, 0, 0, 0, time.UTC)}
+}
+
+func (d Date) String() string {
+	return d.Format("2006-01-02")
+}
+
+// dateOf 时间所在的那一天
+func dateOf(t time.Time) Date {
+	t = t.UTC()
+	return NewDate(t.Year(), t.Month(), t.Day())
+}
+
+// 字符串中的日期和时间可以用这些格式，没有时区的按 UTC
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	time.RFC3339Nano,
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTime 解析日期或时间，结果是 UTC 的时间
+func parseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("无效的日期或时间 %q", s)
+}
+
+// formatTime 时间写成 2006-01-02 15:04:05，有小数部分的秒时带上小数
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.999999999")
+}
+
+func isTime(value interface{}) bool {
+	switch value.(type) {
+	case Date, time.Time:
+		return true
+	}
+	return false
+}
+
+// toTime 日期、时间或可以解析成时间的字符串
+func toTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case Date:
+		return v.Time, true
+	case time.Time:
+		return v.UTC(), true
+	case string:
+		t, err := parseTime(v)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
+
+// Decimal 精确的十进制数，值为 unscaled × 10^-scale。零值是 0，运算都返回新的值，不修改原来的值
+type Decimal struct {
+	unscaled *big.Int
+	scale    int
+}
+
+var bigTen = big.NewInt(10)
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(int64(n)), nil)
+}
+
+// ParseDecimal 解析 [+-]数字[.数字][e[+-]数字]，小数位数就是写出来的位数
+func ParseDecimal(s string) (Decimal, error) {
+	text := s
+	exp := 0
+	if i := strings.IndexAny(text, "eE"); i >= 0 {
+		e, err := strconv.Atoi(text[i+1:])
+		if err != nil || e > maxDecimalDigits || e < -maxDecimalDigits {
+			return Decimal{}, fmt.Errorf("无效的小数 %q", s)
+		}
+		exp = e
+		text = text[:i]
+	}
+	negative := false
+	if text != "" && (text[0] == '+' || text[0] == '-') {
+		negative = text[0] == '-'
+		text = text[1:]
+	}
+	whole, frac, _ := strings.Cut(text, ".")
+	digits := whole + frac
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return Decimal{}, fmt.Errorf("无效的小数 %q", s)
+	}
+	unscaled, _ := new(big.Int).SetString(digits, 10)
+	if negative {
+		unscaled.Neg(unscaled)
+	}
+	d := Decimal{unscaled: unscaled, scale: len(frac) - exp}
+	if d.scale < 0 {
+		d = d.rescale(0)
+	}
+	return d, nil
+}
+
+func decimalFromInt(i int64) Decimal {
+	return Decimal{unscaled: big.NewInt(i)}
+}
+
+// decimalFromFloat 取能还原出这个 float64 的最短的十进制表示，0.1 得到 0.1
+func decimalFromFloat(f float64) (Decimal, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return Decimal{}, fmt.Errorf("%v 不能转换成小数", f)
+	}
+	return ParseDecimal(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
+func (d Decimal) int() *big.Int {
+	if d.unscaled == nil {
+		return new(big.Int)
+	}
+	return d.unscaled
+}
+
+func (d Decimal) String() string {
+	s := d.int().String()
+	if d.scale <= 0 {
+		return s
+	}
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if len(s) <= d.scale {
+		s = strings.Repeat("0", d.scale-len(s)+1) + s
+	}
+	s = s[:len(s)-d.scale] + "." + s[len(s)-d.scale:]
+	if negative {
+		return "-" + s
+	}
+	return s
+}
+
+// rescale 改变小数位数，位数变少时四舍五入(远离 0)
+func (d Decimal) rescale(scale int) Decimal {
+	switch {
+	case scale == d.scale:
+		return d
+	case scale > d.scale:
+		return Decimal{unscaled: new(big.Int).Mul(d.int(), pow10(scale-d.scale)), scale: scale}
+	}
+	div := pow10(d.scale - scale)
+	q, r := new(big.Int).QuoRem(d.int(), div, new(big.Int))
+	// |r| * 2 >= div 时进位
+	if r.Abs(r).Lsh(r, 1).Cmp(div) >= 0 {
+		if d.int().Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return Decimal{unscaled: q, scale: scale}
+}
+
+// normalize 去掉小数部分末尾的 0，1.50 和 1.5 得到相同的值
+func (d Decimal) normalize() Decimal {
+	u, scale := new(big.Int).Set(d.int()), d.scale
+	r := new(big.Int)
+	for scale > 0 {
+		q, _ := new(big.Int).QuoRem(u, bigTen, r)
+		if r.Sign() != 0 {
+			break
+		}
+		u, scale = q, scale-1
+	}
+	return Decimal{unscaled: u, scale: scale}
+}
+
+func (d Decimal) sign() int {
+	return d.int().Sign()
+}
+
+// intDigits 整数部分的位数，0.5 的整数部分是 0 位
+func (d Decimal) intDigits() int {
+	q := new(big.Int).Quo(d.int(), pow10(d.scale))
+	if q.Sign() == 0 {
+		return 0
+	}
+	return len(q.Abs(q).String())
+}
+
+// int64 小数位数为 0 的值转换成 int64，超出范围时返回 false
+func (d Decimal) int64() (interface{}, bool) {
+	if d.scale != 0 || !d.int().IsInt64() {
+		return nil, false
+	}
+	return d.int().Int64(), true
+}
+
+func (d Decimal) rat() *big.Rat {
+	return new(big.Rat).SetFrac(d.int(), pow10(d.scale))
+}
+
+func (d Decimal) float64() float64 {
+	f, _ := d.rat().Float64()
+	return f
+}
+
+// keyParts 关键字中数字的编码: 向下取整的整数部分(超出 int64 时取边界)和小数部分
+func (d Decimal) keyParts() (int64, float64) {
+	div := pow10(d.scale)
+	q, m := new(big.Int).DivMod(d.int(), div, new(big.Int))
+	var i int64
+	switch {
+	case !q.IsInt64() && q.Sign() > 0:
+		i = math.MaxInt64
+	case !q.IsInt64():
+		i = math.MinInt64
+	default:
+		i = q.Int64()
+	}
+	frac, _ := new(big.Rat).SetFrac(m, div).Float64()
+	return i, frac
+}
+
+func (d Decimal) cmp(o Decimal) int {
+	scale := maxScale(d, o)
+	return d.rescale(scale).int().Cmp(o.rescale(scale).int())
+}
+
+func (d Decimal) neg() Decimal {
+	return Decimal{unscaled: new(big.Int).Neg(d.int()), scale: d.scale}
+}
+
+// maxScale 两个数中较多的小数位数
+func maxScale(a, b Decimal) int {
+	if a.scale > b.scale {
+		return a.scale
+	}
+	return b.scale
+}
+
+// decimalArithmetic 小数的四则运算和取余。加减的结果取两边较多的小数位数，乘法的位数相加，
+// 除法比被除数多保留 decimalDivideScale 位
+func decimalArithmetic(op string, a, b Decimal) (Decimal, error) {
+	scale := maxScale(a, b)
+	x, y := a.rescale(scale).int(), b.rescale(scale).int()
+	switch op {
+	case "+":
+		return Decimal{unscaled: new(big.Int).Add(x, y), scale: scale}, nil
+	case "-":
+		return Decimal{unscaled: new(big.Int).Sub(x, y), scale: scale}, nil
+	case "*":
+		return Decimal{unscaled: new(big.Int).Mul(a.int(), b.int()), scale: a.scale + b.scale}, nil
+	case "/", "%":
+		if y.Sign() == 0 {
+			return Decimal{}, fmt.Errorf("除数不能为 0")
+		}
+		if op == "%" {
+			// 余数的符号和被除数相同
+			return Decimal{unscaled: new(big.Int).Rem(x, y), scale: scale}, nil
+		}
+		// 多算一位再四舍五入
+		resultScale := a.scale + decimalDivideScale
+		n := new(big.Int).Mul(x, pow10(resultScale+1))
+		q := Decimal{unscaled: n.Quo(n, y), scale: resultScale + 1}
+		return q.rescale(resultScale), nil
+	}
+	return Decimal{}, fmt.Errorf("未知的运算符 %s", op)
+}
+
+// toDecimal 整数或小数转换成 Decimal
+func toDecimal(value interface{}) Decimal {
+	switch v := value.(type) {
+	case Decimal:
+		return v
+	case int64:
+		return decimalFromInt(v)
+	}
+	return Decimal{}
+}
@@ -0,0 +1,242 @@
+package storgeengine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sync"
+)
+
+// 预写日志(WAL): 事务提交时先把它的全部修改和一条提交记录写进日志并 fsync，
+// 落盘之后才修改 b+树并返回给客户端。日志放在数据目录下的 aliangsql.wal，
+// 检查点时先把所有数据文件刷盘，再把日志清空。
+//
+// 事务号在提交时按顺序分配，同时也是事务的提交时间戳，写在行版本的 Begin / End 中。
+//
+// 文件布局: 魔数 "ALSQLWAL" | 下一个事务号 uint64，之后每条记录为 长度 uint32 | crc32 uint32 | 内容
+const (
+	walFileName       = "aliangsql.wal"
+	walMagic          = "ALSQLWAL"
+	walHeaderSize     = 16
+	walCheckpointSize = 4 << 20 // 日志超过这个大小时做一次检查点
+)
+
+// 日志记录的类型
+const (
+	walWrite  byte = 1
+	walCommit byte = 2
+)
+
+// walRecord 一条日志。修改记录同时保存修改前后的行，恢复时重做修改后的行
+type walRecord struct {
+	kind   byte
+	txn    uint64
+	table  string // 数据库名/表名
+	key    Key
+	before Record // nil 表示修改前这一行不存在
+	after  Record // nil 表示这一行被删除
+}
+
+type WAL struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	nextTxn uint64
+}
+
+// openWAL 打开日志文件，返回其中完整的记录。最后一条记录可能只写了一半，从那里开始的内容都丢弃
+func openWAL(path string) (*WAL, []walRecord, error) {
+	w := &WAL{path: path, nextTxn: 1}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if len(data) < walHeaderSize || string(data[:8]) != walMagic {
+		// 新的数据目录，或者第一次写文件头时就崩溃了
+		if err := w.rewrite(); err != nil {
+			return nil, nil, err
+		}
+		return w, nil, nil
+	}
+
+	var records []walRecord
+	w.nextTxn = binary.LittleEndian.Uint64(data[8:])
+	pos := walHeaderSize
+	for pos+8 <= len(data) {
+		n := int(binary.LittleEndian.Uint32(data[pos:]))
+		if pos+8+n > len(data) {
+			break
+		}
+		payload := data[pos+8 : pos+8+n]
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[pos+4:]) {
+			break
+		}
+		rec, err := decodeWalRecord(payload)
+		if err != nil {
+			break
+		}
+		if rec.txn >= w.nextTxn {
+			w.nextTxn = rec.txn + 1
+		}
+		records = append(records, rec)
+		pos += 8 + n
+	}
+	if w.file, err = os.OpenFile(path, os.O_RDWR, 0644); err != nil {
+		return nil, nil, err
+	}
+	// 之后的记录接着写在最后一条完整的记录后面
+	w.size = int64(pos)
+	return w, records, nil
+}
+
+// commit 分配事务号，把事务的修改和提交记录写进日志并落盘，返回后事务的修改就不会再丢失。
+// 中途失败时日志中可能留下没有提交记录的修改，恢复时会跳过它们
+func (w *WAL) commit(records []walRecord) (uint64, error) {
+	w.mu.Lock()
+	id := w.nextTxn
+	w.nextTxn++
+	w.mu.Unlock()
+	for _, rec := range records {
+		rec.txn = id
+		if err := w.append(rec); err != nil {
+			return 0, err
+		}
+	}
+	if err := w.append(walRecord{kind: walCommit, txn: id}); err != nil {
+		return 0, err
+	}
+	if err := w.sync(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// lastTxn 最后分配的事务号，启动时用来恢复提交时间戳
+func (w *WAL) lastTxn() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.nextTxn - 1
+}
+
+func (w *WAL) append(rec walRecord) error {
+	payload := encodeWalRecord(rec)
+	buf := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(buf, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	buf = append(buf, payload...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := writeAt(w.file, buf, w.size); err != nil {
+		return err
+	}
+	w.size += int64(len(buf))
+	return nil
+}
+
+func (w *WAL) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return syncFile(w.file)
+}
+
+// full 日志已经足够大，应该做检查点了
+func (w *WAL) full() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size > walCheckpointSize
+}
+
+// checkpoint 数据文件全部落盘之后调用，已经提交的修改都不再需要重做，日志只剩文件头
+func (w *WAL) checkpoint() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rewrite()
+}
+
+// rewrite 先写临时文件再改名替换日志，任何时候崩溃都有一份完整的日志。调用方持有 w.mu
+func (w *WAL) rewrite() error {
+	tmp := w.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, walHeaderSize)
+	copy(buf, walMagic)
+	binary.LittleEndian.PutUint64(buf[8:], w.nextTxn)
+	if err := writeAt(file, buf, 0); err != nil {
+		file.Close()
+		return err
+	}
+	if err := syncFile(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		file.Close()
+		return err
+	}
+	if err := syncDir(w.path); err != nil {
+		file.Close()
+		return err
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file = file
+	w.size = int64(len(buf))
+	return nil
+}
+
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// 记录的内容: 类型 uint8 | 事务号 uint64，修改记录之后还有
+// 表名长度 uint16 | 表名 | 主键长度 uint16 | 主键 | 修改前的行 | 修改后的行，行为 是否存在 uint8 | 长度 uint32 | 按表结构编码的行
+func encodeWalRecord(rec walRecord) []byte {
+	buf := []byte{rec.kind}
+	buf = binary.LittleEndian.AppendUint64(buf, rec.txn)
+	if rec.kind != walWrite {
+		return buf
+	}
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(rec.table)))
+	buf = append(buf, rec.table...)
+	buf = appendKey(buf, rec.key)
+	for _, row := range []Record{rec.before, rec.after} {
+		if row == nil {
+			buf = append(buf, 0)
+			continue
+		}
+		buf = append(buf, 1)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(row)))
+		buf = append(buf, row...)
+	}
+	return buf
+}
+
+func decodeWalRecord(buf []byte) (walRecord, error) {
+	r := pageReader{buf: buf}
+	rec := walRecord{kind: r.uint8(), txn: r.uint64()}
+	switch rec.kind {
+	case walCommit:
+	case walWrite:
+		rec.table = string(r.bytes(int(r.uint16())))
+		rec.key = r.key()
+		rows := make([]Record, 2)
+		for i := range rows {
+			if r.uint8() == 1 {
+				// 复制出来，恢复后的行不再引用整个日志文件的内容
+				rows[i] = append(Record{}, r.bytes(int(r.uint32()))...)
+			}
+		}
+		rec.before, rec.after = rows[0], rows[1]
+	default:
+		return walRecord{}, fmt.Errorf("未知的日志类型 %d", rec.kind)
+	}
+	return rec, r.err
+}
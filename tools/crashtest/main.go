@@ -0,0 +1,321 @@
+// crashtest 崩溃恢复测试: 反复启动子进程执行随机的修改语句，用 ALIANGSQL_CRASH_AT
+// 让它在任意一次写文件或落盘时退出，然后重新打开数据库，检查已经返回成功的修改都还在，
+// 并且没有半个事务的结果。
+//
+//	go run ./tools/crashtest -rounds 100 -ops 200
+package main
+
+import (
+	"awesomeProject4/storgeengine"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const ackPrefix = "@ack "
+
+func main() {
+	child := flag.Bool("child", false, "作为子进程执行语句")
+	dir := flag.String("dir", "", "数据目录，默认新建临时目录")
+	seed := flag.Int64("seed", 1, "随机种子")
+	rounds := flag.Int("rounds", 50, "崩溃的次数")
+	ops := flag.Int("ops", 200, "每轮最多执行的语句数")
+	from := flag.Int("from", 0, "子进程从第几条语句开始")
+	flag.Parse()
+
+	if *child {
+		runChild(*dir, *seed, *from, *ops)
+		return
+	}
+	if err := runParent(*dir, *seed, *rounds, *ops); err != nil {
+		fmt.Println("失败:", err)
+		os.Exit(1)
+	}
+}
+
+// 第 i 条语句和它对期望结果的修改，同样的种子总是生成同样的语句
+type op struct {
+	sql     string
+	apply   func(model map[int64]string)
+	mayFail bool // 插入的主键已经存在时语句出错，表中的数据不变
+}
+
+func makeOp(seed int64, i int) op {
+	rng := rand.New(rand.NewSource(seed*1000003 + int64(i)))
+	key := int64(rng.Intn(500))
+	value := randomString(rng)
+	switch n := rng.Intn(100); {
+	case n < 50:
+		return op{
+			sql: fmt.Sprintf("insert into t (id, v) values (%d, '%s');", key, value),
+			apply: func(m map[int64]string) {
+				if _, ok := m[key]; !ok {
+					m[key] = value
+				}
+			},
+			mayFail: true,
+		}
+	case n < 70:
+		return op{
+			sql: fmt.Sprintf("update t set v = '%s' where id = %d;", value, key),
+			apply: func(m map[int64]string) {
+				if _, ok := m[key]; ok {
+					m[key] = value
+				}
+			},
+		}
+	case n < 80:
+		// 一条语句修改多行，崩溃后要么全改了要么全没改
+		return op{
+			sql: fmt.Sprintf("update t set v = '%s' where id >= %d and id < %d;", value, key, key+30),
+			apply: func(m map[int64]string) {
+				for k := range m {
+					if k >= key && k < key+30 {
+						m[k] = value
+					}
+				}
+			},
+		}
+	case n < 95:
+		return op{
+			sql:   fmt.Sprintf("delete from t where id = %d;", key),
+			apply: func(m map[int64]string) { delete(m, key) },
+		}
+	default:
+		return op{
+			sql: fmt.Sprintf("delete from t where id >= %d and id < %d;", key, key+20),
+			apply: func(m map[int64]string) {
+				for k := range m {
+					if k >= key && k < key+20 {
+						delete(m, k)
+					}
+				}
+			},
+		}
+	}
+}
+
+// 长度不一的字符串，长的行会让结点用上溢出页
+func randomString(rng *rand.Rand) string {
+	n := rng.Intn(40)
+	if rng.Intn(10) == 0 {
+		n = 200 + rng.Intn(400)
+	}
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('a' + rng.Intn(26))
+	}
+	return string(b)
+}
+
+// 打开数据目录下的数据库
+func openDB(dir string) (*storgeengine.DB, error) {
+	db := storgeengine.OpenDB(dir, 64)
+	if db == nil {
+		return nil, errors.New("打开数据库失败")
+	}
+	return db, nil
+}
+
+func runChild(dir string, seed int64, from, ops int) {
+	db, err := openDB(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if r := storgeengine.ParseSQL("use crash;", db); r.Error != nil {
+		fmt.Fprintln(os.Stderr, r.Error)
+		os.Exit(1)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	for i := from; i < from+ops; i++ {
+		o := makeOp(seed, i)
+		if r := storgeengine.ParseSQL(o.sql, db); r.Error != nil && !o.mayFail {
+			fmt.Fprintf(os.Stderr, "第 %d 条语句出错: %v\n", i, r.Error)
+			os.Exit(1)
+		}
+		// 语句返回成功之后才告诉父进程
+		fmt.Fprintf(out, "%s%d\n", ackPrefix, i)
+		out.Flush()
+		if i%40 == 39 {
+			if err := db.Checkpoint(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+	}
+	db.Close()
+}
+
+func runParent(dir string, seed int64, rounds, ops int) error {
+	if dir == "" {
+		var err error
+		if dir, err = os.MkdirTemp("", "crashtest"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+	}
+	db, err := openDB(dir)
+	if err != nil {
+		return err
+	}
+	for _, sql := range []string{"create database crash;", "use crash;", "create table t (id int, v string);"} {
+		if r := storgeengine.ParseSQL(sql, db); r.Error != nil {
+			return r.Error
+		}
+	}
+	db.Close()
+
+	rng := rand.New(rand.NewSource(seed))
+	model := make(map[int64]string)
+	done := 0 // 已经确认生效的语句数
+	for round := 0; round < rounds; round++ {
+		crashAt := 1 + rng.Intn(6*ops)
+		acked, code, err := runRound(dir, seed, done, ops, crashAt)
+		if err != nil {
+			return err
+		}
+
+		// 已经返回成功的语句一定生效；正在执行的那一条可能生效也可能没有
+		committed := copyModel(model)
+		for i := done; i < acked; i++ {
+			makeOp(seed, i).apply(committed)
+		}
+		inflight := copyModel(committed)
+		makeOp(seed, acked).apply(inflight)
+
+		db, err := openDB(dir)
+		if err != nil {
+			return err
+		}
+		actual, err := readTable(db)
+		db.Close()
+		if err != nil {
+			return err
+		}
+		switch {
+		case equal(actual, committed):
+			model, done = committed, acked
+		case code != 0 && equal(actual, inflight):
+			model, done = inflight, acked+1
+		default:
+			return fmt.Errorf("第 %d 轮(第 %d 次写文件时崩溃，已确认 %d 条语句)数据不一致: %s",
+				round, crashAt, acked, diff(actual, committed))
+		}
+		if code == 0 {
+			fmt.Printf("第 %d 轮: 没有崩溃，已执行 %d 条语句，表中 %d 行\n", round, done, len(model))
+		} else {
+			fmt.Printf("第 %d 轮: 第 %d 次写文件时崩溃，已执行 %d 条语句，表中 %d 行\n", round, crashAt, done, len(model))
+		}
+	}
+	fmt.Printf("全部 %d 轮通过\n", rounds)
+	return nil
+}
+
+// runRound 运行一次子进程，返回已确认的语句数(下一条语句的序号)和退出码
+func runRound(dir string, seed int64, from, ops, crashAt int) (int, int, error) {
+	cmd := exec.Command(os.Args[0], "-child", "-dir", dir,
+		"-seed", strconv.FormatInt(seed, 10), "-from", strconv.Itoa(from), "-ops", strconv.Itoa(ops))
+	cmd.Env = append(os.Environ(), "ALIANGSQL_CRASH_AT="+strconv.Itoa(crashAt))
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, 0, err
+	}
+	acked := from
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, ackPrefix) {
+			i, err := strconv.Atoi(strings.TrimPrefix(line, ackPrefix))
+			if err == nil && i+1 > acked {
+				acked = i + 1
+			}
+		}
+	}
+	err = cmd.Wait()
+	code := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		return 0, 0, err
+	}
+	if code != 0 && code != storgeengine.CrashExitCode {
+		return 0, 0, fmt.Errorf("子进程异常退出，退出码 %d", code)
+	}
+	return acked, code, nil
+}
+
+func readTable(db *storgeengine.DB) (map[int64]string, error) {
+	r := storgeengine.ParseSQL("select id, v from crash.t;", db)
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	rs, ok := r.Result.(*storgeengine.ResultSet)
+	if !ok {
+		return nil, fmt.Errorf("查询结果的类型不对: %T", r.Result)
+	}
+	rows := make(map[int64]string, len(rs.Rows))
+	for _, row := range rs.Rows {
+		id, _ := row[0].(int64)
+		v, _ := row[1].(string)
+		rows[id] = v
+	}
+	return rows, nil
+}
+
+func copyModel(m map[int64]string) map[int64]string {
+	c := make(map[int64]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func equal(a, b map[int64]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// 列出前几处不一致的主键
+func diff(actual, expected map[int64]string) string {
+	var keys []int64
+	for k := range actual {
+		if v, ok := expected[k]; !ok || v != actual[k] {
+			keys = append(keys, k)
+		}
+	}
+	for k := range expected {
+		if _, ok := actual[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	if len(keys) > 5 {
+		keys = keys[:5]
+	}
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		a, inActual := actual[k]
+		e, inExpected := expected[k]
+		parts[i] = fmt.Sprintf("id=%d 实际(%v,%d) 期望(%v,%d)", k, inActual, len(a), inExpected, len(e))
+	}
+	return fmt.Sprintf("实际 %d 行，期望 %d 行; %s", len(actual), len(expected), strings.Join(parts, "; "))
+}
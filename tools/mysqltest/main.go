@@ -0,0 +1,389 @@
+// mysqltest MySQL 协议的测试客户端: 自己按协议收发包，连到服务端检查握手、认证、切换认证插件、
+// COM_PING、COM_INIT_DB、COM_QUERY 的文本结果集和错误包。默认在临时目录中启动一个服务端；
+// 用 -addr 可以测试已经启动的 server -mysql
+//
+//	go run ./tools/mysqltest
+//	go run ./tools/mysqltest -addr localhost:3306 -user root -password 密码
+package main
+
+import (
+	"awesomeProject4/mysql"
+	"awesomeProject4/storgeengine"
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+const (
+	clientLongPassword     = 0x00000001
+	clientConnectWithDB    = 0x00000008
+	clientProtocol41       = 0x00000200
+	clientSecureConnection = 0x00008000
+	clientPluginAuth       = 0x00080000
+	clientPluginAuthLenEnc = 0x00200000
+)
+
+func main() {
+	addr := flag.String("addr", "", "服务端的 MySQL 协议地址，为空时在临时目录中启动一个")
+	username := flag.String("user", "root", "用户名")
+	password := flag.String("password", "1234", "密码")
+	flag.Parse()
+
+	if *addr == "" {
+		var err error
+		if *addr, err = startServer(*username, *password); err != nil {
+			fmt.Println("启动服务端失败:", err)
+			os.Exit(1)
+		}
+	}
+	if err := run(*addr, *username, *password); err != nil {
+		fmt.Println("失败:", err)
+		os.Exit(1)
+	}
+	fmt.Println("全部通过")
+}
+
+// startServer 在临时目录中打开数据库，在随机端口上启动 MySQL 协议服务
+func startServer(username, password string) (string, error) {
+	dir, err := os.MkdirTemp("", "mysqltest")
+	if err != nil {
+		return "", err
+	}
+	db := storgeengine.OpenDB(filepath.Join(dir, "data"), storgeengine.DefaultPoolSize)
+	if db == nil {
+		return "", fmt.Errorf("打开数据库失败")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	server := &mysql.Server{DB: db, Users: map[string]string{username: password}}
+	go server.Serve(l)
+	return l.Addr().String(), nil
+}
+
+func run(addr, username, password string) error {
+	// 密码不对
+	if _, err := connect(addr, username, password+"x", "", "mysql_native_password"); !isError(err, 1045) {
+		return fmt.Errorf("密码错误时应该返回 1045，得到 %v", err)
+	}
+	fmt.Println("ok 密码错误时拒绝登录")
+	// 数据库不存在
+	if _, err := connect(addr, username, password, "nosuchdb", "mysql_native_password"); !isError(err, 1049) {
+		return fmt.Errorf("数据库不存在时应该返回 1049，得到 %v", err)
+	}
+	fmt.Println("ok 握手时的数据库不存在")
+	// 客户端默认用别的插件，服务端要求切换
+	c, err := connect(addr, username, password, "", "caching_sha2_password")
+	if err != nil {
+		return fmt.Errorf("切换认证插件后登录失败: %v", err)
+	}
+	c.Close()
+	fmt.Println("ok 切换到 mysql_native_password")
+
+	c, err = connect(addr, username, password, "", "mysql_native_password")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.expectOK(c.command(0x0e, "")); err != nil {
+		return fmt.Errorf("COM_PING: %v", err)
+	}
+	fmt.Println("ok COM_PING")
+
+	if rows, err := c.query("select @@version_comment limit 1"); err != nil || len(rows) != 1 || rows[0][0] == nil {
+		return fmt.Errorf("select @@version_comment: %v %v", rows, err)
+	}
+	if err := c.expectOK(c.command(0x03, "create database mysqltest")); err != nil {
+		return err
+	}
+	if err := c.command(0x02, "nosuchdb"); !isError(c.expectOK(err), 1049) {
+		return fmt.Errorf("COM_INIT_DB 不存在的数据库应该返回 1049")
+	}
+	if err := c.expectOK(c.command(0x02, "mysqltest")); err != nil {
+		return fmt.Errorf("COM_INIT_DB: %v", err)
+	}
+	fmt.Println("ok COM_INIT_DB")
+
+	for _, sql := range []string{
+		"create table t (id serial, name string, price decimal(10,2), ok bool)",
+		"insert into t (name, price, ok) values ('阿亮', 12.5, true)",
+		"insert into t (name, ok) values ('b', false)",
+	} {
+		if err := c.expectOK(c.command(0x03, sql)); err != nil {
+			return fmt.Errorf("%s: %v", sql, err)
+		}
+	}
+	rows, err := c.query("select id, name, price, ok from t order by id")
+	if err != nil {
+		return err
+	}
+	want := [][]interface{}{{"1", "阿亮", "12.50", "1"}, {"2", "b", nil, "0"}}
+	if !reflect.DeepEqual(rows, want) {
+		return fmt.Errorf("查询结果是 %v，应该是 %v", rows, want)
+	}
+	fmt.Println("ok COM_QUERY 文本结果集")
+
+	if err := c.command(0x03, "selec 1"); !isError(c.expectOK(err), 1064) {
+		return fmt.Errorf("语法错误应该返回 1064")
+	}
+	fmt.Println("ok 语法错误")
+
+	// MySQL 客户端会发 set autocommit = ON / OFF / true / false
+	for _, tc := range []struct{ sql, want string }{
+		{"set autocommit = OFF", "0"},
+		{"set autocommit = on", "1"},
+		{"set autocommit = false", "0"},
+		{"set autocommit = 'ON'", "1"},
+		{"set autocommit = 0", "0"},
+		{"set autocommit = TRUE", "1"},
+	} {
+		if err := c.expectOK(c.command(0x03, tc.sql)); err != nil {
+			return fmt.Errorf("%s: %v", tc.sql, err)
+		}
+		if rows, err := c.query("select @@autocommit"); err != nil || len(rows) != 1 || rows[0][0] != tc.want {
+			return fmt.Errorf("%s 之后 @@autocommit 是 %v %v，应该是 %s", tc.sql, rows, err, tc.want)
+		}
+	}
+	fmt.Println("ok set autocommit")
+
+	if err := c.command(0x01, ""); err != nil {
+		return err
+	}
+	if _, err := c.readPacket(); err != io.EOF {
+		return fmt.Errorf("COM_QUIT 之后服务端应该关闭连接，得到 %v", err)
+	}
+	fmt.Println("ok COM_QUIT")
+	return nil
+}
+
+// serverError 服务端的 ERR 包
+type serverError struct {
+	code    uint16
+	message string
+}
+
+func (e *serverError) Error() string {
+	return fmt.Sprintf("错误 %d: %s", e.code, e.message)
+}
+
+func isError(err error, code uint16) bool {
+	e, ok := err.(*serverError)
+	return ok && e.code == code
+}
+
+type client struct {
+	net.Conn
+	r   *bufio.Reader
+	seq byte
+}
+
+func (c *client) readPacket() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+	n := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if header[3] != c.seq {
+		return nil, fmt.Errorf("包的序号是 %d，应该是 %d", header[3], c.seq)
+	}
+	c.seq++
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return nil, err
+	}
+	if len(payload) > 0 && payload[0] == 0xff {
+		return nil, &serverError{code: binary.LittleEndian.Uint16(payload[1:]), message: string(payload[9:])}
+	}
+	return payload, nil
+}
+
+func (c *client) writePacket(payload []byte) error {
+	n := len(payload)
+	_, err := c.Write(append([]byte{byte(n), byte(n >> 8), byte(n >> 16), c.seq}, payload...))
+	c.seq++
+	return err
+}
+
+// connect 连接并登录，plugin 是握手回应中声明的认证插件
+func connect(addr, username, password, database, plugin string) (*client, error) {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &client{Conn: nc, r: bufio.NewReader(nc)}
+	if err := c.login(username, password, database, plugin); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *client) login(username, password, database, plugin string) error {
+	hello, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	// 协议版本 | 服务端版本 0 | 连接号 4 | scramble 前 8 字节 | 0 | 能力低 16 位 | 字符集 | 状态 | 能力高 16 位 |
+	// scramble 长度 | 10 个保留字节 | scramble 剩下的部分 0 | 插件名 0
+	if hello[0] != 0x0a {
+		return fmt.Errorf("握手协议版本是 %d", hello[0])
+	}
+	pos := 1
+	for hello[pos] != 0 {
+		pos++
+	}
+	pos += 1 + 4
+	scramble := append([]byte{}, hello[pos:pos+8]...)
+	pos += 8 + 1 + 2 + 1 + 2 + 2
+	n := int(hello[pos]) - 8 - 1
+	pos += 1 + 10
+	scramble = append(scramble, hello[pos:pos+n]...)
+
+	auth := nativePassword(scramble, password)
+	if plugin != "mysql_native_password" {
+		auth = []byte("不是这个插件的回应")
+	}
+	caps := uint32(clientLongPassword | clientProtocol41 | clientSecureConnection | clientPluginAuth | clientPluginAuthLenEnc)
+	if database != "" {
+		caps |= clientConnectWithDB
+	}
+	buf := binary.LittleEndian.AppendUint32(nil, caps)
+	buf = binary.LittleEndian.AppendUint32(buf, 1<<24)
+	buf = append(buf, 45)
+	buf = append(buf, make([]byte, 23)...)
+	buf = append(append(buf, username...), 0)
+	buf = append(append(buf, byte(len(auth))), auth...)
+	if database != "" {
+		buf = append(append(buf, database...), 0)
+	}
+	buf = append(append(buf, plugin...), 0)
+	if err := c.writePacket(buf); err != nil {
+		return err
+	}
+
+	reply, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if reply[0] == 0xfe {
+		// AuthSwitchRequest: 0xfe | 插件名 0 | 新的 scramble 0
+		name := string(reply[1 : 1+len("mysql_native_password")])
+		if name != "mysql_native_password" {
+			return fmt.Errorf("服务端要求切换到 %s", name)
+		}
+		scramble := reply[2+len(name) : len(reply)-1]
+		if err := c.writePacket(nativePassword(scramble, password)); err != nil {
+			return err
+		}
+		if reply, err = c.readPacket(); err != nil {
+			return err
+		}
+	}
+	if reply[0] != 0x00 {
+		return fmt.Errorf("登录后应该是 OK 包，得到 0x%02x", reply[0])
+	}
+	return nil
+}
+
+func nativePassword(scramble []byte, password string) []byte {
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.Sum(append(append([]byte{}, scramble...), stage2[:]...))
+	for i := range h {
+		h[i] ^= stage1[i]
+	}
+	return h[:]
+}
+
+// command 发一条命令，序号从 0 开始
+func (c *client) command(cmd byte, arg string) error {
+	c.seq = 0
+	return c.writePacket(append([]byte{cmd}, arg...))
+}
+
+// expectOK 命令的响应必须是 OK 包
+func (c *client) expectOK(err error) error {
+	if err != nil {
+		return err
+	}
+	payload, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if payload[0] != 0x00 {
+		return fmt.Errorf("应该是 OK 包，得到 0x%02x", payload[0])
+	}
+	return nil
+}
+
+// query 执行查询，读文本结果集，值是字符串，NULL 是 nil
+func (c *client) query(sql string) ([][]interface{}, error) {
+	if err := c.command(0x03, sql); err != nil {
+		return nil, err
+	}
+	payload, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	r := &reader{buf: payload}
+	columns := int(r.lenEncInt())
+	if columns == 0 {
+		return nil, fmt.Errorf("%s 没有返回结果集", sql)
+	}
+	// 列定义和 EOF
+	for i := 0; i <= columns; i++ {
+		if _, err := c.readPacket(); err != nil {
+			return nil, err
+		}
+	}
+	var rows [][]interface{}
+	for {
+		payload, err := c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if payload[0] == 0xfe && len(payload) < 9 {
+			return rows, nil
+		}
+		r := &reader{buf: payload}
+		row := make([]interface{}, columns)
+		for i := range row {
+			if r.buf[r.pos] == 0xfb {
+				r.pos++
+				continue
+			}
+			n := int(r.lenEncInt())
+			row[i] = string(r.buf[r.pos : r.pos+n])
+			r.pos += n
+		}
+		rows = append(rows, row)
+	}
+}
+
+type reader struct {
+	buf []byte
+	pos int
+}
+
+func (r *reader) lenEncInt() uint64 {
+	first := r.buf[r.pos]
+	r.pos++
+	size := map[byte]int{0xfc: 2, 0xfd: 3, 0xfe: 8}[first]
+	if size == 0 {
+		return uint64(first)
+	}
+	var n uint64
+	for i := 0; i < size; i++ {
+		n |= uint64(r.buf[r.pos+i]) << (8 * i)
+	}
+	r.pos += size
+	return n
+}
@@ -0,0 +1,554 @@
+// pgtest PostgreSQL 协议的测试客户端: 自己按 v3 协议收发消息，连到服务端检查启动、MD5 和明文认证、
+// 简单查询、扩展查询(Parse、Bind、Describe、Execute、Sync)和 ErrorResponse 中的 SQLSTATE。
+// 默认在临时目录中启动一个服务端；用 -addr 可以测试已经启动的 server -pg
+//
+//	go run ./tools/pgtest
+//	go run ./tools/pgtest -addr localhost:5432 -user root -password 密码
+package main
+
+import (
+	"awesomeProject4/pg"
+	"awesomeProject4/storgeengine"
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+func main() {
+	addr := flag.String("addr", "", "服务端的 PostgreSQL 协议地址，为空时在临时目录中启动一个")
+	username := flag.String("user", "root", "用户名")
+	password := flag.String("password", "1234", "密码")
+	flag.Parse()
+
+	if *addr == "" {
+		db, err := openDB()
+		if err != nil {
+			fmt.Println("打开数据库失败:", err)
+			os.Exit(1)
+		}
+		users := map[string]string{*username: *password}
+		*addr = start(&pg.Server{DB: db, Users: users, Auth: pg.AuthMD5})
+		// 明文认证用另一个监听测试
+		plain := start(&pg.Server{DB: db, Users: users, Auth: pg.AuthPassword})
+		c, err := connect(plain, *username, *password, "")
+		if err != nil {
+			fmt.Println("失败: 明文认证:", err)
+			os.Exit(1)
+		}
+		c.Close()
+		fmt.Println("ok 明文密码认证")
+	}
+	if err := run(*addr, *username, *password); err != nil {
+		fmt.Println("失败:", err)
+		os.Exit(1)
+	}
+	fmt.Println("全部通过")
+}
+
+func openDB() (*storgeengine.DB, error) {
+	dir, err := os.MkdirTemp("", "pgtest")
+	if err != nil {
+		return nil, err
+	}
+	db := storgeengine.OpenDB(filepath.Join(dir, "data"), storgeengine.DefaultPoolSize)
+	if db == nil {
+		return nil, fmt.Errorf("打开 %s 失败", dir)
+	}
+	return db, nil
+}
+
+// start 在随机端口上启动服务端
+func start(server *pg.Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("监听失败:", err)
+		os.Exit(1)
+	}
+	go server.Serve(l)
+	return l.Addr().String()
+}
+
+func run(addr, username, password string) error {
+	if _, err := connect(addr, username, password+"x", ""); !isError(err, "28P01") {
+		return fmt.Errorf("密码错误时应该返回 28P01，得到 %v", err)
+	}
+	fmt.Println("ok 密码错误时拒绝登录")
+	if _, err := connect(addr, username, password, "nosuchdb"); !isError(err, "3D000") {
+		return fmt.Errorf("数据库不存在时应该返回 3D000，得到 %v", err)
+	}
+	fmt.Println("ok 启动时的数据库不存在")
+
+	c, err := connect(addr, username, password, username)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	fmt.Println("ok MD5 密码认证")
+
+	// 简单查询，一次多条语句
+	results, err := c.query("create database pgtest; use pgtest; create table t (id serial, name string, price decimal(10,2), ok bool);")
+	if err != nil {
+		return err
+	}
+	if tags := results.tags; !reflect.DeepEqual(tags, []string{"CREATE DATABASE", "USE", "CREATE TABLE"}) {
+		return fmt.Errorf("命令是 %v", tags)
+	}
+	if _, err := c.query("insert into t (name, price, ok) values ('阿亮', 12.5, true); insert into t (name, ok) values ('b', false);"); err != nil {
+		return err
+	}
+	results, err = c.query("select id, name, price, ok from t order by id")
+	if err != nil {
+		return err
+	}
+	want := [][]interface{}{{"1", "阿亮", "12.50", "t"}, {"2", "b", nil, "f"}}
+	if !reflect.DeepEqual(results.rows, want) || !reflect.DeepEqual(results.tags, []string{"SELECT 2"}) {
+		return fmt.Errorf("查询结果是 %v %v，应该是 %v", results.rows, results.tags, want)
+	}
+	if !reflect.DeepEqual(results.oids, []int32{20, 25, 1700, 16}) {
+		return fmt.Errorf("列的类型是 %v", results.oids)
+	}
+	fmt.Println("ok 简单查询")
+
+	if results, err = c.query(";"); err != nil || !results.empty {
+		return fmt.Errorf("空查询应该返回 EmptyQueryResponse: %v", err)
+	}
+	if _, err := c.query("selec 1"); !isError(err, "42601") {
+		return fmt.Errorf("语法错误应该返回 42601，得到 %v", err)
+	}
+	if _, err := c.query("select 1 / 0"); !isError(err, "XX000") {
+		return fmt.Errorf("执行出错应该返回 XX000，得到 %v", err)
+	}
+	fmt.Println("ok 错误和空查询")
+
+	// 引擎的错误按种类返回 SQLSTATE
+	if _, err := c.query("create table u (id int primary key, name string not null, n int check (n > 0)); " +
+		"create table v (id int primary key, uid int references u); insert into u (id, name, n) values (1, 'a', 1);"); err != nil {
+		return err
+	}
+	for _, tc := range []struct{ sql, code string }{
+		{"select * from nosuch", "42P01"},
+		{"select * from nosuchdb.t", "3D000"},
+		{"insert into u (id, name, n) values (1, 'b', 1)", "23505"},
+		{"insert into u (id, n) values (2, 1)", "23502"},
+		{"insert into u (id, name, n) values (2, 'b', 0)", "23514"},
+		{"insert into v (id, uid) values (1, 9)", "23503"},
+	} {
+		if _, err := c.query(tc.sql); !isError(err, tc.code) {
+			return fmt.Errorf("%s 应该返回 %s，得到 %v", tc.sql, tc.code, err)
+		}
+	}
+	// 两个事务修改同一行，后修改的事务失败
+	other, err := connect(addr, username, password, "pgtest")
+	if err != nil {
+		return err
+	}
+	defer other.Close()
+	if _, err := c.query("begin; update u set n = 2 where id = 1;"); err != nil {
+		return err
+	}
+	if _, err := other.query("update u set n = 3 where id = 1"); err != nil {
+		return err
+	}
+	if _, err := c.query("commit"); !isError(err, "40001") {
+		return fmt.Errorf("并发修改同一行应该返回 40001，得到 %v", err)
+	}
+	fmt.Println("ok 错误的 SQLSTATE")
+
+	// 多条语句在一个隐式事务中，出错时前面语句的修改也撤销
+	if _, err := c.query("insert into u (id, name, n) values (5, 'e', 1); insert into u (id, name, n) values (1, 'a', 1); insert into u (id, name, n) values (6, 'f', 1)"); !isError(err, "23505") {
+		return fmt.Errorf("重复的主键应该返回 23505，得到 %v", err)
+	}
+	if c.status != 'I' {
+		return fmt.Errorf("隐式事务出错后状态应该是 I，得到 %q", c.status)
+	}
+	if results, err = c.query("select count(*) from u where id in (5, 6)"); err != nil || !reflect.DeepEqual(results.rows, [][]interface{}{{"0"}}) {
+		return fmt.Errorf("出错的多条语句应该全部撤销，得到 %v %v", results, err)
+	}
+	if _, err := c.query("insert into u (id, name, n) values (5, 'e', 1); insert into u (id, name, n) values (6, 'f', 1)"); err != nil {
+		return err
+	}
+	if results, err = other.query("select count(*) from u where id in (5, 6)"); err != nil || !reflect.DeepEqual(results.rows, [][]interface{}{{"2"}}) {
+		return fmt.Errorf("多条语句执行完应该提交，得到 %v %v", results, err)
+	}
+	fmt.Println("ok 多条语句的隐式事务")
+
+	if _, err := c.query("begin"); err != nil || c.status != 'T' {
+		return fmt.Errorf("begin 之后状态应该是 T，得到 %q %v", c.status, err)
+	}
+	if _, err := c.query("commit"); err != nil || c.status != 'I' {
+		return fmt.Errorf("commit 之后状态应该是 I，得到 %q %v", c.status, err)
+	}
+	fmt.Println("ok 事务状态")
+
+	// 扩展查询: 第一个参数用文本，第二个用二进制的 int8；结果的 id 和 price 要二进制
+	c.send(msg('P').str("s1").str("insert into t (name, price) values ($1, $2)").int16(2).int32(25).int32(20))
+	c.send(msg('B').str("").str("s1").int16(2).int16(0).int16(1).int16(2).
+		int32(3).bytes([]byte("abc")).int32(8).bytes(binary.BigEndian.AppendUint64(nil, 7)).int16(0))
+	c.send(msg('E').str("").int32(0))
+	c.send(msg('S'))
+	if got, err := c.expect('1', '2', 'C', 'Z'); err != nil {
+		return fmt.Errorf("扩展查询 insert: %v", err)
+	} else if string(got[2][:len(got[2])-1]) != "INSERT 0 1" {
+		return fmt.Errorf("insert 的命令是 %q", got[2])
+	}
+
+	c.send(msg('P').str("s2").str("select id, name, price from t where id >= $1 order by id").int16(0))
+	c.send(msg('D').byte('S').str("s2"))
+	c.send(msg('B').str("p").str("s2").int16(0).int16(1).int32(1).bytes([]byte("2")).int16(3).int16(1).int16(0).int16(1))
+	c.send(msg('D').byte('P').str("p"))
+	c.send(msg('E').str("p").int32(1))
+	c.send(msg('E').str("p").int32(0))
+	c.send(msg('S'))
+	got, err := c.expect('1', 't', 'T', '2', 'T', 'D', 's', 'D', 'C', 'Z')
+	if err != nil {
+		return fmt.Errorf("扩展查询 select: %v", err)
+	}
+	r := &reader{buf: got[1]}
+	if n, oid := r.int16(), r.int32(); n != 1 || oid != 25 {
+		return fmt.Errorf("ParameterDescription 是 %d 个参数，类型 %d", n, oid)
+	}
+	if oids := rowOIDs(got[2]); !reflect.DeepEqual(oids, []int32{20, 25, 1700}) {
+		return fmt.Errorf("描述语句得到的列的类型是 %v", oids)
+	}
+	// 第一行 id 2 和 price NULL，第二行 id 3、name abc、price 7.00，数字都是二进制
+	row := decodeRow(got[5])
+	if binary.BigEndian.Uint64(row[0]) != 2 || string(row[1]) != "b" || row[2] != nil {
+		return fmt.Errorf("第一行是 %v", row)
+	}
+	row = decodeRow(got[7])
+	if binary.BigEndian.Uint64(row[0]) != 3 || string(row[1]) != "abc" || hex.EncodeToString(row[2]) != "0001000000000002"+"0007" {
+		return fmt.Errorf("第二行是 %x", row)
+	}
+	fmt.Println("ok 扩展查询、二进制参数和结果、分批取行")
+
+	// 描述语句时不执行查询: 没有匹配的行时列也有类型，nextval 也不会被调用
+	if _, err := c.query("create sequence sx"); err != nil {
+		return err
+	}
+	c.send(msg('P').str("s3").str("select id, price, ok, nextval('sx') from t where id = $1").int16(1).int32(20))
+	c.send(msg('D').byte('S').str("s3"))
+	c.send(msg('D').byte('S').str("s3"))
+	c.send(msg('S'))
+	if got, err = c.expect('1', 't', 'T', 't', 'T', 'Z'); err != nil {
+		return fmt.Errorf("描述语句: %v", err)
+	}
+	if oids := rowOIDs(got[2]); !reflect.DeepEqual(oids, []int32{20, 1700, 16, 20}) {
+		return fmt.Errorf("描述语句得到的列的类型是 %v", oids)
+	}
+	if results, err = c.query("select nextval('sx')"); err != nil || !reflect.DeepEqual(results.rows, [][]interface{}{{"1"}}) {
+		return fmt.Errorf("描述语句之后 nextval 应该是 1，得到 %v %v", results, err)
+	}
+	fmt.Println("ok 描述语句不执行查询")
+
+	// 出错后到 Sync 之前的消息都忽略
+	c.send(msg('P').str("").str("selec $1").int16(0))
+	c.send(msg('B').str("").str("").int16(0).int16(1).int32(1).bytes([]byte("1")).int16(0))
+	c.send(msg('E').str("").int32(0))
+	c.send(msg('S'))
+	if _, err := c.expect('Z'); !isError(err, "42601") {
+		return fmt.Errorf("扩展查询中的语法错误应该返回 42601，得到 %v", err)
+	}
+	if _, err := c.expect('Z'); err != nil {
+		return err
+	}
+	fmt.Println("ok 扩展查询出错后跳到 Sync")
+
+	c.send(msg('X'))
+	if _, _, err := c.read(); err != io.EOF {
+		return fmt.Errorf("Terminate 之后服务端应该关闭连接，得到 %v", err)
+	}
+	fmt.Println("ok Terminate")
+	return nil
+}
+
+// serverError 服务端的 ErrorResponse
+type serverError struct {
+	code    string
+	message string
+}
+
+func (e *serverError) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.message)
+}
+
+func isError(err error, code string) bool {
+	e, ok := err.(*serverError)
+	return ok && e.code == code
+}
+
+type client struct {
+	net.Conn
+	r      *bufio.Reader
+	status byte // 最近一次 ReadyForQuery 的事务状态
+}
+
+// message 正在拼的一条客户端消息
+type message struct {
+	buf []byte
+}
+
+// msg 新的消息，typ 为 0 时是没有类型的启动消息
+func msg(typ byte) *message {
+	if typ == 0 {
+		return &message{buf: []byte{0, 0, 0, 0}}
+	}
+	return &message{buf: []byte{typ, 0, 0, 0, 0}}
+}
+
+func (m *message) byte(b byte) *message {
+	m.buf = append(m.buf, b)
+	return m
+}
+
+func (m *message) int16(n int) *message {
+	m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(n))
+	return m
+}
+
+func (m *message) int32(n int) *message {
+	m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(n))
+	return m
+}
+
+func (m *message) str(s string) *message {
+	m.buf = append(append(m.buf, s...), 0)
+	return m
+}
+
+func (m *message) bytes(b []byte) *message {
+	m.buf = append(m.buf, b...)
+	return m
+}
+
+func (c *client) send(m *message) error {
+	start := 1
+	if len(m.buf) >= 4 && m.buf[0] == 0 {
+		start = 0
+	}
+	binary.BigEndian.PutUint32(m.buf[start:], uint32(len(m.buf)-start))
+	_, err := c.Write(m.buf)
+	return err
+}
+
+// read 读一条消息，ErrorResponse 转换成 *serverError
+func (c *client) read() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	if header[0] == 'E' {
+		e := &serverError{}
+		r := &reader{buf: payload}
+		for typ := r.byte(); typ != 0 && r.pos < len(r.buf); typ = r.byte() {
+			value := r.str()
+			switch typ {
+			case 'C':
+				e.code = value
+			case 'M':
+				e.message = value
+			}
+		}
+		return 'E', payload, e
+	}
+	if header[0] == 'Z' {
+		c.status = payload[0]
+	}
+	return header[0], payload, nil
+}
+
+// expect 依次读到这些类型的消息，遇到 ErrorResponse 时返回错误
+func (c *client) expect(types ...byte) ([][]byte, error) {
+	var payloads [][]byte
+	for _, want := range types {
+		typ, payload, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if typ != want {
+			return nil, fmt.Errorf("应该是 %q，收到了 %q", want, typ)
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, nil
+}
+
+func connect(addr, username, password, database string) (*client, error) {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &client{Conn: nc, r: bufio.NewReader(nc)}
+	if err := c.startup(username, password, database); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// startup 先发 SSLRequest，服务端回 N 之后发启动消息并认证
+func (c *client) startup(username, password, database string) error {
+	if err := c.send(msg(0).int32(80877103)); err != nil {
+		return err
+	}
+	if b, err := c.r.ReadByte(); err != nil || b != 'N' {
+		return fmt.Errorf("SSLRequest 的回应是 %q %v", b, err)
+	}
+	m := msg(0).int32(3 << 16).str("user").str(username)
+	if database != "" {
+		m.str("database").str(database)
+	}
+	if err := c.send(m.byte(0)); err != nil {
+		return err
+	}
+	for {
+		typ, payload, err := c.read()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'R':
+			r := &reader{buf: payload}
+			switch kind := r.int32(); kind {
+			case 0:
+			case 3:
+				c.send(msg('p').str(password))
+			case 5:
+				inner := md5.Sum([]byte(password + username))
+				outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), r.buf[4:8]...))
+				c.send(msg('p').str("md5" + hex.EncodeToString(outer[:])))
+			default:
+				return fmt.Errorf("不支持认证方式 %d", kind)
+			}
+		case 'S', 'K':
+		case 'Z':
+			return nil
+		default:
+			return fmt.Errorf("启动时收到了 %q", typ)
+		}
+	}
+}
+
+// result 简单查询的结果
+type result struct {
+	oids  []int32
+	rows  [][]interface{}
+	tags  []string
+	empty bool
+}
+
+// query 简单查询，读到 ReadyForQuery 为止，文本格式的值是字符串，NULL 是 nil
+func (c *client) query(sql string) (*result, error) {
+	if err := c.send(msg('Q').str(sql)); err != nil {
+		return nil, err
+	}
+	res := &result{}
+	var queryErr error
+	for {
+		typ, payload, err := c.read()
+		if typ == 'E' {
+			queryErr = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case 'T':
+			res.oids = rowOIDs(payload)
+		case 'D':
+			var row []interface{}
+			for _, v := range decodeRow(payload) {
+				if v == nil {
+					row = append(row, nil)
+				} else {
+					row = append(row, string(v))
+				}
+			}
+			res.rows = append(res.rows, row)
+		case 'C':
+			res.tags = append(res.tags, string(payload[:len(payload)-1]))
+		case 'I':
+			res.empty = true
+		case 'Z':
+			return res, queryErr
+		default:
+			return nil, fmt.Errorf("查询时收到了 %q", typ)
+		}
+	}
+}
+
+// rowOIDs RowDescription 中每一列的类型
+func rowOIDs(payload []byte) []int32 {
+	r := &reader{buf: payload}
+	var oids []int32
+	for n := r.int16(); n > 0; n-- {
+		r.str()
+		r.int32()
+		r.int16()
+		oids = append(oids, r.int32())
+		r.int16()
+		r.int32()
+		r.int16()
+	}
+	return oids
+}
+
+// decodeRow DataRow 中的每一列，NULL 是 nil
+func decodeRow(payload []byte) [][]byte {
+	r := &reader{buf: payload}
+	var values [][]byte
+	for n := r.int16(); n > 0; n-- {
+		size := r.int32()
+		if size < 0 {
+			values = append(values, nil)
+			continue
+		}
+		values = append(values, r.buf[r.pos:r.pos+int(size)])
+		r.pos += int(size)
+	}
+	return values
+}
+
+type reader struct {
+	buf []byte
+	pos int
+}
+
+func (r *reader) byte() byte {
+	if r.pos >= len(r.buf) {
+		return 0
+	}
+	r.pos++
+	return r.buf[r.pos-1]
+}
+
+func (r *reader) int16() int {
+	r.pos += 2
+	return int(int16(binary.BigEndian.Uint16(r.buf[r.pos-2:])))
+}
+
+func (r *reader) int32() int32 {
+	r.pos += 4
+	return int32(binary.BigEndian.Uint32(r.buf[r.pos-4:]))
+}
+
+func (r *reader) str() string {
+	start := r.pos
+	for r.pos < len(r.buf) && r.buf[r.pos] != 0 {
+		r.pos++
+	}
+	r.pos++
+	return string(r.buf[start : r.pos-1])
+}
@@ -0,0 +1,78 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// DefaultTokenTTL 令牌默认的有效期
+const DefaultTokenTTL = time.Hour
+
+// Tokens 登录后发给客户端的令牌，令牌到用户名，只保存在内存中，服务端重启后都会失效。
+// 令牌发出 ttl 之后过期，过期的令牌在查找时删除，发新令牌时也会清掉所有过期的令牌
+type Tokens struct {
+	mutex  sync.Mutex
+	ttl    time.Duration
+	tokens map[string]tokenEntry
+}
+
+type tokenEntry struct {
+	username string
+	expires  time.Time
+}
+
+func NewTokens(ttl time.Duration) *Tokens {
+	return &Tokens{ttl: ttl, tokens: make(map[string]tokenEntry)}
+}
+
+// TTL 令牌的有效期
+func (t *Tokens) TTL() time.Duration {
+	return t.ttl
+}
+
+// Issue 检查用户名和密码，正确时发一个新的令牌
+func (t *Tokens) Issue(userDB map[string]string, username, password string) (string, error) {
+	if err := Login(userDB, username, password); err != nil {
+		return "", err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	now := time.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// 不再使用的令牌不会被查找，在这里清掉，表不会一直变大
+	for k, e := range t.tokens {
+		if !now.Before(e.expires) {
+			delete(t.tokens, k)
+		}
+	}
+	t.tokens[token] = tokenEntry{username: username, expires: now.Add(t.ttl)}
+	return token, nil
+}
+
+// Check 令牌对应的用户名，令牌无效或已过期时 ok 为 false
+func (t *Tokens) Check(token string) (username string, ok bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	e, ok := t.tokens[token]
+	if !ok {
+		return "", false
+	}
+	if !time.Now().Before(e.expires) {
+		delete(t.tokens, token)
+		return "", false
+	}
+	return e.username, true
+}
+
+// Revoke 让令牌失效
+func (t *Tokens) Revoke(token string) {
+	t.mutex.Lock()
+	delete(t.tokens, token)
+	t.mutex.Unlock()
+}
@@ -2,7 +2,9 @@ package user
 
 import (
 	"bufio"
+	"crypto/subtle"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 )
@@ -76,13 +78,52 @@ Login:
 	}
 }
 
+// 账号文件不存在时创建的默认账号，所有人都知道这个密码
+const (
+	DefaultUsername = "root"
+	DefaultPassword = "1234"
+)
+
 func InitializeUserDB(filePath string) (map[string]string, error) {
-	userDB := make(map[string]string)
 	file, err := openOrCreateUserFile(filePath)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
+	return readUserDB(file)
+}
+
+// NetworkUserDB 读取通过网络登录时用的账号文件。文件必须已经存在，不会创建默认账号；
+// 文件中有默认的 root:1234 或者空密码时报错，以免把谁都知道的密码暴露到网络上
+func NetworkUserDB(filePath string) (map[string]string, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("账号文件 %s 不存在，请创建它，每行一个 用户名:密码", filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	userDB, err := readUserDB(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(userDB) == 0 {
+		return nil, fmt.Errorf("账号文件 %s 中没有账号", filePath)
+	}
+	for username, password := range userDB {
+		if password == "" {
+			return nil, fmt.Errorf("账号文件 %s 中用户 %s 的密码为空", filePath, username)
+		}
+		if username == DefaultUsername && password == DefaultPassword {
+			return nil, fmt.Errorf("账号文件 %s 中用户 %s 还是默认密码，请先修改", filePath, username)
+		}
+	}
+	return userDB, nil
+}
+
+func readUserDB(file *os.File) (map[string]string, error) {
+	userDB := make(map[string]string)
 	// 建一个文本扫描器，逐行扫描文本数据
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
@@ -93,7 +134,9 @@ func InitializeUserDB(filePath string) (map[string]string, error) {
 			userDB[username] = password
 		}
 	}
-
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
 	return userDB, nil
 }
 
@@ -107,12 +150,16 @@ func openOrCreateUserFile(filePath string) (*os.File, error) {
 		if createErr != nil {
 			return nil, createErr
 		}
-		userAccount := "root:1234"
+		userAccount := DefaultUsername + ":" + DefaultPassword
 		_, err := file.WriteString(userAccount)
 		if err != nil {
 			fmt.Println("写入密码出错")
 			return nil, err
 		}
+		// 回到文件开头，才能读到刚写入的账号
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
 		return file, nil
 	}
 
@@ -123,9 +170,10 @@ func openOrCreateUserFile(filePath string) (*os.File, error) {
 	return file, nil
 }
 
+// Login 检查用户名和密码。HTTP 接口每个请求都会调用，密码用固定时间的比较，不能从响应时间猜出密码
 func Login(userDB map[string]string, username, password string) error {
 	storedPassword, userExists := userDB[username]
-	if !userExists || storedPassword != password {
+	if subtle.ConstantTimeCompare([]byte(storedPassword), []byte(password)) != 1 || !userExists {
 		return fmt.Errorf("用户名或密码不正确")
 	}
 	return nil